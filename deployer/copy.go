@@ -0,0 +1,94 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"github.com/threefoldtech/grid3-go/workloads"
+)
+
+// the copies are used by the dry runs like Plan and DetectDrift, which fill the computed fields the same way
+// a deploy does, so they work on a copy and never change the caller's object
+
+// copyDeployment returns a deep copy of a deployment
+func copyDeployment(dl *workloads.Deployment) workloads.Deployment {
+	cp := *dl
+	if dl.SolutionProvider != nil {
+		solutionProvider := *dl.SolutionProvider
+		cp.SolutionProvider = &solutionProvider
+	}
+	cp.Disks = copySlice(dl.Disks)
+	cp.Zdbs = copySlice(dl.Zdbs)
+	for idx := range cp.Zdbs {
+		cp.Zdbs[idx].IPs = copySlice(cp.Zdbs[idx].IPs)
+	}
+	cp.Vms = copySlice(dl.Vms)
+	for idx := range cp.Vms {
+		cp.Vms[idx].Mounts = copySlice(cp.Vms[idx].Mounts)
+		cp.Vms[idx].Zlogs = copySlice(cp.Vms[idx].Zlogs)
+		cp.Vms[idx].EnvVars = copyMap(cp.Vms[idx].EnvVars)
+	}
+	cp.QSFS = copySlice(dl.QSFS)
+	for idx := range cp.QSFS {
+		cp.QSFS[idx].Metadata.Backends = copySlice(cp.QSFS[idx].Metadata.Backends)
+		cp.QSFS[idx].Groups = copySlice(cp.QSFS[idx].Groups)
+		for groupIdx := range cp.QSFS[idx].Groups {
+			cp.QSFS[idx].Groups[groupIdx].Backends = copySlice(cp.QSFS[idx].Groups[groupIdx].Backends)
+		}
+	}
+	cp.NodeDeploymentID = copyMap(dl.NodeDeploymentID)
+	return cp
+}
+
+// copyK8sCluster returns a deep copy of a k8s cluster
+func copyK8sCluster(k8sCluster *workloads.K8sCluster) workloads.K8sCluster {
+	cp := *k8sCluster
+	if k8sCluster.Master != nil {
+		master := *k8sCluster.Master
+		cp.Master = &master
+	}
+	cp.Workers = copySlice(k8sCluster.Workers)
+	cp.NodesIPRange = copyMap(k8sCluster.NodesIPRange)
+	cp.NodeDeploymentID = copyMap(k8sCluster.NodeDeploymentID)
+	return cp
+}
+
+// copyZNet returns a deep copy of a network
+func copyZNet(znet *workloads.ZNet) workloads.ZNet {
+	cp := *znet
+	cp.Nodes = copySlice(znet.Nodes)
+	cp.UserAccesses = copySlice(znet.UserAccesses)
+	for idx := range cp.UserAccesses {
+		cp.UserAccesses[idx].AllowedIPs = copySlice(cp.UserAccesses[idx].AllowedIPs)
+	}
+	cp.NodesSubnetPrefix = copyMap(znet.NodesSubnetPrefix)
+	cp.AccessDNS = copySlice(znet.AccessDNS)
+	if znet.ExternalIP != nil {
+		externalIP := *znet.ExternalIP
+		cp.ExternalIP = &externalIP
+	}
+	cp.NodesIPRange = copyMap(znet.NodesIPRange)
+	cp.NodeDeploymentID = copyMap(znet.NodeDeploymentID)
+	cp.BackupPublicNodeIDs = copySlice(znet.BackupPublicNodeIDs)
+	cp.WGPort = copyMap(znet.WGPort)
+	cp.Keys = copyMap(znet.Keys)
+	return cp
+}
+
+// copySlice returns a copy of a slice, a nil slice stays nil
+func copySlice[T any](s []T) []T {
+	if s == nil {
+		return nil
+	}
+	return append(make([]T, 0, len(s)), s...)
+}
+
+// copyMap returns a copy of a map, a nil map stays nil
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	cp := make(map[K]V, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
@@ -0,0 +1,251 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/grid3-go/subi"
+	"github.com/threefoldtech/grid3-go/workloads"
+	"github.com/threefoldtech/substrate-client"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+const (
+	// pricingPrecision is the precision of the pricing policies values, they are in units of 1e-7 USD per hour
+	pricingPrecision = 1e7
+	// hoursPerMonth is the number of hours in a billing month
+	hoursPerMonth = 24 * 30
+	// certifiedNodeFactor is the increase of the contracts cost on certified nodes
+	certifiedNodeFactor = 1.25
+	// nameContractPricingPolicyID is the pricing policy used to bill name contracts
+	nameContractPricingPolicyID = 1
+)
+
+// NodeCost is the estimated cost of a node contract
+type NodeCost struct {
+	NodeID    uint32
+	Capacity  gridtypes.Capacity
+	PublicIPs uint32
+	// CU and SU are the compute and storage units of the capacity
+	CU        float64
+	SU        float64
+	Certified bool
+	// Rented is set if the node has a rent contract that pays for the capacity, only the public IPs are charged
+	Rented bool
+	// Dedicated is set if the node is in a dedicated farm and not rented yet, it has to be rented as a whole with the dedicated nodes discount
+	Dedicated bool
+	// Hourly is the estimated cost in USD per hour
+	Hourly float64
+}
+
+// CostEstimate is the estimated cost of deployments in USD
+// network usage is not included since it's billed by consumption
+type CostEstimate struct {
+	// Nodes are the node contracts costs sorted by node ID
+	Nodes []NodeCost
+	// NameContracts are the costs of the names contracts in USD per hour
+	NameContracts map[string]float64
+}
+
+// Hourly returns the total estimated cost in USD per hour
+func (c CostEstimate) Hourly() float64 {
+	total := 0.0
+	for _, node := range c.Nodes {
+		total += node.Hourly
+	}
+	for _, cost := range c.NameContracts {
+		total += cost
+	}
+	return total
+}
+
+// Monthly returns the total estimated cost in USD per month
+func (c CostEstimate) Monthly() float64 {
+	return c.Hourly() * hoursPerMonth
+}
+
+// String returns a human readable summary of the estimate
+func (c CostEstimate) String() string {
+	var b strings.Builder
+	for _, node := range c.Nodes {
+		fmt.Fprintf(&b, "node %d: %.4f USD/hour (cu: %.4f, su: %.4f, public ips: %d)\n", node.NodeID, node.Hourly, node.CU, node.SU, node.PublicIPs)
+	}
+
+	names := make([]string, 0, len(c.NameContracts))
+	for name := range c.NameContracts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "name %s: %.4f USD/hour\n", name, c.NameContracts[name])
+	}
+
+	fmt.Fprintf(&b, "total: %.4f USD/hour, %.2f USD/month", c.Hourly(), c.Monthly())
+	return b.String()
+}
+
+// EstimateCost estimates the cost of deploying a workloads object before it's deployed.
+// it accepts a *workloads.Deployment, *workloads.K8sCluster, *workloads.ZNet, *workloads.GatewayFQDNProxy,
+// *workloads.GatewayNameProxy or generated deployments as map[uint32]gridtypes.Deployment.
+// the object is not changed, the computed fields like the IPs and the network wireguard ports are generated on a copy
+func (t *TFPluginClient) EstimateCost(ctx context.Context, obj interface{}) (CostEstimate, error) {
+	var (
+		dls   map[uint32]gridtypes.Deployment
+		names []string
+		err   error
+	)
+
+	switch o := obj.(type) {
+	case map[uint32]gridtypes.Deployment:
+		dls = o
+	case *workloads.Deployment:
+		dl := copyDeployment(o)
+		dls, err = t.DeploymentDeployer.GenerateVersionlessDeployments(ctx, &dl)
+	case *workloads.K8sCluster:
+		k8sCluster := copyK8sCluster(o)
+		if err := t.K8sDeployer.assignNodeIPRange(&k8sCluster); err != nil {
+			return CostEstimate{}, err
+		}
+		dls, err = t.K8sDeployer.GenerateVersionlessDeployments(ctx, &k8sCluster)
+	case *workloads.ZNet:
+		znet := copyZNet(o)
+		dls, err = t.NetworkDeployer.GenerateVersionlessDeployments(ctx, &znet)
+	case *workloads.GatewayFQDNProxy:
+		dls, err = t.GatewayFQDNDeployer.GenerateVersionlessDeployments(ctx, o)
+	case *workloads.GatewayNameProxy:
+		dls, err = t.GatewayNameDeployer.GenerateVersionlessDeployments(ctx, o)
+		names = append(names, o.Name)
+	default:
+		return CostEstimate{}, fmt.Errorf("can't estimate the cost of %T", obj)
+	}
+	if err != nil {
+		return CostEstimate{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	return estimateCost(t.SubstrateConn, dls, names)
+}
+
+// estimateCost estimates the cost of the deployments and name contracts using the chain pricing policies
+func estimateCost(sub subi.SubstrateExt, dls map[uint32]gridtypes.Deployment, names []string) (CostEstimate, error) {
+	estimate := CostEstimate{NameContracts: make(map[string]float64)}
+	policies := make(map[uint32]substrate.PricingPolicy)
+
+	getPolicy := func(id uint32) (substrate.PricingPolicy, error) {
+		if policy, ok := policies[id]; ok {
+			return policy, nil
+		}
+		policy, err := sub.GetPricingPolicy(id)
+		if err != nil {
+			return policy, errors.Wrapf(err, "failed to get pricing policy %d", id)
+		}
+		policies[id] = policy
+		return policy, nil
+	}
+
+	for _, nodeID := range sortedNodes(dls) {
+		dl := dls[nodeID]
+		capacity, err := Capacity(dl)
+		if err != nil {
+			return CostEstimate{}, errors.Wrapf(err, "failed to get deployment capacity on node %d", nodeID)
+		}
+		publicIPs, err := CountDeploymentPublicIPs(dl)
+		if err != nil {
+			return CostEstimate{}, errors.Wrapf(err, "failed to count deployment public IPs on node %d", nodeID)
+		}
+
+		node, err := sub.GetNode(nodeID)
+		if err != nil {
+			return CostEstimate{}, errors.Wrapf(err, "failed to get node %d", nodeID)
+		}
+		farm, err := sub.GetFarm(uint32(node.FarmID))
+		if err != nil {
+			return CostEstimate{}, errors.Wrapf(err, "failed to get farm %d", node.FarmID)
+		}
+		policy, err := getPolicy(uint32(farm.PricingPolicyID))
+		if err != nil {
+			return CostEstimate{}, err
+		}
+
+		_, err = sub.GetNodeRentContract(nodeID)
+		if err != nil && !errors.Is(err, substrate.ErrNotFound) {
+			return CostEstimate{}, errors.Wrapf(err, "failed to get node %d rent contract", nodeID)
+		}
+		rented := err == nil
+
+		cost := NodeCost{
+			NodeID:    nodeID,
+			Capacity:  capacity,
+			PublicIPs: publicIPs,
+			Certified: node.Certification.IsCertified,
+			Rented:    rented,
+			Dedicated: farm.DedicatedFarm && !rented,
+		}
+		cost.CU, cost.SU = computeUnits(capacity, policy)
+		cost.Hourly = nodeContractCost(cost, policy, nodeCapacity(node.Resources))
+		estimate.Nodes = append(estimate.Nodes, cost)
+	}
+
+	for _, name := range names {
+		policy, err := getPolicy(nameContractPricingPolicyID)
+		if err != nil {
+			return CostEstimate{}, err
+		}
+		estimate.NameContracts[name] = float64(policy.UniqueName.Value) / pricingPrecision
+	}
+
+	return estimate, nil
+}
+
+// nodeContractCost calculates the hourly cost of a node contract the same way the chain bills it
+func nodeContractCost(cost NodeCost, policy substrate.PricingPolicy, nodeResources gridtypes.Capacity) float64 {
+	hourly := cost.CU*float64(policy.CU.Value)/pricingPrecision + cost.SU*float64(policy.SU.Value)/pricingPrecision
+
+	switch {
+	case cost.Rented:
+		// the capacity is paid by the node rent contract
+		hourly = 0
+	case cost.Dedicated:
+		// the node has to be rented, so its whole capacity is paid with the dedicated nodes discount
+		cu, su := computeUnits(nodeResources, policy)
+		hourly = cu*float64(policy.CU.Value)/pricingPrecision + su*float64(policy.SU.Value)/pricingPrecision
+		hourly *= 1 - float64(policy.DedicatedNodesDiscount)/100
+	}
+
+	hourly += float64(cost.PublicIPs) * float64(policy.IPU.Value) / pricingPrecision
+
+	if cost.Certified {
+		hourly *= certifiedNodeFactor
+	}
+	return hourly
+}
+
+// computeUnits returns the compute units and storage units of a capacity
+func computeUnits(capacity gridtypes.Capacity, policy substrate.PricingPolicy) (cu float64, su float64) {
+	mru := float64(capacity.MRU) / unitFactor(policy.CU.Unit)
+	cru := float64(capacity.CRU)
+	hru := float64(capacity.HRU) / unitFactor(policy.SU.Unit)
+	sru := float64(capacity.SRU) / unitFactor(policy.SU.Unit)
+
+	cu = math.Min(math.Max(mru/4, cru/2), math.Min(math.Max(mru/8, cru), math.Max(mru/2, cru/4)))
+	su = hru/1200 + sru/200
+	return cu, su
+}
+
+// unitFactor returns the number of bytes of a pricing policy unit
+func unitFactor(unit substrate.Unit) float64 {
+	return math.Pow(1024, float64(unit))
+}
+
+func nodeCapacity(resources substrate.Resources) gridtypes.Capacity {
+	return gridtypes.Capacity{
+		CRU: uint64(resources.CRU),
+		MRU: gridtypes.Unit(resources.MRU),
+		SRU: gridtypes.Unit(resources.SRU),
+		HRU: gridtypes.Unit(resources.HRU),
+	}
+}
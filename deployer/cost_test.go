@@ -0,0 +1,104 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/threefoldtech/grid3-go/mocks"
+	"github.com/threefoldtech/grid3-go/workloads"
+	"github.com/threefoldtech/substrate-client"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+)
+
+const gigabyteUnit substrate.Unit = 3
+
+func TestComputeUnits(t *testing.T) {
+	policy := substrate.PricingPolicy{
+		CU: substrate.Policy{Unit: gigabyteUnit},
+		SU: substrate.Policy{Unit: gigabyteUnit},
+	}
+
+	cu, su := computeUnits(gridtypes.Capacity{CRU: 2, MRU: 4 * gridtypes.Gigabyte, SRU: 200 * gridtypes.Gigabyte, HRU: 1200 * gridtypes.Gigabyte}, policy)
+	assert.Equal(t, 1.0, cu)
+	assert.Equal(t, 2.0, su)
+
+	cu, su = computeUnits(gridtypes.Capacity{CRU: 1, MRU: 16 * gridtypes.Gigabyte}, policy)
+	assert.Equal(t, 2.0, cu)
+	assert.Equal(t, 0.0, su)
+}
+
+func TestEstimateCost(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	sub := mocks.NewMockSubstrateExt(ctrl)
+
+	disk := workloads.Disk{Name: "disk", SizeGB: 200}
+	diskWorkload := disk.ZosWorkload()
+	ipWorkload := gridtypes.Workload{
+		Name: "ip",
+		Type: zos.PublicIPType,
+		Data: gridtypes.MustMarshal(zos.PublicIP{V4: true}),
+	}
+
+	dls := map[uint32]gridtypes.Deployment{
+		10: {Workloads: []gridtypes.Workload{diskWorkload, ipWorkload}},
+		20: {Workloads: []gridtypes.Workload{diskWorkload}},
+		30: {Workloads: []gridtypes.Workload{diskWorkload}},
+	}
+
+	sub.EXPECT().GetNode(uint32(10)).Return(&substrate.Node{
+		FarmID:        1,
+		Certification: substrate.NodeCertification{IsCertified: true},
+	}, nil)
+	sub.EXPECT().GetNode(uint32(20)).Return(&substrate.Node{FarmID: 1}, nil)
+	sub.EXPECT().GetNode(uint32(30)).Return(&substrate.Node{
+		FarmID: 2,
+		Resources: substrate.Resources{
+			CRU: 4,
+			MRU: 8 * 1024 * 1024 * 1024,
+			SRU: 400 * 1024 * 1024 * 1024,
+		},
+	}, nil)
+
+	sub.EXPECT().GetFarm(uint32(1)).Return(&substrate.Farm{PricingPolicyID: 1}, nil).Times(2)
+	sub.EXPECT().GetFarm(uint32(2)).Return(&substrate.Farm{PricingPolicyID: 1, DedicatedFarm: true}, nil)
+
+	sub.EXPECT().GetNodeRentContract(uint32(10)).Return(uint64(0), substrate.ErrNotFound)
+	sub.EXPECT().GetNodeRentContract(uint32(20)).Return(uint64(5), nil)
+	sub.EXPECT().GetNodeRentContract(uint32(30)).Return(uint64(0), substrate.ErrNotFound)
+
+	sub.EXPECT().GetPricingPolicy(uint32(1)).Return(substrate.PricingPolicy{
+		CU:                     substrate.Policy{Value: 100000, Unit: gigabyteUnit},
+		SU:                     substrate.Policy{Value: 50000, Unit: gigabyteUnit},
+		IPU:                    substrate.Policy{Value: 40000, Unit: gigabyteUnit},
+		UniqueName:             substrate.Policy{Value: 2500},
+		DedicatedNodesDiscount: 50,
+	}, nil)
+
+	estimate, err := estimateCost(sub, dls, []string{"example"})
+	assert.NoError(t, err)
+	assert.Len(t, estimate.Nodes, 3)
+
+	// certified node: (1 su + 1 ip) * 1.25
+	assert.Equal(t, uint32(10), estimate.Nodes[0].NodeID)
+	assert.Equal(t, 1.0, estimate.Nodes[0].SU)
+	assert.Equal(t, uint32(1), estimate.Nodes[0].PublicIPs)
+	assert.InDelta(t, 0.01125, estimate.Nodes[0].Hourly, 1e-9)
+
+	// rented node: capacity is paid by the rent contract
+	assert.True(t, estimate.Nodes[1].Rented)
+	assert.Equal(t, 0.0, estimate.Nodes[1].Hourly)
+
+	// dedicated node: (2 cu + 2 su) of the whole node with 50% discount
+	assert.True(t, estimate.Nodes[2].Dedicated)
+	assert.InDelta(t, 0.015, estimate.Nodes[2].Hourly, 1e-9)
+
+	assert.InDelta(t, 0.00025, estimate.NameContracts["example"], 1e-9)
+	assert.InDelta(t, 0.0265, estimate.Hourly(), 1e-9)
+	assert.InDelta(t, 19.08, estimate.Monthly(), 1e-6)
+	assert.Contains(t, estimate.String(), "name example")
+}
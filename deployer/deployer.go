@@ -5,6 +5,9 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -19,6 +22,17 @@ import (
 	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
 )
 
+// UpdateStrategy decides how the deployer applies updates that can't be done in place
+type UpdateStrategy int
+
+const (
+	// UpdateInPlace updates the node contracts and deployments, the public IPs count of a contract can't be increased
+	UpdateInPlace UpdateStrategy = iota
+	// RecreateOnPublicIPsChange cancels and recreates the node contract and deployment when its public IPs count changes
+	// the workloads are recreated, so data on their disks is lost
+	RecreateOnPublicIPsChange
+)
+
 // MockDeployer to be used for any deployer in mock testing
 type MockDeployer interface { //TODO: Change Name && separate them
 	Deploy(ctx context.Context,
@@ -32,6 +46,11 @@ type MockDeployer interface { //TODO: Change Name && separate them
 	) error
 
 	GetDeployments(ctx context.Context, dls map[uint32]uint64) (map[uint32]gridtypes.Deployment, error)
+
+	DetectDrift(ctx context.Context,
+		contracts map[uint32]uint64,
+		desiredDeployments map[uint32]gridtypes.Deployment,
+	) (DriftReport, error)
 }
 
 // Deployer to be used for any deployer
@@ -42,13 +61,26 @@ type Deployer struct {
 	ncPool          client.NodeClientGetter
 	revertOnFailure bool
 	substrateConn   subi.SubstrateExt
+	config          DeployerConfig
+	journal         Journal
+	observers       []Observer
 }
 
-// NewDeployer returns a new deployer
+// NewDeployer returns a new deployer, zero values of the config are replaced with the defaults
 func NewDeployer(
 	tfPluginClient TFPluginClient,
 	revertOnFailure bool,
 ) Deployer {
+	return NewDeployerWithConfig(tfPluginClient, revertOnFailure, tfPluginClient.deployerConfig, tfPluginClient.persistenceConfig.Journal)
+}
+
+// NewDeployerWithConfig generates a new deployer with the given config, it records its contract operations in the journal if it's not nil
+func NewDeployerWithConfig(
+	tfPluginClient TFPluginClient,
+	revertOnFailure bool,
+	config DeployerConfig,
+	journal Journal,
+) Deployer {
 
 	return Deployer{
 		tfPluginClient.Identity,
@@ -57,9 +89,32 @@ func NewDeployer(
 		tfPluginClient.NcPool,
 		revertOnFailure,
 		tfPluginClient.SubstrateConn,
+		config.withDefaults(),
+		journal,
+		nil,
 	}
 }
 
+// SetUpdateStrategy sets the strategy used to update node deployments
+func (d *Deployer) SetUpdateStrategy(strategy UpdateStrategy) {
+	d.config.UpdateStrategy = strategy
+}
+
+// setUpdateStrategy sets the update strategy of a deployer, mocked deployers are left as they are
+func setUpdateStrategy(deployer MockDeployer, strategy UpdateStrategy) {
+	if d, ok := deployer.(*Deployer); ok {
+		d.SetUpdateStrategy(strategy)
+	}
+}
+
+// getUpdateStrategy returns the update strategy of a deployer, mocked deployers update in place
+func getUpdateStrategy(deployer MockDeployer) UpdateStrategy {
+	if d, ok := deployer.(*Deployer); ok {
+		return d.config.UpdateStrategy
+	}
+	return UpdateInPlace
+}
+
 // Deploy deploys or updates a new deployment given the old deployments' IDs
 func (d *Deployer) Deploy(ctx context.Context,
 	oldDeploymentIDs map[uint32]uint64,
@@ -94,6 +149,14 @@ func (d *Deployer) Deploy(ctx context.Context,
 	return currentDeployments, err
 }
 
+// Plan returns the changes Deploy would apply given the old deployments' IDs, without changing any contract
+func (d *Deployer) Plan(ctx context.Context,
+	oldDeploymentIDs map[uint32]uint64,
+	newDeployments map[uint32]gridtypes.Deployment,
+) (Plan, error) {
+	return planDeployments(ctx, d, oldDeploymentIDs, newDeployments)
+}
+
 func (d *Deployer) deploy(
 	ctx context.Context,
 	oldDeployments map[uint32]uint64,
@@ -101,174 +164,657 @@ func (d *Deployer) deploy(
 	newDeploymentSolutionProvider map[uint32]*uint64,
 	revertOnFailure bool,
 ) (currentDeployments map[uint32]uint64, err error) {
-	currentDeployments = make(map[uint32]uint64)
-	for nodeID, contractID := range oldDeployments {
-		currentDeployments[nodeID] = contractID
+	// contracts records the contract of each node as soon as it changes on chain
+	// so that the caller is able to revert it in case of failure
+	contracts := newContractsTracker(oldDeployments)
+	// journal entries of the operations done in this deploy are completed once the contracts are returned
+	defer func() { d.journalComplete(contracts.journalEntries()...) }()
+
+	// the node deployments are prepared first, so all their contracts are created and updated in one batch
+	var (
+		lock        sync.Mutex
+		operations  = make(map[uint32]*nodeOperation)
+		recreations = make(map[uint32]gridtypes.Deployment)
+	)
+
+	err = d.forEachNode(sortedNodes(newDeployments), true, func(node uint32) error {
+		dl := newDeployments[node]
+		solutionProvider := newDeploymentSolutionProvider[node]
+
+		oldDeploymentID, ok := oldDeployments[node]
+		if !ok {
+			op, err := d.prepareCreation(node, dl, solutionProvider)
+			if err != nil {
+				return err
+			}
+
+			lock.Lock()
+			operations[node] = op
+			lock.Unlock()
+			return nil
+		}
+
+		op, oldDl, err := d.prepareUpdate(ctx, node, oldDeploymentID, dl)
+		if err != nil {
+			return err
+		}
+		if op == nil {
+			return nil
+		}
+
+		recreate, err := d.needsRecreation(oldDl, dl)
+		if err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if recreate {
+			recreations[node] = oldDl
+		} else {
+			operations[node] = op
+		}
+		return nil
+	})
+	if err != nil {
+		return contracts.get(), err
+	}
+
+	nodes := make([]uint32, 0, len(operations))
+	submitted := make([]*nodeOperation, 0, len(operations))
+	for _, node := range sortedNodes(operations) {
+		nodes = append(nodes, node)
+		submitted = append(submitted, operations[node])
+	}
+	if err := d.submitContracts(submitted); err != nil {
+		return contracts.get(), err
+	}
+
+	// all the submitted contracts are sent to their nodes even if one of them fails,
+	// otherwise their contracts are left without deployments
+	nodes = append(nodes, sortedNodes(recreations)...)
+	err = d.forEachNode(nodes, false, func(node uint32) error {
+		if oldDl, ok := recreations[node]; ok {
+			return d.recreateDeployment(ctx, node, oldDl, newDeployments[node], newDeploymentSolutionProvider[node], contracts)
+		}
+		return d.sendDeployment(ctx, operations[node], contracts)
+	})
+	if err != nil {
+		return contracts.get(), err
 	}
-	// deletions
-	/*for node, contractID := range oldDeployments {
+
+	// deletions are done after all creations and updates succeed
+	// so a failed deployment doesn't lose the old contracts before being reverted
+	deleted := make(map[uint32]uint64)
+	for node, contractID := range oldDeployments {
 		if _, ok := newDeployments[node]; !ok {
-			err = d.SubstrateConn.EnsureContractCanceled(d.identity, contractID)
-			if err != nil && !strings.Contains(err.Error(), "ContractNotExists") {
-				return currentDeployments, errors.Wrap(err, "failed to delete deployment")
-			}
-			delete(currentDeployments, node)
+			deleted[node] = contractID
 		}
-	}*/
+	}
 
-	// creations
-	for node, dl := range newDeployments {
-		if _, ok := oldDeployments[node]; !ok {
-			client, err := d.ncPool.GetNodeClient(d.substrateConn, node)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "failed to get node client")
-			}
+	if err := d.cancelContracts(deleted); err != nil {
+		return contracts.get(), err
+	}
+	for node := range deleted {
+		contracts.delete(node)
+	}
 
-			if err := dl.Sign(d.twinID, d.identity); err != nil {
-				return currentDeployments, errors.Wrap(err, "error signing deployment")
-			}
+	return contracts.get(), nil
+}
 
-			if err := dl.Valid(); err != nil {
-				return currentDeployments, errors.Wrap(err, "deployment is invalid")
-			}
+// forEachNode runs fn concurrently for the nodes, limited by the maximum concurrent deployments of the config
+// if stopOnError is set, no more nodes are started after a failure
+func (d *Deployer) forEachNode(nodes []uint32, stopOnError bool, fn func(node uint32) error) error {
+	var (
+		lock   sync.Mutex
+		wg     sync.WaitGroup
+		errs   = make(map[uint32]error)
+		tokens = make(chan struct{}, d.config.MaxConcurrentDeployments)
+	)
+
+	for _, node := range nodes {
+		tokens <- struct{}{}
+
+		lock.Lock()
+		failed := len(errs) != 0
+		lock.Unlock()
+		if failed && stopOnError {
+			<-tokens
+			break
+		}
 
-			hash, err := dl.ChallengeHash()
-			log.Debug().Bytes("HASH", hash)
+		wg.Add(1)
+		go func(node uint32) {
+			defer wg.Done()
+			defer func() { <-tokens }()
 
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "failed to create hash")
+			if err := fn(node); err != nil {
+				lock.Lock()
+				errs[node] = err
+				lock.Unlock()
 			}
+		}(node)
+	}
+	wg.Wait()
 
-			hashHex := hex.EncodeToString(hash)
+	return nodesErrors(errs)
+}
 
-			publicIPCount, err := CountDeploymentPublicIPs(dl)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "failed to count deployment public IPs")
-			}
-			log.Debug().Uint32("Number of public ips", publicIPCount)
+// nodeOperation is a signed node deployment whose contract is to be created or updated
+type nodeOperation struct {
+	node             uint32
+	client           *client.NodeClient
+	dl               gridtypes.Deployment
+	hash             string
+	publicIPs        uint32
+	solutionProvider *uint64
+	// update is set if the node contract already exists
+	update   bool
+	versions map[string]uint32
+	entry    JournalEntry
+}
 
-			contractID, err := d.substrateConn.CreateNodeContract(d.identity, node, dl.Metadata, hashHex, publicIPCount, newDeploymentSolutionProvider[node])
-			log.Debug().Uint64("CreateNodeContract returned id", contractID)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "failed to create contract")
-			}
+// createDeployment creates a node contract for the deployment then deploys it on the node
+func (d *Deployer) createDeployment(
+	ctx context.Context,
+	node uint32,
+	dl gridtypes.Deployment,
+	solutionProvider *uint64,
+	contracts *contractsTracker,
+) error {
+	op, err := d.prepareCreation(node, dl, solutionProvider)
+	if err != nil {
+		return err
+	}
 
-			dl.ContractID = contractID
-			ctx, cancel := context.WithTimeout(ctx, 4*time.Minute)
-			defer cancel()
-			err = client.DeploymentDeploy(ctx, dl)
+	if err := d.submitContracts([]*nodeOperation{op}); err != nil {
+		return err
+	}
 
-			if err != nil {
-				rerr := d.substrateConn.EnsureContractCanceled(d.identity, contractID)
-				if rerr != nil {
-					return currentDeployments, fmt.Errorf("error sending deployment to the node: %w, error cancelling contract: %s; you must cancel it manually (id: %d)", err, rerr, contractID)
-				}
-				return currentDeployments, errors.Wrap(err, "error sending deployment to the node")
+	return d.sendDeployment(ctx, op, contracts)
+}
 
-			}
-			currentDeployments[node] = dl.ContractID
-			newWorkloadVersions := make(map[string]uint32)
-			for _, w := range dl.Workloads {
-				newWorkloadVersions[w.Name.String()] = 0
-			}
-			err = d.Wait(ctx, client, dl.ContractID, newWorkloadVersions)
+// prepareCreation signs a new deployment of a node
+func (d *Deployer) prepareCreation(node uint32, dl gridtypes.Deployment, solutionProvider *uint64) (*nodeOperation, error) {
+	client, err := d.ncPool.GetNodeClient(d.substrateConn, node)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get node client")
+	}
 
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "error waiting deployment")
-			}
+	// a new contract always starts from the first version
+	// this matters when an old deployment is created again while reverting
+	dl.Version = 0
+	dl.Workloads = append([]gridtypes.Workload{}, dl.Workloads...)
+	for idx := range dl.Workloads {
+		dl.Workloads[idx].Version = 0
+		dl.Workloads[idx].Result = gridtypes.Result{}
+	}
+
+	if err := dl.Sign(d.twinID, d.identity); err != nil {
+		return nil, errors.Wrap(err, "error signing deployment")
+	}
+
+	if err := dl.Valid(); err != nil {
+		return nil, errors.Wrap(err, "deployment is invalid")
+	}
+
+	hash, err := dl.ChallengeHash()
+	log.Debug().Bytes("HASH", hash)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create hash")
+	}
+
+	hashHex := hex.EncodeToString(hash)
+
+	publicIPCount, err := CountDeploymentPublicIPs(dl)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to count deployment public IPs")
+	}
+	log.Debug().Uint32("Number of public ips", publicIPCount)
+
+	versions := make(map[string]uint32)
+	for _, w := range dl.Workloads {
+		versions[w.Name.String()] = 0
+	}
+
+	entry := newJournalEntry(JournalCreate, node, 0)
+	entry.Hash = hashHex
+	entry.Deployment = dl
+
+	return &nodeOperation{
+		node:             node,
+		client:           client,
+		dl:               dl,
+		hash:             hashHex,
+		publicIPs:        publicIPCount,
+		solutionProvider: solutionProvider,
+		versions:         versions,
+		entry:            entry,
+	}, nil
+}
+
+// prepareUpdate signs the update of a node deployment, it returns a nil operation if the deployment wasn't changed
+func (d *Deployer) prepareUpdate(
+	ctx context.Context,
+	node uint32,
+	oldDeploymentID uint64,
+	dl gridtypes.Deployment,
+) (*nodeOperation, gridtypes.Deployment, error) {
+	newDeploymentHash, err := HashDeployment(dl)
+	if err != nil {
+		return nil, gridtypes.Deployment{}, errors.Wrap(err, "could not get deployment hash")
+	}
+
+	client, err := d.ncPool.GetNodeClient(d.substrateConn, node)
+	if err != nil {
+		return nil, gridtypes.Deployment{}, errors.Wrap(err, "failed to get node client")
+	}
+
+	oldDl, err := client.DeploymentGet(ctx, oldDeploymentID)
+	if err != nil {
+		return nil, gridtypes.Deployment{}, errors.Wrap(err, "failed to get old deployment to update it")
+	}
+
+	oldDeploymentHash, err := HashDeployment(oldDl)
+	if err != nil {
+		return nil, oldDl, errors.Wrap(err, "could not get deployment hash")
+	}
+	if oldDeploymentHash == newDeploymentHash && SameWorkloadsNames(dl, oldDl) {
+		return nil, oldDl, nil
+	}
+
+	oldHashes, err := GetWorkloadHashes(oldDl)
+	if err != nil {
+		return nil, oldDl, errors.Wrap(err, "could not get old workloads hashes")
+	}
+
+	newHashes, err := GetWorkloadHashes(dl)
+	if err != nil {
+		return nil, oldDl, errors.Wrap(err, "could not get new workloads hashes")
+	}
+
+	oldWorkloadsVersions := ConstructWorkloadVersions(oldDl)
+	newWorkloadsVersions := make(map[string]uint32)
+	dl.Version = oldDl.Version + 1
+	dl.ContractID = oldDl.ContractID
+	dl.Workloads = append([]gridtypes.Workload{}, dl.Workloads...)
+	for idx, w := range dl.Workloads {
+		newHash := newHashes[string(w.Name)]
+		oldHash, ok := oldHashes[string(w.Name)]
+		if !ok || newHash != oldHash {
+			dl.Workloads[idx].Version = dl.Version
+		} else if ok && newHash == oldHash {
+			dl.Workloads[idx].Version = oldWorkloadsVersions[string(w.Name)]
 		}
+		newWorkloadsVersions[w.Name.String()] = dl.Workloads[idx].Version
+	}
+	if err := dl.Sign(d.twinID, d.identity); err != nil {
+		return nil, oldDl, errors.Wrap(err, "error signing deployment")
 	}
 
-	// updates
-	for node, dl := range newDeployments {
-		if oldDeploymentID, ok := oldDeployments[node]; ok {
-			newDeploymentHash, err := HashDeployment(dl)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "could not get deployment hash")
-			}
+	if err := dl.Valid(); err != nil {
+		return nil, oldDl, errors.Wrap(err, "deployment is invalid")
+	}
 
-			client, err := d.ncPool.GetNodeClient(d.substrateConn, node)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "failed to get node client")
-			}
+	log.Debug().Interface("deployment", dl)
+	hash, err := dl.ChallengeHash()
+	if err != nil {
+		return nil, oldDl, errors.Wrap(err, "failed to create hash")
+	}
+	hashHex := hex.EncodeToString(hash)
+	log.Debug().Str("HASH", hashHex)
+
+	entry := newJournalEntry(JournalUpdate, node, dl.ContractID)
+	entry.Hash = hashHex
+	entry.Deployment = dl
+
+	return &nodeOperation{
+		node:     node,
+		client:   client,
+		dl:       dl,
+		hash:     hashHex,
+		update:   true,
+		versions: newWorkloadsVersions,
+		entry:    entry,
+	}, oldDl, nil
+}
+
+// submitContracts creates and updates the contracts of the operations
+// a single operation is submitted as it is, many operations are submitted as one batch
+func (d *Deployer) submitContracts(operations []*nodeOperation) error {
+	if len(operations) == 0 {
+		return nil
+	}
+
+	for _, op := range operations {
+		if err := d.journalRecord(&op.entry, StageIntent); err != nil {
+			return err
+		}
+	}
 
-			oldDl, err := client.DeploymentGet(ctx, oldDeploymentID)
+	// journal entries are kept if submitting the contracts fails, the extrinsic may still be applied
+	if len(operations) == 1 {
+		op := operations[0]
+		if op.update {
+			contractID, err := d.substrateConn.UpdateNodeContract(d.identity, op.dl.ContractID, "", op.hash)
 			if err != nil {
-				return currentDeployments, errors.Wrap(err, "failed to get old deployment to update it")
+				return errors.Wrap(err, "failed to update deployment")
 			}
-
-			oldDeploymentHash, err := HashDeployment(oldDl)
+			op.dl.ContractID = contractID
+		} else {
+			contractID, err := d.substrateConn.CreateNodeContract(d.identity, op.node, op.dl.Metadata, op.hash, op.publicIPs, op.solutionProvider)
+			log.Debug().Uint64("CreateNodeContract returned id", contractID)
 			if err != nil {
-				return currentDeployments, errors.Wrap(err, "could not get deployment hash")
+				return errors.Wrap(err, "failed to create contract")
 			}
-			if oldDeploymentHash == newDeploymentHash && SameWorkloadsNames(dl, oldDl) {
+			op.dl.ContractID = contractID
+		}
+	} else {
+		input := subi.BatchContractsInput{}
+		creations := make([]*nodeOperation, 0, len(operations))
+		for _, op := range operations {
+			if op.update {
+				input.Update = append(input.Update, subi.BatchUpdateContractInput{ContractID: op.dl.ContractID, Hash: op.hash})
 				continue
 			}
+			input.Create = append(input.Create, subi.BatchCreateContractInput{
+				Node:               op.node,
+				Body:               op.dl.Metadata,
+				Hash:               op.hash,
+				PublicIPs:          op.publicIPs,
+				SolutionProviderID: op.solutionProvider,
+			})
+			creations = append(creations, op)
+		}
 
-			oldHashes, err := GetWorkloadHashes(oldDl)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "could not get old workloads hashes")
-			}
+		contractIDs, err := d.substrateConn.BatchContracts(d.identity, input)
+		if err != nil {
+			return errors.Wrap(err, "failed to submit contracts")
+		}
+		if len(contractIDs) != len(creations) {
+			return fmt.Errorf("expected %d created contracts, got %d", len(creations), len(contractIDs))
+		}
+		for idx, op := range creations {
+			op.dl.ContractID = contractIDs[idx]
+		}
+	}
 
-			newHashes, err := GetWorkloadHashes(dl)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "could not get new workloads hashes")
-			}
+	for _, op := range operations {
+		op.entry.ContractID = op.dl.ContractID
+		op.entry.Deployment = op.dl
+		// recovering an intent finds the contract using its hash, so failing to record the contract ID is not fatal
+		_ = d.journalRecord(&op.entry, StageContract)
+	}
+	return nil
+}
 
-			oldWorkloadsVersions := ConstructWorkloadVersions(oldDl)
-			newWorkloadsVersions := make(map[string]uint32)
-			dl.Version = oldDl.Version + 1
-			dl.ContractID = oldDl.ContractID
-			for idx, w := range dl.Workloads {
-				newHash := newHashes[string(w.Name)]
-				oldHash, ok := oldHashes[string(w.Name)]
-				if !ok || newHash != oldHash {
-					dl.Workloads[idx].Version = dl.Version
-				} else if ok && newHash == oldHash {
-					dl.Workloads[idx].Version = oldWorkloadsVersions[string(w.Name)]
-				}
-				newWorkloadsVersions[w.Name.String()] = dl.Workloads[idx].Version
-			}
-			if err := dl.Sign(d.twinID, d.identity); err != nil {
-				return currentDeployments, errors.Wrap(err, "error signing deployment")
-			}
+// sendDeployment sends the deployment of a submitted contract to its node then waits for it
+func (d *Deployer) sendDeployment(ctx context.Context, op *nodeOperation, contracts *contractsTracker) error {
+	sub, cancel := context.WithTimeout(ctx, d.config.DeployTimeout)
+	defer cancel()
 
-			if err := dl.Valid(); err != nil {
-				return currentDeployments, errors.Wrap(err, "deployment is invalid")
+	if op.update {
+		err := op.client.DeploymentUpdate(sub, op.dl)
+		if err != nil {
+			return errors.Wrapf(err, "failed to send deployment update request to node %d", op.node)
+		}
+	} else {
+		// creations are waited for within the deploy timeout
+		ctx = sub
+		err := op.client.DeploymentDeploy(sub, op.dl)
+		if err != nil {
+			rerr := d.substrateConn.EnsureContractCanceled(d.identity, op.dl.ContractID)
+			if rerr != nil {
+				return fmt.Errorf("error sending deployment to the node: %w, error cancelling contract: %s; you must cancel it manually (id: %d)", err, rerr, op.dl.ContractID)
 			}
+			d.journalComplete(op.entry.ID)
+			return errors.Wrap(err, "error sending deployment to the node")
+		}
+	}
 
-			log.Debug().Interface("deployment", dl)
-			hash, err := dl.ChallengeHash()
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "failed to create hash")
-			}
-			hashHex := hex.EncodeToString(hash)
-			log.Debug().Str("HASH", hashHex)
+	_ = d.journalRecord(&op.entry, StageNode)
+	contracts.set(op.node, op.dl.ContractID)
+	contracts.journaled(op.entry.ID)
 
-			// TODO: Destroy and create if publicIPCount is changed
-			// publicIPCount, err := countDeploymentPublicIPs(dl)
-			contractID, err := d.substrateConn.UpdateNodeContract(d.identity, dl.ContractID, "", hashHex)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "failed to update deployment")
-			}
-			dl.ContractID = contractID
-			sub, cancel := context.WithTimeout(ctx, 4*time.Minute)
-			defer cancel()
-			err = client.DeploymentUpdate(sub, dl)
-			if err != nil {
-				// cancel previous contract
-				return currentDeployments, errors.Wrapf(err, "failed to send deployment update request to node %d", node)
-			}
-			currentDeployments[node] = dl.ContractID
+	err := d.wait(ctx, op.node, op.client, op.dl.ContractID, op.versions)
+	if err != nil {
+		return errors.Wrap(err, "error waiting deployment")
+	}
 
-			err = d.Wait(ctx, client, dl.ContractID, newWorkloadsVersions)
-			if err != nil {
-				return currentDeployments, errors.Wrap(err, "error waiting deployment")
-			}
+	return nil
+}
+
+// needsRecreation checks if the update strategy requires recreating the node contract instead of updating it
+func (d *Deployer) needsRecreation(oldDl, newDl gridtypes.Deployment) (bool, error) {
+	if d.config.UpdateStrategy != RecreateOnPublicIPsChange {
+		return false, nil
+	}
+
+	oldPublicIPCount, err := CountDeploymentPublicIPs(oldDl)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to count old deployment public IPs")
+	}
+
+	newPublicIPCount, err := CountDeploymentPublicIPs(newDl)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to count new deployment public IPs")
+	}
+
+	return oldPublicIPCount != newPublicIPCount, nil
+}
+
+// recreateDeployment cancels the old node contract then creates a new one for the new deployment
+// if the new deployment fails, the old deployment is created again so the node is not left without a deployment
+func (d *Deployer) recreateDeployment(
+	ctx context.Context,
+	node uint32,
+	oldDl gridtypes.Deployment,
+	dl gridtypes.Deployment,
+	solutionProvider *uint64,
+	contracts *contractsTracker,
+) error {
+	log.Info().Msgf("recreating deployment %d on node %d as its public ips count changed", oldDl.ContractID, node)
+
+	// the old contract is canceled first to release its public ips and capacity
+	if err := d.cancelContract(node, oldDl.ContractID); err != nil {
+		return errors.Wrapf(err, "failed to cancel old deployment %d to recreate it", oldDl.ContractID)
+	}
+	contracts.delete(node)
+
+	err := d.createDeployment(ctx, node, dl, solutionProvider, contracts)
+	if err == nil {
+		return nil
+	}
+
+	// the new contract may exist if waiting on its workloads failed
+	if contractID, ok := contracts.getNode(node); ok {
+		if cerr := d.cancelContract(node, contractID); cerr != nil {
+			return fmt.Errorf("failed to recreate deployment: %w; failed to cancel new contract %d: %s", err, contractID, cerr)
+		}
+		contracts.delete(node)
+	}
+
+	if rerr := d.createDeployment(ctx, node, oldDl, solutionProvider, contracts); rerr != nil {
+		return fmt.Errorf("failed to recreate deployment: %w; failed to roll back old deployment: %s", err, rerr)
+	}
+
+	return errors.Wrap(err, "failed to recreate deployment, old deployment is rolled back")
+}
+
+// cancelContracts cancels the contracts of the given nodes, many contracts are canceled in one batch
+func (d *Deployer) cancelContracts(contracts map[uint32]uint64) error {
+	nodes := sortedNodes(contracts)
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	if len(nodes) == 1 {
+		node := nodes[0]
+		if err := d.cancelContract(node, contracts[node]); err != nil {
+			return errors.Wrapf(err, "failed to delete deployment %d on node %d", contracts[node], node)
+		}
+		return nil
+	}
+
+	entries := make([]string, 0, len(nodes))
+	contractIDs := make([]uint64, 0, len(nodes))
+	for _, node := range nodes {
+		entry := newJournalEntry(JournalCancel, node, contracts[node])
+		if err := d.journalRecord(&entry, StageIntent); err != nil {
+			return err
+		}
+		entries = append(entries, entry.ID)
+		contractIDs = append(contractIDs, contracts[node])
+	}
+
+	if err := d.substrateConn.BatchCancelContracts(d.identity, contractIDs); err != nil {
+		return errors.Wrapf(err, "failed to delete deployments %v", contractIDs)
+	}
+
+	d.journalComplete(entries...)
+	return nil
+}
+
+// cancelContract cancels a node contract, the cancellation is journaled so it's done again by Recover if it's interrupted
+func (d *Deployer) cancelContract(node uint32, contractID uint64) error {
+	entry := newJournalEntry(JournalCancel, node, contractID)
+	if err := d.journalRecord(&entry, StageIntent); err != nil {
+		return err
+	}
+
+	if err := d.substrateConn.EnsureContractCanceled(d.identity, contractID); err != nil {
+		return err
+	}
+
+	d.journalComplete(entry.ID)
+	return nil
+}
+
+// contractsTracker tracks the contracts of the nodes while deploying
+type contractsTracker struct {
+	lock      sync.Mutex
+	contracts map[uint32]uint64
+	// entries are the journal entries of the operations whose contracts are tracked
+	entries []string
+}
+
+func newContractsTracker(contracts map[uint32]uint64) *contractsTracker {
+	t := contractsTracker{contracts: make(map[uint32]uint64)}
+	for node, contractID := range contracts {
+		t.contracts[node] = contractID
+	}
+	return &t
+}
+
+func (t *contractsTracker) set(node uint32, contractID uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.contracts[node] = contractID
+}
+
+func (t *contractsTracker) delete(node uint32) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.contracts, node)
+}
+
+func (t *contractsTracker) getNode(node uint32) (uint64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	contractID, ok := t.contracts[node]
+	return contractID, ok
+}
+
+func (t *contractsTracker) journaled(entryID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.entries = append(t.entries, entryID)
+}
+
+func (t *contractsTracker) journalEntries() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]string{}, t.entries...)
+}
+
+// get returns a copy of the tracked contracts
+func (t *contractsTracker) get() map[uint32]uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	contracts := make(map[uint32]uint64)
+	for node, contractID := range t.contracts {
+		contracts[node] = contractID
+	}
+	return contracts
+}
+
+// sortedNodes returns the nodes IDs of a map in ascending order
+func sortedNodes[T any](nodes map[uint32]T) []uint32 {
+	keys := make([]uint32, 0, len(nodes))
+	for node := range nodes {
+		keys = append(keys, node)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// NodesError is returned if a deployment fails on more than one node, it keeps the error of every failed node
+// so errors.Is and errors.As can find any of them
+type NodesError struct {
+	Errors map[uint32]error
+}
+
+func (e *NodesError) Error() string {
+	nodes := sortedNodes(e.Errors)
+	msgs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		msgs = append(msgs, fmt.Sprintf("node %d: %s", node, e.Errors[node]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the nodes errors sorted by the nodes IDs
+func (e *NodesError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, node := range sortedNodes(e.Errors) {
+		errs = append(errs, e.Errors[node])
+	}
+	return errs
+}
+
+// Is reports whether any of the nodes errors matches target, for go versions before multiple wrapped errors support
+func (e *NodesError) Is(target error) bool {
+	for _, err := range e.Unwrap() {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first node error that matches target, for go versions before multiple wrapped errors support
+func (e *NodesError) As(target interface{}) bool {
+	for _, err := range e.Unwrap() {
+		if errors.As(err, target) {
+			return true
 		}
 	}
+	return false
+}
 
-	return currentDeployments, nil
+// nodesErrors combines the errors of the failed nodes into one error
+func nodesErrors(errs map[uint32]error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	nodes := sortedNodes(errs)
+	if len(nodes) == 1 {
+		return errs[nodes[0]]
+	}
+
+	return &NodesError{Errors: errs}
 }
 
 // Cancel cancels an old deployment not given in the new deployments
@@ -276,7 +822,7 @@ func (d *Deployer) Cancel(ctx context.Context,
 	contractID uint64,
 ) error {
 
-	err := d.substrateConn.EnsureContractCanceled(d.identity, contractID)
+	err := d.cancelContract(0, contractID)
 	if err != nil {
 		return errors.Wrapf(err, "failed to delete deployment: %d", contractID)
 	}
@@ -294,7 +840,7 @@ func (d *Deployer) GetDeployments(ctx context.Context, dls map[uint32]uint64) (m
 			return nil, errors.Wrapf(err, "failed to get a client for node %d", nodeID)
 		}
 
-		sub, cancel := context.WithTimeout(ctx, 10*time.Second)
+		sub, cancel := context.WithTimeout(ctx, d.config.NodeCallTimeout)
 		defer cancel()
 
 		dl, err := nc.DeploymentGet(sub, dlID)
@@ -330,12 +876,25 @@ func (d *Deployer) Wait(
 	deploymentID uint64,
 	workloadVersions map[string]uint32,
 ) error {
-	lastProgress := Progress{time.Now(), 0}
+	return d.wait(ctx, 0, nodeClient, deploymentID, workloadVersions)
+}
+
+// wait waits for a deployment to be deployed on node, reporting the workloads state transitions to the observers
+func (d *Deployer) wait(
+	ctx context.Context,
+	nodeID uint32,
+	nodeClient *client.NodeClient,
+	deploymentID uint64,
+	workloadVersions map[string]uint32,
+) error {
+	start := time.Now()
+	lastProgress := Progress{start, 0}
 	numberOfWorkloads := len(workloadVersions)
+	lastStates := make(map[string]gridtypes.ResultState)
 
 	deploymentError := backoff.Retry(func() error {
 		stateOk := 0
-		sub, cancel := context.WithTimeout(ctx, 10*time.Second)
+		sub, cancel := context.WithTimeout(ctx, d.config.NodeCallTimeout)
 		defer cancel()
 
 		deploymentChanges, err := nodeClient.DeploymentChanges(sub, deploymentID)
@@ -345,6 +904,19 @@ func (d *Deployer) Wait(
 
 		for _, wl := range deploymentChanges {
 			if _, ok := workloadVersions[wl.Name.String()]; ok && wl.Version == workloadVersions[wl.Name.String()] {
+				if lastStates[wl.Name.String()] != wl.Result.State {
+					lastStates[wl.Name.String()] = wl.Result.State
+					d.notify(WorkloadEvent{
+						NodeID:     nodeID,
+						ContractID: deploymentID,
+						Workload:   wl.Name.String(),
+						Type:       wl.Type,
+						State:      wl.Result.State,
+						Error:      wl.Result.Error,
+						Elapsed:    time.Since(start),
+					})
+				}
+
 				var errString string
 				switch wl.Result.State {
 				case gridtypes.StateOk:
@@ -371,14 +943,14 @@ func (d *Deployer) Wait(
 		currentProgress := Progress{time.Now(), stateOk}
 		if lastProgress.stateOk < currentProgress.stateOk {
 			lastProgress = currentProgress
-		} else if currentProgress.time.Sub(lastProgress.time) > 4*time.Minute {
+		} else if currentProgress.time.Sub(lastProgress.time) > d.config.NoProgressTimeout {
 			timeoutError := fmt.Errorf("waiting for deployment %d timed out", deploymentID)
 			return backoff.Permanent(timeoutError)
 		}
 
 		return errors.New("deployment in progress")
 	},
-		backoff.WithContext(getExponentialBackoff(3*time.Second, 1.25, 40*time.Second, 50*time.Minute), ctx))
+		backoff.WithContext(d.config.backoff(), ctx))
 
 	return deploymentError
 }
@@ -453,7 +1025,8 @@ func (d *Deployer) Validate(ctx context.Context, oldDeployments map[uint32]gridt
 		farmIPs[nodeData.FarmID] += int(publicIPCount)
 	}
 
-	for node, dl := range newDeployments {
+	for _, node := range sortedNodes(newDeployments) {
+		dl := newDeployments[node]
 		oldDl, alreadyExists := oldDeployments[node]
 		if err := dl.Valid(); err != nil {
 			return errors.Wrap(err, "invalid deployment")
@@ -470,6 +1043,13 @@ func (d *Deployer) Validate(ctx context.Context, oldDeployments map[uint32]gridt
 		}
 		requiredIPs := int(publicIPCount)
 		nodeInfo := nodeMap[node]
+		if err := d.validateNodeRent(node, nodeInfo, alreadyExists); err != nil {
+			return err
+		}
+		// cpu can be overcommitted, but a virtual machine can't have more cores than its node
+		if err := validateMachinesCPU(node, dl, nodeInfo.Capacity.Total.CRU); err != nil {
+			return err
+		}
 		if alreadyExists {
 			oldCap, err := Capacity(oldDl)
 			if err != nil {
@@ -481,9 +1061,9 @@ func (d *Deployer) Validate(ctx context.Context, oldDeployments map[uint32]gridt
 				return errors.Wrapf(err, "could not get node contract %d", oldDl.ContractID)
 			}
 			current := int(contract.PublicIPCount())
-			if requiredIPs > current {
+			if requiredIPs > current && d.config.UpdateStrategy != RecreateOnPublicIPsChange {
 				return fmt.Errorf(
-					"currently, it's not possible to increase the number of reserved public ips in a deployment, node: %d, current: %d, requested: %d",
+					"currently, it's not possible to increase the number of reserved public ips in a deployment unless the recreate update strategy is used, node: %d, current: %d, requested: %d",
 					node,
 					current,
 					requiredIPs,
@@ -491,36 +1071,82 @@ func (d *Deployer) Validate(ctx context.Context, oldDeployments map[uint32]gridt
 			}
 		}
 
-		farmIPs[nodeInfo.FarmID] -= requiredIPs
-		if farmIPs[nodeInfo.FarmID] < 0 {
-			return fmt.Errorf("farm %d does not have enough public ips", nodeInfo.FarmID)
+		if farmIPs[nodeInfo.FarmID] < requiredIPs {
+			return PublicIPsError{
+				FarmID: uint32(nodeInfo.FarmID),
+				NodeID: node,
+				Needed: uint32(requiredIPs),
+				Free:   uint32(farmIPs[nodeInfo.FarmID]),
+			}
 		}
+		farmIPs[nodeInfo.FarmID] -= requiredIPs
 		if HasWorkload(&dl, zos.GatewayFQDNProxyType) && nodeInfo.PublicConfig.Ipv4 == "" {
-			return fmt.Errorf("node %d cannot deploy a fqdn workload as it does not have a public ipv4 configured", node)
+			return PublicConfigError{NodeID: node, WorkloadType: zos.GatewayFQDNProxyType, Missing: "ipv4"}
 		}
 		if HasWorkload(&dl, zos.GatewayNameProxyType) && nodeInfo.PublicConfig.Domain == "" {
-			return fmt.Errorf("node %d cannot deploy a gateway name workload as it does not have a domain configured", node)
-		}
-		mru := nodeInfo.Capacity.Total.MRU - nodeInfo.Capacity.Used.MRU
-		hru := nodeInfo.Capacity.Total.HRU - nodeInfo.Capacity.Used.HRU
-		sru := 2*nodeInfo.Capacity.Total.SRU - nodeInfo.Capacity.Used.SRU
-		if mru < needed.MRU ||
-			sru < needed.SRU ||
-			hru < needed.HRU {
-			free := gridtypes.Capacity{
-				HRU: hru,
-				MRU: mru,
-				SRU: sru,
-			}
-			return fmt.Errorf("node %d does not have enough resources. needed: %v, free: %v", node, capacityPrettyPrint(needed), capacityPrettyPrint(free))
+			return PublicConfigError{NodeID: node, WorkloadType: zos.GatewayNameProxyType, Missing: "domain"}
+		}
+		free := gridtypes.Capacity{
+			MRU: nodeInfo.Capacity.Total.MRU - nodeInfo.Capacity.Used.MRU,
+			HRU: nodeInfo.Capacity.Total.HRU - nodeInfo.Capacity.Used.HRU,
+			SRU: 2*nodeInfo.Capacity.Total.SRU - nodeInfo.Capacity.Used.SRU,
+		}
+		if err := validateCapacity(node, needed, free); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateNodeRent checks that new contracts are not created on nodes rented by other twins or on dedicated nodes that are not rented
+func (d *Deployer) validateNodeRent(node uint32, nodeInfo proxyTypes.NodeWithNestedCapacity, alreadyExists bool) error {
+	if alreadyExists {
+		// the contract exists already, so renting the node later doesn't affect it
+		return nil
+	}
+	rentedBy := uint32(nodeInfo.RentedByTwinID)
+	if rentedBy != 0 && rentedBy != d.twinID {
+		return NodeRentedError{NodeID: node, RentedByTwinID: rentedBy}
+	}
+	if nodeInfo.Dedicated && rentedBy == 0 {
+		return DedicatedNodeError{NodeID: node}
+	}
+	return nil
+}
+
+// validateMachinesCPU checks that each virtual machine of the deployment has at most the node cores
+func validateMachinesCPU(node uint32, dl gridtypes.Deployment, nodeCRU uint64) error {
+	for _, wl := range dl.Workloads {
+		if wl.Type != zos.ZMachineType {
+			continue
+		}
+		wlCap, err := wl.Capacity()
+		if err != nil {
+			return errors.Wrapf(err, "could not get workload %s capacity", wl.Name)
+		}
+		if wlCap.CRU > nodeCRU {
+			return CapacityError{NodeID: node, Resource: ResourceCRU, Needed: wlCap.CRU, Free: nodeCRU}
 		}
 	}
 	return nil
 }
 
-// capacityPrettyPrint prints the capacity data
-func capacityPrettyPrint(cap gridtypes.Capacity) string {
-	return fmt.Sprintf("[mru: %d, sru: %d, hru: %d]", cap.MRU, cap.SRU, cap.HRU)
+// validateCapacity checks that the free memory and disks of the node are enough for the needed capacity
+func validateCapacity(node uint32, needed, free gridtypes.Capacity) error {
+	resources := []struct {
+		resource     Resource
+		needed, free gridtypes.Unit
+	}{
+		{ResourceMRU, needed.MRU, free.MRU},
+		{ResourceSRU, needed.SRU, free.SRU},
+		{ResourceHRU, needed.HRU, free.HRU},
+	}
+	for _, r := range resources {
+		if r.free < r.needed {
+			return CapacityError{NodeID: node, Resource: r.resource, Needed: uint64(r.needed), Free: uint64(r.free)}
+		}
+	}
+	return nil
 }
 
 // addCapacity adds a new data for capacity
@@ -0,0 +1,110 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"time"
+
+	"github.com/cenkalti/backoff"
+	client "github.com/threefoldtech/grid3-go/node"
+)
+
+// default deployer config values
+const (
+	defaultDeployTimeout            = 4 * time.Minute
+	defaultNoProgressTimeout        = 4 * time.Minute
+	defaultNodeCallTimeout          = 10 * time.Second
+	defaultBackoffInitialInterval   = 3 * time.Second
+	defaultBackoffMultiplier        = 1.25
+	defaultBackoffMaxInterval       = 40 * time.Second
+	defaultBackoffMaxElapsedTime    = 50 * time.Minute
+	defaultMaxConcurrentDeployments = 10
+	defaultWGPortRetries            = 3
+)
+
+// DeployerConfig configures how the deployers deploy: their timeouts, retries, batching and update strategy.
+// zero values are replaced with the defaults
+type DeployerConfig struct {
+	// DeployTimeout is the timeout of sending a deployment or an update to a node and waiting for it, default is 4 minutes
+	DeployTimeout time.Duration
+	// NoProgressTimeout is the time waiting for a deployment fails after if none of its workloads gets ready, default is 4 minutes
+	NoProgressTimeout time.Duration
+	// NodeCallTimeout is the timeout of getting deployments and their changes from the nodes, default is 10 seconds
+	NodeCallTimeout time.Duration
+
+	// BackoffInitialInterval is the first interval between polling deployment changes, default is 3 seconds
+	BackoffInitialInterval time.Duration
+	// BackoffMultiplier is the growth of the interval between polling deployment changes, default is 1.25
+	BackoffMultiplier float64
+	// BackoffMaxInterval is the maximum interval between polling deployment changes, default is 40 seconds
+	BackoffMaxInterval time.Duration
+	// BackoffMaxElapsedTime is the maximum time of polling deployment changes, default is 50 minutes
+	BackoffMaxElapsedTime time.Duration
+
+	// MaxConcurrentDeployments is the maximum number of node deployments handled at the same time, default is 10
+	MaxConcurrentDeployments int
+	// MaxBatchSize is the maximum number of contract operations submitted in one extrinsic, default is subi.DefaultMaxBatchSize.
+	// a batch is only atomic if it's not larger, bigger batches are split and a failure doesn't revert the parts submitted before it
+	MaxBatchSize int
+
+	// UpdateStrategy is the strategy used to update node deployments, default is UpdateInPlace
+	UpdateStrategy UpdateStrategy
+
+	// WGPortRange is the range of the wireguard ports picked for the networks nodes, default is 2000-7999
+	WGPortRange client.WGPortRange
+	// WGPortRetries is the number of times a network deployment is retried with new wireguard ports if a node rejects a port, default is 3
+	WGPortRetries int
+}
+
+// PersistenceConfig configures where the plugin client keeps its contract operations and state across restarts,
+// nothing is persisted by default
+type PersistenceConfig struct {
+	// Journal records the contract operations so Recover can finish or cancel them after a crash, no journal is used if it's nil
+	Journal Journal
+	// StateStore persists the plugin client state, it's loaded on start and saved after each deployer change, the state is only kept in memory if it's nil
+	StateStore StateStore
+}
+
+// DefaultDeployerConfig returns the default deployer config
+func DefaultDeployerConfig() DeployerConfig {
+	return DeployerConfig{}.withDefaults()
+}
+
+// withDefaults returns a copy of the config with its zero values replaced with the defaults
+func (c DeployerConfig) withDefaults() DeployerConfig {
+	if c.DeployTimeout == 0 {
+		c.DeployTimeout = defaultDeployTimeout
+	}
+	if c.NoProgressTimeout == 0 {
+		c.NoProgressTimeout = defaultNoProgressTimeout
+	}
+	if c.NodeCallTimeout == 0 {
+		c.NodeCallTimeout = defaultNodeCallTimeout
+	}
+	if c.BackoffInitialInterval == 0 {
+		c.BackoffInitialInterval = defaultBackoffInitialInterval
+	}
+	if c.BackoffMultiplier == 0 {
+		c.BackoffMultiplier = defaultBackoffMultiplier
+	}
+	if c.BackoffMaxInterval == 0 {
+		c.BackoffMaxInterval = defaultBackoffMaxInterval
+	}
+	if c.BackoffMaxElapsedTime == 0 {
+		c.BackoffMaxElapsedTime = defaultBackoffMaxElapsedTime
+	}
+	if c.MaxConcurrentDeployments == 0 {
+		c.MaxConcurrentDeployments = defaultMaxConcurrentDeployments
+	}
+	if c.WGPortRange == (client.WGPortRange{}) {
+		c.WGPortRange = client.DefaultWGPortRange
+	}
+	if c.WGPortRetries == 0 {
+		c.WGPortRetries = defaultWGPortRetries
+	}
+	return c
+}
+
+// backoff returns the backoff used to poll deployment changes
+func (c DeployerConfig) backoff() *backoff.ExponentialBackOff {
+	return getExponentialBackoff(c.BackoffInitialInterval, c.BackoffMultiplier, c.BackoffMaxInterval, c.BackoffMaxElapsedTime)
+}
@@ -5,9 +5,15 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/centrifuge/go-substrate-rpc-client/v4/types"
 	"github.com/golang/mock/gomock"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
@@ -151,24 +157,15 @@ func TestDeployer(t *testing.T) {
 		mockDeployerValidator(&deployer, ctrl, []uint32{10, 20})
 
 		sub.EXPECT().
-			CreateNodeContract(
+			BatchContracts(
 				identity,
-				uint32(10),
-				``,
-				dl1Hash,
-				uint32(0),
-				nil,
-			).Return(uint64(100), nil)
-
-		sub.EXPECT().
-			CreateNodeContract(
-				identity,
-				uint32(20),
-				``,
-				dl2Hash,
-				uint32(0),
-				nil,
-			).Return(uint64(200), nil)
+				subi.BatchContractsInput{
+					Create: []subi.BatchCreateContractInput{
+						{Node: 10, Hash: dl1Hash},
+						{Node: 20, Hash: dl2Hash},
+					},
+				},
+			).Return([]uint64{100, 200}, nil)
 
 		ncPool.EXPECT().
 			GetNodeClient(sub, uint32(10)).
@@ -368,29 +365,22 @@ func TestDeployer(t *testing.T) {
 			}},
 		}, nil).AnyTimes()
 
+		// the creation of node 30 and the update of node 20 are submitted in one batch
 		sub.EXPECT().
-			CreateNodeContract(
+			BatchContracts(
 				identity,
-				uint32(30),
-				``,
-				dl4Hash,
-				uint32(0),
-				nil,
-			).Return(uint64(300), nil)
-
-		sub.EXPECT().
-			UpdateNodeContract(
-				identity,
-				uint64(200),
-				"",
-				dl3Hash,
-			).Return(uint64(200), nil)
+				subi.BatchContractsInput{
+					Create: []subi.BatchCreateContractInput{{Node: 30, Hash: dl4Hash}},
+					Update: []subi.BatchUpdateContractInput{{ContractID: 200, Hash: dl3Hash}},
+				},
+			).Return([]uint64{300}, nil)
 
+		// node 10 is dropped from the new deployments, then canceled again explicitly
 		sub.EXPECT().
 			EnsureContractCanceled(
 				identity,
 				uint64(100),
-			).Return(nil)
+			).Return(nil).Times(2)
 
 		ncPool.EXPECT().
 			GetNodeClient(sub, uint32(10)).
@@ -496,7 +486,6 @@ func TestDeployer(t *testing.T) {
 		contracts, err := deployer.Deploy(context.Background(), oldDls, newDls, newDlsSolProvider)
 		assert.NoError(t, err)
 		assert.Equal(t, contracts, map[uint32]uint64{
-			10: 100,
 			20: 200,
 			30: 300,
 			40: 400,
@@ -506,3 +495,605 @@ func TestDeployer(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+// setupMockedDeployer creates a deployer with mocked clients which doesn't need a grid connection
+func setupMockedDeployer(t *testing.T, ctrl *gomock.Controller) (Deployer, *mocks.MockSubstrateExt, *mocks.MockNodeClientGetter, *mocks.RMBMockClient) {
+	identity, err := substrate.NewIdentityFromSr25519Phrase("//Alice")
+	assert.NoError(t, err)
+
+	sub := mocks.NewMockSubstrateExt(ctrl)
+	ncPool := mocks.NewMockNodeClientGetter(ctrl)
+	cl := mocks.NewRMBMockClient(ctrl)
+
+	deployer := Deployer{
+		identity:      identity,
+		twinID:        1,
+		ncPool:        ncPool,
+		substrateConn: sub,
+		config:        DefaultDeployerConfig(),
+	}
+
+	return deployer, sub, ncPool, cl
+}
+
+// setupMockedPluginClient creates a plugin client with mocked clients and enough balance to deploy, which doesn't need a grid connection
+func setupMockedPluginClient(ctrl *gomock.Controller) (*TFPluginClient, *mocks.MockSubstrateExt, *mocks.MockNodeClientGetter, *mocks.RMBMockClient) {
+	sub := mocks.NewMockSubstrateExt(ctrl)
+	ncPool := mocks.NewMockNodeClientGetter(ctrl)
+	cl := mocks.NewRMBMockClient(ctrl)
+
+	tfPluginClient := TFPluginClient{
+		TwinID:        twinID,
+		SubstrateConn: sub,
+		NcPool:        ncPool,
+		RMB:           cl,
+		State:         NewState(ncPool, sub),
+	}
+
+	sub.EXPECT().
+		GetBalance(tfPluginClient.Identity).
+		Return(substrate.Balance{Free: types.U128{Int: big.NewInt(100000)}}, nil).
+		AnyTimes()
+
+	return &tfPluginClient, sub, ncPool, cl
+}
+
+func TestDeployerConcurrentPartialFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, ncPool, cl := setupMockedDeployer(t, ctrl)
+	identity := deployer.identity
+	twinID := deployer.twinID
+
+	dl1, err := deploymentWithNameGateway(identity, twinID, true, 0, backendURLWithTLSPassthrough)
+	assert.NoError(t, err)
+	dl2, err := deploymentWithFQDN(identity, twinID, 0)
+	assert.NoError(t, err)
+
+	newDls := map[uint32]gridtypes.Deployment{
+		10: dl1,
+		20: dl2,
+	}
+
+	sub.EXPECT().
+		BatchContracts(identity, gomock.Any()).
+		DoAndReturn(func(identity substrate.Identity, input subi.BatchContractsInput) ([]uint64, error) {
+			assert.Len(t, input.Create, 2)
+			assert.Equal(t, uint32(10), input.Create[0].Node)
+			assert.Equal(t, uint32(20), input.Create[1].Node)
+			return []uint64{100, 200}, nil
+		})
+
+	sub.EXPECT().
+		EnsureContractCanceled(identity, uint64(200)).
+		Return(nil)
+
+	ncPool.EXPECT().
+		GetNodeClient(sub, uint32(10)).
+		Return(client.NewNodeClient(13, cl, 10), nil)
+
+	ncPool.EXPECT().
+		GetNodeClient(sub, uint32(20)).
+		Return(client.NewNodeClient(23, cl, 10), nil)
+
+	// node 20 fails only after node 10 is deployed, so both deployments are in progress at the same time
+	dl1Deployed := make(chan struct{})
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.deploy", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			dl1.Workloads[0].Result.State = gridtypes.StateOk
+			dl1.Workloads[0].Result.Data, _ = json.Marshal(zos.GatewayProxyResult{})
+			return nil
+		})
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.changes", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			var res *[]gridtypes.Workload = result.(*[]gridtypes.Workload)
+			*res = dl1.Workloads
+			close(dl1Deployed)
+			return nil
+		})
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(23), "zos.deployment.deploy", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			<-dl1Deployed
+			return errors.New("node is down")
+		})
+
+	contracts, err := deployer.deploy(context.Background(), nil, newDls, map[uint32]*uint64{}, false)
+	assert.Error(t, err)
+	assert.Equal(t, map[uint32]uint64{10: 100}, contracts)
+}
+
+func TestDeployerNodesErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, _, _, _ := setupMockedDeployer(t, ctrl)
+
+	errNodeDown := errors.New("node is down")
+	err := deployer.forEachNode([]uint32{10, 20, 30}, false, func(node uint32) error {
+		switch node {
+		case 10:
+			return fmt.Errorf("failed to deploy on node 10: %w", CapacityError{NodeID: 10, Resource: ResourceMRU, Needed: 2, Free: 1})
+		case 20:
+			return fmt.Errorf("failed to deploy on node 20: %w", NodeRentedError{NodeID: 20, RentedByTwinID: 5})
+		default:
+			return errNodeDown
+		}
+	})
+	assert.EqualError(t, err, "node 10: failed to deploy on node 10: node 10 does not have enough resources. needed mru: 2, free mru: 1; "+
+		"node 20: failed to deploy on node 20: node 20 is rented by twin 5; node 30: node is down")
+
+	var nodesErr *NodesError
+	assert.True(t, errors.As(err, &nodesErr))
+	assert.Len(t, nodesErr.Errors, 3)
+
+	var capacityErr CapacityError
+	assert.True(t, errors.As(err, &capacityErr))
+	assert.Equal(t, uint32(10), capacityErr.NodeID)
+
+	var rentedErr NodeRentedError
+	assert.True(t, errors.As(err, &rentedErr))
+	assert.Equal(t, uint32(20), rentedErr.NodeID)
+
+	assert.True(t, errors.Is(err, errNodeDown))
+
+	var dedicatedErr DedicatedNodeError
+	assert.False(t, errors.As(err, &dedicatedErr))
+}
+
+func TestDeployerDeletions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, ncPool, cl := setupMockedDeployer(t, ctrl)
+	identity := deployer.identity
+
+	t.Run("dropped nodes are canceled", func(t *testing.T) {
+		sub.EXPECT().BatchCancelContracts(identity, []uint64{100, 200}).Return(nil)
+
+		contracts, err := deployer.deploy(context.Background(), map[uint32]uint64{10: 100, 20: 200}, nil, nil, false)
+		assert.NoError(t, err)
+		assert.Empty(t, contracts)
+	})
+
+	t.Run("failed batch cancellation keeps all contracts", func(t *testing.T) {
+		sub.EXPECT().BatchCancelContracts(identity, []uint64{100, 200}).Return(errors.New("error"))
+
+		contracts, err := deployer.deploy(context.Background(), map[uint32]uint64{10: 100, 20: 200}, nil, nil, false)
+		assert.Error(t, err)
+		assert.Equal(t, map[uint32]uint64{10: 100, 20: 200}, contracts)
+	})
+
+	t.Run("failed cancellation is kept", func(t *testing.T) {
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(100)).Return(errors.New("error"))
+
+		contracts, err := deployer.deploy(context.Background(), map[uint32]uint64{10: 100}, nil, nil, false)
+		assert.Error(t, err)
+		assert.Equal(t, map[uint32]uint64{10: 100}, contracts)
+	})
+
+	t.Run("nothing is canceled if a creation fails", func(t *testing.T) {
+		dl, err := deploymentWithFQDN(identity, deployer.twinID, 0)
+		assert.NoError(t, err)
+
+		ncPool.EXPECT().
+			GetNodeClient(sub, uint32(20)).
+			Return(client.NewNodeClient(23, cl, 10), nil)
+
+		sub.EXPECT().
+			CreateNodeContract(identity, uint32(20), ``, gomock.Any(), uint32(0), nil).
+			Return(uint64(0), errors.New("error"))
+
+		contracts, err := deployer.deploy(context.Background(), map[uint32]uint64{10: 100}, map[uint32]gridtypes.Deployment{20: dl}, map[uint32]*uint64{}, false)
+		assert.Error(t, err)
+		assert.Equal(t, map[uint32]uint64{10: 100}, contracts)
+	})
+}
+
+func TestDeployerRecreateOnPublicIPsChange(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, ncPool, cl := setupMockedDeployer(t, ctrl)
+	deployer.SetUpdateStrategy(RecreateOnPublicIPsChange)
+	identity := deployer.identity
+
+	oldDl, err := deploymentWithNameGateway(identity, deployer.twinID, true, 0, backendURLWithTLSPassthrough)
+	assert.NoError(t, err)
+	oldDl.ContractID = 100
+
+	newDl, err := deploymentWithNameGateway(identity, deployer.twinID, true, 0, backendURLWithTLSPassthrough)
+	assert.NoError(t, err)
+	newDl.Workloads = append(newDl.Workloads, gridtypes.Workload{
+		Name: "ip",
+		Type: zos.PublicIPType,
+		Data: gridtypes.MustMarshal(zos.PublicIP{V4: true}),
+	})
+
+	ncPool.EXPECT().
+		GetNodeClient(sub, uint32(10)).
+		Return(client.NewNodeClient(13, cl, 10), nil).AnyTimes()
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			var res *gridtypes.Deployment = result.(*gridtypes.Deployment)
+			*res = oldDl
+			return nil
+		}).AnyTimes()
+
+	// the node reports the workloads of the last deployment sent to it as ok
+	var deployed gridtypes.Deployment
+	captureDeployment := func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+		deployed = data.(gridtypes.Deployment)
+		return nil
+	}
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.changes", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			var res *[]gridtypes.Workload = result.(*[]gridtypes.Workload)
+			for _, wl := range deployed.Workloads {
+				wl.Result.State = gridtypes.StateOk
+				*res = append(*res, wl)
+			}
+			return nil
+		}).AnyTimes()
+
+	t.Run("recreated", func(t *testing.T) {
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(100)).Return(nil)
+
+		sub.EXPECT().
+			CreateNodeContract(identity, uint32(10), ``, gomock.Any(), uint32(1), nil).
+			Return(uint64(101), nil)
+
+		cl.EXPECT().
+			Call(gomock.Any(), uint32(13), "zos.deployment.deploy", gomock.Any(), gomock.Any()).
+			DoAndReturn(captureDeployment)
+
+		contracts, err := deployer.deploy(context.Background(), map[uint32]uint64{10: 100}, map[uint32]gridtypes.Deployment{10: newDl}, map[uint32]*uint64{}, false)
+		assert.NoError(t, err)
+		assert.Equal(t, map[uint32]uint64{10: 101}, contracts)
+		assert.Equal(t, uint64(101), deployed.ContractID)
+		assert.Equal(t, uint32(0), deployed.Version)
+	})
+
+	t.Run("rolled back", func(t *testing.T) {
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(100)).Return(nil)
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(101)).Return(nil)
+
+		gomock.InOrder(
+			sub.EXPECT().
+				CreateNodeContract(identity, uint32(10), ``, gomock.Any(), uint32(1), nil).
+				Return(uint64(101), nil),
+			sub.EXPECT().
+				CreateNodeContract(identity, uint32(10), ``, gomock.Any(), uint32(0), nil).
+				Return(uint64(102), nil),
+		)
+
+		gomock.InOrder(
+			cl.EXPECT().
+				Call(gomock.Any(), uint32(13), "zos.deployment.deploy", gomock.Any(), gomock.Any()).
+				Return(errors.New("node is busy")),
+			cl.EXPECT().
+				Call(gomock.Any(), uint32(13), "zos.deployment.deploy", gomock.Any(), gomock.Any()).
+				DoAndReturn(captureDeployment),
+		)
+
+		contracts, err := deployer.deploy(context.Background(), map[uint32]uint64{10: 100}, map[uint32]gridtypes.Deployment{10: newDl}, map[uint32]*uint64{}, false)
+		assert.Error(t, err)
+		assert.Equal(t, map[uint32]uint64{10: 102}, contracts)
+		assert.Equal(t, uint64(102), deployed.ContractID)
+		assert.Len(t, deployed.Workloads, 1)
+	})
+}
+
+func TestDeployerObserver(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, ncPool, cl := setupMockedDeployer(t, ctrl)
+	identity := deployer.identity
+
+	var events []WorkloadEvent
+	deployer.RegisterObserver(ObserverFunc(func(event WorkloadEvent) {
+		events = append(events, event)
+	}))
+
+	dl, err := deploymentWithNameGateway(identity, deployer.twinID, true, 0, backendURLWithTLSPassthrough)
+	assert.NoError(t, err)
+	disk := workloads.Disk{Name: "disk", SizeGB: 1}
+	dl.Workloads = append(dl.Workloads, disk.ZosWorkload())
+
+	ncPool.EXPECT().
+		GetNodeClient(sub, uint32(10)).
+		Return(client.NewNodeClient(13, cl, 10), nil)
+
+	sub.EXPECT().
+		CreateNodeContract(identity, uint32(10), ``, gomock.Any(), uint32(0), nil).
+		Return(uint64(100), nil)
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.deploy", gomock.Any(), gomock.Any()).
+		Return(nil)
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.changes", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			var res *[]gridtypes.Workload = result.(*[]gridtypes.Workload)
+			*res = append([]gridtypes.Workload{}, dl.Workloads...)
+			(*res)[0].Result.State = gridtypes.StateOk
+			(*res)[1].Result.State = gridtypes.StateError
+			(*res)[1].Result.Error = "no space left"
+			return nil
+		})
+
+	_, err = deployer.deploy(context.Background(), nil, map[uint32]gridtypes.Deployment{10: dl}, map[uint32]*uint64{}, false)
+	assert.Error(t, err)
+
+	assert.Len(t, events, 2)
+	assert.Equal(t, WorkloadEvent{
+		NodeID:     10,
+		ContractID: 100,
+		Workload:   "name",
+		Type:       zos.GatewayNameProxyType,
+		State:      gridtypes.StateOk,
+		Elapsed:    events[0].Elapsed,
+	}, events[0])
+	assert.Equal(t, "disk", events[1].Workload)
+	assert.Equal(t, gridtypes.StateError, events[1].State)
+	assert.Equal(t, "no space left", events[1].Error)
+}
+
+func TestDeployerConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		config := DeployerConfig{DeployTimeout: time.Minute}.withDefaults()
+		assert.Equal(t, time.Minute, config.DeployTimeout)
+		assert.Equal(t, 4*time.Minute, config.NoProgressTimeout)
+		assert.Equal(t, 10*time.Second, config.NodeCallTimeout)
+		assert.Equal(t, 10, config.MaxConcurrentDeployments)
+		assert.Equal(t, client.DefaultWGPortRange, config.WGPortRange)
+		assert.Equal(t, 3, config.WGPortRetries)
+		assert.Equal(t, UpdateInPlace, config.UpdateStrategy)
+	})
+
+	t.Run("constructors", func(t *testing.T) {
+		journal := NewFileJournal(filepath.Join(t.TempDir(), "journal.json"))
+		tfPluginClient := TFPluginClient{
+			deployerConfig:    DeployerConfig{DeployTimeout: time.Minute},
+			persistenceConfig: PersistenceConfig{Journal: journal},
+		}
+
+		deployer := NewDeployer(tfPluginClient, true)
+		assert.Equal(t, time.Minute, deployer.config.DeployTimeout)
+		assert.Equal(t, 10*time.Second, deployer.config.NodeCallTimeout)
+		assert.Equal(t, journal, deployer.journal)
+
+		deployer = NewDeployerWithConfig(tfPluginClient, true, DeployerConfig{NodeCallTimeout: time.Second}, nil)
+		assert.Equal(t, 4*time.Minute, deployer.config.DeployTimeout)
+		assert.Equal(t, time.Second, deployer.config.NodeCallTimeout)
+		assert.Nil(t, deployer.journal)
+	})
+
+	t.Run("no progress timeout", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		deployer, _, _, cl := setupMockedDeployer(t, ctrl)
+		deployer.config = DeployerConfig{
+			NoProgressTimeout:      20 * time.Millisecond,
+			BackoffInitialInterval: 5 * time.Millisecond,
+			BackoffMaxInterval:     5 * time.Millisecond,
+		}.withDefaults()
+
+		var events []WorkloadEvent
+		deployer.RegisterObserver(ObserverFunc(func(event WorkloadEvent) {
+			events = append(events, event)
+		}))
+
+		cl.EXPECT().
+			Call(gomock.Any(), uint32(13), "zos.deployment.changes", gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+				var res *[]gridtypes.Workload = result.(*[]gridtypes.Workload)
+				*res = []gridtypes.Workload{{Name: "vm", Result: gridtypes.Result{State: gridtypes.StateInit}}}
+				return nil
+			}).MinTimes(2)
+
+		err := deployer.wait(context.Background(), 10, client.NewNodeClient(13, cl, 10), 100, map[string]uint32{"vm": 0})
+		assert.ErrorContains(t, err, "timed out")
+		assert.Len(t, events, 1)
+		assert.Equal(t, gridtypes.StateInit, events[0].State)
+	})
+}
+
+func TestDeployerBatchContracts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, ncPool, cl := setupMockedDeployer(t, ctrl)
+	identity := deployer.identity
+	twinID := deployer.twinID
+
+	oldDl, err := deploymentWithNameGateway(identity, twinID, false, 0, backendURLWithoutTLSPassthrough)
+	assert.NoError(t, err)
+	oldDl.ContractID = 100
+
+	updatedDl, err := deploymentWithNameGateway(identity, twinID, true, 0, backendURLWithTLSPassthrough)
+	assert.NoError(t, err)
+	newDl, err := deploymentWithFQDN(identity, twinID, 0)
+	assert.NoError(t, err)
+
+	ncPool.EXPECT().
+		GetNodeClient(sub, uint32(10)).
+		Return(client.NewNodeClient(13, cl, 10), nil)
+
+	ncPool.EXPECT().
+		GetNodeClient(sub, uint32(20)).
+		Return(client.NewNodeClient(23, cl, 10), nil)
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			var res *gridtypes.Deployment = result.(*gridtypes.Deployment)
+			*res = oldDl
+			return nil
+		})
+
+	sub.EXPECT().
+		BatchContracts(identity, gomock.Any()).
+		DoAndReturn(func(identity substrate.Identity, input subi.BatchContractsInput) ([]uint64, error) {
+			assert.Len(t, input.Create, 1)
+			assert.Equal(t, uint32(20), input.Create[0].Node)
+			assert.Len(t, input.Update, 1)
+			assert.Equal(t, uint64(100), input.Update[0].ContractID)
+			assert.Empty(t, input.Cancel)
+			return []uint64{200}, nil
+		})
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.update", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			updatedDl.Workloads[0].Version = 1
+			updatedDl.Workloads[0].Result.State = gridtypes.StateOk
+			updatedDl.Workloads[0].Result.Data, _ = json.Marshal(zos.GatewayProxyResult{})
+			return nil
+		})
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(13), "zos.deployment.changes", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			var res *[]gridtypes.Workload = result.(*[]gridtypes.Workload)
+			*res = updatedDl.Workloads
+			return nil
+		})
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(23), "zos.deployment.deploy", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			newDl.Workloads[0].Result.State = gridtypes.StateOk
+			newDl.Workloads[0].Result.Data, _ = json.Marshal(zos.GatewayProxyResult{})
+			return nil
+		})
+
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(23), "zos.deployment.changes", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			var res *[]gridtypes.Workload = result.(*[]gridtypes.Workload)
+			*res = newDl.Workloads
+			return nil
+		})
+
+	contracts, err := deployer.deploy(context.Background(), map[uint32]uint64{10: 100}, map[uint32]gridtypes.Deployment{10: updatedDl, 20: newDl}, map[uint32]*uint64{}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint32]uint64{10: 100, 20: 200}, contracts)
+}
+
+func TestDeployerValidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, _, _, _ := setupMockedDeployer(t, ctrl)
+	identity := deployer.identity
+	twinID := deployer.twinID
+	proxyCl := mocks.NewMockClient(ctrl)
+	deployer.gridProxyClient = proxyCl
+
+	vmDeployment := func(cpu int, memory int, publicIP bool) gridtypes.Deployment {
+		vm := workloads.VM{
+			Name:        "vm",
+			Flist:       "https://hub.grid.tf/tf-official-apps/base:latest.flist",
+			CPU:         cpu,
+			Memory:      memory,
+			PublicIP:    publicIP,
+			Planetary:   true,
+			IP:          "10.1.2.2",
+			NetworkName: "network",
+		}
+		return workloads.NewGridDeployment(twinID, vm.ZosWorkload())
+	}
+
+	freeNode := proxyTypes.NodeWithNestedCapacity{
+		FarmID: 1,
+		Capacity: proxyTypes.CapacityResult{
+			Total: proxyTypes.Capacity{
+				CRU: 2,
+				MRU: 2 * gridtypes.Gigabyte,
+				SRU: 10 * gridtypes.Gigabyte,
+			},
+			Used: proxyTypes.Capacity{
+				MRU: gridtypes.Gigabyte,
+			},
+		},
+	}
+
+	validate := func(node proxyTypes.NodeWithNestedCapacity, farm proxyTypes.Farm, dl gridtypes.Deployment) error {
+		proxyCl.EXPECT().Node(uint32(10)).Return(node, nil)
+		proxyCl.EXPECT().Farms(gomock.Any(), gomock.Any()).Return([]proxyTypes.Farm{farm}, 1, nil)
+		return deployer.Validate(context.Background(), nil, map[uint32]gridtypes.Deployment{10: dl})
+	}
+
+	t.Run("enough resources", func(t *testing.T) {
+		assert.NoError(t, validate(freeNode, proxyTypes.Farm{FarmID: 1}, vmDeployment(2, 1024, false)))
+	})
+
+	t.Run("more cores than the node", func(t *testing.T) {
+		err := validate(freeNode, proxyTypes.Farm{FarmID: 1}, vmDeployment(4, 1024, false))
+
+		var capErr CapacityError
+		assert.True(t, errors.As(err, &capErr))
+		assert.Equal(t, CapacityError{NodeID: 10, Resource: ResourceCRU, Needed: 4, Free: 2}, capErr)
+	})
+
+	t.Run("not enough memory", func(t *testing.T) {
+		err := validate(freeNode, proxyTypes.Farm{FarmID: 1}, vmDeployment(1, 2048, false))
+
+		var capErr CapacityError
+		assert.True(t, errors.As(err, &capErr))
+		assert.Equal(t, uint32(10), capErr.NodeID)
+		assert.Equal(t, ResourceMRU, capErr.Resource)
+		assert.Equal(t, uint64(gridtypes.Gigabyte), capErr.Free)
+	})
+
+	t.Run("node rented by another twin", func(t *testing.T) {
+		node := freeNode
+		node.RentedByTwinID = 2
+
+		err := validate(node, proxyTypes.Farm{FarmID: 1}, vmDeployment(1, 1024, false))
+		assert.Equal(t, NodeRentedError{NodeID: 10, RentedByTwinID: 2}, err)
+	})
+
+	t.Run("dedicated node", func(t *testing.T) {
+		node := freeNode
+		node.Dedicated = true
+
+		err := validate(node, proxyTypes.Farm{FarmID: 1}, vmDeployment(1, 1024, false))
+		assert.Equal(t, DedicatedNodeError{NodeID: 10}, err)
+
+		node.RentedByTwinID = uint(twinID)
+		assert.NoError(t, validate(node, proxyTypes.Farm{FarmID: 1}, vmDeployment(1, 1024, false)))
+	})
+
+	t.Run("no free public ips", func(t *testing.T) {
+		farm := proxyTypes.Farm{
+			FarmID:    1,
+			PublicIps: []proxyTypes.PublicIP{{ContractID: 5}},
+		}
+
+		err := validate(freeNode, farm, vmDeployment(1, 1024, true))
+		assert.Equal(t, PublicIPsError{FarmID: 1, NodeID: 10, Needed: 1, Free: 0}, err)
+	})
+
+	t.Run("fqdn on a node without ipv4", func(t *testing.T) {
+		dl, err := deploymentWithFQDN(identity, twinID, 0)
+		assert.NoError(t, err)
+
+		err = validate(freeNode, proxyTypes.Farm{FarmID: 1}, dl)
+		assert.Equal(t, PublicConfigError{NodeID: 10, WorkloadType: zos.GatewayFQDNProxyType, Missing: "ipv4"}, err)
+	})
+}
@@ -3,7 +3,6 @@ package deployer
 
 import (
 	"context"
-	"net"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
@@ -27,10 +26,20 @@ func NewDeploymentDeployer(tfPluginClient *TFPluginClient) DeploymentDeployer {
 	}
 }
 
+// SetUpdateStrategy sets the strategy used to update the deployments
+func (d *DeploymentDeployer) SetUpdateStrategy(strategy UpdateStrategy) {
+	setUpdateStrategy(d.deployer, strategy)
+}
+
+// RegisterObserver registers an observer for the workloads events of the deployments
+func (d *DeploymentDeployer) RegisterObserver(observer Observer) {
+	registerObserver(d.deployer, observer)
+}
+
 // GenerateVersionlessDeployments generates a new deployment without a version
 func (d *DeploymentDeployer) GenerateVersionlessDeployments(ctx context.Context, dl *workloads.Deployment) (map[uint32]gridtypes.Deployment, error) {
 	newDl := workloads.NewGridDeployment(d.tfPluginClient.TwinID, []gridtypes.Workload{})
-	err := d.assignNodesIPs(dl)
+	_, err := d.assignNodesIPs(dl, false)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to assign node ips")
 	}
@@ -66,6 +75,13 @@ func (d *DeploymentDeployer) Deploy(ctx context.Context, dl *workloads.Deploymen
 		return err
 	}
 
+	// the VMs IPs are reserved so concurrent deployments on the same network don't get them
+	release, err := d.assignNodesIPs(dl, true)
+	if err != nil {
+		return errors.Wrap(err, "failed to assign node ips")
+	}
+	defer release()
+
 	// solution providers
 	newDeploymentsSolutionProvider := map[uint32]*uint64{dl.NodeID: dl.SolutionProvider}
 
@@ -74,18 +90,59 @@ func (d *DeploymentDeployer) Deploy(ctx context.Context, dl *workloads.Deploymen
 		return errors.Wrap(err, "could not generate deployments data")
 	}
 
+	oldDeploymentIDs := dl.NodeDeploymentID
 	dl.NodeDeploymentID, err = d.deployer.Deploy(ctx, dl.NodeDeploymentID, newDeployments, newDeploymentsSolutionProvider)
 
 	// update deployment and plugin state
 	// error is not returned immediately before updating state because of untracked failed deployments
+	for nodeID, contractID := range canceledContracts(oldDeploymentIDs, dl.NodeDeploymentID) {
+		d.tfPluginClient.State.removeDeployment(nodeID, contractID)
+		if dl.NetworkName != "" {
+			d.tfPluginClient.State.ips.release(dl.NetworkName, nodeID, contractID)
+		}
+	}
 	if contractID, ok := dl.NodeDeploymentID[dl.NodeID]; ok && contractID != 0 {
 		dl.ContractID = contractID
-		if !workloads.Contains(d.tfPluginClient.State.CurrentNodeDeployments[dl.NodeID], dl.ContractID) {
-			d.tfPluginClient.State.CurrentNodeDeployments[dl.NodeID] = append(d.tfPluginClient.State.CurrentNodeDeployments[dl.NodeID], dl.ContractID)
+		d.tfPluginClient.State.addDeployment(dl.NodeID, dl.ContractID)
+		if dl.NetworkName != "" && len(dl.Vms) != 0 {
+			// the reserved IPs are used by the deployment contract now
+			d.tfPluginClient.State.ips.set(dl.NetworkName, dl.NodeID, dl.ContractID, vmsIPs(dl.Vms))
 		}
 	}
 
-	return err
+	return d.tfPluginClient.State.saveAfter(err)
+}
+
+// Plan returns the changes deploying the deployment would apply, without changing any contract
+// missing IPs are assigned the same way Deploy assigns them, to a copy of the deployment which is left unchanged
+func (d *DeploymentDeployer) Plan(ctx context.Context, dl *workloads.Deployment) (Plan, error) {
+	planned := copyDeployment(dl)
+	dl = &planned
+
+	if err := d.Validate(ctx, dl); err != nil {
+		return Plan{}, err
+	}
+
+	newDeployments, err := d.GenerateVersionlessDeployments(ctx, dl)
+	if err != nil {
+		return Plan{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	return planDeployments(ctx, d.deployer, dl.NodeDeploymentID, newDeployments)
+}
+
+// DetectDrift reports the differences between the deployment and what is live on the grid, without changing the deployment.
+// the desired deployments are generated from a copy of the deployment which is left unchanged
+func (d *DeploymentDeployer) DetectDrift(ctx context.Context, dl *workloads.Deployment) (DriftReport, error) {
+	desired := copyDeployment(dl)
+	dl = &desired
+
+	desiredDeployments, err := d.GenerateVersionlessDeployments(ctx, dl)
+	if err != nil {
+		return DriftReport{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	return d.deployer.DetectDrift(ctx, dl.NodeDeploymentID, desiredDeployments)
 }
 
 // Cancel cancels deployments
@@ -101,10 +158,13 @@ func (d *DeploymentDeployer) Cancel(ctx context.Context, dl *workloads.Deploymen
 
 	// update state
 	delete(dl.NodeDeploymentID, dl.NodeID)
-	d.tfPluginClient.State.CurrentNodeDeployments[dl.NodeID] = workloads.Delete(d.tfPluginClient.State.CurrentNodeDeployments[dl.NodeID], dl.ContractID)
+	d.tfPluginClient.State.removeDeployment(dl.NodeID, dl.ContractID)
+	if dl.NetworkName != "" {
+		d.tfPluginClient.State.ips.release(dl.NetworkName, dl.NodeID, dl.ContractID)
+	}
 	dl.ContractID = 0
 
-	return nil
+	return d.tfPluginClient.State.saveAfter(nil)
 }
 
 // Sync syncs the deployments
@@ -130,10 +190,7 @@ func (d *DeploymentDeployer) Sync(ctx context.Context, dl *workloads.Deployment)
 	qsfs := make([]workloads.QSFS, 0)
 	disks := make([]workloads.Disk, 0)
 
-	network := d.tfPluginClient.State.networks.GetNetwork(dl.NetworkName)
-	network.DeleteDeploymentHostIDs(dl.NodeID, dl.ContractID)
-
-	usedIPs := []byte{}
+	usedIPs := []string{}
 	for _, w := range deployment.Workloads {
 		if !w.Result.State.IsOkay() {
 			continue
@@ -148,8 +205,7 @@ func (d *DeploymentDeployer) Sync(ctx context.Context, dl *workloads.Deployment)
 			}
 			vms = append(vms, vm)
 
-			ip := net.ParseIP(vm.IP).To4()
-			usedIPs = append(usedIPs, ip[3])
+			usedIPs = append(usedIPs, vm.IP)
 
 		case zos.ZDBType:
 			zdb, err := workloads.NewZDBFromWorkload(&w)
@@ -179,8 +235,7 @@ func (d *DeploymentDeployer) Sync(ctx context.Context, dl *workloads.Deployment)
 		}
 	}
 
-	network = d.tfPluginClient.State.networks.GetNetwork(dl.NetworkName)
-	network.SetDeploymentHostIDs(dl.NodeID, dl.ContractID, usedIPs)
+	d.tfPluginClient.State.ips.set(dl.NetworkName, dl.NodeID, dl.ContractID, usedIPs)
 
 	dl.Match(disks, qsfs, zdbs, vms)
 
@@ -203,47 +258,27 @@ func (d *DeploymentDeployer) Validate(ctx context.Context, dl *workloads.Deploym
 	return dl.Validate()
 }
 
-func (d *DeploymentDeployer) assignNodesIPs(dl *workloads.Deployment) error {
-	network := d.tfPluginClient.State.networks.GetNetwork(dl.NetworkName)
-	ipRange := network.getNodeSubnet(dl.NodeID)
-
-	usedHosts := network.getUsedNetworkHostIDs(dl.NodeID)
+// vmsIPs returns the VMs private IPs
+func vmsIPs(vms []workloads.VM) []string {
+	ips := []string{}
+	for _, vm := range vms {
+		ips = append(ips, vm.IP)
+	}
+	return ips
+}
 
+// assignNodesIPs assigns free private IPs to the VMs without IPs in the node subnet,
+// the VMs IPs are reserved until release is called if reserve is set
+func (d *DeploymentDeployer) assignNodesIPs(dl *workloads.Deployment, reserve bool) (release func(), err error) {
 	if len(dl.Vms) == 0 {
-		return nil
-	}
-	ip, ipRangeCIDR, err := net.ParseCIDR(ipRange)
-	if err != nil {
-		return errors.Wrapf(err, "invalid ip %s", ipRange)
-	}
-	for _, vm := range dl.Vms {
-		vmIP := net.ParseIP(vm.IP)
-		if vmIP != nil {
-			vmHostID := vmIP[3]
-			if ipRangeCIDR.Contains(vmIP) && !workloads.Contains(usedHosts, vmHostID) {
-				usedHosts = append(usedHosts, vmHostID)
-			}
-		}
+		return func() {}, nil
 	}
-	curHostID := byte(2)
 
-	for idx, vm := range dl.Vms {
-		if vm.IP != "" && ipRangeCIDR.Contains(net.ParseIP(vm.IP)) {
-			continue
-		}
-
-		for workloads.Contains(usedHosts, curHostID) {
-			if curHostID == 254 {
-				return errors.New("all 253 ips of the network are exhausted")
-			}
-			curHostID++
-		}
-		usedHosts = append(usedHosts, curHostID)
-		vmIP := ip.To4()
-		vmIP[3] = curHostID
-		dl.Vms[idx].IP = vmIP.String()
+	requests := make([]ipRequest, 0, len(dl.Vms))
+	for idx := range dl.Vms {
+		requests = append(requests, ipRequest{nodeID: dl.NodeID, name: dl.Vms[idx].Name, ip: &dl.Vms[idx].IP})
 	}
-	return nil
+	return d.tfPluginClient.State.ips.assign(dl.NetworkName, requests, map[uint32]uint64{dl.NodeID: dl.ContractID}, reserve)
 }
 
 func (d *DeploymentDeployer) syncContract(ctx context.Context, dl *workloads.Deployment) error {
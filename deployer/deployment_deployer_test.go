@@ -5,8 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"math/big"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/centrifuge/go-substrate-rpc-client/v4/types"
@@ -124,7 +127,7 @@ func constructTestDeployment() workloads.Deployment {
 			ComputedIP:    "",
 			ComputedIP6:   "::7/64",
 			YggIP:         "::8/64",
-			IP:            "10.1.0.2",
+			IP:            "10.1.0.3",
 			Description:   "vm2_description",
 			CPU:           1,
 			Memory:        1024,
@@ -308,7 +311,7 @@ func TestDeploymentDeployer(t *testing.T) {
 		d.tfPluginClient.State.CurrentNodeNetworks[nodeID] = append(d.tfPluginClient.State.CurrentNodeNetworks[nodeID], contractID)
 		d.tfPluginClient.State.networks = NetworkState{net.Name: Network{
 			Subnets:               map[uint32]string{nodeID: net.IPRange.String()},
-			NodeDeploymentHostIDs: map[uint32]DeploymentHostIDs{nodeID: map[uint64][]byte{contractID: {}}},
+			NodeDeploymentHostIDs: map[uint32]DeploymentHostIDs{nodeID: map[uint64]HostIDs{contractID: {}}},
 		}}
 
 		ncPool.EXPECT().
@@ -413,6 +416,28 @@ func TestDeploymentDeployer(t *testing.T) {
 
 	})
 
+	t.Run("test plan", func(t *testing.T) {
+		dls, err := d.GenerateVersionlessDeployments(context.Background(), &dl)
+		assert.NoError(t, err)
+
+		sub.EXPECT().
+			GetBalance(d.tfPluginClient.Identity).
+			Return(substrate.Balance{
+				Free: types.U128{
+					Int: big.NewInt(100000),
+				},
+			}, nil)
+
+		deployer.EXPECT().
+			GetDeployments(gomock.Any(), dl.NodeDeploymentID).
+			Return(map[uint32]gridtypes.Deployment{nodeID: dls[nodeID]}, nil)
+
+		plan, err := d.Plan(context.Background(), &dl)
+		assert.NoError(t, err)
+		assert.False(t, plan.HasChanges())
+		assert.Equal(t, []NodePlan{{NodeID: nodeID, ContractID: contractID, Action: NodeNoop}}, plan.Nodes)
+	})
+
 	t.Run("test delete", func(t *testing.T) {
 		dl.ContractID = contractID
 		dl.NodeDeploymentID = map[uint32]uint64{nodeID: contractID}
@@ -666,3 +691,138 @@ func TestDeploymentDeployer(t *testing.T) {
 	})
 
 }
+
+func TestDeploymentDeployerConcurrentIPs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tfPluginClient, _, _, _ := setupMockedPluginClient(ctrl)
+	deployer := mocks.NewMockDeployer(ctrl)
+	tfPluginClient.State.SetNetworks(NetworkState{"network": Network{
+		Subnets:               map[uint32]string{nodeID: "10.1.1.0/24"},
+		NodeDeploymentHostIDs: NodeDeploymentHostIDs{nodeID: DeploymentHostIDs{contractID: {2}}},
+	}})
+
+	d := NewDeploymentDeployer(tfPluginClient)
+	d.deployer = deployer
+
+	// both deployments are deployed only after both got their IPs
+	var deploying sync.WaitGroup
+	deploying.Add(2)
+	var contracts uint64 = contractID
+	deployer.EXPECT().
+		Deploy(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, oldDeploymentIDs map[uint32]uint64, newDeployments map[uint32]gridtypes.Deployment, solutionProviders map[uint32]*uint64) (map[uint32]uint64, error) {
+			deploying.Done()
+			deploying.Wait()
+			return map[uint32]uint64{nodeID: atomic.AddUint64(&contracts, 1)}, nil
+		}).Times(2)
+
+	dls := make([]workloads.Deployment, 2)
+	var wg sync.WaitGroup
+	for idx := range dls {
+		dls[idx] = workloads.Deployment{
+			Name:        fmt.Sprintf("dl%d", idx),
+			NodeID:      nodeID,
+			NetworkName: "network",
+			Vms: []workloads.VM{{
+				Name:        "vm",
+				Flist:       "https://hub.grid.tf/tf-official-apps/base:latest.flist",
+				CPU:         1,
+				Memory:      1024,
+				NetworkName: "network",
+			}},
+		}
+
+		wg.Add(1)
+		go func(dl *workloads.Deployment) {
+			defer wg.Done()
+			assert.NoError(t, d.Deploy(context.Background(), dl))
+		}(&dls[idx])
+	}
+	wg.Wait()
+
+	assert.NotEqual(t, dls[0].Vms[0].IP, dls[1].Vms[0].IP)
+	assert.ElementsMatch(t, []string{"10.1.1.3", "10.1.1.4"}, []string{dls[0].Vms[0].IP, dls[1].Vms[0].IP})
+
+	network := tfPluginClient.State.GetNetworks().GetNetwork("network")
+	assert.ElementsMatch(t, HostIDs{2, 3, 4}, network.getUsedNetworkHostIDs(nodeID))
+	assert.Empty(t, tfPluginClient.State.ips.reservations)
+}
+
+func TestDeploymentDeployerLargeSubnet(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	usedHostIDs := HostIDs{}
+	for id := uint32(2); id < 256; id++ {
+		usedHostIDs = append(usedHostIDs, id)
+	}
+
+	tfPluginClient, _, _, _ := setupMockedPluginClient(ctrl)
+	tfPluginClient.State.SetNetworks(NetworkState{"network": Network{
+		Subnets:               map[uint32]string{nodeID: "10.1.4.0/22"},
+		NodeDeploymentHostIDs: NodeDeploymentHostIDs{nodeID: DeploymentHostIDs{contractID: usedHostIDs}},
+	}})
+	d := NewDeploymentDeployer(tfPluginClient)
+
+	dl := workloads.Deployment{
+		NodeID:      nodeID,
+		NetworkName: "network",
+		Vms:         []workloads.VM{{Name: "vm1", IP: "10.1.6.10"}, {Name: "vm2"}},
+	}
+
+	release, err := d.assignNodesIPs(&dl, false)
+	assert.NoError(t, err)
+	release()
+
+	assert.Equal(t, "10.1.6.10", dl.Vms[0].IP)
+	assert.Equal(t, "10.1.5.0", dl.Vms[1].IP)
+
+	tfPluginClient.State.ips.set("network", nodeID, contractID+1, vmsIPs(dl.Vms))
+	network := tfPluginClient.State.GetNetworks().GetNetwork("network")
+	assert.Equal(t, HostIDs{522, 256}, network.GetDeploymentHostIDs(nodeID, contractID+1))
+}
+
+func TestDeploymentDeployerPlanKeepsDeployment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tfPluginClient, _, _, _ := setupMockedPluginClient(ctrl)
+	deployer := mocks.NewMockDeployer(ctrl)
+	tfPluginClient.State.SetNetworks(NetworkState{"network": Network{
+		Subnets:               map[uint32]string{nodeID: "10.1.1.0/24"},
+		NodeDeploymentHostIDs: NodeDeploymentHostIDs{},
+	}})
+
+	d := NewDeploymentDeployer(tfPluginClient)
+	d.deployer = deployer
+
+	deployer.EXPECT().
+		GetDeployments(gomock.Any(), gomock.Any()).
+		Return(map[uint32]gridtypes.Deployment{}, nil)
+
+	dl := workloads.Deployment{
+		Name:        "dl",
+		NodeID:      nodeID,
+		NetworkName: "network",
+		Vms: []workloads.VM{{
+			Name:        "vm",
+			Flist:       "https://hub.grid.tf/tf-official-apps/base:latest.flist",
+			CPU:         1,
+			Memory:      1024,
+			EnvVars:     map[string]string{"SSH_KEY": "key"},
+			NetworkName: "network",
+		}},
+	}
+	before := copyDeployment(&dl)
+
+	plan, err := d.Plan(context.Background(), &dl)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Nodes, 1)
+	assert.Equal(t, NodeCreate, plan.Nodes[0].Action)
+
+	assert.Equal(t, before, dl)
+	assert.Empty(t, dl.Vms[0].IP)
+	assert.Empty(t, dl.SolutionType)
+}
@@ -58,17 +58,25 @@ func GetWorkloadHashes(dl gridtypes.Deployment) (map[string]string, error) {
 
 	for _, w := range dl.Workloads {
 		key := string(w.Name)
-		md5Hash := md5.New()
-		if err := w.Challenge(md5Hash); err != nil {
+		hash, err := workloadHash(w)
+		if err != nil {
 			return nil, errors.Wrapf(err, "could not get a hash for a workload %s", key)
 		}
-		hash := string(md5Hash.Sum(nil))
 		hashes[key] = hash
 	}
 
 	return hashes, nil
 }
 
+// workloadHash returns the hash of a workload
+func workloadHash(w gridtypes.Workload) (string, error) {
+	md5Hash := md5.New()
+	if err := w.Challenge(md5Hash); err != nil {
+		return "", err
+	}
+	return string(md5Hash.Sum(nil)), nil
+}
+
 // SameWorkloadsNames compares names of 2 deployments' workloads
 func SameWorkloadsNames(d1 gridtypes.Deployment, d2 gridtypes.Deployment) bool {
 	if len(d1.Workloads) != len(d2.Workloads) {
@@ -122,3 +130,14 @@ func Capacity(dl gridtypes.Deployment) (gridtypes.Capacity, error) {
 	}
 	return cap, nil
 }
+
+// canceledContracts returns the old node contracts that are no longer part of the current deployments
+func canceledContracts(oldDeploymentIDs, currentDeploymentIDs map[uint32]uint64) map[uint32]uint64 {
+	canceled := make(map[uint32]uint64)
+	for nodeID, contractID := range oldDeploymentIDs {
+		if currentDeploymentIDs[nodeID] != contractID {
+			canceled[nodeID] = contractID
+		}
+	}
+	return canceled
+}
@@ -0,0 +1,192 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/grid3-go/deployer/drift"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+// DriftKind is the kind of difference found between the desired and the live deployments
+type DriftKind = drift.Kind
+
+const (
+	// DriftNodeMissing is a desired node deployment that has no contract
+	DriftNodeMissing = drift.NodeMissing
+	// DriftNodeUnreachable is a node whose deployment could not be read
+	DriftNodeUnreachable = drift.NodeUnreachable
+	// DriftContractCanceled is a contract that is no longer active on chain
+	DriftContractCanceled = drift.ContractCanceled
+
+	// DriftWorkloadMissing is a desired workload that doesn't exist on the node
+	DriftWorkloadMissing = drift.WorkloadMissing
+	// DriftWorkloadDeleted is a desired workload that was deleted on the node
+	DriftWorkloadDeleted = drift.WorkloadDeleted
+	// DriftWorkloadPaused is a desired workload that is paused on the node
+	DriftWorkloadPaused = drift.WorkloadPaused
+	// DriftWorkloadErrored is a desired workload that is in error state on the node
+	DriftWorkloadErrored = drift.WorkloadErrored
+	// DriftWorkloadChanged is a workload whose data on the node differs from the desired one
+	DriftWorkloadChanged = drift.WorkloadChanged
+	// DriftWorkloadUnexpected is a workload running on the node that is not desired
+	DriftWorkloadUnexpected = drift.WorkloadUnexpected
+)
+
+// Drift is a difference between the desired and the live state of a node deployment
+type Drift = drift.Drift
+
+// DriftReport is the drifts found in a set of deployments
+type DriftReport = drift.Report
+
+// DetectDrift compares the desired deployments with the deployments of the nodes contracts, without changing anything.
+// the live workloads are read from the nodes deployments and their latest changes, and the contracts are checked on chain
+func (d *Deployer) DetectDrift(ctx context.Context, contracts map[uint32]uint64, desiredDeployments map[uint32]gridtypes.Deployment) (DriftReport, error) {
+	var (
+		lock   sync.Mutex
+		report DriftReport
+	)
+
+	nodes := make([]uint32, 0, len(desiredDeployments))
+	for node := range desiredDeployments {
+		nodes = append(nodes, node)
+	}
+
+	err := d.forEachNode(nodes, false, func(node uint32) error {
+		drifts, err := d.nodeDrift(ctx, node, contracts[node], desiredDeployments[node])
+		if err != nil {
+			return err
+		}
+
+		lock.Lock()
+		report.Drifts = append(report.Drifts, drifts...)
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		return DriftReport{}, err
+	}
+
+	report.Sort()
+	return report, nil
+}
+
+// nodeDrift reads the live deployment of a node contract and compares it with the desired one
+func (d *Deployer) nodeDrift(ctx context.Context, node uint32, contractID uint64, desired gridtypes.Deployment) ([]Drift, error) {
+	if contractID == 0 {
+		return []Drift{{NodeID: node, Kind: DriftNodeMissing, Message: "no contract is deployed on the node"}}, nil
+	}
+
+	valid, err := d.substrateConn.IsValidContract(contractID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not check contract %d", contractID)
+	}
+	if !valid {
+		return []Drift{{NodeID: node, ContractID: contractID, Kind: DriftContractCanceled}}, nil
+	}
+
+	unreachable := func(err error) []Drift {
+		return []Drift{{NodeID: node, ContractID: contractID, Kind: DriftNodeUnreachable, Message: err.Error()}}
+	}
+
+	nc, err := d.ncPool.GetNodeClient(d.substrateConn, node)
+	if err != nil {
+		return unreachable(errors.Wrapf(err, "failed to get a client for node %d", node)), nil
+	}
+
+	sub, cancel := context.WithTimeout(ctx, d.config.NodeCallTimeout)
+	defer cancel()
+
+	live, err := nc.DeploymentGet(sub, contractID)
+	if err != nil {
+		return unreachable(errors.Wrapf(err, "failed to get deployment %d", contractID)), nil
+	}
+
+	changes, err := nc.DeploymentChanges(sub, contractID)
+	if err != nil {
+		return unreachable(errors.Wrapf(err, "failed to get deployment %d changes", contractID)), nil
+	}
+
+	return deploymentDrift(node, contractID, desired, live, changes)
+}
+
+// deploymentDrift compares the desired workloads with the live ones.
+// a workload state is taken from its latest change if it's newer than the deployment result, since nodes may drop deleted workloads from the deployment
+func deploymentDrift(node uint32, contractID uint64, desired, live gridtypes.Deployment, changes []gridtypes.Workload) ([]Drift, error) {
+	liveWorkloads := make(map[string]gridtypes.Workload)
+	for _, wl := range live.Workloads {
+		liveWorkloads[wl.Name.String()] = wl
+	}
+
+	for _, change := range changes {
+		wl, ok := liveWorkloads[change.Name.String()]
+		if !ok {
+			liveWorkloads[change.Name.String()] = change
+			continue
+		}
+		if change.Result.Created >= wl.Result.Created {
+			wl.Result = change.Result
+			liveWorkloads[change.Name.String()] = wl
+		}
+	}
+
+	drifts := []Drift{}
+	newDrift := func(wl gridtypes.Workload, kind DriftKind, message string) {
+		drifts = append(drifts, Drift{
+			NodeID:     node,
+			ContractID: contractID,
+			Workload:   wl.Name.String(),
+			Type:       wl.Type,
+			Kind:       kind,
+			Message:    message,
+		})
+	}
+
+	desiredNames := make(map[string]bool)
+	for _, wl := range desired.Workloads {
+		desiredNames[wl.Name.String()] = true
+
+		liveWl, ok := liveWorkloads[wl.Name.String()]
+		if !ok {
+			newDrift(wl, DriftWorkloadMissing, "")
+			continue
+		}
+
+		switch liveWl.Result.State {
+		case gridtypes.StateDeleted:
+			newDrift(wl, DriftWorkloadDeleted, liveWl.Result.Error)
+			continue
+		case gridtypes.StatePaused:
+			newDrift(wl, DriftWorkloadPaused, liveWl.Result.Error)
+			continue
+		case gridtypes.StateError:
+			newDrift(wl, DriftWorkloadErrored, liveWl.Result.Error)
+			continue
+		}
+
+		// desired workloads are versionless, so versions are not compared
+		liveWl.Version = wl.Version
+		liveHash, err := workloadHash(liveWl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get a hash for live workload %s", liveWl.Name)
+		}
+		desiredHash, err := workloadHash(wl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get a hash for desired workload %s", wl.Name)
+		}
+		if liveHash != desiredHash {
+			newDrift(wl, DriftWorkloadChanged, liveWl.Result.Error)
+		}
+	}
+
+	for _, wl := range live.Workloads {
+		if desiredNames[wl.Name.String()] || liveWorkloads[wl.Name.String()].Result.State == gridtypes.StateDeleted {
+			continue
+		}
+		newDrift(wl, DriftWorkloadUnexpected, "")
+	}
+
+	return drifts, nil
+}
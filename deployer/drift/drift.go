@@ -0,0 +1,90 @@
+// Package drift includes the types of the drift reports of the deployer
+package drift
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+// Kind is the kind of difference found between the desired and the live deployments
+type Kind string
+
+const (
+	// NodeMissing is a desired node deployment that has no contract
+	NodeMissing Kind = "node-missing"
+	// NodeUnreachable is a node whose deployment could not be read
+	NodeUnreachable Kind = "node-unreachable"
+	// ContractCanceled is a contract that is no longer active on chain
+	ContractCanceled Kind = "contract-canceled"
+
+	// WorkloadMissing is a desired workload that doesn't exist on the node
+	WorkloadMissing Kind = "workload-missing"
+	// WorkloadDeleted is a desired workload that was deleted on the node
+	WorkloadDeleted Kind = "workload-deleted"
+	// WorkloadPaused is a desired workload that is paused on the node
+	WorkloadPaused Kind = "workload-paused"
+	// WorkloadErrored is a desired workload that is in error state on the node
+	WorkloadErrored Kind = "workload-errored"
+	// WorkloadChanged is a workload whose data on the node differs from the desired one
+	WorkloadChanged Kind = "workload-changed"
+	// WorkloadUnexpected is a workload running on the node that is not desired
+	WorkloadUnexpected Kind = "workload-unexpected"
+)
+
+// Drift is a difference between the desired and the live state of a node deployment,
+// workload drifts have the workload name and type set
+type Drift struct {
+	NodeID     uint32
+	ContractID uint64
+	Workload   string
+	Type       gridtypes.WorkloadType
+	Kind       Kind
+	Message    string
+}
+
+// Report is the drifts found in a set of deployments, sorted by node ID then workload name
+type Report struct {
+	Drifts []Drift
+}
+
+// HasDrift returns true if any drift is found
+func (r Report) HasDrift() bool {
+	return len(r.Drifts) != 0
+}
+
+// String returns a human readable summary of the report
+func (r Report) String() string {
+	if !r.HasDrift() {
+		return "no drift"
+	}
+
+	var b strings.Builder
+	for _, drift := range r.Drifts {
+		fmt.Fprintf(&b, "node %d", drift.NodeID)
+		if drift.ContractID != 0 {
+			fmt.Fprintf(&b, " (contract %d)", drift.ContractID)
+		}
+		fmt.Fprintf(&b, ": %s", drift.Kind)
+		if drift.Workload != "" {
+			fmt.Fprintf(&b, " %s (%s)", drift.Workload, drift.Type)
+		}
+		if drift.Message != "" {
+			fmt.Fprintf(&b, ": %s", drift.Message)
+		}
+		b.WriteString("\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Sort sorts the drifts by node ID then workload name
+func (r *Report) Sort() {
+	sort.SliceStable(r.Drifts, func(i, j int) bool {
+		if r.Drifts[i].NodeID != r.Drifts[j].NodeID {
+			return r.Drifts[i].NodeID < r.Drifts[j].NodeID
+		}
+		return r.Drifts[i].Workload < r.Drifts[j].Workload
+	})
+}
@@ -0,0 +1,136 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	client "github.com/threefoldtech/grid3-go/node"
+	"github.com/threefoldtech/grid3-go/workloads"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+)
+
+func TestDetectDrift(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, ncPool, cl := setupMockedDeployer(t, ctrl)
+
+	disk := func(name string, size int) gridtypes.Workload {
+		d := workloads.Disk{Name: name, SizeGB: size}
+		return d.ZosWorkload()
+	}
+	diskWorkload := func(name string, size int, state gridtypes.ResultState, created gridtypes.Timestamp) gridtypes.Workload {
+		wl := disk(name, size)
+		wl.Result = gridtypes.Result{State: state, Created: created}
+		return wl
+	}
+
+	desired := workloads.NewGridDeployment(deployer.twinID, []gridtypes.Workload{
+		disk("same", 1),
+		disk("changed", 1),
+		disk("errored", 1),
+		disk("paused", 1),
+		disk("deleted", 1),
+		disk("missing", 1),
+	})
+
+	same := diskWorkload("same", 1, gridtypes.StateOk, 1)
+	same.Version = 3
+	errored := diskWorkload("errored", 1, gridtypes.StateError, 1)
+	errored.Result.Error = "no space left"
+	live := workloads.NewGridDeployment(deployer.twinID, []gridtypes.Workload{
+		same,
+		diskWorkload("changed", 2, gridtypes.StateOk, 1),
+		errored,
+		diskWorkload("paused", 1, gridtypes.StatePaused, 1),
+		diskWorkload("deleted", 1, gridtypes.StateOk, 1),
+		diskWorkload("unexpected", 1, gridtypes.StateOk, 1),
+		diskWorkload("removed", 1, gridtypes.StateDeleted, 1),
+	})
+	changes := []gridtypes.Workload{
+		diskWorkload("deleted", 1, gridtypes.StateOk, 1),
+		diskWorkload("deleted", 1, gridtypes.StateDeleted, 2),
+		diskWorkload("paused", 1, gridtypes.StateOk, 0),
+	}
+
+	t.Run("workloads drift", func(t *testing.T) {
+		drifts, err := deploymentDrift(10, 100, desired, live, changes)
+		assert.NoError(t, err)
+		assert.Equal(t, []Drift{
+			{NodeID: 10, ContractID: 100, Workload: "changed", Type: zos.ZMountType, Kind: DriftWorkloadChanged},
+			{NodeID: 10, ContractID: 100, Workload: "errored", Type: zos.ZMountType, Kind: DriftWorkloadErrored, Message: "no space left"},
+			{NodeID: 10, ContractID: 100, Workload: "paused", Type: zos.ZMountType, Kind: DriftWorkloadPaused},
+			{NodeID: 10, ContractID: 100, Workload: "deleted", Type: zos.ZMountType, Kind: DriftWorkloadDeleted},
+			{NodeID: 10, ContractID: 100, Workload: "missing", Type: zos.ZMountType, Kind: DriftWorkloadMissing},
+			{NodeID: 10, ContractID: 100, Workload: "unexpected", Type: zos.ZMountType, Kind: DriftWorkloadUnexpected},
+		}, drifts)
+	})
+
+	t.Run("no drift", func(t *testing.T) {
+		drifts, err := deploymentDrift(10, 100, desired, desired, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, drifts)
+	})
+
+	t.Run("deployer detects drift", func(t *testing.T) {
+		desiredDeployments := map[uint32]gridtypes.Deployment{
+			10: desired,
+			20: desired,
+			30: desired,
+			40: desired,
+		}
+		contracts := map[uint32]uint64{10: 100, 20: 200, 40: 400}
+
+		sub.EXPECT().IsValidContract(uint64(100)).Return(true, nil)
+		sub.EXPECT().IsValidContract(uint64(200)).Return(false, nil)
+		sub.EXPECT().IsValidContract(uint64(400)).Return(true, nil)
+
+		ncPool.EXPECT().
+			GetNodeClient(sub, uint32(10)).
+			Return(client.NewNodeClient(13, cl, 10), nil)
+		ncPool.EXPECT().
+			GetNodeClient(sub, uint32(40)).
+			Return(client.NewNodeClient(43, cl, 10), nil)
+
+		cl.EXPECT().
+			Call(gomock.Any(), uint32(13), "zos.deployment.get", gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+				*result.(*gridtypes.Deployment) = live
+				return nil
+			})
+		cl.EXPECT().
+			Call(gomock.Any(), uint32(13), "zos.deployment.changes", gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+				*result.(*[]gridtypes.Workload) = changes
+				return nil
+			})
+		cl.EXPECT().
+			Call(gomock.Any(), uint32(43), "zos.deployment.get", gomock.Any(), gomock.Any()).
+			Return(errors.New("node is down"))
+
+		report, err := deployer.DetectDrift(context.Background(), contracts, desiredDeployments)
+		assert.NoError(t, err)
+		assert.True(t, report.HasDrift())
+		assert.Len(t, report.Drifts, 9)
+
+		assert.Equal(t, Drift{NodeID: 20, ContractID: 200, Kind: DriftContractCanceled}, report.Drifts[6])
+		assert.Equal(t, Drift{NodeID: 30, Kind: DriftNodeMissing, Message: "no contract is deployed on the node"}, report.Drifts[7])
+		assert.Equal(t, uint32(40), report.Drifts[8].NodeID)
+		assert.Equal(t, DriftNodeUnreachable, report.Drifts[8].Kind)
+		assert.Contains(t, report.Drifts[8].Message, "node is down")
+
+		assert.Contains(t, report.String(), "node 10 (contract 100): workload-errored errored (zmount): no space left")
+		assert.Contains(t, report.String(), "node 20 (contract 200): contract-canceled")
+	})
+
+	t.Run("empty report", func(t *testing.T) {
+		report := DriftReport{}
+		assert.False(t, report.HasDrift())
+		assert.Equal(t, "no drift", report.String())
+	})
+}
@@ -28,6 +28,11 @@ func NewGatewayFqdnDeployer(tfPluginClient *TFPluginClient) GatewayFQDNDeployer
 	return gatewayFQDN
 }
 
+// RegisterObserver registers an observer for the workloads events of the gateway deployments
+func (d *GatewayFQDNDeployer) RegisterObserver(observer Observer) {
+	registerObserver(d.deployer, observer)
+}
+
 // Validate validates gateway FQDN deployer
 func (d *GatewayFQDNDeployer) Validate(ctx context.Context, gw *workloads.GatewayFQDNProxy) error {
 	sub := d.tfPluginClient.SubstrateConn
@@ -87,18 +92,44 @@ func (d *GatewayFQDNDeployer) Deploy(ctx context.Context, gw *workloads.GatewayF
 	newDeploymentsSolutionProvider := make(map[uint32]*uint64)
 	newDeploymentsSolutionProvider[gw.NodeID] = nil
 
+	oldDeploymentIDs := gw.NodeDeploymentID
 	gw.NodeDeploymentID, err = d.deployer.Deploy(ctx, gw.NodeDeploymentID, newDeployments, newDeploymentsSolutionProvider)
 
 	// update state
 	// error is not returned immediately before updating state because of untracked failed deployments
+	for nodeID, contractID := range canceledContracts(oldDeploymentIDs, gw.NodeDeploymentID) {
+		d.tfPluginClient.State.removeDeployment(nodeID, contractID)
+	}
 	if contractID, ok := gw.NodeDeploymentID[gw.NodeID]; ok && contractID != 0 {
 		gw.ContractID = contractID
-		if !workloads.Contains(d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID], gw.ContractID) {
-			d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID] = append(d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID], gw.ContractID)
-		}
+		d.tfPluginClient.State.addDeployment(gw.NodeID, gw.ContractID)
 	}
 
-	return err
+	return d.tfPluginClient.State.saveAfter(err)
+}
+
+// Plan returns the changes deploying the gateway would apply, without changing any contract
+func (d *GatewayFQDNDeployer) Plan(ctx context.Context, gw *workloads.GatewayFQDNProxy) (Plan, error) {
+	if err := d.Validate(ctx, gw); err != nil {
+		return Plan{}, err
+	}
+
+	newDeployments, err := d.GenerateVersionlessDeployments(ctx, gw)
+	if err != nil {
+		return Plan{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	return planDeployments(ctx, d.deployer, gw.NodeDeploymentID, newDeployments)
+}
+
+// DetectDrift reports the differences between the gateway and what is live on the grid, without changing the gateway
+func (d *GatewayFQDNDeployer) DetectDrift(ctx context.Context, gw *workloads.GatewayFQDNProxy) (DriftReport, error) {
+	desiredDeployments, err := d.GenerateVersionlessDeployments(ctx, gw)
+	if err != nil {
+		return DriftReport{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	return d.deployer.DetectDrift(ctx, gw.NodeDeploymentID, desiredDeployments)
 }
 
 // Cancel cancels a gateway deployment
@@ -116,9 +147,9 @@ func (d *GatewayFQDNDeployer) Cancel(ctx context.Context, gw *workloads.GatewayF
 	// update state
 	gw.ContractID = 0
 	delete(gw.NodeDeploymentID, gw.NodeID)
-	d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID] = workloads.Delete(d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID], contractID)
+	d.tfPluginClient.State.removeDeployment(gw.NodeID, contractID)
 
-	return nil
+	return d.tfPluginClient.State.saveAfter(nil)
 }
 
 // TODO: check sync added or not ??
@@ -3,6 +3,7 @@ package deployer
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/pkg/errors"
 	client "github.com/threefoldtech/grid3-go/node"
@@ -27,6 +28,11 @@ func NewGatewayNameDeployer(tfPluginClient *TFPluginClient) GatewayNameDeployer
 	return gatewayName
 }
 
+// RegisterObserver registers an observer for the workloads events of the gateway deployments
+func (d *GatewayNameDeployer) RegisterObserver(observer Observer) {
+	registerObserver(d.deployer, observer)
+}
+
 // Validate validates gatewayName deployer
 func (d *GatewayNameDeployer) Validate(ctx context.Context, gw *workloads.GatewayNameProxy) error {
 	sub := d.tfPluginClient.SubstrateConn
@@ -76,18 +82,65 @@ func (d *GatewayNameDeployer) Deploy(ctx context.Context, gw *workloads.GatewayN
 		}
 	}
 
+	oldDeploymentIDs := gw.NodeDeploymentID
 	gw.NodeDeploymentID, err = d.deployer.Deploy(ctx, gw.NodeDeploymentID, newDeployments, newDeploymentsSolutionProvider)
 
 	// update state
 	// error is not returned immediately before updating state because of untracked failed deployments
+	for nodeID, contractID := range canceledContracts(oldDeploymentIDs, gw.NodeDeploymentID) {
+		d.tfPluginClient.State.removeDeployment(nodeID, contractID)
+	}
 	if contractID, ok := gw.NodeDeploymentID[gw.NodeID]; ok && contractID != 0 {
 		gw.ContractID = contractID
-		if !workloads.Contains(d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID], gw.ContractID) {
-			d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID] = append(d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID], gw.ContractID)
-		}
+		d.tfPluginClient.State.addDeployment(gw.NodeID, gw.ContractID)
 	}
 
-	return err
+	return d.tfPluginClient.State.saveAfter(err)
+}
+
+// Plan returns the changes deploying the gateway would apply, without changing any contract
+// the name contract is not part of the plan
+func (d *GatewayNameDeployer) Plan(ctx context.Context, gw *workloads.GatewayNameProxy) (Plan, error) {
+	if err := d.Validate(ctx, gw); err != nil {
+		return Plan{}, err
+	}
+
+	newDeployments, err := d.GenerateVersionlessDeployments(ctx, gw)
+	if err != nil {
+		return Plan{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	return planDeployments(ctx, d.deployer, gw.NodeDeploymentID, newDeployments)
+}
+
+// DetectDrift reports the differences between the gateway and what is live on the grid, without changing the gateway
+// a canceled name contract is reported as well
+func (d *GatewayNameDeployer) DetectDrift(ctx context.Context, gw *workloads.GatewayNameProxy) (DriftReport, error) {
+	desiredDeployments, err := d.GenerateVersionlessDeployments(ctx, gw)
+	if err != nil {
+		return DriftReport{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	report, err := d.deployer.DetectDrift(ctx, gw.NodeDeploymentID, desiredDeployments)
+	if err != nil {
+		return DriftReport{}, err
+	}
+
+	valid, err := d.tfPluginClient.SubstrateConn.IsValidContract(gw.NameContractID)
+	if err != nil {
+		return DriftReport{}, errors.Wrapf(err, "could not check name contract %d", gw.NameContractID)
+	}
+	if !valid {
+		report.Drifts = append(report.Drifts, Drift{
+			NodeID:     gw.NodeID,
+			ContractID: gw.NameContractID,
+			Kind:       DriftContractCanceled,
+			Message:    fmt.Sprintf("name contract of %s is not active", gw.Name),
+		})
+		report.Sort()
+	}
+
+	return report, nil
 }
 
 // Cancel cancels the gatewayName deployment
@@ -104,16 +157,16 @@ func (d *GatewayNameDeployer) Cancel(ctx context.Context, gw *workloads.GatewayN
 
 	gw.ContractID = 0
 	delete(gw.NodeDeploymentID, gw.NodeID)
-	d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID] = workloads.Delete(d.tfPluginClient.State.CurrentNodeDeployments[gw.NodeID], contractID)
+	d.tfPluginClient.State.removeDeployment(gw.NodeID, contractID)
 
 	if gw.NameContractID != 0 {
 		if err := d.tfPluginClient.SubstrateConn.EnsureContractCanceled(d.tfPluginClient.Identity, gw.NameContractID); err != nil {
-			return err
+			return d.tfPluginClient.State.saveAfter(err)
 		}
 		gw.NameContractID = 0
 	}
 
-	return nil
+	return d.tfPluginClient.State.saveAfter(nil)
 }
 
 // InvalidateNameContract invalidates name contract
@@ -0,0 +1,220 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/grid3-go/workloads"
+)
+
+// ipRequest is a workload that needs a private IP in its node subnet,
+// the IP is kept if it's already in the subnet, otherwise a free IP is assigned to it
+type ipRequest struct {
+	nodeID uint32
+	name   string
+	ip     *string
+}
+
+// reservedHostID is a host ID assigned to a workload of a deployment that is not deployed yet,
+// the workload IP is kept to know the reservations of the deployment itself
+type reservedHostID struct {
+	nodeID uint32
+	hostID uint32
+	ip     *string
+}
+
+// hostIDsReservation is the host IDs assigned to a deployment that is not deployed yet
+type hostIDsReservation struct {
+	network string
+	hostIDs []reservedHostID
+}
+
+// ipAllocator assigns the private IPs of the workloads of all the deployers in the networks node subnets.
+// the IPs of the deployed contracts are kept in the state networks host IDs and the IPs of the deployments that are not deployed yet are reserved,
+// so VMs and k8s nodes on the same network and node never get the same IP.
+// it uses the state lock, which protects its reservations too
+type ipAllocator struct {
+	state *State
+	// reservations are the host IDs assigned to deployments that are not deployed yet
+	reservations      map[uint64]hostIDsReservation
+	reservationsCount uint64
+}
+
+// newIPAllocator creates a new private IPs allocator of the state networks
+func newIPAllocator(state *State) *ipAllocator {
+	return &ipAllocator{
+		state:        state,
+		reservations: make(map[uint64]hostIDsReservation),
+	}
+}
+
+// assign assigns the private IPs of the requests in the network. the IPs of the requests can't be used by other deployments contracts
+// or reserved by other deployments that are not deployed yet, but they can be used by the deployment own contracts or reserved by the deployment itself.
+// if reserve is set the IPs are considered used by the next assignments until release is called, which should be after
+// they are set to the deployment contracts
+func (a *ipAllocator) assign(networkName string, requests []ipRequest, ownContracts map[uint32]uint64, reserve bool) (release func(), err error) {
+	a.state.lock.Lock()
+	defer a.state.lock.Unlock()
+
+	network := a.state.networks.GetNetwork(networkName)
+	own := make(map[*string]bool)
+	for _, request := range requests {
+		own[request.ip] = true
+	}
+	subnets := make(map[uint32]*net.IPNet)
+	used := make(map[uint32]HostIDs)
+	for _, request := range requests {
+		if _, ok := subnets[request.nodeID]; ok {
+			continue
+		}
+		subnet := network.getNodeSubnet(request.nodeID)
+		_, ipRange, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return func() {}, errors.Wrapf(err, "invalid subnet %s of node %d in network %s", subnet, request.nodeID, networkName)
+		}
+		subnets[request.nodeID] = ipRange
+		used[request.nodeID] = append(a.reserved(networkName, request.nodeID, own), deployedHostIDs(network, request.nodeID, ownContracts[request.nodeID])...)
+	}
+
+	hostIDs := []reservedHostID{}
+	for _, request := range requests {
+		id, ok := hostID(*request.ip, subnets[request.nodeID])
+		if !ok {
+			continue
+		}
+		if workloads.Contains(used[request.nodeID], id) {
+			return func() {}, errors.Errorf("ip %s of %s is already used on node %d", *request.ip, request.name, request.nodeID)
+		}
+		used[request.nodeID] = append(used[request.nodeID], id)
+		hostIDs = append(hostIDs, reservedHostID{nodeID: request.nodeID, hostID: id, ip: request.ip})
+	}
+
+	for _, request := range requests {
+		subnet := subnets[request.nodeID]
+		if _, ok := hostID(*request.ip, subnet); ok {
+			continue
+		}
+
+		id, ok := freeHostID(used[request.nodeID], subnet)
+		if !ok {
+			return func() {}, errors.Errorf("failed to find free ip for %s: all ips of the node %d subnet %s are used", request.name, request.nodeID, subnet)
+		}
+		used[request.nodeID] = append(used[request.nodeID], id)
+		hostIDs = append(hostIDs, reservedHostID{nodeID: request.nodeID, hostID: id, ip: request.ip})
+		*request.ip = hostIP(subnet, id).String()
+	}
+
+	if !reserve {
+		return func() {}, nil
+	}
+
+	a.reservationsCount++
+	id := a.reservationsCount
+	a.reservations[id] = hostIDsReservation{network: networkName, hostIDs: hostIDs}
+
+	return func() {
+		a.state.lock.Lock()
+		defer a.state.lock.Unlock()
+
+		delete(a.reservations, id)
+	}, nil
+}
+
+// reserved returns the host IDs reserved on a node for deployments that are not deployed yet,
+// except the host IDs reserved for the own workloads IPs
+func (a *ipAllocator) reserved(networkName string, nodeID uint32, own map[*string]bool) HostIDs {
+	reserved := HostIDs{}
+	for _, reservation := range a.reservations {
+		if reservation.network != networkName {
+			continue
+		}
+		for _, reservedID := range reservation.hostIDs {
+			if reservedID.nodeID == nodeID && !own[reservedID.ip] {
+				reserved = append(reserved, reservedID.hostID)
+			}
+		}
+	}
+	return reserved
+}
+
+// deployedHostIDs returns the host IDs used on a node by the deployments contracts other than the own contract
+func deployedHostIDs(network Network, nodeID uint32, ownContract uint64) HostIDs {
+	used := HostIDs{}
+	for contractID, hostIDs := range network.NodeDeploymentHostIDs[nodeID] {
+		if contractID != ownContract || ownContract == 0 {
+			used = append(used, hostIDs...)
+		}
+	}
+	return used
+}
+
+// set sets the private IPs used by a deployment contract on a node
+func (a *ipAllocator) set(networkName string, nodeID uint32, contractID uint64, ips []string) {
+	a.state.updateNetworks(func(networks NetworkState) {
+		network := networks.GetNetwork(networkName)
+		network.SetDeploymentHostIDs(nodeID, contractID, ipsHostIDs(ips, network.getNodeSubnet(nodeID)))
+	})
+}
+
+// release releases the private IPs used by a canceled deployment contract on a node, so they can be assigned again
+func (a *ipAllocator) release(networkName string, nodeID uint32, contractID uint64) {
+	a.state.updateNetworks(func(networks NetworkState) {
+		network := networks.GetNetwork(networkName)
+		network.DeleteDeploymentHostIDs(nodeID, contractID)
+	})
+}
+
+// ipsHostIDs returns the host IDs of the ips in a node subnet,
+// the ips are considered in /24 subnets if the node subnet is unknown
+func ipsHostIDs(ips []string, subnet string) HostIDs {
+	_, nodeSubnet, err := net.ParseCIDR(subnet)
+
+	hostIDs := HostIDs{}
+	for _, ip := range ips {
+		ipSubnet := nodeSubnet
+		if err != nil {
+			parsed := net.ParseIP(ip).To4()
+			if parsed == nil {
+				continue
+			}
+			ipSubnet = &net.IPNet{IP: parsed.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		}
+		if id, ok := hostID(ip, ipSubnet); ok {
+			hostIDs = append(hostIDs, id)
+		}
+	}
+	return hostIDs
+}
+
+// hostID returns the host ID of an ip in a network subnet, which is its offset from the subnet ip.
+// it returns false if the ip is not in the subnet
+func hostID(ip string, subnet *net.IPNet) (uint32, bool) {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil || subnet == nil || !subnet.Contains(parsed) {
+		return 0, false
+	}
+	base := subnet.IP.To4().Mask(subnet.Mask)
+	return binary.BigEndian.Uint32(parsed) - binary.BigEndian.Uint32(base), true
+}
+
+// hostIP returns the ip of a host ID in a network subnet
+func hostIP(subnet *net.IPNet, id uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4().Mask(subnet.Mask))+id)
+	return ip
+}
+
+// freeHostID returns the first host ID of the subnet that is not used,
+// the subnet ip, the gateway ip and the broadcast ip are never assigned
+func freeHostID(used HostIDs, subnet *net.IPNet) (uint32, bool) {
+	ones, bits := subnet.Mask.Size()
+	size := uint64(1) << (bits - ones)
+	for id := uint64(2); id+1 < size; id++ {
+		if !workloads.Contains(used, uint32(id)) {
+			return uint32(id), true
+		}
+	}
+	return 0, false
+}
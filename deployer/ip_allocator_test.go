@@ -0,0 +1,178 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/threefoldtech/grid3-go/workloads"
+)
+
+func TestIPAllocator(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tfPluginClient, _, _, _ := setupMockedPluginClient(ctrl)
+	tfPluginClient.State.SetNetworks(NetworkState{"network": Network{
+		Subnets:               map[uint32]string{nodeID: "10.1.1.0/24"},
+		NodeDeploymentHostIDs: NodeDeploymentHostIDs{},
+	}})
+	vmDeployer := NewDeploymentDeployer(tfPluginClient)
+	k8sDeployer := K8sDeployer{tfPluginClient: tfPluginClient}
+
+	dl := workloads.Deployment{
+		NodeID:      nodeID,
+		NetworkName: "network",
+		Vms:         []workloads.VM{{Name: "vm1"}, {Name: "vm2"}},
+	}
+	cluster := workloads.K8sCluster{
+		NetworkName: "network",
+		Master:      &workloads.K8sNode{Name: "master", Node: nodeID},
+		Workers:     []workloads.K8sNode{{Name: "worker", Node: nodeID}},
+	}
+	usedHostIDs := func() HostIDs {
+		network := tfPluginClient.State.GetNetworks().GetNetwork("network")
+		return network.getUsedNetworkHostIDs(nodeID)
+	}
+
+	t.Run("vms and k8s nodes on the same node", func(t *testing.T) {
+		releaseVMs, err := vmDeployer.assignNodesIPs(&dl, true)
+		assert.NoError(t, err)
+		releaseK8s, err := k8sDeployer.assignNodesIPs(&cluster, true)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "10.1.1.2", dl.Vms[0].IP)
+		assert.Equal(t, "10.1.1.3", dl.Vms[1].IP)
+		assert.Equal(t, "10.1.1.4", cluster.Master.IP)
+		assert.Equal(t, "10.1.1.5", cluster.Workers[0].IP)
+
+		dl.ContractID = contractID
+		tfPluginClient.State.ips.set("network", nodeID, contractID, vmsIPs(dl.Vms))
+		releaseVMs()
+		cluster.NodeDeploymentID = map[uint32]uint64{nodeID: contractID + 1}
+		tfPluginClient.State.ips.set("network", nodeID, contractID+1, k8sNodesIPs(&cluster, nodeID))
+		releaseK8s()
+
+		assert.Empty(t, tfPluginClient.State.ips.reservations)
+		assert.ElementsMatch(t, HostIDs{2, 3, 4, 5}, usedHostIDs())
+	})
+
+	t.Run("deployments keep their own ips", func(t *testing.T) {
+		_, err := vmDeployer.assignNodesIPs(&dl, false)
+		assert.NoError(t, err)
+		_, err = k8sDeployer.assignNodesIPs(&cluster, false)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "10.1.1.2", dl.Vms[0].IP)
+		assert.Equal(t, "10.1.1.4", cluster.Master.IP)
+	})
+
+	t.Run("ips used by other deployments", func(t *testing.T) {
+		other := workloads.K8sCluster{
+			NetworkName: "network",
+			Master:      &workloads.K8sNode{Name: "master", Node: nodeID, IP: "10.1.1.3"},
+		}
+		_, err := k8sDeployer.assignNodesIPs(&other, false)
+		assert.ErrorContains(t, err, "ip 10.1.1.3 of master is already used")
+
+		otherDl := workloads.Deployment{
+			NodeID:      nodeID,
+			NetworkName: "network",
+			Vms:         []workloads.VM{{Name: "vm", IP: "10.1.1.5"}},
+		}
+		_, err = vmDeployer.assignNodesIPs(&otherDl, false)
+		assert.ErrorContains(t, err, "ip 10.1.1.5 of vm is already used")
+	})
+
+	t.Run("duplicate ips in the same deployment", func(t *testing.T) {
+		otherDl := workloads.Deployment{
+			NodeID:      nodeID,
+			NetworkName: "network",
+			Vms:         []workloads.VM{{Name: "vm1", IP: "10.1.1.9"}, {Name: "vm2", IP: "10.1.1.9"}},
+		}
+		_, err := vmDeployer.assignNodesIPs(&otherDl, false)
+		assert.ErrorContains(t, err, "ip 10.1.1.9 of vm2 is already used")
+	})
+
+	t.Run("canceled deployments ips are reused", func(t *testing.T) {
+		tfPluginClient.State.ips.release("network", nodeID, contractID)
+		assert.ElementsMatch(t, HostIDs{4, 5}, usedHostIDs())
+
+		other := workloads.K8sCluster{
+			NetworkName: "network",
+			Master:      &workloads.K8sNode{Name: "master", Node: nodeID},
+		}
+		_, err := k8sDeployer.assignNodesIPs(&other, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.1.1.2", other.Master.IP)
+	})
+
+	t.Run("unknown node subnet", func(t *testing.T) {
+		other := workloads.Deployment{
+			NodeID:      nodeID + 1,
+			NetworkName: "network",
+			Vms:         []workloads.VM{{Name: "vm"}},
+		}
+		_, err := vmDeployer.assignNodesIPs(&other, false)
+		assert.Error(t, err)
+	})
+
+	t.Run("ips reserved by other deployments", func(t *testing.T) {
+		pending := workloads.Deployment{
+			NodeID:      nodeID,
+			NetworkName: "network",
+			Vms:         []workloads.VM{{Name: "vm", IP: "10.1.1.20"}},
+		}
+		release, err := vmDeployer.assignNodesIPs(&pending, true)
+		assert.NoError(t, err)
+
+		other := workloads.K8sCluster{
+			NetworkName: "network",
+			Master:      &workloads.K8sNode{Name: "master", Node: nodeID, IP: "10.1.1.20"},
+		}
+		_, err = k8sDeployer.assignNodesIPs(&other, false)
+		assert.ErrorContains(t, err, "ip 10.1.1.20 of master is already used")
+
+		// the deployment itself can use its reserved ips while it's deployed
+		_, err = vmDeployer.assignNodesIPs(&pending, false)
+		assert.NoError(t, err)
+
+		release()
+		_, err = k8sDeployer.assignNodesIPs(&other, false)
+		assert.NoError(t, err)
+	})
+
+	t.Run("concurrent deployments with the same ip", func(t *testing.T) {
+		var wg sync.WaitGroup
+		var lock sync.Mutex
+		releases := []func(){}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				dl := workloads.Deployment{
+					NodeID:      nodeID,
+					NetworkName: "network",
+					Vms:         []workloads.VM{{Name: fmt.Sprintf("vm%d", i), IP: "10.1.1.30"}},
+				}
+				release, err := vmDeployer.assignNodesIPs(&dl, true)
+				if err != nil {
+					return
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				releases = append(releases, release)
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Len(t, releases, 1)
+		for _, release := range releases {
+			release()
+		}
+		assert.Empty(t, tfPluginClient.State.ips.reservations)
+	})
+}
@@ -0,0 +1,210 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+// JournalOp is the contract operation a journal entry is recorded for
+type JournalOp string
+
+// JournalStage is the last step of an operation known to be done
+type JournalStage string
+
+const (
+	// JournalCreate creates a node contract then deploys it on the node
+	JournalCreate JournalOp = "create"
+	// JournalUpdate updates a node contract then updates the deployment on the node
+	JournalUpdate JournalOp = "update"
+	// JournalCancel cancels a node contract
+	JournalCancel JournalOp = "cancel"
+
+	// StageIntent is recorded before sending the contract extrinsic
+	StageIntent JournalStage = "intent"
+	// StageContract is recorded after the contract extrinsic succeeds
+	StageContract JournalStage = "contract"
+	// StageNode is recorded after the node accepts the deployment
+	StageNode JournalStage = "node"
+)
+
+// JournalEntry is a contract operation that is not known to be finished yet
+type JournalEntry struct {
+	ID     string       `json:"id"`
+	Op     JournalOp    `json:"op"`
+	Stage  JournalStage `json:"stage"`
+	NodeID uint32       `json:"node_id"`
+	// ContractID is the contract of the operation, 0 if a creation didn't return it yet
+	ContractID uint64 `json:"contract_id"`
+	// Hash is the deployment challenge hash set on the contract
+	Hash       string               `json:"hash"`
+	Deployment gridtypes.Deployment `json:"deployment"`
+	Time       time.Time            `json:"time"`
+}
+
+// Journal is a write-ahead log of the deployer contract operations
+// entries are recorded before and after each extrinsic and node call, so Recover can finish or cancel them after a crash
+type Journal interface {
+	// Record adds or replaces the entry with the same ID, the entry must be persisted when it returns
+	Record(entry JournalEntry) error
+	// Complete removes the entry of a finished operation
+	Complete(id string) error
+	// Pending returns the entries of the unfinished operations
+	Pending() ([]JournalEntry, error)
+}
+
+// FileJournal is a journal stored as a json file
+type FileJournal struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewFileJournal returns a journal stored in the given file, the file is created on the first record
+func NewFileJournal(path string) *FileJournal {
+	return &FileJournal{path: path}
+}
+
+// Record adds or replaces an entry in the journal file
+func (j *FileJournal) Record(entry JournalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return err
+	}
+	entries[entry.ID] = entry
+	return j.save(entries)
+}
+
+// Complete removes an entry from the journal file
+func (j *FileJournal) Complete(id string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[id]; !ok {
+		return nil
+	}
+	delete(entries, id)
+	return j.save(entries)
+}
+
+// Pending returns the entries of the journal file sorted by their recording time
+func (j *FileJournal) Pending() ([]JournalEntry, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entries, err := j.load()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]JournalEntry, 0, len(entries))
+	for _, entry := range entries {
+		pending = append(pending, entry)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Time.Before(pending[j].Time) })
+	return pending, nil
+}
+
+func (j *FileJournal) load() (map[string]JournalEntry, error) {
+	entries := make(map[string]JournalEntry)
+
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read journal file %s", j.path)
+	}
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse journal file %s", j.path)
+	}
+	return entries, nil
+}
+
+// save writes the entries to a temporary file then renames it, so a crash never leaves a partially written journal
+func (j *FileJournal) save(entries map[string]JournalEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode journal entries")
+	}
+
+	// the journal has signed deployments that may include secrets
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create journal temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write journal")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to sync journal")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close journal")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), j.path), "failed to replace journal file")
+}
+
+var journalEntriesCount uint64
+
+// newJournalEntry returns a new entry for an operation on a node
+func newJournalEntry(op JournalOp, node uint32, contractID uint64) JournalEntry {
+	now := time.Now()
+	return JournalEntry{
+		ID:         fmt.Sprintf("%d-%d-%d", now.UnixNano(), node, atomic.AddUint64(&journalEntriesCount, 1)),
+		Op:         op,
+		NodeID:     node,
+		ContractID: contractID,
+		Time:       now,
+	}
+}
+
+// journalRecord records an entry at the given stage, it's a no-op if the deployer has no journal
+func (d *Deployer) journalRecord(entry *JournalEntry, stage JournalStage) error {
+	if d.journal == nil {
+		return nil
+	}
+
+	entry.Stage = stage
+	if err := d.journal.Record(*entry); err != nil {
+		log.Error().Err(err).Msgf("failed to record %s operation on node %d at %s stage", entry.Op, entry.NodeID, stage)
+		return errors.Wrap(err, "failed to record operation in the journal")
+	}
+	return nil
+}
+
+// journalComplete removes finished operations from the journal
+// failures are only logged since Recover finds out the operations are already done
+func (d *Deployer) journalComplete(ids ...string) {
+	if d.journal == nil {
+		return
+	}
+
+	for _, id := range ids {
+		if err := d.journal.Complete(id); err != nil {
+			log.Error().Err(err).Msgf("failed to complete journal entry %s", id)
+		}
+	}
+}
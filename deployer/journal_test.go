@@ -0,0 +1,193 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	client "github.com/threefoldtech/grid3-go/node"
+	"github.com/threefoldtech/grid3-go/subi"
+	"github.com/threefoldtech/substrate-client"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+func TestFileJournal(t *testing.T) {
+	journal := NewFileJournal(filepath.Join(t.TempDir(), "journal.json"))
+
+	pending, err := journal.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	first := newJournalEntry(JournalCreate, 10, 0)
+	first.Stage = StageIntent
+	second := newJournalEntry(JournalCancel, 20, 200)
+	second.Stage = StageIntent
+
+	assert.NoError(t, journal.Record(first))
+	assert.NoError(t, journal.Record(second))
+
+	first.Stage = StageContract
+	first.ContractID = 100
+	assert.NoError(t, journal.Record(first))
+
+	pending, err = NewFileJournal(journal.path).Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+	assert.Equal(t, first.ID, pending[0].ID)
+	assert.Equal(t, StageContract, pending[0].Stage)
+	assert.Equal(t, uint64(100), pending[0].ContractID)
+	assert.Equal(t, second.ID, pending[1].ID)
+
+	assert.NoError(t, journal.Complete(first.ID))
+	assert.NoError(t, journal.Complete("unknown"))
+
+	pending, err = journal.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, second.ID, pending[0].ID)
+}
+
+func TestDeployerJournal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, ncPool, cl := setupMockedDeployer(t, ctrl)
+	identity := deployer.identity
+	journal := NewFileJournal(filepath.Join(t.TempDir(), "journal.json"))
+	deployer.journal = journal
+
+	dl, err := deploymentWithFQDN(identity, deployer.twinID, 0)
+	assert.NoError(t, err)
+
+	t.Run("failed contract creation is kept", func(t *testing.T) {
+		ncPool.EXPECT().
+			GetNodeClient(sub, uint32(10)).
+			Return(client.NewNodeClient(13, cl, 10), nil)
+
+		sub.EXPECT().
+			CreateNodeContract(identity, uint32(10), ``, gomock.Any(), uint32(0), nil).
+			Return(uint64(0), errors.New("error"))
+
+		_, err := deployer.deploy(context.Background(), nil, map[uint32]gridtypes.Deployment{10: dl}, map[uint32]*uint64{}, false)
+		assert.Error(t, err)
+
+		pending, err := journal.Pending()
+		assert.NoError(t, err)
+		assert.Len(t, pending, 1)
+		assert.Equal(t, JournalCreate, pending[0].Op)
+		assert.Equal(t, StageIntent, pending[0].Stage)
+		assert.Equal(t, uint32(10), pending[0].NodeID)
+		assert.NotEmpty(t, pending[0].Hash)
+
+		assert.NoError(t, journal.Complete(pending[0].ID))
+	})
+
+	t.Run("contract that failed to be canceled is kept", func(t *testing.T) {
+		ncPool.EXPECT().
+			GetNodeClient(sub, uint32(10)).
+			Return(client.NewNodeClient(13, cl, 10), nil)
+
+		sub.EXPECT().
+			CreateNodeContract(identity, uint32(10), ``, gomock.Any(), uint32(0), nil).
+			Return(uint64(100), nil)
+
+		cl.EXPECT().
+			Call(gomock.Any(), uint32(13), "zos.deployment.deploy", gomock.Any(), gomock.Any()).
+			Return(errors.New("error"))
+
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(100)).Return(errors.New("error"))
+
+		_, err := deployer.deploy(context.Background(), nil, map[uint32]gridtypes.Deployment{10: dl}, map[uint32]*uint64{}, false)
+		assert.Error(t, err)
+
+		pending, err := journal.Pending()
+		assert.NoError(t, err)
+		assert.Len(t, pending, 1)
+		assert.Equal(t, StageContract, pending[0].Stage)
+		assert.Equal(t, uint64(100), pending[0].ContractID)
+
+		assert.NoError(t, journal.Complete(pending[0].ID))
+	})
+
+	t.Run("finished operations are completed", func(t *testing.T) {
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(100)).Return(nil)
+
+		contracts, err := deployer.deploy(context.Background(), map[uint32]uint64{10: 100}, nil, nil, false)
+		assert.NoError(t, err)
+		assert.Empty(t, contracts)
+
+		pending, err := journal.Pending()
+		assert.NoError(t, err)
+		assert.Empty(t, pending)
+	})
+}
+
+func TestDeployerRecover(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, _, _ := setupMockedDeployer(t, ctrl)
+	identity := deployer.identity
+	journal := NewFileJournal(filepath.Join(t.TempDir(), "journal.json"))
+	deployer.journal = journal
+
+	record := func(op JournalOp, stage JournalStage, node uint32, contractID uint64, hash string) {
+		entry := newJournalEntry(op, node, contractID)
+		entry.Stage = stage
+		entry.Hash = hash
+		assert.NoError(t, journal.Record(entry))
+	}
+
+	t.Run("no journal", func(t *testing.T) {
+		deployer := deployer
+		deployer.journal = nil
+		assert.NoError(t, deployer.Recover(context.Background()))
+	})
+
+	t.Run("interrupted operations", func(t *testing.T) {
+		record(JournalCreate, StageIntent, 10, 0, "created")
+		record(JournalCreate, StageIntent, 20, 0, "not created")
+		record(JournalCreate, StageNode, 30, 300, "deployed")
+		record(JournalCancel, StageIntent, 40, 400, "")
+		record(JournalUpdate, StageIntent, 50, 500, "not updated")
+
+		sub.EXPECT().GetContractIDByNodeHash(uint32(10), "created").Return(uint64(100), nil)
+		sub.EXPECT().GetContractIDByNodeHash(uint32(20), "not created").Return(uint64(0), substrate.ErrNotFound)
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(100)).Return(nil)
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(300)).Return(nil)
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(400)).Return(nil)
+		sub.EXPECT().GetContract(uint64(500)).Return(subi.Contract{
+			Contract: &substrate.Contract{
+				State: substrate.ContractState{IsCreated: true},
+				ContractType: substrate.ContractType{
+					IsNodeContract: true,
+					NodeContract:   substrate.NodeContract{DeploymentHash: substrate.NewHexHash("old hash")},
+				},
+			},
+		}, nil)
+
+		assert.NoError(t, deployer.Recover(context.Background()))
+
+		pending, err := journal.Pending()
+		assert.NoError(t, err)
+		assert.Empty(t, pending)
+	})
+
+	t.Run("failed recovery is kept", func(t *testing.T) {
+		record(JournalCancel, StageIntent, 40, 400, "")
+
+		sub.EXPECT().EnsureContractCanceled(identity, uint64(400)).Return(errors.New("error"))
+
+		err := deployer.Recover(context.Background())
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to cancel contract 400")
+
+		pending, err := journal.Pending()
+		assert.NoError(t, err)
+		assert.Len(t, pending, 1)
+	})
+}
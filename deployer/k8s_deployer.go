@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 
 	"github.com/pkg/errors"
 	zerolog "github.com/rs/zerolog/log"
@@ -33,6 +32,16 @@ func NewK8sDeployer(tfPluginClient *TFPluginClient) K8sDeployer {
 	return k8sDeployer
 }
 
+// SetUpdateStrategy sets the strategy used to update the cluster deployments
+func (d *K8sDeployer) SetUpdateStrategy(strategy UpdateStrategy) {
+	setUpdateStrategy(d.deployer, strategy)
+}
+
+// RegisterObserver registers an observer for the workloads events of the cluster deployments
+func (d *K8sDeployer) RegisterObserver(observer Observer) {
+	registerObserver(d.deployer, observer)
+}
+
 // Validate validates K8s deployer
 func (d *K8sDeployer) Validate(ctx context.Context, k8sCluster *workloads.K8sCluster) error {
 	sub := d.tfPluginClient.SubstrateConn
@@ -74,7 +83,7 @@ func (d *K8sDeployer) Validate(ctx context.Context, k8sCluster *workloads.K8sClu
 
 // GenerateVersionlessDeployments generates a new deployment without a version
 func (d *K8sDeployer) GenerateVersionlessDeployments(ctx context.Context, k8sCluster *workloads.K8sCluster) (map[uint32]gridtypes.Deployment, error) {
-	err := d.assignNodesIPs(k8sCluster)
+	_, err := d.assignNodesIPs(k8sCluster, false)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to assign node ips")
 	}
@@ -115,6 +124,13 @@ func (d *K8sDeployer) Deploy(ctx context.Context, k8sCluster *workloads.K8sClust
 		return err
 	}
 
+	// the nodes IPs are reserved so concurrent deployments on the same network don't get them
+	release, err := d.assignNodesIPs(k8sCluster, true)
+	if err != nil {
+		return errors.Wrap(err, "failed to assign node ips")
+	}
+	defer release()
+
 	newDeployments, err := d.GenerateVersionlessDeployments(ctx, k8sCluster)
 	if err != nil {
 		return errors.Wrap(err, "could not generate k8s grid deployments")
@@ -123,22 +139,68 @@ func (d *K8sDeployer) Deploy(ctx context.Context, k8sCluster *workloads.K8sClust
 	newDeploymentsSolutionProvider := make(map[uint32]*uint64)
 	newDeploymentsSolutionProvider[k8sCluster.Master.Node] = nil
 
+	oldDeploymentIDs := k8sCluster.NodeDeploymentID
 	k8sCluster.NodeDeploymentID, err = d.deployer.Deploy(ctx, k8sCluster.NodeDeploymentID, newDeployments, newDeploymentsSolutionProvider)
 
 	// update deployments state
 	// error is not returned immediately before updating state because of untracked failed deployments
+	for nodeID, contractID := range canceledContracts(oldDeploymentIDs, k8sCluster.NodeDeploymentID) {
+		d.tfPluginClient.State.removeDeployment(nodeID, contractID)
+		d.tfPluginClient.State.ips.release(k8sCluster.NetworkName, nodeID, contractID)
+	}
 	if contractID, ok := k8sCluster.NodeDeploymentID[k8sCluster.Master.Node]; ok && contractID != 0 {
-		if !workloads.Contains(d.tfPluginClient.State.CurrentNodeDeployments[k8sCluster.Master.Node], contractID) {
-			d.tfPluginClient.State.CurrentNodeDeployments[k8sCluster.Master.Node] = append(d.tfPluginClient.State.CurrentNodeDeployments[k8sCluster.Master.Node], contractID)
-		}
+		d.tfPluginClient.State.addDeployment(k8sCluster.Master.Node, contractID)
 		for _, w := range k8sCluster.Workers {
-			if !workloads.Contains(d.tfPluginClient.State.CurrentNodeDeployments[w.Node], k8sCluster.NodeDeploymentID[w.Node]) {
-				d.tfPluginClient.State.CurrentNodeDeployments[w.Node] = append(d.tfPluginClient.State.CurrentNodeDeployments[w.Node], k8sCluster.NodeDeploymentID[w.Node])
-			}
+			d.tfPluginClient.State.addDeployment(w.Node, k8sCluster.NodeDeploymentID[w.Node])
+		}
+		// the reserved IPs are used by the nodes deployment contracts now
+		for nodeID, contractID := range k8sCluster.NodeDeploymentID {
+			d.tfPluginClient.State.ips.set(k8sCluster.NetworkName, nodeID, contractID, k8sNodesIPs(k8sCluster, nodeID))
 		}
 	}
 
-	return err
+	return d.tfPluginClient.State.saveAfter(err)
+}
+
+// Plan returns the changes deploying the cluster would apply, without changing any contract
+// missing IPs are assigned the same way Deploy assigns them, to a copy of the cluster which is left unchanged
+func (d *K8sDeployer) Plan(ctx context.Context, k8sCluster *workloads.K8sCluster) (Plan, error) {
+	planned := copyK8sCluster(k8sCluster)
+	k8sCluster = &planned
+
+	if err := d.assignNodeIPRange(k8sCluster); err != nil {
+		return Plan{}, err
+	}
+
+	err := k8sCluster.InvalidateBrokenAttributes(d.tfPluginClient.SubstrateConn)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	if err := d.Validate(ctx, k8sCluster); err != nil {
+		return Plan{}, err
+	}
+
+	newDeployments, err := d.GenerateVersionlessDeployments(ctx, k8sCluster)
+	if err != nil {
+		return Plan{}, errors.Wrap(err, "could not generate k8s grid deployments")
+	}
+
+	return planDeployments(ctx, d.deployer, k8sCluster.NodeDeploymentID, newDeployments)
+}
+
+// DetectDrift reports the differences between the cluster and what is live on the grid, without changing the cluster.
+// the desired deployments are generated from a copy of the cluster which is left unchanged
+func (d *K8sDeployer) DetectDrift(ctx context.Context, k8sCluster *workloads.K8sCluster) (DriftReport, error) {
+	desired := copyK8sCluster(k8sCluster)
+	k8sCluster = &desired
+
+	desiredDeployments, err := d.GenerateVersionlessDeployments(ctx, k8sCluster)
+	if err != nil {
+		return DriftReport{}, errors.Wrap(err, "could not generate k8s grid deployments")
+	}
+
+	return d.deployer.DetectDrift(ctx, k8sCluster.NodeDeploymentID, desiredDeployments)
 }
 
 // Cancel cancels a k8s cluster deployment
@@ -151,9 +213,10 @@ func (d *K8sDeployer) Cancel(ctx context.Context, k8sCluster *workloads.K8sClust
 		if k8sCluster.Master.Node == nodeID {
 			err = d.deployer.Cancel(ctx, contractID)
 			if err != nil {
-				return errors.Wrapf(err, "could not cancel master %s, contract %d", k8sCluster.Master.Name, contractID)
+				return d.tfPluginClient.State.saveAfter(errors.Wrapf(err, "could not cancel master %s, contract %d", k8sCluster.Master.Name, contractID))
 			}
-			d.tfPluginClient.State.CurrentNodeDeployments[nodeID] = workloads.Delete(d.tfPluginClient.State.CurrentNodeDeployments[nodeID], contractID)
+			d.tfPluginClient.State.removeDeployment(nodeID, contractID)
+			d.tfPluginClient.State.ips.release(k8sCluster.NetworkName, nodeID, contractID)
 			delete(k8sCluster.NodeDeploymentID, nodeID)
 			continue
 		}
@@ -161,16 +224,17 @@ func (d *K8sDeployer) Cancel(ctx context.Context, k8sCluster *workloads.K8sClust
 			if worker.Node == nodeID {
 				err = d.deployer.Cancel(ctx, contractID)
 				if err != nil {
-					return errors.Wrapf(err, "could not cancel worker %s, contract %d", worker.Name, contractID)
+					return d.tfPluginClient.State.saveAfter(errors.Wrapf(err, "could not cancel worker %s, contract %d", worker.Name, contractID))
 				}
-				d.tfPluginClient.State.CurrentNodeDeployments[nodeID] = workloads.Delete(d.tfPluginClient.State.CurrentNodeDeployments[nodeID], contractID)
+				d.tfPluginClient.State.removeDeployment(nodeID, contractID)
+				d.tfPluginClient.State.ips.release(k8sCluster.NetworkName, nodeID, contractID)
 				delete(k8sCluster.NodeDeploymentID, nodeID)
 				break
 			}
 		}
 	}
 
-	return nil
+	return d.tfPluginClient.State.saveAfter(nil)
 }
 
 // UpdateFromRemote update a k8s cluster
@@ -343,68 +407,31 @@ func (d *K8sDeployer) removeDeletedContracts(ctx context.Context, k8sCluster *wo
 	return nil
 }
 
-func (d *K8sDeployer) getK8sUsedIPs(k8s *workloads.K8sCluster) map[uint32][]byte {
-	usedIPs := make(map[uint32][]byte)
-	network := d.tfPluginClient.State.networks.GetNetwork(k8s.NetworkName)
-
-	if k8s.Master.IP != "" {
-		usedIPs[k8s.Master.Node] = append(usedIPs[k8s.Master.Node], net.ParseIP(k8s.Master.IP)[3])
-	}
-	usedIPs[k8s.Master.Node] = append(usedIPs[k8s.Master.Node], network.getUsedNetworkHostIDs(k8s.Master.Node)...)
-	for _, w := range k8s.Workers {
-		if w.IP != "" {
-			usedIPs[w.Node] = append(usedIPs[w.Node], net.ParseIP(w.IP)[3])
-			usedIPs[w.Node] = append(usedIPs[w.Node], network.getUsedNetworkHostIDs(w.Node)...)
-		}
-	}
-
-	return usedIPs
-}
-
-func (d *K8sDeployer) getK8sFreeIP(ipRange gridtypes.IPNet, nodeID uint32, k8s *workloads.K8sCluster) (string, error) {
-	nodeUsedIPs := d.getK8sUsedIPs(k8s)
-
-	ip := ipRange.IP.To4()
-	if ip == nil {
-		return "", fmt.Errorf("the provided ip range (%s) is not a valid ipv4", ipRange.String())
-	}
-
-	for i := 2; i < 255; i++ {
-		hostID := byte(i)
-		if !workloads.Contains(nodeUsedIPs[nodeID], hostID) {
-			nodeUsedIPs[nodeID] = append(nodeUsedIPs[nodeID], hostID)
-			ip[3] = hostID
-			return ip.String(), nil
+// k8sNodesIPs returns the cluster nodes private IPs on a node
+func k8sNodesIPs(k8sCluster *workloads.K8sCluster, nodeID uint32) []string {
+	ips := []string{}
+	nodes := append([]workloads.K8sNode{*k8sCluster.Master}, k8sCluster.Workers...)
+	for _, node := range nodes {
+		if node.Node == nodeID {
+			ips = append(ips, node.IP)
 		}
 	}
-	return "", errors.New("all ips are used")
+	return ips
 }
 
-func (d *K8sDeployer) assignNodesIPs(k8sCluster *workloads.K8sCluster) error {
-	masterNodeRange := k8sCluster.NodesIPRange[k8sCluster.Master.Node]
-	if k8sCluster.Master.IP == "" || !masterNodeRange.Contains(net.ParseIP(k8sCluster.Master.IP)) {
-		ip, err := d.getK8sFreeIP(masterNodeRange, k8sCluster.Master.Node, k8sCluster)
-		if err != nil {
-			return errors.Wrap(err, "failed to find free ip for master")
-		}
-		k8sCluster.Master.IP = ip
+// assignNodesIPs assigns free private IPs to the cluster nodes without IPs in their node subnet,
+// the nodes IPs are reserved until release is called if reserve is set
+func (d *K8sDeployer) assignNodesIPs(k8sCluster *workloads.K8sCluster, reserve bool) (release func(), err error) {
+	requests := []ipRequest{{nodeID: k8sCluster.Master.Node, name: k8sCluster.Master.Name, ip: &k8sCluster.Master.IP}}
+	for idx := range k8sCluster.Workers {
+		worker := &k8sCluster.Workers[idx]
+		requests = append(requests, ipRequest{nodeID: worker.Node, name: worker.Name, ip: &worker.IP})
 	}
-	for idx, w := range k8sCluster.Workers {
-		workerNodeRange := k8sCluster.NodesIPRange[w.Node]
-		if w.IP != "" && workerNodeRange.Contains(net.ParseIP(w.IP)) {
-			continue
-		}
-		ip, err := d.getK8sFreeIP(workerNodeRange, w.Node, k8sCluster)
-		if err != nil {
-			return errors.Wrap(err, "failed to find free ip for worker")
-		}
-		k8sCluster.Workers[idx].IP = ip
-	}
-	return nil
+	return d.tfPluginClient.State.ips.assign(k8sCluster.NetworkName, requests, k8sCluster.NodeDeploymentID, reserve)
 }
 
 func (d *K8sDeployer) assignNodeIPRange(k8sCluster *workloads.K8sCluster) (err error) {
-	network := d.tfPluginClient.State.networks.GetNetwork(k8sCluster.NetworkName)
+	network := d.tfPluginClient.State.GetNetworks().GetNetwork(k8sCluster.NetworkName)
 	nodesIPRange := make(map[uint32]gridtypes.IPNet)
 	nodesIPRange[k8sCluster.Master.Node], err = gridtypes.ParseIPNet(network.getNodeSubnet(k8sCluster.Master.Node))
 	if err != nil {
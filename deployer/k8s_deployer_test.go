@@ -55,7 +55,7 @@ func constructTestK8s(t *testing.T, mock bool) (
 	net := constructTestNetwork()
 	tfPluginClient.State.networks = NetworkState{net.Name: Network{
 		Subnets:               map[uint32]string{nodeID: net.IPRange.String()},
-		NodeDeploymentHostIDs: map[uint32]DeploymentHostIDs{nodeID: map[uint64][]byte{contractID: {}}},
+		NodeDeploymentHostIDs: map[uint32]DeploymentHostIDs{nodeID: map[uint64]HostIDs{contractID: {}}},
 	}}
 
 	return tfPluginClient.K8sDeployer, cl, sub, ncPool, deployer, gridProxyCl
@@ -144,6 +144,41 @@ func TestK8sDeployer(t *testing.T) {
 	k8sCluster, err := constructK8sCluster()
 	assert.NoError(t, err)
 
+	t.Run("test plan keeps the cluster", func(t *testing.T) {
+		k8sMockValidation(d.tfPluginClient.Identity, cl, sub, ncPool, proxyCl, d)
+		deployer.EXPECT().
+			GetDeployments(gomock.Any(), gomock.Any()).
+			Return(map[uint32]gridtypes.Deployment{}, nil)
+
+		before := copyK8sCluster(&k8sCluster)
+		plan, err := d.Plan(context.Background(), &k8sCluster)
+		assert.NoError(t, err)
+		assert.True(t, plan.HasChanges())
+
+		assert.Equal(t, before, k8sCluster)
+		assert.Empty(t, k8sCluster.NodesIPRange)
+		assert.Empty(t, k8sCluster.Workers[0].IP)
+	})
+
+	t.Run("test detect drift keeps the cluster", func(t *testing.T) {
+		cluster := copyK8sCluster(&k8sCluster)
+		err := d.assignNodeIPRange(&cluster)
+		assert.NoError(t, err)
+
+		missing := DriftReport{Drifts: []Drift{{NodeID: nodeID, Kind: DriftNodeMissing}}}
+		deployer.EXPECT().
+			DetectDrift(gomock.Any(), cluster.NodeDeploymentID, gomock.Any()).
+			Return(missing, nil)
+
+		before := copyK8sCluster(&cluster)
+		report, err := d.DetectDrift(context.Background(), &cluster)
+		assert.NoError(t, err)
+		assert.Equal(t, missing, report)
+
+		assert.Equal(t, before, cluster)
+		assert.Empty(t, cluster.Workers[0].IP)
+	})
+
 	t.Run("test validate master reachable", func(t *testing.T) {
 		k8sMockValidation(d.tfPluginClient.Identity, cl, sub, ncPool, proxyCl, d)
 
@@ -3,11 +3,16 @@ package deployer
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"reflect"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	client "github.com/threefoldtech/grid3-go/node"
+	"github.com/threefoldtech/grid3-go/subi"
 	"github.com/threefoldtech/grid3-go/workloads"
 	"github.com/threefoldtech/substrate-client"
 	"github.com/threefoldtech/zos/pkg/gridtypes"
@@ -15,10 +20,15 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// wgPortClashErrors are parts of the errors of network workloads whose wireguard ports are already used on their nodes
+var wgPortClashErrors = []string{"address already in use", "port is already in use"}
+
 // NetworkDeployer struct
 type NetworkDeployer struct {
 	tfPluginClient *TFPluginClient
 	deployer       MockDeployer
+	wgPorts        *client.WGPortAllocator
+	wgPortRetries  int
 }
 
 // NewNetworkDeployer generates a new network deployer
@@ -27,9 +37,16 @@ func NewNetworkDeployer(tfPluginClient *TFPluginClient) NetworkDeployer {
 	return NetworkDeployer{
 		tfPluginClient: tfPluginClient,
 		deployer:       &deployer,
+		wgPorts:        client.NewWGPortAllocator(deployer.config.WGPortRange),
+		wgPortRetries:  deployer.config.WGPortRetries,
 	}
 }
 
+// RegisterObserver registers an observer for the workloads events of the network deployments
+func (d *NetworkDeployer) RegisterObserver(observer Observer) {
+	registerObserver(d.deployer, observer)
+}
+
 // Validate validates a network deployer
 func (d *NetworkDeployer) Validate(ctx context.Context, znet *workloads.ZNet) error {
 	sub := d.tfPluginClient.SubstrateConn
@@ -50,8 +67,16 @@ func (d *NetworkDeployer) Validate(ctx context.Context, znet *workloads.ZNet) er
 	return d.InvalidateBrokenAttributes(znet)
 }
 
-// GenerateVersionlessDeployments generates deployments for network deployer without versions
+// GenerateVersionlessDeployments generates deployments for network deployer without versions.
+// the wireguard ports picked for the nodes are not kept reserved, only a deploy keeps them reserved until the nodes use them
 func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, znet *workloads.ZNet) (map[uint32]gridtypes.Deployment, error) {
+	deployments, reservedPorts, err := d.generateDeployments(ctx, znet)
+	d.releaseWGPorts(reservedPorts)
+	return deployments, err
+}
+
+// generateVersionlessDeployments generates deployments for network deployer without versions, the new wireguard ports stay reserved
+func (d *NetworkDeployer) generateVersionlessDeployments(ctx context.Context, znet *workloads.ZNet) (map[uint32]gridtypes.Deployment, error) {
 	deployments := make(map[uint32]gridtypes.Deployment)
 
 	log.Debug().Msgf("nodes: %v", znet.Nodes)
@@ -60,7 +85,7 @@ func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, zn
 	endpoints := make(map[uint32]string)
 	hiddenNodes := make([]uint32, 0)
 	accessibleNodes := make([]uint32, 0)
-	var ipv4Node uint32
+	ipv4Nodes := make([]uint32, 0)
 
 	for _, nodeID := range znet.Nodes {
 		nodeClient, err := d.tfPluginClient.NcPool.GetNodeClient(sub, nodeID)
@@ -73,44 +98,40 @@ func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, zn
 			hiddenNodes = append(hiddenNodes, nodeID)
 		} else if err != nil {
 			return nil, errors.Wrapf(err, "failed to get node %d endpoint", nodeID)
-		} else if endpoint.To4() != nil {
-			accessibleNodes = append(accessibleNodes, nodeID)
-			ipv4Node = nodeID
-			endpoints[nodeID] = endpoint.String()
 		} else {
 			accessibleNodes = append(accessibleNodes, nodeID)
-			endpoints[nodeID] = fmt.Sprintf("[%s]", endpoint.String())
+			if endpoint.To4() != nil {
+				ipv4Nodes = append(ipv4Nodes, nodeID)
+			}
+			endpoints[nodeID] = wgEndpointHost(endpoint)
 		}
 	}
 
-	needsIPv4Access := znet.AddWGAccess || (len(hiddenNodes) != 0 && len(hiddenNodes)+len(accessibleNodes) > 1)
+	needsIPv4Access := znet.AddWGAccess || len(znet.UserAccesses) != 0 || (len(hiddenNodes) != 0 && len(hiddenNodes)+len(accessibleNodes) > 1)
 	if needsIPv4Access {
-		if znet.PublicNodeID != 0 { // it's set
-			// if public node id is already set, it should be added to accessible nodes
-			if !workloads.Contains(accessibleNodes, znet.PublicNodeID) {
-				accessibleNodes = append(accessibleNodes, znet.PublicNodeID)
+		if err := d.assignPublicNodes(ctx, znet, ipv4Nodes); err != nil {
+			return nil, errors.Wrap(err, "public node needed because you requested adding wg access or a hidden node is added to the network")
+		}
+
+		for _, publicNode := range znet.PublicNodes() {
+			// public nodes that are not one of the network nodes should be added to accessible nodes
+			if !workloads.Contains(accessibleNodes, publicNode) {
+				accessibleNodes = append(accessibleNodes, publicNode)
 			}
-		} else if ipv4Node != 0 { // there's one in the network original nodes
-			znet.PublicNodeID = ipv4Node
-		} else {
-			publicNode, err := GetPublicNode(ctx, d.tfPluginClient.GridProxyClient, []uint32{})
-			if err != nil {
-				return nil, errors.Wrap(err, "public node needed because you requested adding wg access or a hidden node is added to the network")
+			if endpoints[publicNode] != "" {
+				continue
 			}
-			znet.PublicNodeID = publicNode
-			accessibleNodes = append(accessibleNodes, publicNode)
-		}
 
-		if endpoints[znet.PublicNodeID] == "" { // old or new outsider
-			cl, err := d.tfPluginClient.NcPool.GetNodeClient(sub, znet.PublicNodeID)
+			// old or new outsider
+			cl, err := d.tfPluginClient.NcPool.GetNodeClient(sub, publicNode)
 			if err != nil {
-				return nil, errors.Wrapf(err, "could not get node %d client", znet.PublicNodeID)
+				return nil, errors.Wrapf(err, "could not get node %d client", publicNode)
 			}
 			endpoint, err := cl.GetNodeEndpoint(ctx)
 			if err != nil {
-				return nil, errors.Wrapf(err, "failed to get node %d endpoint", znet.PublicNodeID)
+				return nil, errors.Wrapf(err, "failed to get node %d endpoint", publicNode)
 			}
-			endpoints[znet.PublicNodeID] = endpoint.String()
+			endpoints[publicNode] = wgEndpointHost(endpoint)
 		}
 	}
 
@@ -121,9 +142,12 @@ func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, zn
 	if err := znet.AssignNodesWGKey(allNodes); err != nil {
 		return nil, errors.Wrap(err, "could not assign node wg keys")
 	}
-	if err := znet.AssignNodesWGPort(ctx, sub, d.tfPluginClient.NcPool, allNodes); err != nil {
+	if err := znet.AssignNodesWGPort(ctx, sub, d.tfPluginClient.NcPool, d.wgPorts, allNodes); err != nil {
 		return nil, errors.Wrap(err, "could not assign node wg ports")
 	}
+	if err := znet.AssignUserAccessesKeys(); err != nil {
+		return nil, errors.Wrap(err, "could not assign user accesses wg keys")
+	}
 
 	nonAccessibleIPRanges := []gridtypes.IPNet{}
 	for _, nodeID := range hiddenNodes {
@@ -136,21 +160,21 @@ func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, zn
 		nonAccessibleIPRanges = append(nonAccessibleIPRanges, *r)
 		nonAccessibleIPRanges = append(nonAccessibleIPRanges, workloads.WgIP(*r))
 	}
+	for _, access := range znet.UserAccesses {
+		nonAccessibleIPRanges = append(nonAccessibleIPRanges, access.Subnet)
+		nonAccessibleIPRanges = append(nonAccessibleIPRanges, workloads.WgIP(access.Subnet))
+	}
 
 	log.Debug().Msgf("hidden nodes: %v", hiddenNodes)
 	log.Debug().Uint32("public node", znet.PublicNodeID)
+	log.Debug().Msgf("backup public nodes: %v", znet.BackupPublicNodeIDs)
 	log.Debug().Msgf("accessible nodes: %v", accessibleNodes)
 	log.Debug().Msgf("non accessible ip ranges: %v", nonAccessibleIPRanges)
 
 	if znet.AddWGAccess {
-		znet.AccessWGConfig = workloads.GenerateWGConfig(
-			workloads.WgIP(*znet.ExternalIP).IP.String(),
-			znet.ExternalSK.String(),
-			znet.Keys[znet.PublicNodeID].PublicKey().String(),
-			fmt.Sprintf("%s:%d", endpoints[znet.PublicNodeID], znet.WGPort[znet.PublicNodeID]),
-			znet.IPRange.String(),
-		)
+		znet.AccessWGConfig = accessWGConfig(znet, endpoints)
 	}
+	setUserAccessesConfig(znet, endpoints)
 
 	// accessible nodes deployments
 	for _, nodeID := range accessibleNodes {
@@ -166,7 +190,8 @@ func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, zn
 				workloads.WgIP(peerIPRange),
 			}
 
-			if peerNodeID == znet.PublicNodeID {
+			// backup public nodes reach the non accessible ranges through their own peers
+			if peerNodeID == znet.PublicNodeID && !workloads.Contains(znet.BackupPublicNodeIDs, nodeID) {
 				allowedIPs = append(allowedIPs, nonAccessibleIPRanges...)
 			}
 
@@ -178,16 +203,29 @@ func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, zn
 			})
 		}
 
-		if nodeID == znet.PublicNodeID {
+		if workloads.Contains(znet.PublicNodes(), nodeID) {
 			// external node
 			if znet.AddWGAccess {
 				peers = append(peers, zos.Peer{
 					Subnet:      *znet.ExternalIP,
-					WGPublicKey: znet.ExternalSK.PublicKey().String(),
+					WGPublicKey: znet.ExternalPublicKey().String(),
 					AllowedIPs:  []gridtypes.IPNet{*znet.ExternalIP, workloads.WgIP(*znet.ExternalIP)},
 				})
 			}
 
+			// named user accesses
+			for _, access := range znet.UserAccesses {
+				publicKey, err := access.PublicKey()
+				if err != nil {
+					return nil, err
+				}
+				peers = append(peers, zos.Peer{
+					Subnet:      access.Subnet,
+					WGPublicKey: publicKey.String(),
+					AllowedIPs:  []gridtypes.IPNet{access.Subnet, workloads.WgIP(access.Subnet)},
+				})
+			}
+
 			// hidden nodes
 			for _, peerNodeID := range hiddenNodes {
 				peerIPRange := znet.NodesIPRange[peerNodeID]
@@ -224,11 +262,25 @@ func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, zn
 				Subnet:      znet.NodesIPRange[nodeID],
 				AllowedIPs: []gridtypes.IPNet{
 					znet.IPRange,
-					workloads.IPNet(100, 64, 0, 0, 16),
+					workloads.WgIPRange(znet.IPRange),
 				},
 				Endpoint: fmt.Sprintf("%s:%d", endpoints[znet.PublicNodeID], znet.WGPort[znet.PublicNodeID]),
 			})
 		}
+		// wireguard routes an ip range through one peer only, so the backup public nodes are only used to reach their own subnets
+		// until one of them replaces a dead public node
+		for _, publicNode := range znet.BackupPublicNodeIDs {
+			peerIPRange := znet.NodesIPRange[publicNode]
+			peers = append(peers, zos.Peer{
+				WGPublicKey: znet.Keys[publicNode].PublicKey().String(),
+				Subnet:      znet.NodesIPRange[nodeID],
+				AllowedIPs: []gridtypes.IPNet{
+					peerIPRange,
+					workloads.WgIP(peerIPRange),
+				},
+				Endpoint: fmt.Sprintf("%s:%d", endpoints[publicNode], znet.WGPort[publicNode]),
+			})
+		}
 		workload := znet.ZosWorkload(znet.NodesIPRange[nodeID], znet.Keys[nodeID].String(), uint16(znet.WGPort[nodeID]), peers)
 		deployment := workloads.NewGridDeployment(d.tfPluginClient.TwinID, []gridtypes.Workload{workload})
 
@@ -244,6 +296,37 @@ func (d *NetworkDeployer) GenerateVersionlessDeployments(ctx context.Context, zn
 	return deployments, nil
 }
 
+// assignPublicNodes keeps the network public nodes and assigns new ones until the network has PublicNodesCount public nodes.
+// the network nodes with ipv4 endpoints are preferred over the other grid public nodes
+func (d *NetworkDeployer) assignPublicNodes(ctx context.Context, znet *workloads.ZNet, ipv4Nodes []uint32) error {
+	count := znet.PublicNodesCount
+	if count < 1 {
+		count = 1
+	}
+
+	publicNodes := znet.PublicNodes()
+	for _, nodeID := range ipv4Nodes {
+		if len(publicNodes) >= count {
+			break
+		}
+		if !workloads.Contains(publicNodes, nodeID) {
+			publicNodes = append(publicNodes, nodeID)
+		}
+	}
+
+	if len(publicNodes) < count {
+		nodes, err := getPublicNodes(ctx, d.tfPluginClient.GridProxyClient, d.tfPluginClient.SubstrateConn, d.tfPluginClient.NcPool, publicNodes, count-len(publicNodes))
+		if err != nil {
+			return err
+		}
+		publicNodes = append(publicNodes, nodes...)
+	}
+
+	znet.PublicNodeID = publicNodes[0]
+	znet.BackupPublicNodeIDs = publicNodes[1:count]
+	return nil
+}
+
 // Deploy deploys the network deployments using the deployer
 func (d *NetworkDeployer) Deploy(ctx context.Context, znet *workloads.ZNet) error {
 	err := d.Validate(ctx, znet)
@@ -251,15 +334,31 @@ func (d *NetworkDeployer) Deploy(ctx context.Context, znet *workloads.ZNet) erro
 		return err
 	}
 
-	newDeployments, err := d.GenerateVersionlessDeployments(ctx, znet)
+	err = d.retryWGPortClashes(znet, func() (map[uint32]int, error) {
+		return d.deploy(ctx, znet)
+	})
 	if err != nil {
-		return errors.Wrap(err, "could not generate deployments data")
+		return err
+	}
+
+	if err := d.ReadNodesConfig(ctx, znet); err != nil {
+		return errors.Wrap(err, "could not read node's data")
+	}
+
+	return nil
+}
+
+// deploy generates the network deployments and deploys them, it returns the wireguard ports reserved for the deployments
+func (d *NetworkDeployer) deploy(ctx context.Context, znet *workloads.ZNet) (map[uint32]int, error) {
+	newDeployments, reservedPorts, err := d.generateDeployments(ctx, znet)
+	if err != nil {
+		return reservedPorts, errors.Wrap(err, "could not generate deployments data")
 	}
 
 	log.Debug().Msg("new deployments")
 	err = PrintDeployments(newDeployments)
 	if err != nil {
-		return errors.Wrap(err, "could not print deployments data")
+		return reservedPorts, errors.Wrap(err, "could not print deployments data")
 	}
 
 	newDeploymentsSolutionProvider := make(map[uint32]*uint64)
@@ -268,22 +367,399 @@ func (d *NetworkDeployer) Deploy(ctx context.Context, znet *workloads.ZNet) erro
 		newDeploymentsSolutionProvider[nodeID] = nil
 	}
 
+	oldDeploymentIDs := znet.NodeDeploymentID
 	znet.NodeDeploymentID, err = d.deployer.Deploy(ctx, znet.NodeDeploymentID, newDeployments, newDeploymentsSolutionProvider)
 
-	// update deployment and plugin state
 	// error is not returned immediately before updating state because of untracked failed deployments
-	for _, nodeID := range znet.Nodes {
-		if contractID, ok := znet.NodeDeploymentID[nodeID]; ok && contractID != 0 {
-			d.tfPluginClient.State.networks.UpdateNetwork(znet.Name, znet.NodesIPRange)
-			if !workloads.Contains(d.tfPluginClient.State.CurrentNodeDeployments[nodeID], znet.NodeDeploymentID[nodeID]) {
-				d.tfPluginClient.State.CurrentNodeNetworks[nodeID] = append(d.tfPluginClient.State.CurrentNodeNetworks[nodeID], znet.NodeDeploymentID[nodeID])
+	return reservedPorts, d.updateState(znet, oldDeploymentIDs, err)
+}
+
+// generateDeployments generates the network deployments and returns the wireguard ports reserved for the nodes that had no ports,
+// the ports should be released once the deployments are deployed
+func (d *NetworkDeployer) generateDeployments(ctx context.Context, znet *workloads.ZNet) (map[uint32]gridtypes.Deployment, map[uint32]int, error) {
+	oldPorts := make(map[uint32]int)
+	for nodeID, port := range znet.WGPort {
+		oldPorts[nodeID] = port
+	}
+
+	deployments, err := d.generateVersionlessDeployments(ctx, znet)
+
+	reservedPorts := make(map[uint32]int)
+	for nodeID, port := range znet.WGPort {
+		if oldPort, ok := oldPorts[nodeID]; !ok || oldPort != port {
+			reservedPorts[nodeID] = port
+		}
+	}
+	return deployments, reservedPorts, err
+}
+
+// releaseWGPorts releases the local reservations of nodes wireguard ports
+func (d *NetworkDeployer) releaseWGPorts(ports map[uint32]int) {
+	for nodeID, port := range ports {
+		d.wgPorts.Release(nodeID, port)
+	}
+}
+
+// retryWGPortClashes deploys the network again with new wireguard ports if a node rejects one of the ports reserved by the deploy.
+// nodes that are deployed keep their ports, and the ports reserved by all the tries are released after the last one
+func (d *NetworkDeployer) retryWGPortClashes(znet *workloads.ZNet, deploy func() (map[uint32]int, error)) error {
+	reserved := make([]map[uint32]int, 0)
+	defer func() {
+		for _, ports := range reserved {
+			d.releaseWGPorts(ports)
+		}
+	}()
+
+	for try := 0; ; try++ {
+		ports, err := deploy()
+		reserved = append(reserved, ports)
+		if err == nil || try >= d.wgPortRetries || len(ports) == 0 || !isWGPortClash(err) {
+			return err
+		}
+
+		log.Warn().Err(err).Msgf("retrying network %s deployment with new wireguard ports", znet.Name)
+		for nodeID := range ports {
+			if _, ok := znet.NodeDeploymentID[nodeID]; !ok {
+				delete(znet.WGPort, nodeID)
 			}
 		}
 	}
+}
 
-	if err != nil {
+// isWGPortClash returns true if the error is caused by a wireguard port that is already used on a node
+func isWGPortClash(err error) bool {
+	for _, clash := range wgPortClashErrors {
+		if strings.Contains(err.Error(), clash) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateState updates the deployment and plugin state with the network contracts after deploying it, then saves the state
+func (d *NetworkDeployer) updateState(znet *workloads.ZNet, oldDeploymentIDs map[uint32]uint64, deployErr error) error {
+	for nodeID, contractID := range canceledContracts(oldDeploymentIDs, znet.NodeDeploymentID) {
+		d.tfPluginClient.State.removeNetworkContract(nodeID, contractID)
+		if _, ok := znet.NodeDeploymentID[nodeID]; !ok {
+			// the node was removed from the network, its subnet and keys are free now
+			delete(znet.NodesIPRange, nodeID)
+			delete(znet.Keys, nodeID)
+			delete(znet.WGPort, nodeID)
+		}
+	}
+
+	// the public node contract is tracked too even if it's not one of the network nodes, so the network can be loaded from the grid
+	for nodeID, contractID := range znet.NodeDeploymentID {
+		if contractID != 0 {
+			d.tfPluginClient.State.updateNetworks(func(networks NetworkState) {
+				networks.UpdateNetwork(znet.Name, znet.NodesIPRange)
+				networks.setAccessKeys(znet.Name, accessKeys(znet))
+			})
+			d.tfPluginClient.State.addNetworkContract(nodeID, contractID)
+		}
+	}
+
+	if err := d.tfPluginClient.State.saveAfter(deployErr); err != nil {
 		return errors.Wrapf(err, "could not deploy network %s", znet.Name)
 	}
+	return nil
+}
+
+// Plan returns the changes deploying the network would apply, without changing any contract
+// missing IPs, keys and ports are assigned the same way Deploy assigns them, to a copy of the network which is left unchanged
+func (d *NetworkDeployer) Plan(ctx context.Context, znet *workloads.ZNet) (Plan, error) {
+	planned := copyZNet(znet)
+	znet = &planned
+
+	err := d.Validate(ctx, znet)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	newDeployments, reservedPorts, err := d.generateDeployments(ctx, znet)
+	defer d.releaseWGPorts(reservedPorts)
+	if err != nil {
+		return Plan{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	return planDeployments(ctx, d.deployer, znet.NodeDeploymentID, newDeployments)
+}
+
+// DetectDrift reports the differences between the network and what is live on the grid, without changing the network.
+// the desired deployments are generated from a copy of the network which is left unchanged
+func (d *NetworkDeployer) DetectDrift(ctx context.Context, znet *workloads.ZNet) (DriftReport, error) {
+	desired := copyZNet(znet)
+	znet = &desired
+
+	desiredDeployments, reservedPorts, err := d.generateDeployments(ctx, znet)
+	defer d.releaseWGPorts(reservedPorts)
+	if err != nil {
+		return DriftReport{}, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	return d.deployer.DetectDrift(ctx, znet.NodeDeploymentID, desiredDeployments)
+}
+
+// AddNodes adds nodes to a deployed network. the existing nodes keep their subnets, wireguard keys and ports,
+// and only the contracts of the new nodes and of the nodes whose peers change, like the public access node, are updated
+func (d *NetworkDeployer) AddNodes(ctx context.Context, znet *workloads.ZNet, nodes []uint32) error {
+	for _, nodeID := range nodes {
+		if !workloads.Contains(znet.Nodes, nodeID) {
+			znet.Nodes = append(znet.Nodes, nodeID)
+		}
+	}
+
+	return d.deployChangedNodes(ctx, znet)
+}
+
+// RemoveNodes removes nodes from a deployed network, their contracts are canceled and only the contracts of the nodes
+// whose peers change, like the public access node, are updated. nodes with deployments using the network can't be removed
+func (d *NetworkDeployer) RemoveNodes(ctx context.Context, znet *workloads.ZNet, nodes []uint32) error {
+	network := d.tfPluginClient.State.GetNetworks().GetNetwork(znet.Name)
+	for _, nodeID := range nodes {
+		if len(network.getUsedNetworkHostIDs(nodeID)) != 0 {
+			return fmt.Errorf("could not remove node %d from network %s, it has deployments using the network", nodeID, znet.Name)
+		}
+	}
+
+	remaining := make([]uint32, 0, len(znet.Nodes))
+	for _, nodeID := range znet.Nodes {
+		if !workloads.Contains(nodes, nodeID) {
+			remaining = append(remaining, nodeID)
+		}
+	}
+	znet.Nodes = remaining
+
+	// new public nodes are assigned if the network still needs them
+	removePublicNodes(znet, nodes)
+
+	return d.deployChangedNodes(ctx, znet)
+}
+
+// AddUserAccess adds a named user access to a deployed network and returns it with its wireguard config.
+// the other user accesses keep their subnets and keys, and only the public node and the nodes routing to the public node are updated
+func (d *NetworkDeployer) AddUserAccess(ctx context.Context, znet *workloads.ZNet, name string) (workloads.UserAccess, error) {
+	for _, access := range znet.UserAccesses {
+		if access.Name == name {
+			return workloads.UserAccess{}, fmt.Errorf("user access %s already exists in network %s", name, znet.Name)
+		}
+	}
+	znet.UserAccesses = append(znet.UserAccesses, workloads.UserAccess{Name: name})
+
+	if err := d.deployChangedNodes(ctx, znet); err != nil {
+		return workloads.UserAccess{}, err
+	}
+
+	for _, access := range znet.UserAccesses {
+		if access.Name == name {
+			return access, nil
+		}
+	}
+	return workloads.UserAccess{}, fmt.Errorf("could not find user access %s in network %s", name, znet.Name)
+}
+
+// RevokeUserAccess removes a named user access from a deployed network, its subnet is free to be used again
+func (d *NetworkDeployer) RevokeUserAccess(ctx context.Context, znet *workloads.ZNet, name string) error {
+	accesses := make([]workloads.UserAccess, 0, len(znet.UserAccesses))
+	for _, access := range znet.UserAccesses {
+		if access.Name != name {
+			accesses = append(accesses, access)
+		}
+	}
+	if len(accesses) == len(znet.UserAccesses) {
+		return fmt.Errorf("could not find user access %s in network %s", name, znet.Name)
+	}
+	znet.UserAccesses = accesses
+
+	return d.deployChangedNodes(ctx, znet)
+}
+
+// KeyRotation selects the wireguard keys of a network to rotate
+type KeyRotation struct {
+	// Nodes are the nodes whose keys are rotated
+	Nodes []uint32
+	// Access rotates the key of the user access of AddWGAccess
+	Access bool
+	// UserAccesses are the names of the user accesses whose keys are rotated
+	UserAccesses []string
+}
+
+// RotateKeys generates new wireguard keys for the selected nodes and user accesses of a deployed network,
+// then updates the nodes deployments with the new keys and peers together, and returns the new AccessWGConfig.
+// the user accesses configs are regenerated in the network UserAccesses. if the update fails the old keys are restored
+// only if no node deployment was changed, otherwise the new keys are kept and an error says the rotation is partially applied
+func (d *NetworkDeployer) RotateKeys(ctx context.Context, znet *workloads.ZNet, rotation KeyRotation) (string, error) {
+	for _, nodeID := range rotation.Nodes {
+		if _, ok := znet.Keys[nodeID]; !ok {
+			return "", fmt.Errorf("could not rotate node %d key, it has no key in network %s", nodeID, znet.Name)
+		}
+	}
+	if rotation.Access && !znet.AddWGAccess {
+		return "", fmt.Errorf("could not rotate access key, network %s has no wireguard access", znet.Name)
+	}
+	names := make([]string, 0, len(znet.UserAccesses))
+	for _, access := range znet.UserAccesses {
+		names = append(names, access.Name)
+	}
+	for _, name := range rotation.UserAccesses {
+		if !workloads.Contains(names, name) {
+			return "", fmt.Errorf("could not find user access %s in network %s", name, znet.Name)
+		}
+	}
+
+	oldKeys := make(map[uint32]wgtypes.Key)
+	for nodeID, key := range znet.Keys {
+		oldKeys[nodeID] = key
+	}
+	oldExternalSK, oldExternalPK := znet.ExternalSK, znet.ExternalPK
+	oldUserAccesses := append([]workloads.UserAccess{}, znet.UserAccesses...)
+	oldDeploymentIDs := make(map[uint32]uint64)
+	for nodeID, contractID := range znet.NodeDeploymentID {
+		oldDeploymentIDs[nodeID] = contractID
+	}
+	oldVersions, err := d.deploymentsVersions(ctx, oldDeploymentIDs)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not get network %s deployments", znet.Name)
+	}
+
+	if err := rotateKeys(znet, rotation); err != nil {
+		return "", err
+	}
+
+	if err := d.deployChangedNodes(ctx, znet); err != nil {
+		if d.deploymentsChanged(ctx, oldDeploymentIDs, oldVersions, znet.NodeDeploymentID) {
+			return "", errors.Wrapf(err, "key rotation of network %s is partially applied, some nodes have the new keys", znet.Name)
+		}
+		znet.Keys = oldKeys
+		znet.ExternalSK, znet.ExternalPK = oldExternalSK, oldExternalPK
+		znet.UserAccesses = oldUserAccesses
+		return "", err
+	}
+
+	return znet.AccessWGConfig, nil
+}
+
+// deploymentsVersions returns the versions of the nodes deployments
+func (d *NetworkDeployer) deploymentsVersions(ctx context.Context, nodeDeploymentID map[uint32]uint64) (map[uint32]uint32, error) {
+	dls, err := d.deployer.GetDeployments(ctx, nodeDeploymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[uint32]uint32)
+	for nodeID, dl := range dls {
+		versions[nodeID] = dl.Version
+	}
+	return versions, nil
+}
+
+// deploymentsChanged checks if any node contract was created, canceled or updated after a failed deploy.
+// it assumes they changed if their versions can't be loaded, so the caller never drops keys that may be deployed
+func (d *NetworkDeployer) deploymentsChanged(ctx context.Context, oldDeploymentIDs map[uint32]uint64, oldVersions map[uint32]uint32, nodeDeploymentID map[uint32]uint64) bool {
+	if !reflect.DeepEqual(oldDeploymentIDs, nodeDeploymentID) {
+		return true
+	}
+
+	versions, err := d.deploymentsVersions(ctx, nodeDeploymentID)
+	if err != nil {
+		log.Error().Err(err).Msg("could not get the network deployments versions")
+		return true
+	}
+	return !reflect.DeepEqual(oldVersions, versions)
+}
+
+// rotateKeys replaces the selected keys of the network with new ones
+func rotateKeys(znet *workloads.ZNet, rotation KeyRotation) error {
+	for _, nodeID := range rotation.Nodes {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate wg private key")
+		}
+		znet.Keys[nodeID] = key
+	}
+
+	if rotation.Access {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate wg private key")
+		}
+		znet.ExternalSK = key
+		znet.ExternalPK = key.PublicKey()
+	}
+
+	for i := range znet.UserAccesses {
+		if !workloads.Contains(rotation.UserAccesses, znet.UserAccesses[i].Name) {
+			continue
+		}
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate wg private key")
+		}
+		znet.UserAccesses[i].UserSecretKey = key.String()
+		znet.UserAccesses[i].UserPublicKey = key.PublicKey().String()
+	}
+	return nil
+}
+
+// FailoverPublicNodes replaces the network public nodes that are down, the public nodes that are up are kept with their subnets, keys and ports.
+// if PublicNodeID is down, the first backup public node that is up replaces it and a new backup public node is assigned
+func (d *NetworkDeployer) FailoverPublicNodes(ctx context.Context, znet *workloads.ZNet) error {
+	downNodes := d.downPublicNodes(ctx, znet)
+	if len(downNodes) == 0 {
+		return nil
+	}
+	log.Info().Msgf("replacing public nodes %v of network %s", downNodes, znet.Name)
+
+	removePublicNodes(znet, downNodes)
+	return d.deployChangedNodes(ctx, znet)
+}
+
+// downPublicNodes returns the network public nodes that are down
+func (d *NetworkDeployer) downPublicNodes(ctx context.Context, znet *workloads.ZNet) []uint32 {
+	downNodes := make([]uint32, 0)
+	for _, nodeID := range znet.PublicNodes() {
+		cl, err := d.tfPluginClient.NcPool.GetNodeClient(d.tfPluginClient.SubstrateConn, nodeID)
+		if err != nil {
+			downNodes = append(downNodes, nodeID)
+			continue
+		}
+		if err := cl.IsNodeUp(ctx); err != nil {
+			downNodes = append(downNodes, nodeID)
+		}
+	}
+	return downNodes
+}
+
+// removePublicNodes removes nodes from the network public nodes, the first remaining backup public node replaces a removed PublicNodeID
+func removePublicNodes(znet *workloads.ZNet, nodes []uint32) {
+	publicNodes := make([]uint32, 0)
+	for _, nodeID := range znet.PublicNodes() {
+		if !workloads.Contains(nodes, nodeID) {
+			publicNodes = append(publicNodes, nodeID)
+		}
+	}
+
+	znet.PublicNodeID = 0
+	znet.BackupPublicNodeIDs = nil
+	if len(publicNodes) != 0 {
+		znet.PublicNodeID = publicNodes[0]
+		znet.BackupPublicNodeIDs = publicNodes[1:]
+	}
+}
+
+// deployChangedNodes deploys the network nodes whose deployments differ from the deployed ones, and cancels the contracts of the removed nodes.
+// the other nodes contracts are not touched
+func (d *NetworkDeployer) deployChangedNodes(ctx context.Context, znet *workloads.ZNet) error {
+	if err := d.Validate(ctx, znet); err != nil {
+		return err
+	}
+
+	err := d.retryWGPortClashes(znet, func() (map[uint32]int, error) {
+		return d.deployChanges(ctx, znet)
+	})
+	if err != nil {
+		return err
+	}
 
 	if err := d.ReadNodesConfig(ctx, znet); err != nil {
 		return errors.Wrap(err, "could not read node's data")
@@ -292,6 +768,57 @@ func (d *NetworkDeployer) Deploy(ctx context.Context, znet *workloads.ZNet) erro
 	return nil
 }
 
+// deployChanges generates the network deployments and deploys the changed ones, it returns the wireguard ports reserved for the deployments
+func (d *NetworkDeployer) deployChanges(ctx context.Context, znet *workloads.ZNet) (map[uint32]int, error) {
+	newDeployments, reservedPorts, err := d.generateDeployments(ctx, znet)
+	if err != nil {
+		return reservedPorts, errors.Wrap(err, "could not generate deployments data")
+	}
+
+	plan, err := planDeployments(ctx, d.deployer, znet.NodeDeploymentID, newDeployments)
+	if err != nil {
+		return reservedPorts, err
+	}
+
+	changedDeploymentIDs := make(map[uint32]uint64)
+	changedDeployments := make(map[uint32]gridtypes.Deployment)
+	changedDeploymentsSolutionProvider := make(map[uint32]*uint64)
+	for _, nodePlan := range plan.Nodes {
+		if nodePlan.Action == NodeNoop {
+			continue
+		}
+		if nodePlan.ContractID != 0 {
+			changedDeploymentIDs[nodePlan.NodeID] = nodePlan.ContractID
+		}
+		if dl, ok := newDeployments[nodePlan.NodeID]; ok {
+			changedDeployments[nodePlan.NodeID] = dl
+			changedDeploymentsSolutionProvider[nodePlan.NodeID] = nil
+		}
+	}
+	log.Debug().Msgf("changed network nodes: %s", plan)
+
+	oldDeploymentIDs := make(map[uint32]uint64)
+	for nodeID, contractID := range znet.NodeDeploymentID {
+		oldDeploymentIDs[nodeID] = contractID
+	}
+
+	deploymentIDs, err := d.deployer.Deploy(ctx, changedDeploymentIDs, changedDeployments, changedDeploymentsSolutionProvider)
+
+	nodeDeploymentID := make(map[uint32]uint64)
+	for nodeID, contractID := range oldDeploymentIDs {
+		if _, ok := changedDeploymentIDs[nodeID]; !ok {
+			nodeDeploymentID[nodeID] = contractID
+		}
+	}
+	for nodeID, contractID := range deploymentIDs {
+		nodeDeploymentID[nodeID] = contractID
+	}
+	znet.NodeDeploymentID = nodeDeploymentID
+
+	// error is not returned immediately before updating state because of untracked failed deployments
+	return reservedPorts, d.updateState(znet, oldDeploymentIDs, err)
+}
+
 // Cancel cancels all the deployments
 func (d *NetworkDeployer) Cancel(ctx context.Context, znet *workloads.ZNet) error {
 	err := d.Validate(ctx, znet)
@@ -299,19 +826,23 @@ func (d *NetworkDeployer) Cancel(ctx context.Context, znet *workloads.ZNet) erro
 		return err
 	}
 
+	// the public and backup public nodes contracts are canceled too, they are not in the network nodes
 	for nodeID, contractID := range znet.NodeDeploymentID {
-		if workloads.Contains(znet.Nodes, nodeID) {
-			err = d.deployer.Cancel(ctx, contractID)
-			if err != nil {
-				return errors.Wrapf(err, "could not cancel network %s, contract %d", znet.Name, contractID)
-			}
-			delete(znet.NodeDeploymentID, nodeID)
-			d.tfPluginClient.State.CurrentNodeDeployments[nodeID] = workloads.Delete(d.tfPluginClient.State.CurrentNodeDeployments[nodeID], contractID)
+		err = d.deployer.Cancel(ctx, contractID)
+		if err != nil {
+			return d.tfPluginClient.State.saveAfter(errors.Wrapf(err, "could not cancel network %s, contract %d", znet.Name, contractID))
 		}
+		delete(znet.NodeDeploymentID, nodeID)
+		d.tfPluginClient.State.removeNetworkContract(nodeID, contractID)
 	}
 
 	// delete network from state if all contracts was deleted
-	d.tfPluginClient.State.networks.DeleteNetwork(znet.Name)
+	d.tfPluginClient.State.updateNetworks(func(networks NetworkState) {
+		networks.DeleteNetwork(znet.Name)
+	})
+	if err := d.tfPluginClient.State.Save(); err != nil {
+		return err
+	}
 
 	if err := d.ReadNodesConfig(ctx, znet); err != nil {
 		return errors.Wrap(err, "could not read node's data")
@@ -336,22 +867,19 @@ func (d *NetworkDeployer) InvalidateBrokenAttributes(znet *workloads.ZNet) error
 	if znet.ExternalIP != nil && !znet.IPRange.Contains(znet.ExternalIP.IP) {
 		znet.ExternalIP = nil
 	}
+	for i := range znet.UserAccesses {
+		if subnet := znet.UserAccesses[i].Subnet; subnet.IP != nil && !znet.IPRange.Contains(subnet.IP) {
+			znet.UserAccesses[i].Subnet = gridtypes.IPNet{}
+		}
+	}
 	for node, ip := range znet.NodesIPRange {
 		if !znet.IPRange.Contains(ip.IP) {
 			delete(znet.NodesIPRange, node)
 		}
 	}
-	if znet.PublicNodeID != 0 {
-		// TODO: add a check that the node is still public
-		cl, err := d.tfPluginClient.NcPool.GetNodeClient(d.tfPluginClient.SubstrateConn, znet.PublicNodeID)
-		if err != nil {
-			// whatever the error, delete it and it will get reassigned later
-			znet.PublicNodeID = 0
-		}
-		if err := cl.IsNodeUp(context.Background()); err != nil {
-			znet.PublicNodeID = 0
-		}
-	}
+	// TODO: add a check that the public nodes are still public
+	// whatever the error, the public nodes that are down are removed and they will get reassigned later
+	removePublicNodes(znet, d.downPublicNodes(context.Background(), znet))
 
 	if !znet.AddWGAccess {
 		znet.ExternalIP = nil
@@ -392,11 +920,8 @@ func (d *NetworkDeployer) ReadNodesConfig(ctx context.Context, znet *workloads.Z
 				return errors.Wrap(err, "could not parse wg private key from workload object")
 			}
 			nodesIPRange[node] = d.Subnet
-			// this will fail when hidden node is supported
-			for _, peer := range d.Peers {
-				if peer.Endpoint == "" {
-					WGAccess = true
-				}
+			if hasUserAccess(wl, d.Peers) {
+				WGAccess = true
 			}
 		}
 	}
@@ -409,3 +934,174 @@ func (d *NetworkDeployer) ReadNodesConfig(ctx context.Context, znet *workloads.Z
 	}
 	return nil
 }
+
+// hasUserAccess returns true if a network workload has the user access of AddWGAccess in its metadata.
+// workloads deployed without metadata have it if a peer has no endpoint, which is true for hidden nodes peers as well
+func hasUserAccess(wl gridtypes.Workload, peers []zos.Peer) bool {
+	var metadata workloads.NetworkMetaData
+	if err := json.Unmarshal([]byte(wl.Metadata), &metadata); err == nil && metadata.Version != 0 {
+		for _, access := range metadata.UserAccesses {
+			if access.Name == "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, peer := range peers {
+		if peer.Endpoint == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// setUserAccessesConfig sets the public node data and the wireguard config of the network named user accesses,
+// the accesses whose private keys are not known have no wireguard config
+func setUserAccessesConfig(znet *workloads.ZNet, endpoints map[uint32]string) {
+	for i := range znet.UserAccesses {
+		access := &znet.UserAccesses[i]
+		access.UserAddress = workloads.WgIP(access.Subnet).IP.String()
+		access.PublicNodePK = znet.Keys[znet.PublicNodeID].PublicKey().String()
+		access.PublicNodeEndpoint = fmt.Sprintf("%s:%d", endpoints[znet.PublicNodeID], znet.WGPort[znet.PublicNodeID])
+		access.AllowedIPs = networkAllowedIPs(znet)
+
+		access.WGConfig = ""
+		if access.UserSecretKey != "" {
+			config := userAccessWGConfig(znet, access.UserAddress, access.UserSecretKey, endpoints)
+			access.WGConfig = config.Render()
+		}
+	}
+}
+
+// userAccessWGConfig builds the wireguard config of a user access with a peer for each of the network public nodes.
+// the primary public node routes the whole network, and the backup public nodes only route their own subnets
+func userAccessWGConfig(znet *workloads.ZNet, address, privateKey string, endpoints map[uint32]string) workloads.WGConfig {
+	config := workloads.WGConfig{
+		Interface: workloads.WGInterface{
+			PrivateKey: privateKey,
+			Addresses:  []string{address},
+			DNS:        znet.AccessDNS,
+			MTU:        znet.AccessMTU,
+		},
+		Peers: []workloads.WGPeer{{
+			PublicKey:           znet.Keys[znet.PublicNodeID].PublicKey().String(),
+			AllowedIPs:          networkAllowedIPs(znet),
+			Endpoint:            fmt.Sprintf("%s:%d", endpoints[znet.PublicNodeID], znet.WGPort[znet.PublicNodeID]),
+			PersistentKeepalive: workloads.DefaultPersistentKeepalive,
+		}},
+	}
+
+	for _, nodeID := range znet.BackupPublicNodeIDs {
+		ipRange := znet.NodesIPRange[nodeID]
+		config.Peers = append(config.Peers, workloads.WGPeer{
+			PublicKey:           znet.Keys[nodeID].PublicKey().String(),
+			AllowedIPs:          []string{ipRange.String(), workloads.WgIP(ipRange).String()},
+			Endpoint:            fmt.Sprintf("%s:%d", endpoints[nodeID], znet.WGPort[nodeID]),
+			PersistentKeepalive: workloads.DefaultPersistentKeepalive,
+		})
+	}
+	return config
+}
+
+// networkAllowedIPs returns the ranges a user access routes through the network, which are the network ip range and its wireguard ips
+func networkAllowedIPs(znet *workloads.ZNet) []string {
+	return []string{znet.IPRange.String(), workloads.WgIPRange(znet.IPRange).String()}
+}
+
+// publicNodesEndpoints returns the wireguard endpoint hosts of the network public nodes
+func publicNodesEndpoints(ctx context.Context, sub subi.SubstrateExt, ncPool client.NodeClientGetter, znet *workloads.ZNet) (map[uint32]string, error) {
+	endpoints := make(map[uint32]string)
+	for _, nodeID := range znet.PublicNodes() {
+		nodeClient, err := ncPool.GetNodeClient(sub, nodeID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get node client: %d", nodeID)
+		}
+		endpoint, err := nodeClient.GetNodeEndpoint(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get node %d endpoint", nodeID)
+		}
+		endpoints[nodeID] = wgEndpointHost(endpoint)
+	}
+	return endpoints, nil
+}
+
+// wgEndpointHost returns the host of a node wireguard endpoint, ipv6 addresses are enclosed in brackets
+func wgEndpointHost(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return fmt.Sprintf("[%s]", ip.String())
+}
+
+// accessKeys returns the known private keys of the network user accesses by name, the access of AddWGAccess has an empty name
+func accessKeys(znet *workloads.ZNet) map[string]string {
+	keys := make(map[string]string)
+	if znet.AddWGAccess && znet.ExternalSK != (wgtypes.Key{}) {
+		keys[""] = znet.ExternalSK.String()
+	}
+	for _, access := range znet.UserAccesses {
+		if access.UserSecretKey != "" {
+			keys[access.Name] = access.UserSecretKey
+		}
+	}
+	return keys
+}
+
+// setAccessKeys sets the private keys of the network user accesses that are not known, if their public keys match
+func setAccessKeys(znet *workloads.ZNet, keys map[string]string) {
+	matches := func(secret string, publicKey wgtypes.Key) (wgtypes.Key, bool) {
+		key, err := wgtypes.ParseKey(secret)
+		return key, err == nil && key.PublicKey() == publicKey
+	}
+
+	if secret, ok := keys[""]; ok && znet.AddWGAccess && znet.ExternalSK == (wgtypes.Key{}) {
+		if key, ok := matches(secret, znet.ExternalPK); ok {
+			znet.ExternalSK = key
+		}
+	}
+	for i := range znet.UserAccesses {
+		access := &znet.UserAccesses[i]
+		secret, ok := keys[access.Name]
+		if !ok || access.UserSecretKey != "" {
+			continue
+		}
+		if publicKey, err := access.PublicKey(); err == nil {
+			if _, ok := matches(secret, publicKey); ok {
+				access.UserSecretKey = secret
+			}
+		}
+	}
+}
+
+// SetAccessWGConfigs sets the wireguard configs of the network user accesses, it's used with networks loaded from the grid
+// after setting ExternalSK or the UserSecretKey of the user accesses, since the network workloads only have their public keys
+func (d *NetworkDeployer) SetAccessWGConfigs(ctx context.Context, znet *workloads.ZNet) error {
+	return setAccessWGConfigs(ctx, d.tfPluginClient.SubstrateConn, d.tfPluginClient.NcPool, znet)
+}
+
+// setAccessWGConfigs sets the wireguard configs of the network user accesses using the endpoints of the public nodes
+func setAccessWGConfigs(ctx context.Context, sub subi.SubstrateExt, ncPool client.NodeClientGetter, znet *workloads.ZNet) error {
+	if !znet.AddWGAccess && len(znet.UserAccesses) == 0 {
+		return nil
+	}
+
+	endpoints, err := publicNodesEndpoints(ctx, sub, ncPool, znet)
+	if err != nil {
+		return err
+	}
+	if znet.AddWGAccess {
+		znet.AccessWGConfig = accessWGConfig(znet, endpoints)
+	}
+	setUserAccessesConfig(znet, endpoints)
+	return nil
+}
+
+// accessWGConfig generates the wireguard config of the network user access through its public nodes, it's empty if ExternalSK is not known
+func accessWGConfig(znet *workloads.ZNet, endpoints map[uint32]string) string {
+	if znet.ExternalSK == (wgtypes.Key{}) {
+		return ""
+	}
+	config := userAccessWGConfig(znet, workloads.WgIP(*znet.ExternalIP).IP.String(), znet.ExternalSK.String(), endpoints)
+	return config.Render()
+}
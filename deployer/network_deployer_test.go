@@ -3,16 +3,22 @@ package deployer
 
 import (
 	"context"
+	"errors"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/threefoldtech/grid3-go/mocks"
 	client "github.com/threefoldtech/grid3-go/node"
+	"github.com/threefoldtech/grid3-go/subi"
 	"github.com/threefoldtech/grid3-go/workloads"
+	proxyTypes "github.com/threefoldtech/grid_proxy_server/pkg/types"
+	"github.com/threefoldtech/substrate-client"
 	"github.com/threefoldtech/zos/pkg/gridtypes"
 	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func constructTestNetwork() workloads.ZNet {
@@ -109,3 +115,771 @@ func TestNetworkDeployer(t *testing.T) {
 		})
 	})
 }
+
+func TestNetworkDeployerNodes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tfPluginClient, sub, ncPool, cl := setupMockedPluginClient(ctrl)
+	deployer := mocks.NewMockDeployer(ctrl)
+
+	d := NewNetworkDeployer(tfPluginClient)
+	d.deployer = deployer
+
+	sub.EXPECT().
+		GetContract(gomock.Any()).
+		Return(subi.Contract{Contract: &substrate.Contract{State: substrate.ContractState{IsCreated: true}}}, nil).
+		AnyTimes()
+
+	// node 1 is the public node, nodes 2 and 3 are hidden
+	for nodeID, twin := range map[uint32]uint32{1: 11, 2: 22, 3: 33} {
+		ncPool.EXPECT().
+			GetNodeClient(sub, nodeID).
+			Return(client.NewNodeClient(twin, cl, 10), nil).
+			AnyTimes()
+	}
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.system.version", gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.network.public_config_get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			if twin != 11 {
+				return errors.New("no public config")
+			}
+			*result.(*client.PublicConfig) = client.PublicConfig{IPv4: gridtypes.MustParseIPNet("1.1.1.1/24")}
+			return nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.network.interfaces", gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(33), "zos.network.list_wg_ports", gomock.Any(), gomock.Any()).
+		Return(nil)
+
+	keys := map[uint32]wgtypes.Key{}
+	for _, nodeID := range []uint32{1, 2} {
+		key, err := wgtypes.GenerateKey()
+		assert.NoError(t, err)
+		keys[nodeID] = key
+	}
+	znet := workloads.ZNet{
+		Name:         "network",
+		Nodes:        []uint32{1, 2},
+		IPRange:      gridtypes.MustParseIPNet("10.1.0.0/16"),
+		PublicNodeID: 1,
+		NodesIPRange: map[uint32]gridtypes.IPNet{
+			1: gridtypes.MustParseIPNet("10.1.2.0/24"),
+			2: gridtypes.MustParseIPNet("10.1.3.0/24"),
+		},
+		WGPort:           map[uint32]int{1: 1000, 2: 2000},
+		Keys:             keys,
+		NodeDeploymentID: map[uint32]uint64{1: 10, 2: 20},
+	}
+
+	current := znet
+	current.Nodes = append([]uint32{}, znet.Nodes...)
+	live, err := d.GenerateVersionlessDeployments(context.Background(), &current)
+	assert.NoError(t, err)
+	liveContracts := map[uint64]gridtypes.Deployment{10: live[1], 20: live[2]}
+
+	deployer.EXPECT().
+		GetDeployments(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, dls map[uint32]uint64) (map[uint32]gridtypes.Deployment, error) {
+			res := make(map[uint32]gridtypes.Deployment)
+			for nodeID, contractID := range dls {
+				res[nodeID] = liveContracts[contractID]
+			}
+			return res, nil
+		}).
+		AnyTimes()
+
+	tfPluginClient.State.SetNetworks(NetworkState{"network": Network{
+		Subnets:               map[uint32]string{1: "10.1.2.0/24", 2: "10.1.3.0/24"},
+		NodeDeploymentHostIDs: NodeDeploymentHostIDs{2: DeploymentHostIDs{200: {2}}},
+	}})
+
+	expectDeploy := func(oldDeploymentIDs map[uint32]uint64, nodes []uint32) {
+		deployer.EXPECT().
+			Deploy(gomock.Any(), oldDeploymentIDs, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, oldDeploymentIDs map[uint32]uint64, newDeployments map[uint32]gridtypes.Deployment, solutionProviders map[uint32]*uint64) (map[uint32]uint64, error) {
+				deployed := make([]uint32, 0, len(newDeployments))
+				res := make(map[uint32]uint64)
+				for nodeID, dl := range newDeployments {
+					deployed = append(deployed, nodeID)
+					res[nodeID] = uint64(nodeID) * 10
+					liveContracts[res[nodeID]] = dl
+				}
+				assert.ElementsMatch(t, nodes, deployed)
+				return res, nil
+			})
+	}
+
+	t.Run("add nodes", func(t *testing.T) {
+		// the hidden node 2 peers only with the public node, so it's not updated
+		expectDeploy(map[uint32]uint64{1: 10}, []uint32{1, 3})
+
+		err := d.AddNodes(context.Background(), &znet, []uint32{3})
+		assert.NoError(t, err)
+
+		assert.Equal(t, []uint32{1, 2, 3}, znet.Nodes)
+		assert.Equal(t, map[uint32]uint64{1: 10, 2: 20, 3: 30}, znet.NodeDeploymentID)
+		assert.Equal(t, keys[1], znet.Keys[1])
+		assert.Equal(t, keys[2], znet.Keys[2])
+		assert.Equal(t, 1000, znet.WGPort[1])
+		assert.Equal(t, 2000, znet.WGPort[2])
+
+		network := tfPluginClient.State.GetNetworks().GetNetwork("network")
+		assert.Equal(t, znet.NodesIPRange[3].String(), network.getNodeSubnet(3))
+		assert.Equal(t, HostIDs{2}, network.getUsedNetworkHostIDs(2))
+		assert.Equal(t, ContractIDs{30}, tfPluginClient.State.nodeNetworks()[3])
+	})
+
+	t.Run("remove nodes", func(t *testing.T) {
+		expectDeploy(map[uint32]uint64{1: 10, 3: 30}, []uint32{1})
+
+		err := d.RemoveNodes(context.Background(), &znet, []uint32{3})
+		assert.NoError(t, err)
+
+		assert.Equal(t, []uint32{1, 2}, znet.Nodes)
+		assert.Equal(t, map[uint32]uint64{1: 10, 2: 20}, znet.NodeDeploymentID)
+		assert.Equal(t, live[1], liveContracts[10])
+
+		network := tfPluginClient.State.GetNetworks().GetNetwork("network")
+		assert.Empty(t, network.getNodeSubnet(3))
+		assert.Empty(t, tfPluginClient.State.nodeNetworks()[3])
+	})
+
+	t.Run("user accesses", func(t *testing.T) {
+		// user accesses are peers of the public node only, the hidden node 2 routes everything through it
+		expectDeploy(map[uint32]uint64{1: 10}, []uint32{1})
+		laptop, err := d.AddUserAccess(context.Background(), &znet, "laptop")
+		assert.NoError(t, err)
+		assert.Equal(t, "laptop", laptop.Name)
+		assert.Equal(t, "1.1.1.1:1000", laptop.PublicNodeEndpoint)
+		assert.Equal(t, keys[1].PublicKey().String(), laptop.PublicNodePK)
+		assert.Contains(t, laptop.WGConfig, "Endpoint = 1.1.1.1:1000")
+		assert.Contains(t, laptop.WGConfig, "PrivateKey = "+laptop.UserSecretKey)
+
+		expectDeploy(map[uint32]uint64{1: 10}, []uint32{1})
+		phone, err := d.AddUserAccess(context.Background(), &znet, "phone")
+		assert.NoError(t, err)
+		assert.NotEqual(t, laptop.Subnet, phone.Subnet)
+		assert.NotEqual(t, laptop.UserSecretKey, phone.UserSecretKey)
+		assert.Equal(t, laptop, znet.UserAccesses[0])
+
+		_, err = d.AddUserAccess(context.Background(), &znet, "phone")
+		assert.Error(t, err)
+
+		expectDeploy(map[uint32]uint64{1: 10}, []uint32{1})
+		err = d.RevokeUserAccess(context.Background(), &znet, "laptop")
+		assert.NoError(t, err)
+		assert.Equal(t, []workloads.UserAccess{phone}, znet.UserAccesses)
+		assert.Equal(t, map[uint32]uint64{1: 10, 2: 20}, znet.NodeDeploymentID)
+
+		publicNetwork, err := workloads.NewNetworkFromWorkload(liveContracts[10].Workloads[0], 1)
+		assert.NoError(t, err)
+		assert.Len(t, publicNetwork.UserAccesses, 1)
+		assert.Equal(t, "phone", publicNetwork.UserAccesses[0].Name)
+		assert.Equal(t, live[2], liveContracts[20])
+
+		assert.Error(t, d.RevokeUserAccess(context.Background(), &znet, "laptop"))
+	})
+
+	t.Run("nodes with deployments can't be removed", func(t *testing.T) {
+		err := d.RemoveNodes(context.Background(), &znet, []uint32{2})
+		assert.Error(t, err)
+		assert.Equal(t, []uint32{1, 2}, znet.Nodes)
+	})
+}
+
+func TestNetworkDeployerPublicNodes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tfPluginClient, sub, ncPool, cl := setupMockedPluginClient(ctrl)
+	deployer := mocks.NewMockDeployer(ctrl)
+	gridProxyCl := mocks.NewMockClient(ctrl)
+	tfPluginClient.GridProxyClient = gridProxyCl
+
+	d := NewNetworkDeployer(tfPluginClient)
+	d.deployer = deployer
+
+	sub.EXPECT().
+		GetContract(gomock.Any()).
+		Return(subi.Contract{Contract: &substrate.Contract{State: substrate.ContractState{IsCreated: true}}}, nil).
+		AnyTimes()
+
+	// nodes 2 and 3 are hidden, nodes 4, 5 and 6 are public nodes found on the grid
+	publicIPs := map[uint32]string{44: "4.4.4.4/24", 55: "5.5.5.5/24", 66: "6.6.6.6/24"}
+	for nodeID, twin := range map[uint32]uint32{2: 22, 3: 33, 4: 44, 5: 55, 6: 66} {
+		ncPool.EXPECT().
+			GetNodeClient(sub, nodeID).
+			Return(client.NewNodeClient(twin, cl, 10), nil).
+			AnyTimes()
+	}
+	gridProxyCl.EXPECT().
+		Nodes(gomock.Any(), gomock.Any()).
+		Return([]proxyTypes.Node{
+			{NodeID: 4, PublicConfig: proxyTypes.PublicConfig{Ipv4: publicIPs[44]}},
+			{NodeID: 5, PublicConfig: proxyTypes.PublicConfig{Ipv4: publicIPs[55]}},
+			{NodeID: 6, PublicConfig: proxyTypes.PublicConfig{Ipv4: publicIPs[66]}},
+		}, 3, nil).
+		AnyTimes()
+
+	down := map[uint32]bool{}
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.system.version", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			if down[twin] {
+				return errors.New("node is down")
+			}
+			return nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.network.public_config_get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			ip, ok := publicIPs[twin]
+			if !ok {
+				return errors.New("no public config")
+			}
+			*result.(*client.PublicConfig) = client.PublicConfig{IPv4: gridtypes.MustParseIPNet(ip)}
+			return nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.network.interfaces", gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.network.list_wg_ports", gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
+
+	znet := workloads.ZNet{
+		Name:             "network",
+		Nodes:            []uint32{2, 3},
+		IPRange:          gridtypes.MustParseIPNet("10.16.0.0/12"),
+		AddWGAccess:      true,
+		PublicNodesCount: 2,
+	}
+
+	liveContracts := map[uint64]gridtypes.Deployment{}
+	deployer.EXPECT().
+		GetDeployments(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, dls map[uint32]uint64) (map[uint32]gridtypes.Deployment, error) {
+			res := make(map[uint32]gridtypes.Deployment)
+			for nodeID, contractID := range dls {
+				res[nodeID] = liveContracts[contractID]
+			}
+			return res, nil
+		}).
+		AnyTimes()
+
+	networkData := func(dl gridtypes.Deployment) *zos.Network {
+		data, err := dl.Workloads[0].WorkloadData()
+		assert.NoError(t, err)
+		return data.(*zos.Network)
+	}
+
+	t.Run("plan keeps the network", func(t *testing.T) {
+		before := copyZNet(&znet)
+		plan, err := d.Plan(context.Background(), &znet)
+		assert.NoError(t, err)
+		assert.Len(t, plan.Nodes, 4)
+
+		assert.Equal(t, before, znet)
+		assert.Zero(t, znet.PublicNodeID)
+		assert.Empty(t, znet.Keys)
+		assert.Empty(t, znet.WGPort)
+	})
+
+	t.Run("generate", func(t *testing.T) {
+		dls, err := d.GenerateVersionlessDeployments(context.Background(), &znet)
+		assert.NoError(t, err)
+
+		assert.Equal(t, uint32(4), znet.PublicNodeID)
+		assert.Equal(t, []uint32{5}, znet.BackupPublicNodeIDs)
+		assert.Len(t, dls, 4)
+
+		// hidden nodes peer with all the public nodes
+		backupSubnet := znet.NodesIPRange[5]
+		hiddenPeers := networkData(dls[2]).Peers
+		assert.Len(t, hiddenPeers, 2)
+		assert.Equal(t, znet.Keys[4].PublicKey().String(), hiddenPeers[0].WGPublicKey)
+		assert.Equal(t, []gridtypes.IPNet{znet.IPRange, workloads.IPNet(100, 64, 16, 0, 20)}, hiddenPeers[0].AllowedIPs)
+		assert.Equal(t, znet.Keys[5].PublicKey().String(), hiddenPeers[1].WGPublicKey)
+		assert.Equal(t, []gridtypes.IPNet{backupSubnet, workloads.WgIP(backupSubnet)}, hiddenPeers[1].AllowedIPs)
+
+		// both public nodes have the hidden nodes and the user access peers,
+		// and the backup public node doesn't route them through the other public node
+		for _, nodeID := range []uint32{4, 5} {
+			peers := networkData(dls[nodeID]).Peers
+			assert.Len(t, peers, 4)
+			assert.Len(t, peers[0].AllowedIPs, 2)
+		}
+
+		assert.Equal(t, 2, strings.Count(znet.AccessWGConfig, "[Peer]"))
+		assert.Contains(t, znet.AccessWGConfig, "Endpoint = 4.4.4.4:")
+		assert.Contains(t, znet.AccessWGConfig, "Endpoint = 5.5.5.5:")
+
+		loaded, err := workloads.NewNetworkFromWorkload(dls[5].Workloads[0], 5)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(4), loaded.PublicNodeID)
+		assert.Equal(t, []uint32{5}, loaded.BackupPublicNodeIDs)
+		assert.Equal(t, 2, loaded.PublicNodesCount)
+		assert.True(t, loaded.AddWGAccess)
+
+		znet.NodeDeploymentID = map[uint32]uint64{}
+		for nodeID, dl := range dls {
+			znet.NodeDeploymentID[nodeID] = uint64(nodeID) * 10
+			liveContracts[uint64(nodeID)*10] = dl
+		}
+	})
+
+	t.Run("no failover if the public nodes are up", func(t *testing.T) {
+		err := d.FailoverPublicNodes(context.Background(), &znet)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(4), znet.PublicNodeID)
+		assert.Equal(t, []uint32{5}, znet.BackupPublicNodeIDs)
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		down[44] = true
+		backupKey := znet.Keys[5]
+		backupPort := znet.WGPort[5]
+		backupSubnet := znet.NodesIPRange[5]
+
+		deployer.EXPECT().
+			Deploy(gomock.Any(), map[uint32]uint64{2: 20, 3: 30, 4: 40, 5: 50}, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, oldDeploymentIDs map[uint32]uint64, newDeployments map[uint32]gridtypes.Deployment, solutionProviders map[uint32]*uint64) (map[uint32]uint64, error) {
+				deployed := make([]uint32, 0, len(newDeployments))
+				res := make(map[uint32]uint64)
+				for nodeID, dl := range newDeployments {
+					deployed = append(deployed, nodeID)
+					res[nodeID] = uint64(nodeID) * 10
+					liveContracts[res[nodeID]] = dl
+				}
+				// the dead public node contract is canceled
+				assert.ElementsMatch(t, []uint32{2, 3, 5, 6}, deployed)
+				return res, nil
+			})
+
+		err := d.FailoverPublicNodes(context.Background(), &znet)
+		assert.NoError(t, err)
+
+		assert.Equal(t, uint32(5), znet.PublicNodeID)
+		assert.Equal(t, []uint32{6}, znet.BackupPublicNodeIDs)
+		assert.Equal(t, map[uint32]uint64{2: 20, 3: 30, 5: 50, 6: 60}, znet.NodeDeploymentID)
+		assert.Equal(t, backupKey, znet.Keys[5])
+		assert.Equal(t, backupPort, znet.WGPort[5])
+		assert.Equal(t, backupSubnet, znet.NodesIPRange[5])
+		assert.NotContains(t, znet.Keys, uint32(4))
+		assert.Contains(t, znet.AccessWGConfig, "Endpoint = 6.6.6.6:")
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		// the public node 5 and the backup public node 6 are not in the network nodes
+		canceled := []uint64{}
+		deployer.EXPECT().
+			Cancel(gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, contractID uint64) error {
+				canceled = append(canceled, contractID)
+				return nil
+			}).
+			Times(4)
+
+		for nodeID, contractID := range znet.NodeDeploymentID {
+			d.tfPluginClient.State.addNetworkContract(nodeID, contractID)
+		}
+
+		err := d.Cancel(context.Background(), &znet)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []uint64{20, 30, 50, 60}, canceled)
+		assert.Empty(t, znet.NodeDeploymentID)
+		for nodeID, contracts := range d.tfPluginClient.State.CurrentNodeNetworks {
+			assert.Empty(t, contracts, "node %d", nodeID)
+		}
+	})
+}
+
+func TestNetworkDeployerWGPortClash(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tfPluginClient, sub, ncPool, cl := setupMockedPluginClient(ctrl)
+	deployer := mocks.NewMockDeployer(ctrl)
+
+	d := NewNetworkDeployer(tfPluginClient)
+	d.deployer = deployer
+
+	ncPool.EXPECT().
+		GetNodeClient(sub, uint32(1)).
+		Return(client.NewNodeClient(11, cl, 10), nil).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(11), "zos.system.version", gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(11), "zos.network.public_config_get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			*result.(*client.PublicConfig) = client.PublicConfig{IPv4: gridtypes.MustParseIPNet("1.1.1.1/24")}
+			return nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(11), "zos.network.list_wg_ports", gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
+
+	clashErr := errors.New("workload network within deployment 10 failed with error: failed to setup wireguard: bind: address already in use")
+	deployedPort := func(dls map[uint32]gridtypes.Deployment) int {
+		data, err := dls[1].Workloads[0].WorkloadData()
+		assert.NoError(t, err)
+		return int(data.(*zos.Network).WGListenPort)
+	}
+
+	t.Run("retry with a new port", func(t *testing.T) {
+		znet := workloads.ZNet{
+			Name:    "network",
+			Nodes:   []uint32{1},
+			IPRange: gridtypes.MustParseIPNet("10.1.0.0/16"),
+		}
+
+		var ports []int
+		var deployed gridtypes.Deployment
+		gomock.InOrder(
+			deployer.EXPECT().
+				Deploy(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, oldDeploymentIDs map[uint32]uint64, newDeployments map[uint32]gridtypes.Deployment, solutionProviders map[uint32]*uint64) (map[uint32]uint64, error) {
+					ports = append(ports, deployedPort(newDeployments))
+					return map[uint32]uint64{}, clashErr
+				}),
+			deployer.EXPECT().
+				Deploy(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, oldDeploymentIDs map[uint32]uint64, newDeployments map[uint32]gridtypes.Deployment, solutionProviders map[uint32]*uint64) (map[uint32]uint64, error) {
+					ports = append(ports, deployedPort(newDeployments))
+					deployed = newDeployments[1]
+					return map[uint32]uint64{1: 10}, nil
+				}),
+		)
+		deployer.EXPECT().
+			GetDeployments(gomock.Any(), map[uint32]uint64{1: 10}).
+			DoAndReturn(func(ctx context.Context, dls map[uint32]uint64) (map[uint32]gridtypes.Deployment, error) {
+				return map[uint32]gridtypes.Deployment{1: deployed}, nil
+			})
+
+		err := d.Deploy(context.Background(), &znet)
+		assert.NoError(t, err)
+
+		assert.Len(t, ports, 2)
+		assert.NotEqual(t, ports[0], ports[1])
+		assert.Equal(t, ports[1], znet.WGPort[1])
+		assert.Equal(t, map[uint32]uint64{1: 10}, znet.NodeDeploymentID)
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		znet := workloads.ZNet{
+			Name:    "network",
+			Nodes:   []uint32{1},
+			IPRange: gridtypes.MustParseIPNet("10.1.0.0/16"),
+		}
+
+		deployer.EXPECT().
+			Deploy(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(map[uint32]uint64{}, errors.New("node is out of capacity"))
+
+		err := d.Deploy(context.Background(), &znet)
+		assert.ErrorContains(t, err, "node is out of capacity")
+	})
+
+	t.Run("retries are exhausted", func(t *testing.T) {
+		znet := workloads.ZNet{
+			Name:    "network",
+			Nodes:   []uint32{1},
+			IPRange: gridtypes.MustParseIPNet("10.1.0.0/16"),
+		}
+
+		deployer.EXPECT().
+			Deploy(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(map[uint32]uint64{}, clashErr).
+			Times(d.wgPortRetries + 1)
+
+		err := d.Deploy(context.Background(), &znet)
+		assert.ErrorContains(t, err, "address already in use")
+	})
+
+	t.Run("cost estimates don't keep the ports", func(t *testing.T) {
+		// a single port in the range, so a leaked reservation would fail the next reserve
+		d.wgPorts = client.NewWGPortAllocator(client.WGPortRange{Min: 1000, Max: 1000})
+		d.tfPluginClient.NetworkDeployer = d
+
+		sub.EXPECT().GetNode(uint32(1)).Return(&substrate.Node{FarmID: 1}, nil)
+		sub.EXPECT().GetFarm(uint32(1)).Return(&substrate.Farm{PricingPolicyID: 1}, nil)
+		sub.EXPECT().GetNodeRentContract(uint32(1)).Return(uint64(0), substrate.ErrNotFound)
+		sub.EXPECT().GetPricingPolicy(uint32(1)).Return(substrate.PricingPolicy{}, nil)
+
+		znet := workloads.ZNet{
+			Name:    "network",
+			Nodes:   []uint32{1},
+			IPRange: gridtypes.MustParseIPNet("10.1.0.0/16"),
+		}
+		before := copyZNet(&znet)
+
+		estimate, err := d.tfPluginClient.EstimateCost(context.Background(), &znet)
+		assert.NoError(t, err)
+		assert.Len(t, estimate.Nodes, 1)
+		assert.Equal(t, before, znet)
+
+		port, err := d.wgPorts.Reserve(1, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, port)
+	})
+}
+
+func TestNetworkDeployerRotateKeys(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	tfPluginClient, sub, ncPool, cl := setupMockedPluginClient(ctrl)
+	deployer := mocks.NewMockDeployer(ctrl)
+
+	d := NewNetworkDeployer(tfPluginClient)
+	d.deployer = deployer
+
+	sub.EXPECT().
+		GetContract(gomock.Any()).
+		Return(subi.Contract{Contract: &substrate.Contract{State: substrate.ContractState{IsCreated: true}}}, nil).
+		AnyTimes()
+
+	// node 1 is the public node, node 2 is hidden
+	for nodeID, twin := range map[uint32]uint32{1: 11, 2: 22} {
+		ncPool.EXPECT().
+			GetNodeClient(sub, nodeID).
+			Return(client.NewNodeClient(twin, cl, 10), nil).
+			AnyTimes()
+	}
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.system.version", gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.network.public_config_get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			if twin != 11 {
+				return errors.New("no public config")
+			}
+			*result.(*client.PublicConfig) = client.PublicConfig{IPv4: gridtypes.MustParseIPNet("1.1.1.1/24")}
+			return nil
+		}).
+		AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.network.interfaces", gomock.Any(), gomock.Any()).
+		Return(nil).
+		AnyTimes()
+
+	keys := map[uint32]wgtypes.Key{}
+	for _, nodeID := range []uint32{1, 2} {
+		key, err := wgtypes.GenerateKey()
+		assert.NoError(t, err)
+		keys[nodeID] = key
+	}
+	accessKey, err := wgtypes.GenerateKey()
+	assert.NoError(t, err)
+	userAccessKey, err := wgtypes.GenerateKey()
+	assert.NoError(t, err)
+	externalIP := gridtypes.MustParseIPNet("10.1.4.0/24")
+
+	znet := workloads.ZNet{
+		Name:         "network",
+		Nodes:        []uint32{1, 2},
+		IPRange:      gridtypes.MustParseIPNet("10.1.0.0/16"),
+		AddWGAccess:  true,
+		UserAccesses: []workloads.UserAccess{{Name: "laptop", Subnet: gridtypes.MustParseIPNet("10.1.5.0/24"), UserSecretKey: userAccessKey.String()}},
+		ExternalIP:   &externalIP,
+		ExternalSK:   accessKey,
+		PublicNodeID: 1,
+		NodesIPRange: map[uint32]gridtypes.IPNet{
+			1: gridtypes.MustParseIPNet("10.1.2.0/24"),
+			2: gridtypes.MustParseIPNet("10.1.3.0/24"),
+		},
+		WGPort:           map[uint32]int{1: 1000, 2: 2000},
+		Keys:             map[uint32]wgtypes.Key{1: keys[1], 2: keys[2]},
+		NodeDeploymentID: map[uint32]uint64{1: 10, 2: 20},
+	}
+
+	live, err := d.GenerateVersionlessDeployments(context.Background(), &znet)
+	assert.NoError(t, err)
+	liveContracts := map[uint64]gridtypes.Deployment{10: live[1], 20: live[2]}
+
+	deployer.EXPECT().
+		GetDeployments(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, dls map[uint32]uint64) (map[uint32]gridtypes.Deployment, error) {
+			res := make(map[uint32]gridtypes.Deployment)
+			for nodeID, contractID := range dls {
+				res[nodeID] = liveContracts[contractID]
+			}
+			return res, nil
+		}).
+		AnyTimes()
+
+	expectDeploy := func(oldDeploymentIDs map[uint32]uint64, nodes []uint32) {
+		deployer.EXPECT().
+			Deploy(gomock.Any(), oldDeploymentIDs, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, oldDeploymentIDs map[uint32]uint64, newDeployments map[uint32]gridtypes.Deployment, solutionProviders map[uint32]*uint64) (map[uint32]uint64, error) {
+				deployed := make([]uint32, 0, len(newDeployments))
+				res := make(map[uint32]uint64)
+				for nodeID, dl := range newDeployments {
+					deployed = append(deployed, nodeID)
+					res[nodeID] = oldDeploymentIDs[nodeID]
+					liveContracts[res[nodeID]] = dl
+				}
+				assert.ElementsMatch(t, nodes, deployed)
+				return res, nil
+			})
+	}
+
+	peerKeys := func(dl gridtypes.Deployment) []string {
+		data, err := dl.Workloads[0].WorkloadData()
+		assert.NoError(t, err)
+		keys := []string{}
+		for _, peer := range data.(*zos.Network).Peers {
+			keys = append(keys, peer.WGPublicKey)
+		}
+		return keys
+	}
+
+	t.Run("rotate node key", func(t *testing.T) {
+		// the public node is updated with the new hidden node key
+		expectDeploy(map[uint32]uint64{1: 10, 2: 20}, []uint32{1, 2})
+
+		_, err := d.RotateKeys(context.Background(), &znet, KeyRotation{Nodes: []uint32{2}})
+		assert.NoError(t, err)
+
+		assert.NotEqual(t, keys[2], znet.Keys[2])
+		assert.Equal(t, keys[1], znet.Keys[1])
+		assert.Contains(t, peerKeys(liveContracts[10]), znet.Keys[2].PublicKey().String())
+		assert.NotContains(t, peerKeys(liveContracts[10]), keys[2].PublicKey().String())
+	})
+
+	t.Run("rotate access keys", func(t *testing.T) {
+		// only the public node has the access peers
+		expectDeploy(map[uint32]uint64{1: 10}, []uint32{1})
+
+		config, err := d.RotateKeys(context.Background(), &znet, KeyRotation{Access: true, UserAccesses: []string{"laptop"}})
+		assert.NoError(t, err)
+
+		assert.NotEqual(t, accessKey, znet.ExternalSK)
+		assert.Equal(t, znet.AccessWGConfig, config)
+		assert.Contains(t, config, znet.ExternalSK.String())
+		assert.NotContains(t, config, accessKey.String())
+		assert.Contains(t, peerKeys(liveContracts[10]), znet.ExternalSK.PublicKey().String())
+
+		assert.NotEqual(t, userAccessKey.String(), znet.UserAccesses[0].UserSecretKey)
+		assert.Contains(t, znet.UserAccesses[0].WGConfig, znet.UserAccesses[0].UserSecretKey)
+
+		// the private keys are only kept in the local state
+		assert.NotContains(t, liveContracts[10].Workloads[0].Metadata, znet.ExternalSK.String())
+		assert.NotContains(t, liveContracts[10].Workloads[0].Metadata, znet.UserAccesses[0].UserSecretKey)
+		assert.Equal(t, map[string]string{
+			"":       znet.ExternalSK.String(),
+			"laptop": znet.UserAccesses[0].UserSecretKey,
+		}, d.tfPluginClient.State.GetNetworks().GetNetwork(znet.Name).AccessKeys)
+	})
+
+	t.Run("keys are kept if the update fails", func(t *testing.T) {
+		deployer.EXPECT().
+			Deploy(gomock.Any(), map[uint32]uint64{1: 10, 2: 20}, gomock.Any(), gomock.Any()).
+			Return(map[uint32]uint64{1: 10, 2: 20}, errors.New("node is down"))
+
+		nodeKey := znet.Keys[1]
+		_, err := d.RotateKeys(context.Background(), &znet, KeyRotation{Nodes: []uint32{1}})
+		assert.Error(t, err)
+		assert.Equal(t, nodeKey, znet.Keys[1])
+	})
+
+	t.Run("new keys are kept if the update is partially applied", func(t *testing.T) {
+		// the hidden node is updated with the new public node key, then the public node update fails
+		deployer.EXPECT().
+			Deploy(gomock.Any(), map[uint32]uint64{1: 10, 2: 20}, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, oldDeploymentIDs map[uint32]uint64, newDeployments map[uint32]gridtypes.Deployment, solutionProviders map[uint32]*uint64) (map[uint32]uint64, error) {
+				dl := newDeployments[2]
+				dl.Version = liveContracts[20].Version + 1
+				liveContracts[20] = dl
+				return map[uint32]uint64{1: 10, 2: 20}, errors.New("node is down")
+			})
+
+		nodeKey := znet.Keys[1]
+		_, err := d.RotateKeys(context.Background(), &znet, KeyRotation{Nodes: []uint32{1}})
+		assert.ErrorContains(t, err, "partially applied")
+		assert.NotEqual(t, nodeKey, znet.Keys[1])
+		assert.Contains(t, peerKeys(liveContracts[20]), znet.Keys[1].PublicKey().String())
+	})
+
+	t.Run("invalid rotations", func(t *testing.T) {
+		_, err := d.RotateKeys(context.Background(), &znet, KeyRotation{Nodes: []uint32{5}})
+		assert.Error(t, err)
+
+		_, err = d.RotateKeys(context.Background(), &znet, KeyRotation{UserAccesses: []string{"phone"}})
+		assert.Error(t, err)
+
+		noAccess := znet
+		noAccess.AddWGAccess = false
+		_, err = d.RotateKeys(context.Background(), &noAccess, KeyRotation{Access: true})
+		assert.Error(t, err)
+	})
+}
+
+func TestNetworkAccessWGConfig(t *testing.T) {
+	keys := make(map[uint32]wgtypes.Key)
+	for _, nodeID := range []uint32{1, 2} {
+		key, err := wgtypes.GenerateKey()
+		assert.NoError(t, err)
+		keys[nodeID] = key
+	}
+	externalSK, err := wgtypes.GenerateKey()
+	assert.NoError(t, err)
+	externalIP := workloads.IPNet(10, 1, 2, 0, 24)
+
+	znet := constructTestNetwork()
+	znet.AddWGAccess = true
+	znet.ExternalIP = &externalIP
+	znet.ExternalSK = externalSK
+	znet.AccessDNS = []string{"1.1.1.1"}
+	znet.AccessMTU = 1400
+	znet.PublicNodeID = 1
+	znet.BackupPublicNodeIDs = []uint32{2}
+	znet.NodesIPRange = map[uint32]gridtypes.IPNet{1: workloads.IPNet(10, 1, 3, 0, 24), 2: workloads.IPNet(10, 1, 4, 0, 24)}
+	znet.WGPort = map[uint32]int{1: 1000, 2: 2000}
+	znet.Keys = keys
+
+	config, err := workloads.ParseWGConfig(accessWGConfig(&znet, map[uint32]string{1: "1.1.1.1", 2: "[2a02:1802:5e::1]"}))
+	assert.NoError(t, err)
+	assert.Equal(t, workloads.WGConfig{
+		Interface: workloads.WGInterface{
+			PrivateKey: externalSK.String(),
+			Addresses:  []string{"100.64.1.2"},
+			DNS:        []string{"1.1.1.1"},
+			MTU:        1400,
+		},
+		Peers: []workloads.WGPeer{
+			{
+				PublicKey:           keys[1].PublicKey().String(),
+				AllowedIPs:          []string{"10.1.0.0/16", "100.64.1.0/24"},
+				Endpoint:            "1.1.1.1:1000",
+				PersistentKeepalive: workloads.DefaultPersistentKeepalive,
+			},
+			{
+				PublicKey:           keys[2].PublicKey().String(),
+				AllowedIPs:          []string{"10.1.4.0/24", "100.64.1.4/32"},
+				Endpoint:            "[2a02:1802:5e::1]:2000",
+				PersistentKeepalive: workloads.DefaultPersistentKeepalive,
+			},
+		},
+	}, config)
+}
@@ -1,7 +1,11 @@
 // Package deployer for grid deployer
 package deployer
 
-import "github.com/threefoldtech/zos/pkg/gridtypes"
+import (
+	"encoding/json"
+
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
 
 // NetworkState is a map of of names and their networks
 type NetworkState map[string]Network
@@ -10,13 +14,42 @@ type NetworkState map[string]Network
 type Network struct {
 	Subnets               map[uint32]string
 	NodeDeploymentHostIDs NodeDeploymentHostIDs
+	// AccessKeys are the wireguard private keys of the network user accesses by name, the access of AddWGAccess has an empty name.
+	// they are only kept in the local state, the network workloads only have their public keys
+	AccessKeys map[string]string
 }
 
 // NodeDeploymentHostIDs is a map for nodes ID and its deployments' IPs
 type NodeDeploymentHostIDs map[uint32]DeploymentHostIDs
 
 // DeploymentHostIDs is a map for deployment and its IPs
-type DeploymentHostIDs map[uint64][]byte
+type DeploymentHostIDs map[uint64]HostIDs
+
+// HostIDs is the offsets of private IPs in their node subnet
+type HostIDs []uint32
+
+// UnmarshalJSON decodes host IDs, it accepts the base64 bytes of the states saved before node subnets could be larger than /24
+func (h *HostIDs) UnmarshalJSON(data []byte) error {
+	if len(data) != 0 && data[0] == '"' {
+		var bytes []byte
+		if err := json.Unmarshal(data, &bytes); err != nil {
+			return err
+		}
+		ids := make(HostIDs, 0, len(bytes))
+		for _, id := range bytes {
+			ids = append(ids, uint32(id))
+		}
+		*h = ids
+		return nil
+	}
+
+	var ids []uint32
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+	*h = ids
+	return nil
+}
 
 // NewNetwork creates a new Network
 func NewNetwork() Network {
@@ -26,6 +59,26 @@ func NewNetwork() Network {
 	}
 }
 
+// copy returns a deep copy of the networks
+func (nm NetworkState) copy() NetworkState {
+	cp := make(NetworkState, len(nm))
+	for name, network := range nm {
+		net := NewNetwork()
+		for nodeID, subnet := range network.Subnets {
+			net.Subnets[nodeID] = subnet
+		}
+		for nodeID, deployments := range network.NodeDeploymentHostIDs {
+			net.NodeDeploymentHostIDs[nodeID] = DeploymentHostIDs{}
+			for contractID, hostIDs := range deployments {
+				net.NodeDeploymentHostIDs[nodeID][contractID] = append(HostIDs{}, hostIDs...)
+			}
+		}
+		net.AccessKeys = copyMap(network.AccessKeys)
+		cp[name] = net
+	}
+	return cp
+}
+
 // GetNetwork get a Network using its name
 func (nm NetworkState) GetNetwork(networkName string) Network {
 	if _, ok := nm[networkName]; !ok {
@@ -35,15 +88,31 @@ func (nm NetworkState) GetNetwork(networkName string) Network {
 	return net
 }
 
-// UpdateNetwork updates a network subnets given its name
+// UpdateNetwork updates a network subnets given its name, the host IDs of the nodes that are no longer in the network are deleted
 func (nm NetworkState) UpdateNetwork(networkName string, ipRange map[uint32]gridtypes.IPNet) {
-	nm.DeleteNetwork(networkName)
-	Network := nm.GetNetwork(networkName)
+	network := nm.GetNetwork(networkName)
+	for nodeID := range network.Subnets {
+		if _, ok := ipRange[nodeID]; !ok {
+			network.deleteNodeSubnet(nodeID)
+		}
+	}
+	for nodeID := range network.NodeDeploymentHostIDs {
+		if _, ok := ipRange[nodeID]; !ok {
+			delete(network.NodeDeploymentHostIDs, nodeID)
+		}
+	}
 	for nodeID, subnet := range ipRange {
-		Network.SetNodeSubnet(nodeID, subnet.String())
+		network.SetNodeSubnet(nodeID, subnet.String())
 	}
 }
 
+// setAccessKeys replaces the private keys of a network user accesses
+func (nm NetworkState) setAccessKeys(networkName string, keys map[string]string) {
+	network := nm.GetNetwork(networkName)
+	network.AccessKeys = keys
+	nm[networkName] = network
+}
+
 // DeleteNetwork deletes a Network using its name
 func (nm NetworkState) DeleteNetwork(networkName string) {
 	delete(nm, networkName)
@@ -65,8 +134,8 @@ func (n *Network) deleteNodeSubnet(nodeID uint32) {
 }
 
 // GetUsedNetworkHostIDs gets the used host IDs on the overlay Network
-func (n *Network) getUsedNetworkHostIDs(nodeID uint32) []byte {
-	ips := []byte{}
+func (n *Network) getUsedNetworkHostIDs(nodeID uint32) HostIDs {
+	ips := HostIDs{}
 	for _, v := range n.NodeDeploymentHostIDs[nodeID] {
 		ips = append(ips, v...)
 	}
@@ -74,15 +143,15 @@ func (n *Network) getUsedNetworkHostIDs(nodeID uint32) []byte {
 }
 
 // GetDeploymentHostIDs gets the private Network host IDs relevant to the deployment
-func (n *Network) GetDeploymentHostIDs(nodeID uint32, contractID uint64) []byte {
+func (n *Network) GetDeploymentHostIDs(nodeID uint32, contractID uint64) HostIDs {
 	if n.NodeDeploymentHostIDs[nodeID] == nil {
-		return []byte{}
+		return HostIDs{}
 	}
 	return n.NodeDeploymentHostIDs[nodeID][contractID]
 }
 
 // SetDeploymentHostIDs sets the relevant deployment host IDs
-func (n *Network) SetDeploymentHostIDs(nodeID uint32, contractID uint64, ips []byte) {
+func (n *Network) SetDeploymentHostIDs(nodeID uint32, contractID uint64, ips HostIDs) {
 	if n.NodeDeploymentHostIDs[nodeID] == nil {
 		n.NodeDeploymentHostIDs[nodeID] = DeploymentHostIDs{}
 	}
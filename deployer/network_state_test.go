@@ -2,9 +2,12 @@
 package deployer
 
 import (
+	"encoding/json"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
 )
 
 func TestNetworkState(t *testing.T) {
@@ -13,7 +16,7 @@ func TestNetworkState(t *testing.T) {
 
 	networkState := NetworkState{net.Name: Network{
 		Subnets:               map[uint32]string{nodeID: net.IPRange.String()},
-		NodeDeploymentHostIDs: map[uint32]DeploymentHostIDs{nodeID: map[uint64][]byte{contractID: {}}},
+		NodeDeploymentHostIDs: map[uint32]DeploymentHostIDs{nodeID: map[uint64]HostIDs{contractID: {}}},
 	}}
 	network := networkState.GetNetwork(net.Name)
 
@@ -23,12 +26,63 @@ func TestNetworkState(t *testing.T) {
 	network.SetNodeSubnet(nodeID, "10.1.1.0/24")
 	assert.Equal(t, network.getNodeSubnet(nodeID), "10.1.1.0/24")
 
-	network.SetDeploymentHostIDs(nodeID, contractID, []byte{1, 2, 3})
-	assert.Equal(t, network.GetDeploymentHostIDs(nodeID, contractID), []byte{1, 2, 3})
+	network.SetDeploymentHostIDs(nodeID, contractID, HostIDs{1, 2, 3})
+	assert.Equal(t, network.GetDeploymentHostIDs(nodeID, contractID), HostIDs{1, 2, 3})
 
 	network.deleteNodeSubnet(nodeID)
 	assert.Empty(t, network.getNodeSubnet(nodeID))
 
 	network.DeleteDeploymentHostIDs(nodeID, contractID)
 	assert.Empty(t, network.GetDeploymentHostIDs(nodeID, contractID))
+
+	network.SetDeploymentHostIDs(nodeID, contractID, HostIDs{2})
+	network.SetDeploymentHostIDs(nodeID+1, contractID, HostIDs{3})
+	networkState.UpdateNetwork(net.Name, map[uint32]gridtypes.IPNet{nodeID: gridtypes.MustParseIPNet("10.1.2.0/24")})
+	assert.Equal(t, "10.1.2.0/24", network.getNodeSubnet(nodeID))
+	assert.Equal(t, HostIDs{2}, network.GetDeploymentHostIDs(nodeID, contractID))
+	assert.Empty(t, network.GetDeploymentHostIDs(nodeID+1, contractID))
+}
+
+func TestHostIDs(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.20.4.0/22")
+	assert.NoError(t, err)
+
+	t.Run("host ids in subnets larger than /24", func(t *testing.T) {
+		id, ok := hostID("10.20.6.3", subnet)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(515), id)
+		assert.Equal(t, "10.20.6.3", hostIP(subnet, id).String())
+
+		_, ok = hostID("10.20.8.3", subnet)
+		assert.False(t, ok)
+
+		assert.Equal(t, HostIDs{515, 2}, ipsHostIDs([]string{"10.20.6.3", "10.20.4.2", "10.20.8.3"}, subnet.String()))
+		assert.Equal(t, HostIDs{3}, ipsHostIDs([]string{"10.20.6.3"}, ""))
+	})
+
+	t.Run("free host ids", func(t *testing.T) {
+		id, ok := freeHostID(HostIDs{2, 3}, subnet)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(4), id)
+
+		_, small, err := net.ParseCIDR("10.20.4.0/30")
+		assert.NoError(t, err)
+		_, ok = freeHostID(HostIDs{2}, small)
+		assert.False(t, ok)
+	})
+
+	t.Run("host ids json", func(t *testing.T) {
+		var network Network
+		// states saved before the host IDs could be larger than a byte have them as base64 bytes
+		assert.NoError(t, json.Unmarshal([]byte(`{"NodeDeploymentHostIDs":{"1":{"10":"AgM="}}}`), &network))
+		assert.Equal(t, HostIDs{2, 3}, network.GetDeploymentHostIDs(1, 10))
+
+		network.SetDeploymentHostIDs(1, 10, HostIDs{2, 515})
+		content, err := json.Marshal(network)
+		assert.NoError(t, err)
+
+		var got Network
+		assert.NoError(t, json.Unmarshal(content, &got))
+		assert.Equal(t, HostIDs{2, 515}, got.GetDeploymentHostIDs(1, 10))
+	})
 }
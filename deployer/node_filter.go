@@ -8,6 +8,9 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	client "github.com/threefoldtech/grid3-go/node"
+	"github.com/threefoldtech/grid3-go/subi"
+	"github.com/threefoldtech/grid3-go/workloads"
 	proxy "github.com/threefoldtech/grid_proxy_server/pkg/client"
 	proxyTypes "github.com/threefoldtech/grid_proxy_server/pkg/types"
 )
@@ -81,18 +84,63 @@ func GetPublicNode(ctx context.Context, gridClient proxy.Client, preferredNodes
 	}
 
 	for _, node := range nodes {
-		log.Printf("found a node with ipv4 public config: %d %s\n", node.NodeID, node.PublicConfig.Ipv4)
-		ip, _, err := net.ParseCIDR(node.PublicConfig.Ipv4)
+		if hasPublicIPv4(node) {
+			return uint32(node.NodeID), nil
+		}
+	}
+
+	return 0, errors.New("no nodes with public ipv4")
+}
+
+// getPublicNodes returns count public nodes that are not excluded, the nodes are checked to be up before they are returned
+func getPublicNodes(ctx context.Context, gridClient proxy.Client, sub subi.SubstrateExt, ncPool client.NodeClientGetter, excludedNodes []uint32, count int) ([]uint32, error) {
+	nodes, err := FilterNodes(gridClient, proxyTypes.NodeFilter{
+		IPv4:   &trueVal,
+		Status: &statusUp,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	publicNodes := make([]uint32, 0, count)
+	for _, node := range nodes {
+		if len(publicNodes) == count {
+			break
+		}
+		nodeID := uint32(node.NodeID)
+		if workloads.Contains(excludedNodes, nodeID) || !hasPublicIPv4(node) {
+			continue
+		}
+
+		cl, err := ncPool.GetNodeClient(sub, nodeID)
 		if err != nil {
-			log.Printf("could not parse public ip %s of node %d: %s", node.PublicConfig.Ipv4, node.NodeID, err.Error())
+			log.Printf("could not get node %d client: %s", nodeID, err.Error())
 			continue
 		}
-		if ip.IsPrivate() {
-			log.Printf("public ip %s of node %d is private", node.PublicConfig.Ipv4, node.NodeID)
+		if err := cl.IsNodeUp(ctx); err != nil {
+			log.Printf("node %d is not up: %s", nodeID, err.Error())
 			continue
 		}
-		return uint32(node.NodeID), nil
+		publicNodes = append(publicNodes, nodeID)
 	}
 
-	return 0, errors.New("no nodes with public ipv4")
+	if len(publicNodes) < count {
+		return nil, errors.Errorf("could only find %d of %d nodes with public ipv4", len(publicNodes), count)
+	}
+	return publicNodes, nil
+}
+
+// hasPublicIPv4 returns true if the node public config has a public ipv4
+func hasPublicIPv4(node proxyTypes.Node) bool {
+	log.Printf("found a node with ipv4 public config: %d %s\n", node.NodeID, node.PublicConfig.Ipv4)
+	ip, _, err := net.ParseCIDR(node.PublicConfig.Ipv4)
+	if err != nil {
+		log.Printf("could not parse public ip %s of node %d: %s", node.PublicConfig.Ipv4, node.NodeID, err.Error())
+		return false
+	}
+	if ip.IsPrivate() {
+		log.Printf("public ip %s of node %d is private", node.PublicConfig.Ipv4, node.NodeID)
+		return false
+	}
+	return true
 }
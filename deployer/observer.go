@@ -0,0 +1,53 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"time"
+
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+// WorkloadEvent is a workload state transition seen while waiting for a deployment
+type WorkloadEvent struct {
+	NodeID     uint32
+	ContractID uint64
+	Workload   string
+	Type       gridtypes.WorkloadType
+	// State is one of init, ok, error, deleted, paused and unchanged
+	State gridtypes.ResultState
+	Error string
+	// Elapsed is the time since the deployer started waiting for the deployment
+	Elapsed time.Duration
+}
+
+// Observer is notified with the workloads state transitions of the deployments
+// it's called from the deploying goroutines, so it must be safe for concurrent use
+type Observer interface {
+	OnWorkloadEvent(event WorkloadEvent)
+}
+
+// ObserverFunc is a function used as an observer
+type ObserverFunc func(event WorkloadEvent)
+
+// OnWorkloadEvent calls the observer function
+func (f ObserverFunc) OnWorkloadEvent(event WorkloadEvent) {
+	f(event)
+}
+
+// RegisterObserver registers an observer for the workloads events, observers must be registered before deploying
+func (d *Deployer) RegisterObserver(observer Observer) {
+	d.observers = append(d.observers, observer)
+}
+
+func (d *Deployer) notify(event WorkloadEvent) {
+	for _, observer := range d.observers {
+		observer.OnWorkloadEvent(event)
+	}
+}
+
+// registerObserver registers an observer on a deployer, mocked deployers are left as they are
+func registerObserver(deployer MockDeployer, observer Observer) {
+	if d, ok := deployer.(*Deployer); ok {
+		d.RegisterObserver(observer)
+	}
+}
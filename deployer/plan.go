@@ -0,0 +1,251 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+// NodeAction is the action a deploy would take on a node deployment
+type NodeAction string
+
+// WorkloadAction is the change a deploy would apply to a workload
+type WorkloadAction string
+
+const (
+	// NodeCreate creates a new contract and deployment on the node
+	NodeCreate NodeAction = "create"
+	// NodeUpdate updates the node contract and deployment
+	NodeUpdate NodeAction = "update"
+	// NodeNoop leaves the node deployment as it is
+	NodeNoop NodeAction = "no-op"
+	// NodeDelete cancels the node contract
+	NodeDelete NodeAction = "delete"
+	// NodeRecreate cancels the node contract then creates a new contract and deployment
+	NodeRecreate NodeAction = "recreate"
+
+	// WorkloadAdded is a workload that doesn't exist in the old deployment
+	WorkloadAdded WorkloadAction = "added"
+	// WorkloadChanged is a workload whose hash differs from the old one
+	WorkloadChanged WorkloadAction = "changed"
+	// WorkloadRemoved is a workload that doesn't exist in the new deployment
+	WorkloadRemoved WorkloadAction = "removed"
+)
+
+// WorkloadChange is a planned change of a workload
+type WorkloadChange struct {
+	Name   string
+	Type   gridtypes.WorkloadType
+	Action WorkloadAction
+}
+
+// CapacityDelta is the difference between the new and the old capacity, negative values are released capacity
+type CapacityDelta struct {
+	CRU int64
+	MRU int64
+	SRU int64
+	HRU int64
+}
+
+// NodePlan is the planned change of a node deployment
+type NodePlan struct {
+	NodeID uint32
+	// ContractID is the current contract of the node, 0 if it's a new deployment
+	ContractID uint64
+	Action     NodeAction
+	Workloads  []WorkloadChange
+	Capacity   CapacityDelta
+	PublicIPs  int
+}
+
+// Plan is the set of changes a deploy would apply, sorted by node ID
+type Plan struct {
+	Nodes []NodePlan
+}
+
+// HasChanges returns true if any node deployment would be changed
+func (p Plan) HasChanges() bool {
+	for _, node := range p.Nodes {
+		if node.Action != NodeNoop {
+			return true
+		}
+	}
+	return false
+}
+
+// Capacity returns the total capacity delta of the plan
+func (p Plan) Capacity() CapacityDelta {
+	total := CapacityDelta{}
+	for _, node := range p.Nodes {
+		total.add(node.Capacity)
+	}
+	return total
+}
+
+// PublicIPs returns the total public IPs delta of the plan
+func (p Plan) PublicIPs() int {
+	total := 0
+	for _, node := range p.Nodes {
+		total += node.PublicIPs
+	}
+	return total
+}
+
+// String returns a human readable summary of the plan
+func (p Plan) String() string {
+	var b strings.Builder
+	for _, node := range p.Nodes {
+		fmt.Fprintf(&b, "node %d: %s", node.NodeID, node.Action)
+		if node.ContractID != 0 {
+			fmt.Fprintf(&b, " (contract %d)", node.ContractID)
+		}
+		fmt.Fprintf(&b, ", capacity: %s, public ips: %+d\n", node.Capacity, node.PublicIPs)
+
+		for _, wl := range node.Workloads {
+			fmt.Fprintf(&b, "  %s %s (%s)\n", wl.Action, wl.Name, wl.Type)
+		}
+	}
+	fmt.Fprintf(&b, "total capacity: %s, public ips: %+d", p.Capacity(), p.PublicIPs())
+	return b.String()
+}
+
+// String returns the capacity delta in a readable format
+func (c CapacityDelta) String() string {
+	return fmt.Sprintf("[cru: %+d, mru: %+d, sru: %+d, hru: %+d]", c.CRU, c.MRU, c.SRU, c.HRU)
+}
+
+func (c *CapacityDelta) add(delta CapacityDelta) {
+	c.CRU += delta.CRU
+	c.MRU += delta.MRU
+	c.SRU += delta.SRU
+	c.HRU += delta.HRU
+}
+
+func newCapacityDelta(old, new gridtypes.Capacity) CapacityDelta {
+	return CapacityDelta{
+		CRU: int64(new.CRU) - int64(old.CRU),
+		MRU: int64(new.MRU) - int64(old.MRU),
+		SRU: int64(new.SRU) - int64(old.SRU),
+		HRU: int64(new.HRU) - int64(old.HRU),
+	}
+}
+
+// planDeployments loads the old deployments using the deployer then computes the plan to reach the new deployments
+func planDeployments(ctx context.Context, deployer MockDeployer, oldDeploymentIDs map[uint32]uint64, newDeployments map[uint32]gridtypes.Deployment) (Plan, error) {
+	oldDeployments, err := deployer.GetDeployments(ctx, oldDeploymentIDs)
+	if err != nil {
+		return Plan{}, errors.Wrap(err, "failed to get old deployments")
+	}
+
+	return newPlan(oldDeploymentIDs, oldDeployments, newDeployments, getUpdateStrategy(deployer))
+}
+
+// newPlan computes the changes needed to move from the old deployments to the new ones
+func newPlan(oldDeploymentIDs map[uint32]uint64, oldDeployments, newDeployments map[uint32]gridtypes.Deployment, strategy UpdateStrategy) (Plan, error) {
+	plan := Plan{}
+
+	for node, dl := range newDeployments {
+		nodePlan, err := planNodeDeployment(node, oldDeploymentIDs[node], oldDeployments[node], dl, true, strategy)
+		if err != nil {
+			return Plan{}, errors.Wrapf(err, "could not plan node %d deployment", node)
+		}
+		plan.Nodes = append(plan.Nodes, nodePlan)
+	}
+
+	for node, contractID := range oldDeploymentIDs {
+		if _, ok := newDeployments[node]; ok {
+			continue
+		}
+
+		nodePlan, err := planNodeDeployment(node, contractID, oldDeployments[node], gridtypes.Deployment{}, false, strategy)
+		if err != nil {
+			return Plan{}, errors.Wrapf(err, "could not plan node %d deployment", node)
+		}
+		plan.Nodes = append(plan.Nodes, nodePlan)
+	}
+
+	sort.Slice(plan.Nodes, func(i, j int) bool { return plan.Nodes[i].NodeID < plan.Nodes[j].NodeID })
+	return plan, nil
+}
+
+// planNodeDeployment computes the changes of one node, the same way the deployer decides to create, update or delete
+func planNodeDeployment(node uint32, contractID uint64, oldDl, newDl gridtypes.Deployment, exists bool, strategy UpdateStrategy) (NodePlan, error) {
+	nodePlan := NodePlan{NodeID: node, ContractID: contractID}
+
+	switch {
+	case !exists:
+		nodePlan.Action = NodeDelete
+	case contractID == 0:
+		nodePlan.Action = NodeCreate
+	default:
+		oldHash, err := HashDeployment(oldDl)
+		if err != nil {
+			return NodePlan{}, errors.Wrap(err, "could not get old deployment hash")
+		}
+		newHash, err := HashDeployment(newDl)
+		if err != nil {
+			return NodePlan{}, errors.Wrap(err, "could not get new deployment hash")
+		}
+
+		nodePlan.Action = NodeUpdate
+		if oldHash == newHash && SameWorkloadsNames(newDl, oldDl) {
+			nodePlan.Action = NodeNoop
+		}
+	}
+
+	oldHashes, err := GetWorkloadHashes(oldDl)
+	if err != nil {
+		return NodePlan{}, errors.Wrap(err, "could not get old workloads hashes")
+	}
+	newHashes, err := GetWorkloadHashes(newDl)
+	if err != nil {
+		return NodePlan{}, errors.Wrap(err, "could not get new workloads hashes")
+	}
+
+	if nodePlan.Action != NodeNoop {
+		for _, wl := range newDl.Workloads {
+			oldHash, ok := oldHashes[string(wl.Name)]
+			if !ok {
+				nodePlan.Workloads = append(nodePlan.Workloads, WorkloadChange{Name: string(wl.Name), Type: wl.Type, Action: WorkloadAdded})
+			} else if oldHash != newHashes[string(wl.Name)] {
+				nodePlan.Workloads = append(nodePlan.Workloads, WorkloadChange{Name: string(wl.Name), Type: wl.Type, Action: WorkloadChanged})
+			}
+		}
+		for _, wl := range oldDl.Workloads {
+			if _, ok := newHashes[string(wl.Name)]; !ok {
+				nodePlan.Workloads = append(nodePlan.Workloads, WorkloadChange{Name: string(wl.Name), Type: wl.Type, Action: WorkloadRemoved})
+			}
+		}
+	}
+
+	oldCap, err := Capacity(oldDl)
+	if err != nil {
+		return NodePlan{}, errors.Wrap(err, "could not read old deployment capacity")
+	}
+	newCap, err := Capacity(newDl)
+	if err != nil {
+		return NodePlan{}, errors.Wrap(err, "could not read new deployment capacity")
+	}
+	nodePlan.Capacity = newCapacityDelta(oldCap, newCap)
+
+	oldIPs, err := CountDeploymentPublicIPs(oldDl)
+	if err != nil {
+		return NodePlan{}, errors.Wrap(err, "failed to count old deployment public IPs")
+	}
+	newIPs, err := CountDeploymentPublicIPs(newDl)
+	if err != nil {
+		return NodePlan{}, errors.Wrap(err, "failed to count new deployment public IPs")
+	}
+	nodePlan.PublicIPs = int(newIPs) - int(oldIPs)
+
+	if nodePlan.Action == NodeUpdate && nodePlan.PublicIPs != 0 && strategy == RecreateOnPublicIPsChange {
+		nodePlan.Action = NodeRecreate
+	}
+
+	return nodePlan, nil
+}
@@ -0,0 +1,145 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	client "github.com/threefoldtech/grid3-go/node"
+	"github.com/threefoldtech/grid3-go/workloads"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+)
+
+func TestPlan(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	deployer, sub, ncPool, cl := setupMockedDeployer(t, ctrl)
+	identity := deployer.identity
+	twinID := deployer.twinID
+
+	disk := workloads.Disk{Name: "disk", SizeGB: 1}
+
+	oldNameGW, err := deploymentWithNameGateway(identity, twinID, false, 0, backendURLWithoutTLSPassthrough)
+	assert.NoError(t, err)
+	newNameGW, err := deploymentWithNameGateway(identity, twinID, true, 0, backendURLWithTLSPassthrough)
+	assert.NoError(t, err)
+	sameNameGW, err := deploymentWithNameGateway(identity, twinID, false, 0, backendURLWithoutTLSPassthrough)
+	assert.NoError(t, err)
+	deletedNameGW, err := deploymentWithNameGateway(identity, twinID, false, 0, backendURLWithoutTLSPassthrough)
+	assert.NoError(t, err)
+	deletedNameGW.Workloads = append(deletedNameGW.Workloads, disk.ZosWorkload())
+
+	fqdn, err := deploymentWithFQDN(identity, twinID, 0)
+	assert.NoError(t, err)
+	fqdn.Workloads = append(fqdn.Workloads, disk.ZosWorkload())
+
+	oldDeploymentIDs := map[uint32]uint64{
+		10: 100,
+		20: 200,
+		40: 400,
+	}
+	oldDeployments := map[uint32]gridtypes.Deployment{
+		10: deletedNameGW,
+		20: oldNameGW,
+		40: sameNameGW,
+	}
+	newDeployments := map[uint32]gridtypes.Deployment{
+		20: newNameGW,
+		30: fqdn,
+		40: sameNameGW,
+	}
+
+	t.Run("diff", func(t *testing.T) {
+		plan, err := newPlan(oldDeploymentIDs, oldDeployments, newDeployments, UpdateInPlace)
+		assert.NoError(t, err)
+		assert.True(t, plan.HasChanges())
+
+		assert.Equal(t, []NodePlan{
+			{
+				NodeID:     10,
+				ContractID: 100,
+				Action:     NodeDelete,
+				Workloads: []WorkloadChange{
+					{Name: "name", Type: zos.GatewayNameProxyType, Action: WorkloadRemoved},
+					{Name: "disk", Type: zos.ZMountType, Action: WorkloadRemoved},
+				},
+				Capacity: CapacityDelta{SRU: -int64(gridtypes.Gigabyte)},
+			},
+			{
+				NodeID:     20,
+				ContractID: 200,
+				Action:     NodeUpdate,
+				Workloads: []WorkloadChange{
+					{Name: "name", Type: zos.GatewayNameProxyType, Action: WorkloadChanged},
+				},
+			},
+			{
+				NodeID: 30,
+				Action: NodeCreate,
+				Workloads: []WorkloadChange{
+					{Name: "fqdn", Type: zos.GatewayFQDNProxyType, Action: WorkloadAdded},
+					{Name: "disk", Type: zos.ZMountType, Action: WorkloadAdded},
+				},
+				Capacity: CapacityDelta{SRU: int64(gridtypes.Gigabyte)},
+			},
+			{
+				NodeID:     40,
+				ContractID: 400,
+				Action:     NodeNoop,
+			},
+		}, plan.Nodes)
+
+		assert.Equal(t, CapacityDelta{}, plan.Capacity())
+		assert.Equal(t, 0, plan.PublicIPs())
+		assert.Contains(t, plan.String(), "node 10: delete (contract 100)")
+		assert.Contains(t, plan.String(), "added fqdn (gateway-fqdn-proxy)")
+	})
+
+	t.Run("no changes", func(t *testing.T) {
+		plan, err := newPlan(map[uint32]uint64{40: 400}, map[uint32]gridtypes.Deployment{40: sameNameGW}, map[uint32]gridtypes.Deployment{40: sameNameGW}, UpdateInPlace)
+		assert.NoError(t, err)
+		assert.False(t, plan.HasChanges())
+	})
+
+	t.Run("recreate on public ips change", func(t *testing.T) {
+		withIP := newNameGW
+		withIP.Workloads = append([]gridtypes.Workload{}, newNameGW.Workloads...)
+		withIP.Workloads = append(withIP.Workloads, gridtypes.Workload{
+			Name: "ip",
+			Type: zos.PublicIPType,
+			Data: gridtypes.MustMarshal(zos.PublicIP{V4: true}),
+		})
+
+		plan, err := newPlan(map[uint32]uint64{20: 200}, map[uint32]gridtypes.Deployment{20: oldNameGW}, map[uint32]gridtypes.Deployment{20: withIP}, UpdateInPlace)
+		assert.NoError(t, err)
+		assert.Equal(t, NodeUpdate, plan.Nodes[0].Action)
+		assert.Equal(t, 1, plan.PublicIPs())
+
+		plan, err = newPlan(map[uint32]uint64{20: 200}, map[uint32]gridtypes.Deployment{20: oldNameGW}, map[uint32]gridtypes.Deployment{20: withIP}, RecreateOnPublicIPsChange)
+		assert.NoError(t, err)
+		assert.Equal(t, NodeRecreate, plan.Nodes[0].Action)
+	})
+
+	t.Run("deployer plan loads old deployments", func(t *testing.T) {
+		ncPool.EXPECT().
+			GetNodeClient(sub, uint32(20)).
+			Return(client.NewNodeClient(23, cl, 10), nil)
+
+		cl.EXPECT().
+			Call(gomock.Any(), uint32(23), "zos.deployment.get", gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+				var res *gridtypes.Deployment = result.(*gridtypes.Deployment)
+				*res = oldNameGW
+				return nil
+			})
+
+		plan, err := deployer.Plan(context.Background(), map[uint32]uint64{20: 200}, map[uint32]gridtypes.Deployment{20: newNameGW})
+		assert.NoError(t, err)
+		assert.Len(t, plan.Nodes, 1)
+		assert.Equal(t, NodeUpdate, plan.Nodes[0].Action)
+	})
+}
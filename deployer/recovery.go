@@ -0,0 +1,124 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// Recover finishes or cancels the operations left in the journal by an interrupted deployer, it should be called on startup before deploying.
+// contracts of interrupted creations are canceled since they were never returned to the caller,
+// interrupted updates are sent again to the nodes and interrupted cancellations are done again.
+// entries that fail to be recovered are kept in the journal
+func (d *Deployer) Recover(ctx context.Context) error {
+	if d.journal == nil {
+		return nil
+	}
+
+	entries, err := d.journal.Pending()
+	if err != nil {
+		return errors.Wrap(err, "failed to read the journal")
+	}
+
+	var errs []string
+	for _, entry := range entries {
+		if err := d.recoverEntry(ctx, entry); err != nil {
+			errs = append(errs, fmt.Sprintf("%s operation %s on node %d: %s", entry.Op, entry.ID, entry.NodeID, err))
+			continue
+		}
+		d.journalComplete(entry.ID)
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to recover operations: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (d *Deployer) recoverEntry(ctx context.Context, entry JournalEntry) error {
+	switch entry.Op {
+	case JournalCreate:
+		return d.recoverCreation(entry)
+	case JournalUpdate:
+		return d.recoverUpdate(ctx, entry)
+	case JournalCancel:
+		log.Info().Msgf("canceling contract %d of an interrupted cancellation", entry.ContractID)
+		return errors.Wrapf(d.substrateConn.EnsureContractCanceled(d.identity, entry.ContractID), "failed to cancel contract %d", entry.ContractID)
+	}
+	return fmt.Errorf("unknown journal operation %s", entry.Op)
+}
+
+// recoverCreation cancels the contract of an interrupted creation if it was created
+func (d *Deployer) recoverCreation(entry JournalEntry) error {
+	contractID := entry.ContractID
+	if contractID == 0 {
+		id, err := d.substrateConn.GetContractIDByNodeHash(entry.NodeID, entry.Hash)
+		if errors.Is(err, substrate.ErrNotFound) {
+			// the contract was never created
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to get contract using the deployment hash")
+		}
+		contractID = id
+	}
+
+	log.Info().Msgf("canceling contract %d of an interrupted deployment on node %d", contractID, entry.NodeID)
+	return errors.Wrapf(d.substrateConn.EnsureContractCanceled(d.identity, contractID), "failed to cancel contract %d", contractID)
+}
+
+// recoverUpdate sends an interrupted update to the node if its contract was updated
+// if the node refuses it, the contract hash is set back to the node deployment hash
+func (d *Deployer) recoverUpdate(ctx context.Context, entry JournalEntry) error {
+	contract, err := d.substrateConn.GetContract(entry.ContractID)
+	if errors.Is(err, substrate.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get contract %d", entry.ContractID)
+	}
+	if !contract.IsCreated() || contract.ContractType.NodeContract.DeploymentHash != substrate.NewHexHash(entry.Hash) {
+		// the contract was not updated, so the node couldn't accept the update
+		return nil
+	}
+
+	nodeClient, err := d.ncPool.GetNodeClient(d.substrateConn, entry.NodeID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get node client")
+	}
+
+	sub, cancel := context.WithTimeout(ctx, d.config.NodeCallTimeout)
+	defer cancel()
+	nodeDl, err := nodeClient.DeploymentGet(sub, entry.ContractID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get deployment %d", entry.ContractID)
+	}
+	if nodeDl.Version >= entry.Deployment.Version {
+		return nil
+	}
+
+	log.Info().Msgf("sending interrupted update of deployment %d to node %d", entry.ContractID, entry.NodeID)
+	sub, cancel = context.WithTimeout(ctx, d.config.DeployTimeout)
+	defer cancel()
+	err = nodeClient.DeploymentUpdate(sub, entry.Deployment)
+	if err == nil {
+		return nil
+	}
+
+	hash, herr := nodeDl.ChallengeHash()
+	if herr != nil {
+		return fmt.Errorf("failed to send deployment update: %w; failed to get node deployment hash: %s", err, herr)
+	}
+	if _, cerr := d.substrateConn.UpdateNodeContract(d.identity, entry.ContractID, "", hex.EncodeToString(hash)); cerr != nil {
+		return fmt.Errorf("failed to send deployment update: %w; failed to set contract hash back: %s", err, cerr)
+	}
+
+	log.Warn().Err(err).Msgf("node %d refused the interrupted update of deployment %d, the contract is set back to the node deployment", entry.NodeID, entry.ContractID)
+	return nil
+}
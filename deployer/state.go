@@ -5,7 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"reflect"
+	"net"
+	"sort"
+	"sync"
 
 	"github.com/pkg/errors"
 	client "github.com/threefoldtech/grid3-go/node"
@@ -19,12 +21,26 @@ import (
 type ContractIDs []uint64
 
 // State struct
+// it's safe for concurrent use, the exported maps must not be changed directly while deployers are using the state
 type State struct {
 	CurrentNodeDeployments map[uint32]ContractIDs
 	// TODO: remove it and merge with deployments
 	CurrentNodeNetworks map[uint32]ContractIDs
 
 	networks NetworkState
+	// ips assigns the private IPs of the deployments in the networks
+	ips *ipAllocator
+	// lock protects the contracts, networks and the IPs reservations
+	lock sync.RWMutex
+	// index caches the contracts deployments used to load workloads from the grid
+	index *deploymentsIndex
+	// saveLock keeps the saves in the same order of the changes
+	saveLock sync.Mutex
+
+	// store persists the state after each deployer change, the state is only kept in memory if it's nil
+	store StateStore
+	// contractsLister lists the twin contracts to discover the state
+	contractsLister ContractsLister
 
 	ncPool    client.NodeClientGetter
 	substrate subi.SubstrateExt
@@ -32,18 +48,175 @@ type State struct {
 
 // NewState generates a new state
 func NewState(ncPool client.NodeClientGetter, substrate subi.SubstrateExt) *State {
-	return &State{
+	st := &State{
 		CurrentNodeDeployments: make(map[uint32]ContractIDs),
 		CurrentNodeNetworks:    make(map[uint32]ContractIDs),
 		networks:               NetworkState{},
+		index:                  newDeploymentsIndex(DefaultIndexTTL),
 		ncPool:                 ncPool,
 		substrate:              substrate,
 	}
+	st.ips = newIPAllocator(st)
+	return st
+}
+
+// Load replaces the state with the state saved in its store
+func (st *State) Load() error {
+	if st.store == nil {
+		return nil
+	}
+
+	data, err := st.store.Load()
+	if err != nil {
+		return errors.Wrap(err, "failed to load state")
+	}
+
+	st.replace(data.CurrentNodeDeployments, data.CurrentNodeNetworks, data.Networks)
+	return nil
+}
+
+// Save writes the state to its store
+func (st *State) Save() error {
+	if st.store == nil {
+		return nil
+	}
+
+	st.saveLock.Lock()
+	defer st.saveLock.Unlock()
+
+	st.lock.RLock()
+	data := StateData{
+		CurrentNodeDeployments: copyContracts(st.CurrentNodeDeployments),
+		CurrentNodeNetworks:    copyContracts(st.CurrentNodeNetworks),
+		Networks:               st.networks.copy(),
+	}
+	st.lock.RUnlock()
+
+	return errors.Wrap(st.store.Save(data), "failed to save state")
+}
+
+// SetStore sets the store used to persist the state
+func (st *State) SetStore(store StateStore) {
+	st.store = store
+}
+
+// saveAfter saves the state after a deployer change, the save error is added to the change error if both failed
+func (st *State) saveAfter(err error) error {
+	saveErr := st.Save()
+	if saveErr == nil {
+		return err
+	}
+	if err == nil {
+		return saveErr
+	}
+	return fmt.Errorf("%w; %s", err, saveErr)
+}
+
+// replace replaces all the contracts and networks of the state
+func (st *State) replace(deployments, networkContracts map[uint32]ContractIDs, networks NetworkState) {
+	if deployments == nil {
+		deployments = make(map[uint32]ContractIDs)
+	}
+	if networkContracts == nil {
+		networkContracts = make(map[uint32]ContractIDs)
+	}
+	if networks == nil {
+		networks = NetworkState{}
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.CurrentNodeDeployments = deployments
+	st.CurrentNodeNetworks = networkContracts
+	st.networks = networks
+	st.index.invalidate()
+}
+
+// addDeployment adds a deployment contract to a node if it's not added
+func (st *State) addDeployment(nodeID uint32, contractID uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.index.invalidate(contractID)
+
+	if !workloads.Contains(st.CurrentNodeDeployments[nodeID], contractID) {
+		st.CurrentNodeDeployments[nodeID] = append(st.CurrentNodeDeployments[nodeID], contractID)
+	}
+}
+
+// removeDeployment removes a deployment contract from a node
+func (st *State) removeDeployment(nodeID uint32, contractID uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.index.invalidate(contractID)
+
+	st.CurrentNodeDeployments[nodeID] = workloads.Delete(st.CurrentNodeDeployments[nodeID], contractID)
+}
+
+// addNetworkContract adds a network contract to a node if it's not added
+func (st *State) addNetworkContract(nodeID uint32, contractID uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.index.invalidate(contractID)
+
+	if !workloads.Contains(st.CurrentNodeNetworks[nodeID], contractID) {
+		st.CurrentNodeNetworks[nodeID] = append(st.CurrentNodeNetworks[nodeID], contractID)
+	}
+}
+
+// removeNetworkContract removes a network contract from a node
+func (st *State) removeNetworkContract(nodeID uint32, contractID uint64) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.index.invalidate(contractID)
+
+	st.CurrentNodeNetworks[nodeID] = workloads.Delete(st.CurrentNodeNetworks[nodeID], contractID)
+}
+
+// nodeDeployments returns a copy of the deployment contracts of a node
+func (st *State) nodeDeployments(nodeID uint32) (ContractIDs, bool) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	contractIDs, ok := st.CurrentNodeDeployments[nodeID]
+	return append(ContractIDs{}, contractIDs...), ok
+}
+
+// nodeNetworks returns a copy of the network contracts of all nodes
+func (st *State) nodeNetworks() map[uint32]ContractIDs {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	return copyContracts(st.CurrentNodeNetworks)
+}
+
+// allDeployments returns a copy of the deployment contracts of all nodes
+func (st *State) allDeployments() map[uint32]ContractIDs {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	return copyContracts(st.CurrentNodeDeployments)
+}
+
+// updateNetworks runs fn with the state networks while no other change can happen
+func (st *State) updateNetworks(fn func(networks NetworkState)) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	fn(st.networks)
+}
+
+func copyContracts(contracts map[uint32]ContractIDs) map[uint32]ContractIDs {
+	cp := make(map[uint32]ContractIDs, len(contracts))
+	for nodeID, contractIDs := range contracts {
+		cp[nodeID] = append(ContractIDs{}, contractIDs...)
+	}
+	return cp
 }
 
 // LoadDiskFromGrid loads a disk from grid
-func (st *State) LoadDiskFromGrid(nodeID uint32, name string, deploymentName string) (workloads.Disk, error) {
-	wl, dl, err := st.GetWorkloadInDeployment(nodeID, name, deploymentName)
+func (st *State) LoadDiskFromGrid(ctx context.Context, nodeID uint32, name string, deploymentName string) (workloads.Disk, error) {
+	wl, dl, err := st.GetWorkloadInDeployment(ctx, nodeID, name, deploymentName)
 	if err != nil {
 		return workloads.Disk{}, errors.Wrapf(err, "could not get workload from node %d within deployment %v", nodeID, dl)
 	}
@@ -52,8 +225,8 @@ func (st *State) LoadDiskFromGrid(nodeID uint32, name string, deploymentName str
 }
 
 // LoadGatewayFQDNFromGrid loads a gateway FQDN proxy from grid
-func (st *State) LoadGatewayFQDNFromGrid(nodeID uint32, name string, deploymentName string) (workloads.GatewayFQDNProxy, error) {
-	wl, dl, err := st.GetWorkloadInDeployment(nodeID, name, deploymentName)
+func (st *State) LoadGatewayFQDNFromGrid(ctx context.Context, nodeID uint32, name string, deploymentName string) (workloads.GatewayFQDNProxy, error) {
+	wl, dl, err := st.GetWorkloadInDeployment(ctx, nodeID, name, deploymentName)
 	if err != nil {
 		return workloads.GatewayFQDNProxy{}, errors.Wrapf(err, "could not get workload from node %d within deployment %v", nodeID, dl)
 	}
@@ -74,8 +247,8 @@ func (st *State) LoadGatewayFQDNFromGrid(nodeID uint32, name string, deploymentN
 }
 
 // LoadQSFSFromGrid loads a QSFS from grid
-func (st *State) LoadQSFSFromGrid(nodeID uint32, name string, deploymentName string) (workloads.QSFS, error) {
-	wl, dl, err := st.GetWorkloadInDeployment(nodeID, name, deploymentName)
+func (st *State) LoadQSFSFromGrid(ctx context.Context, nodeID uint32, name string, deploymentName string) (workloads.QSFS, error) {
+	wl, dl, err := st.GetWorkloadInDeployment(ctx, nodeID, name, deploymentName)
 	if err != nil {
 		return workloads.QSFS{}, errors.Wrapf(err, "could not get workload from node %d within deployment %v", nodeID, dl)
 	}
@@ -84,8 +257,8 @@ func (st *State) LoadQSFSFromGrid(nodeID uint32, name string, deploymentName str
 }
 
 // LoadGatewayNameFromGrid loads a gateway name proxy from grid
-func (st *State) LoadGatewayNameFromGrid(nodeID uint32, name string, deploymentName string) (workloads.GatewayNameProxy, error) {
-	wl, dl, err := st.GetWorkloadInDeployment(nodeID, name, deploymentName)
+func (st *State) LoadGatewayNameFromGrid(ctx context.Context, nodeID uint32, name string, deploymentName string) (workloads.GatewayNameProxy, error) {
+	wl, dl, err := st.GetWorkloadInDeployment(ctx, nodeID, name, deploymentName)
 	if err != nil {
 		return workloads.GatewayNameProxy{}, errors.Wrapf(err, "could not get workload from node %d within deployment %v", nodeID, dl)
 	}
@@ -111,8 +284,8 @@ func (st *State) LoadGatewayNameFromGrid(nodeID uint32, name string, deploymentN
 }
 
 // LoadZdbFromGrid loads a zdb from grid
-func (st *State) LoadZdbFromGrid(nodeID uint32, name string, deploymentName string) (workloads.ZDB, error) {
-	wl, dl, err := st.GetWorkloadInDeployment(nodeID, name, deploymentName)
+func (st *State) LoadZdbFromGrid(ctx context.Context, nodeID uint32, name string, deploymentName string) (workloads.ZDB, error) {
+	wl, dl, err := st.GetWorkloadInDeployment(ctx, nodeID, name, deploymentName)
 	if err != nil {
 		return workloads.ZDB{}, errors.Wrapf(err, "could not get workload from node %d within deployment %v", nodeID, dl)
 	}
@@ -121,8 +294,8 @@ func (st *State) LoadZdbFromGrid(nodeID uint32, name string, deploymentName stri
 }
 
 // LoadVMFromGrid loads a vm from a grid
-func (st *State) LoadVMFromGrid(nodeID uint32, name string, deploymentName string) (workloads.VM, error) {
-	wl, dl, err := st.GetWorkloadInDeployment(nodeID, name, deploymentName)
+func (st *State) LoadVMFromGrid(ctx context.Context, nodeID uint32, name string, deploymentName string) (workloads.VM, error) {
+	wl, dl, err := st.GetWorkloadInDeployment(ctx, nodeID, name, deploymentName)
 	if err != nil {
 		return workloads.VM{}, errors.Wrapf(err, "could not get workload from node %d", nodeID)
 	}
@@ -131,22 +304,86 @@ func (st *State) LoadVMFromGrid(nodeID uint32, name string, deploymentName strin
 }
 
 // LoadK8sFromGrid loads k8s from grid
-func (st *State) LoadK8sFromGrid(nodeIDs []uint32, deploymentName string) (workloads.K8sCluster, error) {
+func (st *State) LoadK8sFromGrid(ctx context.Context, nodeIDs []uint32, deploymentName string) (workloads.K8sCluster, error) {
+	// the nodes deployments are indexed concurrently before looking for the cluster deployment in each node
+	nodeContracts := make(map[uint32]ContractIDs)
+	for _, nodeID := range nodeIDs {
+		if contractIDs, ok := st.nodeDeployments(nodeID); ok {
+			nodeContracts[nodeID] = contractIDs
+		}
+	}
+	if _, err := st.indexedDeployments(ctx, nodeContracts); err != nil {
+		return workloads.K8sCluster{}, errors.Wrapf(err, "could not get deployment %s", deploymentName)
+	}
 
 	clusterDeployments := make(map[uint32]gridtypes.Deployment)
-	nodeDeploymentID := map[uint32]uint64{}
 	for _, nodeID := range nodeIDs {
-		_, deployment, err := st.GetWorkloadInDeployment(nodeID, "", deploymentName)
+		_, deployment, err := st.GetWorkloadInDeployment(ctx, nodeID, "", deploymentName)
 		if err != nil {
 			return workloads.K8sCluster{}, errors.Wrapf(err, "could not get deployment %s", deploymentName)
 		}
 		clusterDeployments[nodeID] = deployment
-		nodeDeploymentID[nodeID] = deployment.ContractID
 	}
 
-	cluster := workloads.K8sCluster{}
+	return st.k8sClusterFromDeployments(clusterDeployments, deploymentName)
+}
+
+// LoadK8sFromGridByName loads k8s from grid without knowing its nodes, the cluster nodes are the nodes
+// of the state deployments with the cluster name, or the nodes of the twin contracts with the cluster name
+// if the state has no deployments of the cluster and a contracts lister is set
+func (st *State) LoadK8sFromGridByName(ctx context.Context, deploymentName string) (workloads.K8sCluster, error) {
+	clusterDeployments, err := st.k8sDeployments(ctx, st.allDeployments(), deploymentName)
+	if err != nil {
+		return workloads.K8sCluster{}, err
+	}
+
+	if len(clusterDeployments) == 0 && st.contractsLister != nil {
+		nodeContracts, err := st.twinContractsByName(k8sDeploymentType, deploymentName)
+		if err != nil {
+			return workloads.K8sCluster{}, err
+		}
+
+		clusterDeployments, err = st.k8sDeployments(ctx, nodeContracts, deploymentName)
+		if err != nil {
+			return workloads.K8sCluster{}, err
+		}
+	}
+
+	if len(clusterDeployments) == 0 {
+		return workloads.K8sCluster{}, errors.Errorf("could not find k8s cluster %s", deploymentName)
+	}
+
+	return st.k8sClusterFromDeployments(clusterDeployments, deploymentName)
+}
+
+// k8sDeployments returns the k8s deployments with the cluster name in the node contracts
+func (st *State) k8sDeployments(ctx context.Context, nodeContracts map[uint32]ContractIDs, deploymentName string) (map[uint32]gridtypes.Deployment, error) {
+	nodeEntries, err := st.indexedDeployments(ctx, nodeContracts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not get deployment %s", deploymentName)
+	}
+
+	clusterDeployments := make(map[uint32]gridtypes.Deployment)
+	for nodeID, entries := range nodeEntries {
+		for _, entry := range entries {
+			if entry.dataErr == nil && entry.data.Type == k8sDeploymentType && entry.data.Name == deploymentName {
+				clusterDeployments[nodeID] = entry.deployment
+			}
+		}
+	}
+	return clusterDeployments, nil
+}
+
+// k8sClusterFromDeployments generates a k8s cluster from its nodes deployments
+func (st *State) k8sClusterFromDeployments(clusterDeployments map[uint32]gridtypes.Deployment, deploymentName string) (workloads.K8sCluster, error) {
+	cluster := workloads.K8sCluster{
+		NodesIPRange:     make(map[uint32]gridtypes.IPNet),
+		NodeDeploymentID: make(map[uint32]uint64),
+	}
 
 	for nodeID, deployment := range clusterDeployments {
+		cluster.NodeDeploymentID[nodeID] = deployment.ContractID
+
 		for _, workload := range deployment.Workloads {
 			if workload.Type != zos.ZMachineType {
 				continue
@@ -172,6 +409,9 @@ func (st *State) LoadK8sFromGrid(nodeIDs []uint32, deploymentName string) (workl
 					return workloads.K8sCluster{}, errors.Wrapf(err, "could not generate node deployment metadata for %s", workload.Name)
 				}
 				cluster.SolutionType = deploymentData.ProjectName
+				if err := loadK8sClusterConfig(&cluster, workload); err != nil {
+					return workloads.K8sCluster{}, err
+				}
 				continue
 			}
 			cluster.Workers = append(cluster.Workers, node)
@@ -180,10 +420,56 @@ func (st *State) LoadK8sFromGrid(nodeIDs []uint32, deploymentName string) (workl
 	if cluster.Master == nil {
 		return workloads.K8sCluster{}, fmt.Errorf("failed to get master node for k8s cluster %s", deploymentName)
 	}
-	cluster.NodeDeploymentID = nodeDeploymentID
+	sort.Slice(cluster.Workers, func(i, j int) bool { return cluster.Workers[i].Name < cluster.Workers[j].Name })
+
+	network := st.GetNetworks().GetNetwork(cluster.NetworkName)
+	for _, node := range append([]workloads.K8sNode{*cluster.Master}, cluster.Workers...) {
+		if _, ok := cluster.NodesIPRange[node.Node]; ok {
+			continue
+		}
+		ipRange, err := k8sNodeIPRange(network, node)
+		if err != nil {
+			return workloads.K8sCluster{}, err
+		}
+		cluster.NodesIPRange[node.Node] = ipRange
+	}
+
 	return cluster, nil
 }
 
+// loadK8sClusterConfig loads the cluster network, token and ssh key from the master workload
+func loadK8sClusterConfig(cluster *workloads.K8sCluster, master gridtypes.Workload) error {
+	dataI, err := master.WorkloadData()
+	if err != nil {
+		return errors.Wrapf(err, "could not get workload %s data", master.Name)
+	}
+	data, ok := dataI.(*zos.ZMachine)
+	if !ok {
+		return errors.Errorf("could not create vm workload from data %v", dataI)
+	}
+
+	if len(data.Network.Interfaces) != 0 {
+		cluster.NetworkName = data.Network.Interfaces[0].Network.String()
+	}
+	cluster.Token = data.Env["K3S_TOKEN"]
+	cluster.SSHKey = data.Env["SSH_KEY"]
+	return nil
+}
+
+// k8sNodeIPRange returns the node subnet in the cluster network, the state network subnet is used if it's known,
+// otherwise it's the /24 subnet of the node private IP
+func k8sNodeIPRange(network Network, node workloads.K8sNode) (gridtypes.IPNet, error) {
+	if subnet := network.getNodeSubnet(node.Node); subnet != "" {
+		return gridtypes.ParseIPNet(subnet)
+	}
+
+	ip := net.ParseIP(node.IP).To4()
+	if ip == nil {
+		return gridtypes.IPNet{}, errors.Errorf("invalid private ip %s of k8s node %s", node.IP, node.Name)
+	}
+	return workloads.IPNet(ip[0], ip[1], ip[2], 0, 24), nil
+}
+
 func isMasterNode(workload gridtypes.Workload) (bool, error) {
 	dataI, err := workload.WorkloadData()
 	if err != nil {
@@ -247,43 +533,94 @@ func (st *State) computeK8sDeploymentResources(nodeID uint32, dl gridtypes.Deplo
 	return
 }
 
-// LoadNetworkFromGrid loads a network from grid
-func (st *State) LoadNetworkFromGrid(name string) (znet workloads.ZNet, err error) {
-	sub := st.substrate
-	for nodeID := range st.CurrentNodeNetworks {
-		nodeClient, err := st.ncPool.GetNodeClient(sub, nodeID)
-		if err != nil {
-			return znet, errors.Wrapf(err, "could not get node client: %d", nodeID)
-		}
+// LoadNetworkFromGrid loads a network from grid, the network workloads of all nodes are merged in one network
+// with its nodes subnets, keys, ports and the user wireguard access
+func (st *State) LoadNetworkFromGrid(ctx context.Context, name string) (znet workloads.ZNet, err error) {
+	nodeEntries, err := st.indexedDeployments(ctx, st.nodeNetworks())
+	if err != nil {
+		return znet, errors.Wrapf(err, "could not get network %s deployments", name)
+	}
 
-		for _, contractID := range st.CurrentNodeNetworks[nodeID] {
-			dl, err := nodeClient.DeploymentGet(context.Background(), contractID)
-			if err != nil {
-				return znet, errors.Wrapf(err, "could not get network deployment %d from node %d", contractID, nodeID)
-			}
+	found := false
+	for nodeID, entries := range nodeEntries {
+		for _, entry := range entries {
+			for _, wl := range entry.deployment.Workloads {
+				if wl.Type != zos.NetworkType || wl.Name != gridtypes.Name(name) {
+					continue
+				}
 
-			for _, wl := range dl.Workloads {
-				if wl.Type == zos.NetworkType && wl.Name == gridtypes.Name(name) {
-					znet, err = workloads.NewNetworkFromWorkload(wl, nodeID)
-					if err != nil {
-						return workloads.ZNet{}, errors.Wrapf(err, "failed to get network from workload %s", name)
-					}
-					break
+				nodeNetwork, err := workloads.NewNetworkFromWorkload(wl, nodeID)
+				if err != nil {
+					return workloads.ZNet{}, errors.Wrapf(err, "failed to get network from workload %s", name)
+				}
+				if !found {
+					znet = nodeNetwork
+					znet.Nodes = []uint32{}
+					znet.NodeDeploymentID = map[uint32]uint64{}
+					found = true
+				}
+				mergeNodeNetwork(&znet, nodeNetwork, nodeID)
+				znet.NodeDeploymentID[nodeID] = entry.deployment.ContractID
+				if entry.dataErr == nil {
+					znet.SolutionType = entry.data.ProjectName
 				}
 			}
 		}
 	}
 
-	if reflect.DeepEqual(znet, workloads.ZNet{}) {
+	if !found {
 		return znet, errors.Errorf("failed to get network %s", name)
 	}
+	sort.Slice(znet.Nodes, func(i, j int) bool { return znet.Nodes[i] < znet.Nodes[j] })
+
+	// the user accesses private keys are not in the network workloads, they are only known if they are in the local state
+	st.lock.RLock()
+	setAccessKeys(&znet, st.networks[name].AccessKeys)
+	st.lock.RUnlock()
+
+	if err := setAccessWGConfigs(ctx, st.substrate, st.ncPool, &znet); err != nil {
+		return workloads.ZNet{}, err
+	}
 
 	return znet, nil
 }
 
+// mergeNodeNetwork adds the data of a node network workload to the network
+func mergeNodeNetwork(znet *workloads.ZNet, nodeNetwork workloads.ZNet, nodeID uint32) {
+	if !workloads.Contains(znet.Nodes, nodeID) {
+		znet.Nodes = append(znet.Nodes, nodeID)
+	}
+	znet.NodesIPRange[nodeID] = nodeNetwork.NodesIPRange[nodeID]
+	znet.WGPort[nodeID] = nodeNetwork.WGPort[nodeID]
+	if key, ok := nodeNetwork.Keys[nodeID]; ok {
+		znet.Keys[nodeID] = key
+	}
+
+	if nodeNetwork.AddWGAccess {
+		znet.AddWGAccess = true
+		znet.ExternalIP = nodeNetwork.ExternalIP
+		znet.ExternalSK = nodeNetwork.ExternalSK
+		znet.ExternalPK = nodeNetwork.ExternalPK
+	}
+	if len(nodeNetwork.UserAccesses) != 0 {
+		znet.UserAccesses = nodeNetwork.UserAccesses
+	}
+	if nodeNetwork.PublicNodeID != 0 {
+		znet.PublicNodeID = nodeNetwork.PublicNodeID
+	}
+	if len(nodeNetwork.BackupPublicNodeIDs) != 0 {
+		znet.BackupPublicNodeIDs = nodeNetwork.BackupPublicNodeIDs
+		znet.PublicNodesCount = nodeNetwork.PublicNodesCount
+	}
+	if len(nodeNetwork.AccessDNS) != 0 || nodeNetwork.AccessMTU != 0 {
+		znet.AccessDNS = nodeNetwork.AccessDNS
+		znet.AccessMTU = nodeNetwork.AccessMTU
+	}
+}
+
 // LoadDeploymentFromGrid loads deployment from grid
-func (st *State) LoadDeploymentFromGrid(nodeID uint32, name string) (workloads.Deployment, error) {
-	_, deployment, err := st.GetWorkloadInDeployment(nodeID, "", name)
+func (st *State) LoadDeploymentFromGrid(ctx context.Context, nodeID uint32, name string) (workloads.Deployment, error) {
+	_, deployment, err := st.GetWorkloadInDeployment(ctx, nodeID, "", name)
 	if err != nil {
 		return workloads.Deployment{}, err
 	}
@@ -292,29 +629,24 @@ func (st *State) LoadDeploymentFromGrid(nodeID uint32, name string) (workloads.D
 
 // GetWorkloadInDeployment return a workload in a deployment using their names and node ID
 // if name is empty it returns a deployment with name equal to deploymentName and empty workload
-func (st *State) GetWorkloadInDeployment(nodeID uint32, name string, deploymentName string) (gridtypes.Workload, gridtypes.Deployment, error) {
-	sub := st.substrate
-	if contractIDs, ok := st.CurrentNodeDeployments[nodeID]; ok {
-		nodeClient, err := st.ncPool.GetNodeClient(sub, nodeID)
+func (st *State) GetWorkloadInDeployment(ctx context.Context, nodeID uint32, name string, deploymentName string) (gridtypes.Workload, gridtypes.Deployment, error) {
+	if contractIDs, ok := st.nodeDeployments(nodeID); ok {
+		entries, err := st.indexedDeployments(ctx, map[uint32]ContractIDs{nodeID: contractIDs})
 		if err != nil {
-			return gridtypes.Workload{}, gridtypes.Deployment{}, errors.Wrapf(err, "could not get node client: %d", nodeID)
+			return gridtypes.Workload{}, gridtypes.Deployment{}, err
 		}
 
-		for _, contractID := range contractIDs {
-			dl, err := nodeClient.DeploymentGet(context.Background(), contractID)
-			if err != nil {
-				return gridtypes.Workload{}, gridtypes.Deployment{}, errors.Wrapf(err, "could not get deployment %d from node %d", contractID, nodeID)
-			}
-
-			dlData, err := workloads.ParseDeploymentData(dl.Metadata)
-			if err != nil {
-				return gridtypes.Workload{}, gridtypes.Deployment{}, errors.Wrapf(err, "could not get deployment %d data", contractID)
+		for _, entry := range entries[nodeID] {
+			if entry.dataErr != nil {
+				return gridtypes.Workload{}, gridtypes.Deployment{}, entry.dataErr
 			}
 
-			if dlData.Name != deploymentName {
+			if entry.data.Name != deploymentName {
 				continue
 			}
 
+			dl := entry.deployment
+
 			if name == "" {
 				return gridtypes.Workload{}, dl, nil
 			}
@@ -330,12 +662,18 @@ func (st *State) GetWorkloadInDeployment(nodeID uint32, name string, deploymentN
 	return gridtypes.Workload{}, gridtypes.Deployment{}, fmt.Errorf("could not get workload '%s' with node ID %d", name, nodeID)
 }
 
-// GetNetworks gets state networks
+// GetNetworks gets a copy of the state networks
 func (st *State) GetNetworks() NetworkState {
-	return st.networks
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	return st.networks.copy()
 }
 
 // SetNetworks sets state networks
 func (st *State) SetNetworks(networks NetworkState) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
 	st.networks = networks
 }
@@ -0,0 +1,251 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/grid3-go/graphql"
+	"github.com/threefoldtech/grid3-go/workloads"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+)
+
+const (
+	// networkDeploymentType is the deployment data type of network deployments
+	networkDeploymentType = "network"
+	// k8sDeploymentType is the deployment data type of k8s deployments
+	k8sDeploymentType = "kubernetes"
+)
+
+// ContractsLister lists the contracts of a twin
+type ContractsLister interface {
+	ListContractsByTwinID(states []string) (graphql.Contracts, error)
+}
+
+// SetContractsLister sets the lister used to discover the twin contracts
+func (st *State) SetContractsLister(lister ContractsLister) {
+	st.contractsLister = lister
+}
+
+// DiscoverError is returned by Discover if some contracts could not be discovered, it keeps the error of every skipped contract
+// by its contract ID so errors.Is and errors.As can find any of them
+type DiscoverError struct {
+	Errors map[string]error
+}
+
+func (e *DiscoverError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, contractID := range e.contracts() {
+		msgs = append(msgs, fmt.Sprintf("contract %s: %s", contractID, e.Errors[contractID]))
+	}
+	return fmt.Sprintf("could not discover %d contracts: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the contracts errors sorted by the contracts IDs
+func (e *DiscoverError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, contractID := range e.contracts() {
+		errs = append(errs, e.Errors[contractID])
+	}
+	return errs
+}
+
+// Is reports whether any of the contracts errors matches target, for go versions before multiple wrapped errors support
+func (e *DiscoverError) Is(target error) bool {
+	for _, err := range e.Unwrap() {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first contract error that matches target, for go versions before multiple wrapped errors support
+func (e *DiscoverError) As(target interface{}) bool {
+	for _, err := range e.Unwrap() {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// contracts returns the IDs of the failed contracts sorted
+func (e *DiscoverError) contracts() []string {
+	contracts := make([]string, 0, len(e.Errors))
+	for contractID := range e.Errors {
+		contracts = append(contracts, contractID)
+	}
+	sort.Strings(contracts)
+	return contracts
+}
+
+// Discover rebuilds the state from the twin's active node contracts, so a fresh process can load the deployments of another one.
+// contracts are grouped by node and classified by their deployment data type into networks and deployments,
+// then the networks subnets and used host IDs are read from the nodes deployments.
+// a contract that can't be read, like the contracts of unreachable nodes, is skipped, the state keeps the other contracts
+// and a *DiscoverError with the skipped contracts errors is returned
+func (st *State) Discover(ctx context.Context) error {
+	if st.contractsLister == nil {
+		return errors.New("no contracts lister is set to discover the state")
+	}
+
+	contracts, err := st.contractsLister.ListContractsByTwinID([]string{"Created", "GracePeriod"})
+	if err != nil {
+		return errors.Wrap(err, "failed to list twin contracts")
+	}
+
+	nodeDeployments := make(map[uint32]ContractIDs)
+	nodeNetworks := make(map[uint32]ContractIDs)
+	networks := NetworkState{}
+	// the host IDs are discovered after all the networks subnets are known
+	deployments := make(map[uint64]gridtypes.Deployment)
+	deploymentsNodes := make(map[uint64]uint32)
+	failed := make(map[string]error)
+
+	for _, contract := range contracts.NodeContracts {
+		contractID, err := strconv.ParseUint(contract.ContractID, 0, 64)
+		if err != nil {
+			failed[contract.ContractID] = errors.Wrapf(err, "could not parse contract %s into uint64", contract.ContractID)
+			continue
+		}
+
+		deploymentData, err := workloads.ParseDeploymentData(contract.DeploymentData)
+		if err != nil {
+			failed[contract.ContractID] = errors.Wrapf(err, "could not parse contract %d deployment data", contractID)
+			continue
+		}
+
+		dl, err := st.getDeployment(ctx, contract.NodeID, contractID)
+		if err != nil {
+			failed[contract.ContractID] = err
+			continue
+		}
+
+		if deploymentData.Type == networkDeploymentType {
+			// the subnets are read into a separate state first, so a broken deployment doesn't add some of its networks
+			discovered := networks.copy()
+			if err := discoverNetworkSubnets(discovered, contract.NodeID, dl); err != nil {
+				failed[contract.ContractID] = errors.Wrapf(err, "could not read network deployment %d", contractID)
+				continue
+			}
+			networks = discovered
+			nodeNetworks[contract.NodeID] = append(nodeNetworks[contract.NodeID], contractID)
+			continue
+		}
+
+		deployments[contractID] = dl
+		deploymentsNodes[contractID] = contract.NodeID
+	}
+
+	for contractID, dl := range deployments {
+		discovered := networks.copy()
+		if err := discoverHostIDs(discovered, deploymentsNodes[contractID], contractID, dl); err != nil {
+			failed[strconv.FormatUint(contractID, 10)] = errors.Wrapf(err, "could not read deployment %d", contractID)
+			continue
+		}
+		networks = discovered
+		nodeID := deploymentsNodes[contractID]
+		nodeDeployments[nodeID] = append(nodeDeployments[nodeID], contractID)
+	}
+
+	st.replace(nodeDeployments, nodeNetworks, networks)
+
+	var discoverErr error
+	if len(failed) != 0 {
+		discoverErr = &DiscoverError{Errors: failed}
+	}
+	return st.saveAfter(discoverErr)
+}
+
+// twinContractsByName returns the twin's active node contracts of the deployments with the type and name
+func (st *State) twinContractsByName(deploymentType, deploymentName string) (map[uint32]ContractIDs, error) {
+	contracts, err := st.contractsLister.ListContractsByTwinID([]string{"Created", "GracePeriod"})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list twin contracts")
+	}
+
+	nodeContracts := make(map[uint32]ContractIDs)
+	for _, contract := range contracts.NodeContracts {
+		deploymentData, err := workloads.ParseDeploymentData(contract.DeploymentData)
+		if err != nil || deploymentData.Type != deploymentType || deploymentData.Name != deploymentName {
+			continue
+		}
+
+		contractID, err := strconv.ParseUint(contract.ContractID, 0, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse contract %s into uint64", contract.ContractID)
+		}
+		nodeContracts[contract.NodeID] = append(nodeContracts[contract.NodeID], contractID)
+	}
+	return nodeContracts, nil
+}
+
+func (st *State) getDeployment(ctx context.Context, nodeID uint32, contractID uint64) (gridtypes.Deployment, error) {
+	nodeClient, err := st.ncPool.GetNodeClient(st.substrate, nodeID)
+	if err != nil {
+		return gridtypes.Deployment{}, errors.Wrapf(err, "could not get node client: %d", nodeID)
+	}
+
+	dl, err := nodeClient.DeploymentGet(ctx, contractID)
+	if err != nil {
+		return gridtypes.Deployment{}, errors.Wrapf(err, "could not get deployment %d from node %d", contractID, nodeID)
+	}
+	return dl, nil
+}
+
+// discoverNetworkSubnets sets the node subnets of the networks in a network deployment
+func discoverNetworkSubnets(networks NetworkState, nodeID uint32, dl gridtypes.Deployment) error {
+	for _, wl := range dl.Workloads {
+		if wl.Type != zos.NetworkType {
+			continue
+		}
+
+		dataI, err := wl.WorkloadData()
+		if err != nil {
+			return errors.Wrapf(err, "failed to get workload %s data", wl.Name)
+		}
+		data, ok := dataI.(*zos.Network)
+		if !ok {
+			return errors.Errorf("could not create network workload from data %v", dataI)
+		}
+
+		network := networks.GetNetwork(wl.Name.String())
+		network.SetNodeSubnet(nodeID, data.Subnet.String())
+	}
+	return nil
+}
+
+// discoverHostIDs sets the host IDs used by the virtual machines of a deployment in their networks
+func discoverHostIDs(networks NetworkState, nodeID uint32, contractID uint64, dl gridtypes.Deployment) error {
+	for _, wl := range dl.Workloads {
+		if wl.Type != zos.ZMachineType {
+			continue
+		}
+
+		dataI, err := wl.WorkloadData()
+		if err != nil {
+			return errors.Wrapf(err, "failed to get workload %s data", wl.Name)
+		}
+		data, ok := dataI.(*zos.ZMachine)
+		if !ok {
+			return errors.Errorf("could not create vm workload from data %v", dataI)
+		}
+
+		for _, iface := range data.Network.Interfaces {
+			if iface.IP.To4() == nil {
+				continue
+			}
+			network := networks.GetNetwork(iface.Network.String())
+			hostIDs := network.GetDeploymentHostIDs(nodeID, contractID)
+			ids := ipsHostIDs([]string{iface.IP.String()}, network.getNodeSubnet(nodeID))
+			network.SetDeploymentHostIDs(nodeID, contractID, append(hostIDs, ids...))
+		}
+	}
+	return nil
+}
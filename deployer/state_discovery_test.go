@@ -0,0 +1,134 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/threefoldtech/grid3-go/graphql"
+	"github.com/threefoldtech/grid3-go/mocks"
+	client "github.com/threefoldtech/grid3-go/node"
+	"github.com/threefoldtech/grid3-go/workloads"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+)
+
+func TestStateDiscover(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cl := mocks.NewRMBMockClient(ctrl)
+	sub := mocks.NewMockSubstrateExt(ctrl)
+	ncPool := mocks.NewMockNodeClientGetter(ctrl)
+	lister := mocks.NewMockContractsLister(ctrl)
+
+	networkDl := workloads.NewGridDeployment(1, []gridtypes.Workload{{
+		Name: "net",
+		Type: zos.NetworkType,
+		Data: gridtypes.MustMarshal(zos.Network{
+			NetworkIPRange: gridtypes.MustParseIPNet("10.1.0.0/16"),
+			Subnet:         gridtypes.MustParseIPNet("10.1.1.0/24"),
+		}),
+	}})
+	vm := workloads.VM{
+		Name:        "vm",
+		Flist:       "https://hub.grid.tf/tf-official-apps/base:latest.flist",
+		CPU:         1,
+		Memory:      1024,
+		IP:          "10.1.2.3",
+		NetworkName: "net",
+	}
+	vmDl := workloads.NewGridDeployment(1, vm.ZosWorkload())
+	gateway := workloads.GatewayFQDNProxy{Name: "fqdn", FQDN: "a.b.com"}
+	gatewayDl := workloads.NewGridDeployment(1, []gridtypes.Workload{gateway.ZosWorkload()})
+
+	deployments := map[uint32]gridtypes.Deployment{13: networkDl, 23: vmDl, 33: gatewayDl}
+	for node, twin := range map[uint32]uint32{1: 13, 2: 23, 3: 33} {
+		ncPool.EXPECT().
+			GetNodeClient(sub, node).
+			Return(client.NewNodeClient(twin, cl, 10), nil).AnyTimes()
+	}
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.deployment.get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			*result.(*gridtypes.Deployment) = deployments[twin]
+			return nil
+		}).AnyTimes()
+
+	contracts := graphql.Contracts{
+		NodeContracts: []graphql.Contract{
+			{ContractID: "10", NodeID: 1, DeploymentData: `{"type":"network","name":"net"}`},
+			{ContractID: "20", NodeID: 2, DeploymentData: `{"type":"vm","name":"vm"}`},
+			{ContractID: "30", NodeID: 3, DeploymentData: `{"type":"Gateway Fqdn","name":"fqdn"}`},
+		},
+	}
+
+	t.Run("no contracts lister", func(t *testing.T) {
+		state := NewState(ncPool, sub)
+		assert.Error(t, state.Discover(context.Background()))
+	})
+
+	t.Run("failed listing contracts", func(t *testing.T) {
+		state := NewState(ncPool, sub)
+		state.SetContractsLister(lister)
+		lister.EXPECT().ListContractsByTwinID([]string{"Created", "GracePeriod"}).Return(graphql.Contracts{}, errors.New("error"))
+
+		assert.Error(t, state.Discover(context.Background()))
+	})
+
+	t.Run("success", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.json")
+		state := NewState(ncPool, sub)
+		state.SetContractsLister(lister)
+		state.SetStore(NewFileStateStore(path))
+		state.CurrentNodeDeployments[5] = ContractIDs{50}
+		lister.EXPECT().ListContractsByTwinID([]string{"Created", "GracePeriod"}).Return(contracts, nil)
+
+		assert.NoError(t, state.Discover(context.Background()))
+
+		assert.Equal(t, map[uint32]ContractIDs{2: {20}, 3: {30}}, state.CurrentNodeDeployments)
+		assert.Equal(t, map[uint32]ContractIDs{1: {10}}, state.CurrentNodeNetworks)
+
+		network := state.GetNetworks().GetNetwork("net")
+		assert.Equal(t, "10.1.1.0/24", network.getNodeSubnet(1))
+		assert.Equal(t, HostIDs{3}, network.GetDeploymentHostIDs(2, 20))
+
+		saved, err := NewFileStateStore(path).Load()
+		assert.NoError(t, err)
+		assert.Equal(t, state.CurrentNodeDeployments, saved.CurrentNodeDeployments)
+	})
+
+	t.Run("bad contracts are skipped", func(t *testing.T) {
+		ncPool.EXPECT().
+			GetNodeClient(sub, uint32(4)).
+			Return(nil, errors.New("node is unreachable"))
+
+		badContracts := graphql.Contracts{
+			NodeContracts: append([]graphql.Contract{
+				{ContractID: "40", NodeID: 4, DeploymentData: `{"type":"vm","name":"vm2"}`},
+				{ContractID: "50", NodeID: 2, DeploymentData: `invalid`},
+			}, contracts.NodeContracts...),
+		}
+
+		state := NewState(ncPool, sub)
+		state.SetContractsLister(lister)
+		lister.EXPECT().ListContractsByTwinID([]string{"Created", "GracePeriod"}).Return(badContracts, nil)
+
+		err := state.Discover(context.Background())
+		var discoverErr *DiscoverError
+		assert.True(t, errors.As(err, &discoverErr))
+		assert.Len(t, discoverErr.Errors, 2)
+		assert.Contains(t, discoverErr.Errors, "40")
+		assert.Contains(t, discoverErr.Errors, "50")
+
+		assert.Equal(t, map[uint32]ContractIDs{2: {20}, 3: {30}}, state.CurrentNodeDeployments)
+		assert.Equal(t, map[uint32]ContractIDs{1: {10}}, state.CurrentNodeNetworks)
+
+		network := state.GetNetworks().GetNetwork("net")
+		assert.Equal(t, HostIDs{3}, network.GetDeploymentHostIDs(2, 20))
+	})
+}
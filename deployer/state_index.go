@@ -0,0 +1,172 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/grid3-go/workloads"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+const (
+	// DefaultIndexTTL is the default time a deployment is kept in the state index before it's fetched again
+	DefaultIndexTTL = time.Minute
+	// maxConcurrentIndexFetches is the maximum number of deployments fetched at the same time to fill the index
+	maxConcurrentIndexFetches = 10
+)
+
+// indexEntry is a deployment in the state index
+type indexEntry struct {
+	nodeID uint32
+	// data is the deployment metadata
+	data workloads.DeploymentData
+	// dataErr is the error of parsing the deployment metadata, network deployments may have no metadata
+	dataErr    error
+	deployment gridtypes.Deployment
+	fetchedAt  time.Time
+}
+
+// deploymentsIndex indexes the decoded deployments of the state contracts by their contract IDs
+type deploymentsIndex struct {
+	lock    sync.RWMutex
+	ttl     time.Duration
+	entries map[uint64]indexEntry
+}
+
+func newDeploymentsIndex(ttl time.Duration) *deploymentsIndex {
+	return &deploymentsIndex{
+		ttl:     ttl,
+		entries: make(map[uint64]indexEntry),
+	}
+}
+
+// get returns the indexed deployment of a contract if it's not expired
+func (i *deploymentsIndex) get(contractID uint64) (indexEntry, bool) {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	entry, ok := i.entries[contractID]
+	if !ok || time.Since(entry.fetchedAt) >= i.ttl {
+		return indexEntry{}, false
+	}
+	return entry, true
+}
+
+func (i *deploymentsIndex) set(contractID uint64, entry indexEntry) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.ttl <= 0 {
+		return
+	}
+	i.entries[contractID] = entry
+}
+
+// invalidate removes the contracts deployments from the index, all deployments are removed if no contracts are passed
+func (i *deploymentsIndex) invalidate(contractIDs ...uint64) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if len(contractIDs) == 0 {
+		i.entries = make(map[uint64]indexEntry)
+		return
+	}
+	for _, contractID := range contractIDs {
+		delete(i.entries, contractID)
+	}
+}
+
+func (i *deploymentsIndex) setTTL(ttl time.Duration) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.ttl = ttl
+}
+
+// SetIndexTTL sets the time a deployment is kept in the state index, a zero ttl disables the index
+func (st *State) SetIndexTTL(ttl time.Duration) {
+	st.index.setTTL(ttl)
+	st.index.invalidate()
+}
+
+// InvalidateIndex removes the contracts deployments from the state index so they are fetched again by the next loads,
+// the whole index is invalidated if no contracts are passed
+func (st *State) InvalidateIndex(contractIDs ...uint64) {
+	st.index.invalidate(contractIDs...)
+}
+
+// indexedDeployments returns the deployments of the node contracts in the same order of the contracts.
+// deployments missing from the index or expired are fetched concurrently from their nodes then indexed
+func (st *State) indexedDeployments(ctx context.Context, nodeContracts map[uint32]ContractIDs) (map[uint32][]indexEntry, error) {
+	var (
+		lock     sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		tokens   = make(chan struct{}, maxConcurrentIndexFetches)
+	)
+
+	entries := make(map[uint32][]indexEntry)
+	for nodeID, contractIDs := range nodeContracts {
+		entries[nodeID] = make([]indexEntry, len(contractIDs))
+	}
+
+	for nodeID, contractIDs := range nodeContracts {
+		for idx, contractID := range contractIDs {
+			if entry, ok := st.index.get(contractID); ok {
+				entries[nodeID][idx] = entry
+				continue
+			}
+
+			if err := ctx.Err(); err != nil {
+				wg.Wait()
+				return nil, err
+			}
+
+			tokens <- struct{}{}
+			wg.Add(1)
+			go func(nodeID uint32, contractID uint64, entry *indexEntry) {
+				defer wg.Done()
+				defer func() { <-tokens }()
+
+				fetched, err := st.fetchIndexEntry(ctx, nodeID, contractID)
+				if err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					lock.Unlock()
+					return
+				}
+				st.index.set(contractID, fetched)
+				*entry = fetched
+			}(nodeID, contractID, &entries[nodeID][idx])
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return entries, nil
+}
+
+// fetchIndexEntry gets a contract deployment from its node and decodes its metadata
+func (st *State) fetchIndexEntry(ctx context.Context, nodeID uint32, contractID uint64) (indexEntry, error) {
+	dl, err := st.getDeployment(ctx, nodeID, contractID)
+	if err != nil {
+		return indexEntry{}, err
+	}
+
+	dlData, err := workloads.ParseDeploymentData(dl.Metadata)
+
+	return indexEntry{
+		nodeID:     nodeID,
+		data:       dlData,
+		dataErr:    errors.Wrapf(err, "could not get deployment %d data", contractID),
+		deployment: dl,
+		fetchedAt:  time.Now(),
+	}, nil
+}
@@ -0,0 +1,106 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/threefoldtech/grid3-go/mocks"
+	client "github.com/threefoldtech/grid3-go/node"
+	"github.com/threefoldtech/grid3-go/workloads"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+)
+
+func TestStateIndex(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cl := mocks.NewRMBMockClient(ctrl)
+	sub := mocks.NewMockSubstrateExt(ctrl)
+	ncPool := mocks.NewMockNodeClientGetter(ctrl)
+
+	diskWl := gridtypes.Workload{
+		Name: "disk",
+		Type: zos.ZMountType,
+		Data: gridtypes.MustMarshal(zos.ZMount{Size: 10 * gridtypes.Gigabyte}),
+	}
+	dl := workloads.NewGridDeployment(13, []gridtypes.Workload{diskWl})
+	dl.Metadata = `{"type":"vm","name":"dl","projectName":""}`
+
+	ncPool.EXPECT().
+		GetNodeClient(sub, uint32(1)).
+		Return(client.NewNodeClient(13, cl, 10), nil).AnyTimes()
+
+	expectDeploymentGet := func(times int) {
+		cl.EXPECT().
+			Call(gomock.Any(), uint32(13), "zos.deployment.get", gomock.Any(), gomock.Any()).
+			DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+				*result.(*gridtypes.Deployment) = dl
+				return nil
+			}).Times(times)
+	}
+
+	newState := func() *State {
+		state := NewState(ncPool, sub)
+		state.CurrentNodeDeployments = map[uint32]ContractIDs{1: {10, 20}}
+		return state
+	}
+
+	t.Run("deployments are fetched once", func(t *testing.T) {
+		state := newState()
+		expectDeploymentGet(2)
+
+		for i := 0; i < 3; i++ {
+			disk, err := state.LoadDiskFromGrid(context.Background(), 1, "disk", "dl")
+			assert.NoError(t, err)
+			assert.Equal(t, 10, disk.SizeGB)
+		}
+	})
+
+	t.Run("invalidated deployments are fetched again", func(t *testing.T) {
+		state := newState()
+		expectDeploymentGet(3)
+
+		_, err := state.LoadDiskFromGrid(context.Background(), 1, "disk", "dl")
+		assert.NoError(t, err)
+
+		state.InvalidateIndex(20)
+		_, err = state.LoadDiskFromGrid(context.Background(), 1, "disk", "dl")
+		assert.NoError(t, err)
+	})
+
+	t.Run("changed contracts are invalidated", func(t *testing.T) {
+		state := newState()
+		expectDeploymentGet(3)
+
+		_, err := state.LoadDiskFromGrid(context.Background(), 1, "disk", "dl")
+		assert.NoError(t, err)
+
+		state.addDeployment(1, 10)
+		_, err = state.LoadDiskFromGrid(context.Background(), 1, "disk", "dl")
+		assert.NoError(t, err)
+	})
+
+	t.Run("zero ttl disables the index", func(t *testing.T) {
+		state := newState()
+		state.SetIndexTTL(0)
+		expectDeploymentGet(4)
+
+		for i := 0; i < 2; i++ {
+			_, err := state.LoadDiskFromGrid(context.Background(), 1, "disk", "dl")
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		state := newState()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := state.LoadDiskFromGrid(ctx, 1, "disk", "dl")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,186 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// StateData is the persisted part of the deployer state
+type StateData struct {
+	CurrentNodeDeployments map[uint32]ContractIDs `json:"current_node_deployments"`
+	CurrentNodeNetworks    map[uint32]ContractIDs `json:"current_node_networks"`
+	Networks               NetworkState           `json:"networks"`
+}
+
+// StateStore persists the deployer state, so restarted processes keep the owned contracts and the taken network host IDs
+type StateStore interface {
+	// Load returns the stored state, an empty state is returned if nothing was stored yet
+	Load() (StateData, error)
+	// Save replaces the stored state, the state must be persisted when it returns
+	Save(data StateData) error
+}
+
+// FileStateStore is a state store saved as a json file
+type FileStateStore struct {
+	path string
+	lock sync.Mutex
+}
+
+// NewFileStateStore returns a state store saved in the given file, the file is created on the first save
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+// Load reads the state from the json file
+func (s *FileStateStore) Load() (StateData, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var data StateData
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return data, nil
+	}
+	if err != nil {
+		return data, errors.Wrapf(err, "failed to read state file %s", s.path)
+	}
+
+	if err := json.Unmarshal(content, &data); err != nil {
+		return StateData{}, errors.Wrapf(err, "failed to parse state file %s", s.path)
+	}
+	return data, nil
+}
+
+// Save writes the state to a temporary file then renames it, so a crash never leaves a partially written state
+func (s *FileStateStore) Save(data StateData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode state")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create state temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write state")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to sync state")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to close state")
+	}
+
+	return errors.Wrap(os.Rename(tmp.Name(), s.path), "failed to replace state file")
+}
+
+const defaultBoltStateStoreTimeout = 10 * time.Second
+
+var (
+	stateBucket             = []byte("state")
+	nodeDeploymentsStateKey = []byte("current_node_deployments")
+	nodeNetworksStateKey    = []byte("current_node_networks")
+	networksStateKey        = []byte("networks")
+)
+
+// BoltStateStore is a state store saved in an embedded bolt key-value database.
+// the database is opened for each load and save, so many processes can share it one at a time
+type BoltStateStore struct {
+	path string
+	// Timeout is the time waiting for the database lock held by another process, default is 10 seconds
+	Timeout time.Duration
+}
+
+// NewBoltStateStore returns a state store saved in the given bolt database file, the file is created on the first save
+func NewBoltStateStore(path string) *BoltStateStore {
+	return &BoltStateStore{path: path, Timeout: defaultBoltStateStoreTimeout}
+}
+
+// Load reads the state from the database
+func (s *BoltStateStore) Load() (StateData, error) {
+	var data StateData
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return data, nil
+	}
+
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: s.Timeout, ReadOnly: true})
+	if err != nil {
+		return data, errors.Wrapf(err, "failed to open state database %s", s.path)
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(stateBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		values := map[string]interface{}{
+			string(nodeDeploymentsStateKey): &data.CurrentNodeDeployments,
+			string(nodeNetworksStateKey):    &data.CurrentNodeNetworks,
+			string(networksStateKey):        &data.Networks,
+		}
+		for key, value := range values {
+			content := bucket.Get([]byte(key))
+			if content == nil {
+				continue
+			}
+			if err := json.Unmarshal(content, value); err != nil {
+				return errors.Wrapf(err, "failed to parse state %s", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return StateData{}, errors.Wrapf(err, "failed to read state database %s", s.path)
+	}
+	return data, nil
+}
+
+// Save writes the state to the database in one transaction
+func (s *BoltStateStore) Save(data StateData) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: s.Timeout})
+	if err != nil {
+		return errors.Wrapf(err, "failed to open state database %s", s.path)
+	}
+	defer db.Close()
+
+	values := map[string]interface{}{
+		string(nodeDeploymentsStateKey): data.CurrentNodeDeployments,
+		string(nodeNetworksStateKey):    data.CurrentNodeNetworks,
+		string(networksStateKey):        data.Networks,
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			content, err := json.Marshal(value)
+			if err != nil {
+				return errors.Wrapf(err, "failed to encode state %s", key)
+			}
+			if err := bucket.Put([]byte(key), content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrapf(err, "failed to write state database %s", s.path)
+}
@@ -0,0 +1,104 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateStores(t *testing.T) {
+	stores := map[string]func(dir string) StateStore{
+		"json": func(dir string) StateStore { return NewFileStateStore(filepath.Join(dir, "state.json")) },
+		"bolt": func(dir string) StateStore { return NewBoltStateStore(filepath.Join(dir, "state.db")) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := newStore(dir)
+
+			data, err := store.Load()
+			assert.NoError(t, err)
+			assert.Equal(t, StateData{}, data)
+
+			network := NewNetwork()
+			network.SetNodeSubnet(10, "10.1.2.0/24")
+			network.SetDeploymentHostIDs(10, 100, HostIDs{2, 3})
+			saved := StateData{
+				CurrentNodeDeployments: map[uint32]ContractIDs{10: {100, 101}},
+				CurrentNodeNetworks:    map[uint32]ContractIDs{10: {102}},
+				Networks:               NetworkState{"network": network},
+			}
+			assert.NoError(t, store.Save(saved))
+
+			data, err = newStore(dir).Load()
+			assert.NoError(t, err)
+			assert.Equal(t, saved, data)
+
+			saved.CurrentNodeDeployments[10] = ContractIDs{101}
+			assert.NoError(t, store.Save(saved))
+
+			data, err = newStore(dir).Load()
+			assert.NoError(t, err)
+			assert.Equal(t, ContractIDs{101}, data.CurrentNodeDeployments[10])
+		})
+	}
+
+	t.Run("corrupted json state", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "state.json")
+		assert.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+
+		_, err := NewFileStateStore(path).Load()
+		assert.Error(t, err)
+	})
+}
+
+func TestStatePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	st := NewState(nil, nil)
+	st.SetStore(NewFileStateStore(path))
+	assert.NoError(t, st.Load())
+	assert.Empty(t, st.CurrentNodeDeployments)
+	assert.NotNil(t, st.CurrentNodeNetworks)
+	assert.NotNil(t, st.GetNetworks())
+
+	st.CurrentNodeDeployments[10] = ContractIDs{100}
+	network := st.networks.GetNetwork("network")
+	network.SetDeploymentHostIDs(10, 100, HostIDs{2})
+	assert.NoError(t, st.saveAfter(nil))
+
+	restarted := NewState(nil, nil)
+	restarted.SetStore(NewFileStateStore(path))
+	assert.NoError(t, restarted.Load())
+	assert.Equal(t, ContractIDs{100}, restarted.CurrentNodeDeployments[10])
+	restartedNetwork := restarted.networks.GetNetwork("network")
+	assert.Equal(t, HostIDs{2}, restartedNetwork.getUsedNetworkHostIDs(10))
+
+	t.Run("deploy error is kept", func(t *testing.T) {
+		deployErr := errors.New("deploy error")
+		assert.Equal(t, deployErr, st.saveAfter(deployErr))
+	})
+
+	t.Run("save error is added", func(t *testing.T) {
+		st.SetStore(NewFileStateStore(filepath.Join(path, "not a directory", "state.json")))
+
+		err := st.saveAfter(nil)
+		assert.Error(t, err)
+
+		deployErr := errors.New("deploy error")
+		err = st.saveAfter(deployErr)
+		assert.ErrorIs(t, err, deployErr)
+		assert.Contains(t, err.Error(), "failed to save state")
+	})
+
+	t.Run("no store", func(t *testing.T) {
+		st.SetStore(nil)
+		assert.NoError(t, st.Save())
+		assert.NoError(t, st.Load())
+	})
+}
@@ -5,16 +5,21 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/threefoldtech/grid3-go/graphql"
 	"github.com/threefoldtech/grid3-go/mocks"
 	client "github.com/threefoldtech/grid3-go/node"
 	"github.com/threefoldtech/grid3-go/workloads"
 	"github.com/threefoldtech/zos/pkg/gridtypes"
 	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const deploymentName = "testName"
@@ -74,7 +79,7 @@ func TestLoadDiskFromGrid(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		state := SetupLoaderTests(t, []gridtypes.Workload{diskWl})
 
-		got, err := state.LoadDiskFromGrid(1, "test", deploymentName)
+		got, err := state.LoadDiskFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.NoError(t, err)
 		assert.Equal(t, disk, got)
 	})
@@ -85,7 +90,7 @@ func TestLoadDiskFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{diskWlCp})
 
-		_, err := state.LoadDiskFromGrid(1, "test", deploymentName)
+		_, err := state.LoadDiskFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -98,7 +103,7 @@ func TestLoadDiskFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{diskWlCp})
 
-		_, err := state.LoadDiskFromGrid(1, "test", deploymentName)
+		_, err := state.LoadDiskFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 }
@@ -129,7 +134,7 @@ func TestLoadGatewayFQDNFromGrid(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		state := SetupLoaderTests(t, []gridtypes.Workload{gatewayWl})
 
-		got, err := state.LoadGatewayFQDNFromGrid(1, "test", deploymentName)
+		got, err := state.LoadGatewayFQDNFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.NoError(t, err)
 		assert.Equal(t, gateway, got)
 	})
@@ -140,7 +145,7 @@ func TestLoadGatewayFQDNFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{gatewayWlCp})
 
-		_, err := state.LoadGatewayFQDNFromGrid(1, "test", deploymentName)
+		_, err := state.LoadGatewayFQDNFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -153,7 +158,7 @@ func TestLoadGatewayFQDNFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{gatewayWlCp})
 
-		_, err := state.LoadGatewayFQDNFromGrid(1, "test", deploymentName)
+		_, err := state.LoadGatewayFQDNFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 }
@@ -194,7 +199,7 @@ func TestLoadGatewayNameFromGrid(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		state := SetupLoaderTests(t, []gridtypes.Workload{gatewayWl})
 
-		got, err := state.LoadGatewayNameFromGrid(1, "test", deploymentName)
+		got, err := state.LoadGatewayNameFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.NoError(t, err)
 		assert.Equal(t, gateway, got)
 	})
@@ -204,7 +209,7 @@ func TestLoadGatewayNameFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{gatewayWlCp})
 
-		_, err := state.LoadGatewayNameFromGrid(1, "test", deploymentName)
+		_, err := state.LoadGatewayNameFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -217,7 +222,7 @@ func TestLoadGatewayNameFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{gatewayWlCp})
 
-		_, err := state.LoadGatewayNameFromGrid(1, "test", deploymentName)
+		_, err := state.LoadGatewayNameFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 }
@@ -252,7 +257,8 @@ func TestLoadK8sFromGrid(t *testing.T) {
 		Workers:          Workers,
 		Token:            "",
 		SSHKey:           "",
-		NetworkName:      "",
+		NetworkName:      "test_network",
+		NodesIPRange:     map[uint32]gridtypes.IPNet{1: workloads.IPNet(1, 1, 1, 0, 24)},
 		NodeDeploymentID: map[uint32]uint64{1: 10},
 	}
 
@@ -291,7 +297,7 @@ func TestLoadK8sFromGrid(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		state := SetupLoaderTests(t, []gridtypes.Workload{k8sWorkload})
 
-		got, err := state.LoadK8sFromGrid([]uint32{1}, deploymentName)
+		got, err := state.LoadK8sFromGrid(context.Background(), []uint32{1}, deploymentName)
 		assert.NoError(t, err)
 		assert.Equal(t, cluster, got)
 	})
@@ -302,7 +308,7 @@ func TestLoadK8sFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{k8sWorkloadCp})
 
-		_, err := state.LoadK8sFromGrid([]uint32{1}, deploymentName)
+		_, err := state.LoadK8sFromGrid(context.Background(), []uint32{1}, deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -315,7 +321,119 @@ func TestLoadK8sFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{k8sWorkloadCp})
 
-		_, err := state.LoadK8sFromGrid([]uint32{1}, deploymentName)
+		_, err := state.LoadK8sFromGrid(context.Background(), []uint32{1}, deploymentName)
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadK8sFromGridByName(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cl := mocks.NewRMBMockClient(ctrl)
+	sub := mocks.NewMockSubstrateExt(ctrl)
+	ncPool := mocks.NewMockNodeClientGetter(ctrl)
+	lister := mocks.NewMockContractsLister(ctrl)
+
+	flists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "checksum")
+	}))
+	defer flists.Close()
+	flist := flists.URL + "/k3s.flist"
+
+	cluster := workloads.K8sCluster{
+		Master: &workloads.K8sNode{
+			Name: "master", Node: 1, DiskSize: 10, PublicIP: true, PublicIP6: true, Planetary: true,
+			Flist: flist, FlistChecksum: "checksum", ComputedIP: "5.5.5.5/24", ComputedIP6: "2a02::5/64",
+			YggIP: "300::1", IP: "10.1.2.2", CPU: 2, Memory: 2048,
+		},
+		Workers: []workloads.K8sNode{{
+			Name: "worker", Node: 2, DiskSize: 5, Planetary: true,
+			Flist: flist, FlistChecksum: "checksum",
+			YggIP: "300::2", IP: "10.1.3.2", CPU: 1, Memory: 1024,
+		}},
+		Token:        "token123",
+		NetworkName:  "net",
+		SolutionType: "Kubernetes",
+		SSHKey:       "ssh-key",
+		NodesIPRange: map[uint32]gridtypes.IPNet{
+			1: workloads.IPNet(10, 1, 2, 0, 24),
+			2: workloads.IPNet(10, 1, 3, 0, 24),
+		},
+		NodeDeploymentID: map[uint32]uint64{1: 10, 2: 20},
+	}
+
+	metadata, err := cluster.GenerateMetadata()
+	assert.NoError(t, err)
+
+	nodeDeployment := func(node workloads.K8sNode, wls []gridtypes.Workload) gridtypes.Deployment {
+		for idx, wl := range wls {
+			switch wl.Type {
+			case zos.ZMachineType:
+				wls[idx].Result.Data = mustMarshal(t, zos.ZMachineResult{YggIP: node.YggIP})
+			case zos.PublicIPType:
+				wls[idx].Result.Data = mustMarshal(t, zos.PublicIPResult{
+					IP:   gridtypes.MustParseIPNet(node.ComputedIP),
+					IPv6: gridtypes.MustParseIPNet(node.ComputedIP6),
+				})
+			}
+		}
+		dl := workloads.NewGridDeployment(13, wls)
+		dl.ContractID = cluster.NodeDeploymentID[node.Node]
+		dl.Metadata = metadata
+		return dl
+	}
+	otherDl := workloads.NewGridDeployment(13, []gridtypes.Workload{})
+	otherDl.ContractID = 30
+	otherDl.Metadata = `{"type":"vm","name":"master","projectName":""}`
+
+	deployments := map[uint32]gridtypes.Deployment{
+		11: nodeDeployment(*cluster.Master, cluster.Master.MasterZosWorkload(&cluster)),
+		22: nodeDeployment(cluster.Workers[0], cluster.Workers[0].WorkerZosWorkload(&cluster)),
+		33: otherDl,
+	}
+	for node, twin := range map[uint32]uint32{1: 11, 2: 22, 3: 33} {
+		ncPool.EXPECT().
+			GetNodeClient(sub, node).
+			Return(client.NewNodeClient(twin, cl, 10), nil).AnyTimes()
+	}
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.deployment.get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			*result.(*gridtypes.Deployment) = deployments[twin]
+			return nil
+		}).AnyTimes()
+
+	t.Run("state deployments", func(t *testing.T) {
+		state := NewState(ncPool, sub)
+		state.CurrentNodeDeployments = map[uint32]ContractIDs{1: {10}, 2: {20}, 3: {30}}
+
+		got, err := state.LoadK8sFromGridByName(context.Background(), "master")
+		assert.NoError(t, err)
+		assert.Equal(t, cluster, got)
+	})
+
+	t.Run("twin contracts", func(t *testing.T) {
+		state := NewState(ncPool, sub)
+		state.SetContractsLister(lister)
+		lister.EXPECT().ListContractsByTwinID([]string{"Created", "GracePeriod"}).Return(graphql.Contracts{
+			NodeContracts: []graphql.Contract{
+				{ContractID: "10", NodeID: 1, DeploymentData: metadata},
+				{ContractID: "20", NodeID: 2, DeploymentData: metadata},
+				{ContractID: "30", NodeID: 3, DeploymentData: otherDl.Metadata},
+			},
+		}, nil)
+
+		got, err := state.LoadK8sFromGridByName(context.Background(), "master")
+		assert.NoError(t, err)
+		assert.Equal(t, cluster, got)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		state := NewState(ncPool, sub)
+		state.CurrentNodeDeployments = map[uint32]ContractIDs{3: {30}}
+
+		_, err := state.LoadK8sFromGridByName(context.Background(), "master")
 		assert.Error(t, err)
 	})
 }
@@ -325,11 +443,15 @@ func TestLoadNetworkFromGrid(t *testing.T) {
 	assert.NoError(t, err)
 
 	znet := workloads.ZNet{
-		Name:        "test",
-		Description: "test description",
-		Nodes:       []uint32{1},
-		IPRange:     ipRange,
-		AddWGAccess: false,
+		Name:             "test",
+		Description:      "test description",
+		Nodes:            []uint32{1},
+		IPRange:          ipRange,
+		AddWGAccess:      false,
+		NodesIPRange:     map[uint32]gridtypes.IPNet{1: ipRange},
+		NodeDeploymentID: map[uint32]uint64{1: 10},
+		WGPort:           map[uint32]int{1: 0},
+		Keys:             map[uint32]wgtypes.Key{},
 	}
 
 	networkWl := gridtypes.Workload{
@@ -351,7 +473,7 @@ func TestLoadNetworkFromGrid(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		state := SetupLoaderTests(t, []gridtypes.Workload{networkWl})
 
-		got, err := state.LoadNetworkFromGrid("test")
+		got, err := state.LoadNetworkFromGrid(context.Background(), "test")
 		assert.NoError(t, err)
 		assert.Equal(t, znet, got)
 	})
@@ -362,7 +484,7 @@ func TestLoadNetworkFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{networkWlCp})
 
-		_, err := state.LoadNetworkFromGrid("test")
+		_, err := state.LoadNetworkFromGrid(context.Background(), "test")
 		assert.Error(t, err)
 	})
 
@@ -375,11 +497,111 @@ func TestLoadNetworkFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{networkWlCp})
 
-		_, err := state.LoadNetworkFromGrid("test")
+		_, err := state.LoadNetworkFromGrid(context.Background(), "test")
 		assert.Error(t, err)
 	})
 }
 
+func TestLoadNetworkFromGridNodes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cl := mocks.NewRMBMockClient(ctrl)
+	sub := mocks.NewMockSubstrateExt(ctrl)
+	ncPool := mocks.NewMockNodeClientGetter(ctrl)
+
+	externalSK, err := wgtypes.GenerateKey()
+	assert.NoError(t, err)
+	externalIP := gridtypes.MustParseIPNet("10.1.4.0/24")
+	keys := map[uint32]wgtypes.Key{}
+	for _, nodeID := range []uint32{1, 2} {
+		keys[nodeID], err = wgtypes.GenerateKey()
+		assert.NoError(t, err)
+	}
+
+	znet := workloads.ZNet{
+		Name:         "net",
+		Description:  "network",
+		Nodes:        []uint32{1, 2},
+		IPRange:      gridtypes.MustParseIPNet("10.1.0.0/16"),
+		AddWGAccess:  true,
+		SolutionType: "Network",
+		ExternalIP:   &externalIP,
+		ExternalSK:   externalSK,
+		ExternalPK:   externalSK.PublicKey(),
+		PublicNodeID: 1,
+		NodesIPRange: map[uint32]gridtypes.IPNet{
+			1: gridtypes.MustParseIPNet("10.1.2.0/24"),
+			2: gridtypes.MustParseIPNet("10.1.3.0/24"),
+		},
+		NodeDeploymentID: map[uint32]uint64{1: 10, 2: 20},
+		WGPort:           map[uint32]int{1: 1000, 2: 2000},
+		Keys:             keys,
+	}
+
+	peers := map[uint32][]zos.Peer{
+		1: {
+			{Subnet: znet.NodesIPRange[2], WGPublicKey: keys[2].PublicKey().String(), Endpoint: "2.2.2.2:2000", AllowedIPs: []gridtypes.IPNet{znet.NodesIPRange[2]}},
+			{Subnet: externalIP, WGPublicKey: externalSK.PublicKey().String(), AllowedIPs: []gridtypes.IPNet{externalIP}},
+		},
+		2: {
+			{Subnet: znet.NodesIPRange[1], WGPublicKey: keys[1].PublicKey().String(), Endpoint: "1.1.1.1:1000", AllowedIPs: []gridtypes.IPNet{znet.NodesIPRange[1]}},
+		},
+	}
+	deployments := map[uint32]gridtypes.Deployment{}
+	for nodeID, twin := range map[uint32]uint32{1: 11, 2: 22} {
+		wl := znet.ZosWorkload(znet.NodesIPRange[nodeID], keys[nodeID].String(), uint16(znet.WGPort[nodeID]), peers[nodeID])
+		dl := workloads.NewGridDeployment(twin, []gridtypes.Workload{wl})
+		dl.ContractID = znet.NodeDeploymentID[nodeID]
+		dl.Metadata, err = znet.GenerateMetadata()
+		assert.NoError(t, err)
+		deployments[twin] = dl
+
+		ncPool.EXPECT().
+			GetNodeClient(sub, nodeID).
+			Return(client.NewNodeClient(twin, cl, 10), nil).AnyTimes()
+	}
+
+	cl.EXPECT().
+		Call(gomock.Any(), gomock.Any(), "zos.deployment.get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			*result.(*gridtypes.Deployment) = deployments[twin]
+			return nil
+		}).AnyTimes()
+	cl.EXPECT().
+		Call(gomock.Any(), uint32(11), "zos.network.public_config_get", gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, twin uint32, fn string, data, result interface{}) error {
+			*result.(*client.PublicConfig) = client.PublicConfig{IPv4: gridtypes.MustParseIPNet("1.1.1.1/24")}
+			return nil
+		}).
+		Times(2)
+
+	state := NewState(ncPool, sub)
+	state.CurrentNodeNetworks = map[uint32]ContractIDs{1: {10}, 2: {20}}
+
+	t.Run("unknown access key", func(t *testing.T) {
+		got, err := state.LoadNetworkFromGrid(context.Background(), "net")
+		assert.NoError(t, err)
+
+		// the workloads only have the access public key
+		want := znet
+		want.ExternalSK = wgtypes.Key{}
+		assert.Equal(t, want, got)
+		assert.Empty(t, got.AccessWGConfig)
+	})
+
+	t.Run("access key in the local state", func(t *testing.T) {
+		state.SetNetworks(NetworkState{"net": Network{AccessKeys: map[string]string{"": externalSK.String()}}})
+
+		got, err := state.LoadNetworkFromGrid(context.Background(), "net")
+		assert.NoError(t, err)
+
+		want := znet
+		want.AccessWGConfig = accessWGConfig(&znet, map[uint32]string{1: "1.1.1.1"})
+		assert.Equal(t, want, got)
+	})
+}
+
 func TestLoadQSFSFromGrid(t *testing.T) {
 	res, err := json.Marshal(zos.QuatumSafeFSResult{
 		Path:            "path",
@@ -465,7 +687,7 @@ func TestLoadQSFSFromGrid(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		state := SetupLoaderTests(t, []gridtypes.Workload{qsfsWl})
 
-		got, err := state.LoadQSFSFromGrid(1, "test", deploymentName)
+		got, err := state.LoadQSFSFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.NoError(t, err)
 		assert.Equal(t, qsfs, got)
 	})
@@ -475,7 +697,7 @@ func TestLoadQSFSFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{qsfsWlCp})
 
-		_, err := state.LoadQSFSFromGrid(1, "test", deploymentName)
+		_, err := state.LoadQSFSFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -488,7 +710,7 @@ func TestLoadQSFSFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{qsfsWlCp})
 
-		_, err := state.LoadQSFSFromGrid(1, "test", deploymentName)
+		_, err := state.LoadQSFSFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -498,7 +720,7 @@ func TestLoadQSFSFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{qsfsWlCp})
 
-		_, err := state.LoadQSFSFromGrid(1, "test", deploymentName)
+		_, err := state.LoadQSFSFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 }
@@ -576,7 +798,7 @@ func TestLoadVMFromGrid(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		state := SetupLoaderTests(t, []gridtypes.Workload{vmWl})
 
-		got, err := state.LoadVMFromGrid(1, "test", deploymentName)
+		got, err := state.LoadVMFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.NoError(t, err)
 		assert.Equal(t, vm, got)
 	})
@@ -587,7 +809,7 @@ func TestLoadVMFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{vmWlCp})
 
-		_, err := state.LoadVMFromGrid(1, "test", deploymentName)
+		_, err := state.LoadVMFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -600,7 +822,7 @@ func TestLoadVMFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{vmWlCp})
 
-		_, err := state.LoadVMFromGrid(1, "test", deploymentName)
+		_, err := state.LoadVMFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -610,7 +832,7 @@ func TestLoadVMFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{vmWlCp})
 
-		_, err := state.LoadVMFromGrid(1, "test", deploymentName)
+		_, err := state.LoadVMFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 }
@@ -661,7 +883,7 @@ func TestLoadZdbFromGrid(t *testing.T) {
 	t.Run("success", func(t *testing.T) {
 		state := SetupLoaderTests(t, []gridtypes.Workload{zdbWl})
 
-		got, err := state.LoadZdbFromGrid(1, "test", deploymentName)
+		got, err := state.LoadZdbFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.NoError(t, err)
 		assert.Equal(t, zdb, got)
 	})
@@ -672,7 +894,7 @@ func TestLoadZdbFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{zdbWlCp})
 
-		_, err := state.LoadZdbFromGrid(1, "test", deploymentName)
+		_, err := state.LoadZdbFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -685,7 +907,7 @@ func TestLoadZdbFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{zdbWlCp})
 
-		_, err := state.LoadZdbFromGrid(1, "test", deploymentName)
+		_, err := state.LoadZdbFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 
@@ -695,7 +917,7 @@ func TestLoadZdbFromGrid(t *testing.T) {
 
 		state := SetupLoaderTests(t, []gridtypes.Workload{zdbWlCp})
 
-		_, err := state.LoadZdbFromGrid(1, "test", deploymentName)
+		_, err := state.LoadZdbFromGrid(context.Background(), 1, "test", deploymentName)
 		assert.Error(t, err)
 	})
 }
@@ -67,6 +67,10 @@ type TFPluginClient struct {
 	// network
 	Network string
 
+	// deployers config
+	deployerConfig    DeployerConfig
+	persistenceConfig PersistenceConfig
+
 	// clients
 	GridProxyClient proxy.Client
 	RMB             rmb.Client
@@ -88,7 +92,7 @@ type TFPluginClient struct {
 	ContractsGetter graphql.ContractsGetter
 }
 
-// NewTFPluginClient generates a new tf plugin client
+// NewTFPluginClient generates a new tf plugin client with the default deployer config that doesn't persist its state
 func NewTFPluginClient(
 	mnemonics string,
 	keyType string,
@@ -100,6 +104,24 @@ func NewTFPluginClient(
 	verifyReply bool,
 	showLogs bool,
 ) (TFPluginClient, error) {
+	return NewTFPluginClientWithConfig(mnemonics, keyType, network, substrateURL, relayURL, rmbProxyURL, rmbTimeout, verifyReply, showLogs, DeployerConfig{}, PersistenceConfig{})
+}
+
+// NewTFPluginClientWithConfig generates a new tf plugin client whose deployers use the deployer config,
+// its contract operations and state are persisted as set in the persistence config
+func NewTFPluginClientWithConfig(
+	mnemonics string,
+	keyType string,
+	network string,
+	substrateURL string,
+	relayURL string,
+	rmbProxyURL string,
+	rmbTimeout int,
+	verifyReply bool,
+	showLogs bool,
+	deployerConfig DeployerConfig,
+	persistenceConfig PersistenceConfig,
+) (TFPluginClient, error) {
 
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	if showLogs {
@@ -160,6 +182,7 @@ func NewTFPluginClient(
 		return TFPluginClient{}, errors.Wrap(err, "could not validate substrate account")
 	}
 
+	sub.MaxBatchSize = deployerConfig.MaxBatchSize
 	tfPluginClient.SubstrateConn = sub
 
 	twinID, err := sub.GetTwinByPubKey(keyPair.Public())
@@ -212,6 +235,8 @@ func NewTFPluginClient(
 	ncPool := client.NewNodeClientPool(tfPluginClient.RMB, tfPluginClient.RMBTimeout)
 	tfPluginClient.NcPool = ncPool
 
+	tfPluginClient.deployerConfig = deployerConfig
+	tfPluginClient.persistenceConfig = persistenceConfig
 	tfPluginClient.DeploymentDeployer = NewDeploymentDeployer(&tfPluginClient)
 	tfPluginClient.NetworkDeployer = NewNetworkDeployer(&tfPluginClient)
 	tfPluginClient.GatewayFQDNDeployer = NewGatewayFqdnDeployer(&tfPluginClient)
@@ -219,6 +244,10 @@ func NewTFPluginClient(
 	tfPluginClient.GatewayNameDeployer = NewGatewayNameDeployer(&tfPluginClient)
 
 	tfPluginClient.State = NewState(tfPluginClient.NcPool, tfPluginClient.SubstrateConn)
+	tfPluginClient.State.SetStore(persistenceConfig.StateStore)
+	if err := tfPluginClient.State.Load(); err != nil {
+		return TFPluginClient{}, err
+	}
 
 	graphqlURL := GraphQlURLs[network]
 	tfPluginClient.graphQl, err = graphql.NewGraphQl(graphqlURL)
@@ -227,10 +256,32 @@ func NewTFPluginClient(
 	}
 
 	tfPluginClient.ContractsGetter = graphql.NewContractsGetter(tfPluginClient.TwinID, tfPluginClient.graphQl, tfPluginClient.SubstrateConn, tfPluginClient.NcPool)
+	tfPluginClient.State.SetContractsLister(&tfPluginClient.ContractsGetter)
 
 	return tfPluginClient, nil
 }
 
+// SetUpdateStrategy sets the strategy used to update VM and kubernetes deployments
+func (t *TFPluginClient) SetUpdateStrategy(strategy UpdateStrategy) {
+	t.DeploymentDeployer.SetUpdateStrategy(strategy)
+	t.K8sDeployer.SetUpdateStrategy(strategy)
+}
+
+// RegisterObserver registers an observer for the workloads events of all the deployers
+func (t *TFPluginClient) RegisterObserver(observer Observer) {
+	t.DeploymentDeployer.RegisterObserver(observer)
+	t.NetworkDeployer.RegisterObserver(observer)
+	t.GatewayFQDNDeployer.RegisterObserver(observer)
+	t.GatewayNameDeployer.RegisterObserver(observer)
+	t.K8sDeployer.RegisterObserver(observer)
+}
+
+// Recover finishes or cancels the contract operations left in the journal of the persistence config by an interrupted client
+func (t *TFPluginClient) Recover(ctx context.Context) error {
+	deployer := NewDeployer(*t, true)
+	return deployer.Recover(ctx)
+}
+
 func generateSessionID() string {
 	return fmt.Sprintf("tf-%d", os.Getpid())
 }
@@ -17,17 +17,32 @@ func (t *TFPluginClient) CancelByProjectName(projectName string) error {
 	}
 
 	contractsSlice := append(contracts.NameContracts, contracts.NodeContracts...)
+	contractIDs := make([]uint64, 0, len(contractsSlice))
+	nodeContracts := make(map[uint64]uint32)
 	for _, contract := range contractsSlice {
 		contractID, err := strconv.ParseUint(contract.ContractID, 0, 64)
 		if err != nil {
 			return errors.Wrapf(err, "could not parse contract %s into uint64", contract.ContractID)
 		}
-		log.Debug().Uint64("canceling contract", contractID)
-		err = t.SubstrateConn.CancelContract(t.Identity, contractID)
-		if err != nil {
-			return errors.Wrapf(err, "could not cancel contract %d", contractID)
+		contractIDs = append(contractIDs, contractID)
+		if contract.NodeID != 0 {
+			nodeContracts[contractID] = contract.NodeID
 		}
 	}
+
+	// the project contracts are canceled in batches of at most MaxBatchSize contracts, if one fails the ones before it stay canceled
+	// and running it again cancels the rest
+	log.Debug().Msgf("canceling contracts %v", contractIDs)
+	err = t.SubstrateConn.BatchCancelContracts(t.Identity, contractIDs)
+	if err != nil {
+		return errors.Wrapf(err, "could not cancel contracts of project %s", projectName)
+	}
 	log.Info().Msgf("%s canceled", projectName)
-	return nil
+
+	// the canceled contracts are removed from the state
+	for contractID, nodeID := range nodeContracts {
+		t.State.removeDeployment(nodeID, contractID)
+		t.State.removeNetworkContract(nodeID, contractID)
+	}
+	return t.State.Save()
 }
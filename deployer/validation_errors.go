@@ -0,0 +1,74 @@
+// Package deployer for grid deployer
+package deployer
+
+import (
+	"fmt"
+
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+// Resource is a node capacity resource
+type Resource string
+
+// node capacity resources
+const (
+	ResourceCRU Resource = "cru"
+	ResourceMRU Resource = "mru"
+	ResourceSRU Resource = "sru"
+	ResourceHRU Resource = "hru"
+)
+
+// CapacityError is returned if a node doesn't have enough of a resource for a deployment
+type CapacityError struct {
+	NodeID   uint32
+	Resource Resource
+	Needed   uint64
+	Free     uint64
+}
+
+func (e CapacityError) Error() string {
+	return fmt.Sprintf("node %d does not have enough resources. needed %s: %d, free %s: %d", e.NodeID, e.Resource, e.Needed, e.Resource, e.Free)
+}
+
+// NodeRentedError is returned if a node is rented by another twin
+type NodeRentedError struct {
+	NodeID         uint32
+	RentedByTwinID uint32
+}
+
+func (e NodeRentedError) Error() string {
+	return fmt.Sprintf("node %d is rented by twin %d", e.NodeID, e.RentedByTwinID)
+}
+
+// DedicatedNodeError is returned if a node is dedicated and not rented, dedicated nodes must be rented before deploying on them
+type DedicatedNodeError struct {
+	NodeID uint32
+}
+
+func (e DedicatedNodeError) Error() string {
+	return fmt.Sprintf("node %d is a dedicated node, it must be rented before deploying on it", e.NodeID)
+}
+
+// PublicIPsError is returned if a farm doesn't have enough free public ips for the deployments on its nodes
+type PublicIPsError struct {
+	FarmID uint32
+	NodeID uint32
+	Needed uint32
+	Free   uint32
+}
+
+func (e PublicIPsError) Error() string {
+	return fmt.Sprintf("farm %d does not have enough public ips for node %d. needed: %d, free: %d", e.FarmID, e.NodeID, e.Needed, e.Free)
+}
+
+// PublicConfigError is returned if a node doesn't have the public config needed by a gateway workload
+type PublicConfigError struct {
+	NodeID       uint32
+	WorkloadType gridtypes.WorkloadType
+	// Missing is the missing public config, either ipv4 or domain
+	Missing string
+}
+
+func (e PublicConfigError) Error() string {
+	return fmt.Sprintf("node %d cannot deploy a %s workload as it does not have a public %s configured", e.NodeID, e.WorkloadType, e.Missing)
+}
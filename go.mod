@@ -11,6 +11,7 @@ require (
 	github.com/threefoldtech/rmb-sdk-go v1.0.1-0.20230316162347-255e7faa0006
 	github.com/threefoldtech/substrate-client v0.1.5
 	github.com/threefoldtech/zos v0.5.6-0.20230321103809-44426c1a69c7
+	go.etcd.io/bbolt v1.3.7
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20200609130330-bd2cb7843e1b
 )
 
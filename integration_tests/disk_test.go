@@ -33,7 +33,7 @@ func TestDiskDeployment(t *testing.T) {
 	err = tfPluginClient.DeploymentDeployer.Deploy(ctx, &dl)
 	assert.NoError(t, err)
 
-	resDisk, err := tfPluginClient.State.LoadDiskFromGrid(nodeID, disk.Name, dl.Name)
+	resDisk, err := tfPluginClient.State.LoadDiskFromGrid(ctx, nodeID, disk.Name, dl.Name)
 	assert.NoError(t, err)
 	assert.Equal(t, disk, resDisk)
 
@@ -41,6 +41,6 @@ func TestDiskDeployment(t *testing.T) {
 	err = tfPluginClient.DeploymentDeployer.Cancel(ctx, &dl)
 	assert.NoError(t, err)
 
-	_, err = tfPluginClient.State.LoadDiskFromGrid(nodeID, disk.Name, dl.Name)
+	_, err = tfPluginClient.State.LoadDiskFromGrid(ctx, nodeID, disk.Name, dl.Name)
 	assert.Error(t, err)
 }
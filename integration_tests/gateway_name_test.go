@@ -67,7 +67,7 @@ func TestGatewayNameDeployment(t *testing.T) {
 	err = tfPluginClient.DeploymentDeployer.Deploy(ctx, &dl)
 	assert.NoError(t, err)
 
-	v, err := tfPluginClient.State.LoadVMFromGrid(nodeID, vm.Name, dl.Name)
+	v, err := tfPluginClient.State.LoadVMFromGrid(ctx, nodeID, vm.Name, dl.Name)
 	assert.NoError(t, err)
 
 	backend := fmt.Sprintf("http://[%s]:9000", v.YggIP)
@@ -81,7 +81,7 @@ func TestGatewayNameDeployment(t *testing.T) {
 	err = tfPluginClient.GatewayNameDeployer.Deploy(ctx, &gw)
 	assert.NoError(t, err)
 
-	result, err := tfPluginClient.State.LoadGatewayNameFromGrid(gwNodeID, gw.Name, gw.Name)
+	result, err := tfPluginClient.State.LoadGatewayNameFromGrid(ctx, gwNodeID, gw.Name, gw.Name)
 	assert.NoError(t, err)
 
 	assert.NotEmpty(t, result.FQDN)
@@ -111,7 +111,7 @@ func TestGatewayNameDeployment(t *testing.T) {
 	err = tfPluginClient.DeploymentDeployer.Cancel(ctx, &dl)
 	assert.NoError(t, err)
 
-	_, err = tfPluginClient.State.LoadGatewayNameFromGrid(nodeID, gw.Name, gw.Name)
+	_, err = tfPluginClient.State.LoadGatewayNameFromGrid(ctx, nodeID, gw.Name, gw.Name)
 	assert.Error(t, err)
 
 }
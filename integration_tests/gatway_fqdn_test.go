@@ -65,7 +65,7 @@ func TestGatewayFQDNDeployment(t *testing.T) {
 	err = tfPluginClient.DeploymentDeployer.Deploy(ctx, &dl)
 	assert.NoError(t, err)
 
-	v, err := tfPluginClient.State.LoadVMFromGrid(nodeID, vm.Name, dl.Name)
+	v, err := tfPluginClient.State.LoadVMFromGrid(ctx, nodeID, vm.Name, dl.Name)
 	assert.NoError(t, err)
 
 	backend := fmt.Sprintf("http://[%s]:9000", v.YggIP)
@@ -82,7 +82,7 @@ func TestGatewayFQDNDeployment(t *testing.T) {
 	err = tfPluginClient.GatewayFQDNDeployer.Deploy(ctx, &gw)
 	assert.NoError(t, err)
 
-	_, err = tfPluginClient.State.LoadGatewayFQDNFromGrid(gatewayNode, gw.Name, gw.Name)
+	_, err = tfPluginClient.State.LoadGatewayFQDNFromGrid(ctx, gatewayNode, gw.Name, gw.Name)
 	assert.NoError(t, err)
 
 	_, err = RemoteRun("root", v.YggIP, "apk add python3; python3 -m http.server 9000 --bind :: &> /dev/null &", privateKey)
@@ -110,6 +110,6 @@ func TestGatewayFQDNDeployment(t *testing.T) {
 	err = tfPluginClient.NetworkDeployer.Cancel(ctx, &network)
 	assert.NoError(t, err)
 
-	_, err = tfPluginClient.State.LoadGatewayFQDNFromGrid(nodeID, gw.Name, gw.Name)
+	_, err = tfPluginClient.State.LoadGatewayFQDNFromGrid(ctx, nodeID, gw.Name, gw.Name)
 	assert.Error(t, err)
 }
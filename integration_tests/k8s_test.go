@@ -130,7 +130,7 @@ func TestK8sDeployment(t *testing.T) {
 	err = tfPluginClient.K8sDeployer.Deploy(ctx, &k8sCluster)
 	assert.NoError(t, err)
 
-	result, err := tfPluginClient.State.LoadK8sFromGrid([]uint32{masterNodeID, workerNodeID}, k8sCluster.Master.Name)
+	result, err := tfPluginClient.State.LoadK8sFromGrid(ctx, []uint32{masterNodeID, workerNodeID}, k8sCluster.Master.Name)
 	assert.NoError(t, err)
 
 	// check workers count
@@ -154,6 +154,6 @@ func TestK8sDeployment(t *testing.T) {
 	err = tfPluginClient.NetworkDeployer.Cancel(ctx, &network)
 	assert.NoError(t, err)
 
-	_, err = tfPluginClient.State.LoadK8sFromGrid([]uint32{masterNodeID, workerNodeID}, k8sCluster.Master.Name)
+	_, err = tfPluginClient.State.LoadK8sFromGrid(ctx, []uint32{masterNodeID, workerNodeID}, k8sCluster.Master.Name)
 	assert.Error(t, err)
 }
@@ -43,7 +43,7 @@ func TestNetworkDeployment(t *testing.T) {
 		err = tfPluginClient.NetworkDeployer.Deploy(ctx, &network)
 		assert.NoError(t, err)
 
-		_, err := tfPluginClient.State.LoadNetworkFromGrid(network.Name)
+		_, err := tfPluginClient.State.LoadNetworkFromGrid(ctx, network.Name)
 		assert.NoError(t, err)
 	})
 
@@ -53,7 +53,7 @@ func TestNetworkDeployment(t *testing.T) {
 		err = tfPluginClient.NetworkDeployer.Deploy(ctx, &networkCp)
 		assert.NoError(t, err)
 
-		_, err := tfPluginClient.State.LoadNetworkFromGrid(networkCp.Name)
+		_, err := tfPluginClient.State.LoadNetworkFromGrid(ctx, networkCp.Name)
 		assert.NoError(t, err)
 	})
 
@@ -64,7 +64,7 @@ func TestNetworkDeployment(t *testing.T) {
 		err = tfPluginClient.NetworkDeployer.Deploy(ctx, &networkCp)
 		assert.NoError(t, err)
 
-		_, err := tfPluginClient.State.LoadNetworkFromGrid(networkCp.Name)
+		_, err := tfPluginClient.State.LoadNetworkFromGrid(ctx, networkCp.Name)
 		assert.NoError(t, err)
 	})
 
@@ -75,7 +75,7 @@ func TestNetworkDeployment(t *testing.T) {
 		err = tfPluginClient.NetworkDeployer.Cancel(ctx, &networkCp)
 		assert.NoError(t, err)
 
-		_, err := tfPluginClient.State.LoadNetworkFromGrid(network.Name)
+		_, err := tfPluginClient.State.LoadNetworkFromGrid(ctx, network.Name)
 		assert.Error(t, err)
 	})
 
@@ -69,7 +69,7 @@ func TestVMDeployment(t *testing.T) {
 		err = tfPluginClient.DeploymentDeployer.Deploy(ctx, &dl)
 		assert.NoError(t, err)
 
-		v, err := tfPluginClient.State.LoadVMFromGrid(nodeID, vm.Name, dl.Name)
+		v, err := tfPluginClient.State.LoadVMFromGrid(ctx, nodeID, vm.Name, dl.Name)
 		assert.NoError(t, err)
 		assert.Equal(t, v.IP, "10.20.2.5")
 
@@ -91,7 +91,7 @@ func TestVMDeployment(t *testing.T) {
 		err = tfPluginClient.NetworkDeployer.Cancel(ctx, &network)
 		assert.NoError(t, err)
 
-		_, err = tfPluginClient.State.LoadVMFromGrid(nodeID, vm.Name, dl.Name)
+		_, err = tfPluginClient.State.LoadVMFromGrid(ctx, nodeID, vm.Name, dl.Name)
 		assert.Error(t, err)
 	})
 }
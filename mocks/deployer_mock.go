@@ -9,6 +9,7 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	drift "github.com/threefoldtech/grid3-go/deployer/drift"
 	gridtypes "github.com/threefoldtech/zos/pkg/gridtypes"
 )
 
@@ -64,6 +65,21 @@ func (mr *MockDeployerMockRecorder) Deploy(ctx, oldDeploymentIDs, newDeployments
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Deploy", reflect.TypeOf((*MockDeployer)(nil).Deploy), ctx, oldDeploymentIDs, newDeployments, newDeploymentSolutionProvider)
 }
 
+// DetectDrift mocks base method.
+func (m *MockDeployer) DetectDrift(ctx context.Context, contracts map[uint32]uint64, desiredDeployments map[uint32]gridtypes.Deployment) (drift.Report, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DetectDrift", ctx, contracts, desiredDeployments)
+	ret0, _ := ret[0].(drift.Report)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DetectDrift indicates an expected call of DetectDrift.
+func (mr *MockDeployerMockRecorder) DetectDrift(ctx, contracts, desiredDeployments interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DetectDrift", reflect.TypeOf((*MockDeployer)(nil).DetectDrift), ctx, contracts, desiredDeployments)
+}
+
 // GetDeployments mocks base method.
 func (m *MockDeployer) GetDeployments(ctx context.Context, dls map[uint32]uint64) (map[uint32]gridtypes.Deployment, error) {
 	m.ctrl.T.Helper()
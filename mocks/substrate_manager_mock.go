@@ -199,6 +199,50 @@ func (m *MockSubstrateExt) EXPECT() *MockSubstrateExtMockRecorder {
 	return m.recorder
 }
 
+// BatchCancelContracts mocks base method.
+func (m *MockSubstrateExt) BatchCancelContracts(identity substrate.Identity, contracts []uint64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BatchCancelContracts", identity, contracts)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// BatchCancelContracts indicates an expected call of BatchCancelContracts.
+func (mr *MockSubstrateExtMockRecorder) BatchCancelContracts(identity, contracts interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BatchCancelContracts", reflect.TypeOf((*MockSubstrateExt)(nil).BatchCancelContracts), identity, contracts)
+}
+
+// BatchContracts mocks base method.
+func (m *MockSubstrateExt) BatchContracts(identity substrate.Identity, input subi.BatchContractsInput) ([]uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BatchContracts", identity, input)
+	ret0, _ := ret[0].([]uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BatchContracts indicates an expected call of BatchContracts.
+func (mr *MockSubstrateExtMockRecorder) BatchContracts(identity, input interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BatchContracts", reflect.TypeOf((*MockSubstrateExt)(nil).BatchContracts), identity, input)
+}
+
+// BatchCreateNodeContracts mocks base method.
+func (m *MockSubstrateExt) BatchCreateNodeContracts(identity substrate.Identity, contracts []subi.BatchCreateContractInput) ([]uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BatchCreateNodeContracts", identity, contracts)
+	ret0, _ := ret[0].([]uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BatchCreateNodeContracts indicates an expected call of BatchCreateNodeContracts.
+func (mr *MockSubstrateExtMockRecorder) BatchCreateNodeContracts(identity, contracts interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BatchCreateNodeContracts", reflect.TypeOf((*MockSubstrateExt)(nil).BatchCreateNodeContracts), identity, contracts)
+}
+
 // CancelContract mocks base method.
 func (m *MockSubstrateExt) CancelContract(identity substrate.Identity, contractID uint64) error {
 	m.ctrl.T.Helper()
@@ -343,6 +387,66 @@ func (mr *MockSubstrateExtMockRecorder) GetContractIDByNameRegistration(name int
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetContractIDByNameRegistration", reflect.TypeOf((*MockSubstrateExt)(nil).GetContractIDByNameRegistration), name)
 }
 
+// GetContractIDByNodeHash mocks base method.
+func (m *MockSubstrateExt) GetContractIDByNodeHash(nodeID uint32, hash string) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetContractIDByNodeHash", nodeID, hash)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetContractIDByNodeHash indicates an expected call of GetContractIDByNodeHash.
+func (mr *MockSubstrateExtMockRecorder) GetContractIDByNodeHash(nodeID, hash interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetContractIDByNodeHash", reflect.TypeOf((*MockSubstrateExt)(nil).GetContractIDByNodeHash), nodeID, hash)
+}
+
+// GetFarm mocks base method.
+func (m *MockSubstrateExt) GetFarm(farmID uint32) (*substrate.Farm, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFarm", farmID)
+	ret0, _ := ret[0].(*substrate.Farm)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFarm indicates an expected call of GetFarm.
+func (mr *MockSubstrateExtMockRecorder) GetFarm(farmID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFarm", reflect.TypeOf((*MockSubstrateExt)(nil).GetFarm), farmID)
+}
+
+// GetNode mocks base method.
+func (m *MockSubstrateExt) GetNode(nodeID uint32) (*substrate.Node, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetNode", nodeID)
+	ret0, _ := ret[0].(*substrate.Node)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetNode indicates an expected call of GetNode.
+func (mr *MockSubstrateExtMockRecorder) GetNode(nodeID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNode", reflect.TypeOf((*MockSubstrateExt)(nil).GetNode), nodeID)
+}
+
+// GetNodeRentContract mocks base method.
+func (m *MockSubstrateExt) GetNodeRentContract(nodeID uint32) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetNodeRentContract", nodeID)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetNodeRentContract indicates an expected call of GetNodeRentContract.
+func (mr *MockSubstrateExtMockRecorder) GetNodeRentContract(nodeID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNodeRentContract", reflect.TypeOf((*MockSubstrateExt)(nil).GetNodeRentContract), nodeID)
+}
+
 // GetNodeTwin mocks base method.
 func (m *MockSubstrateExt) GetNodeTwin(id uint32) (uint32, error) {
 	m.ctrl.T.Helper()
@@ -358,6 +462,21 @@ func (mr *MockSubstrateExtMockRecorder) GetNodeTwin(id interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNodeTwin", reflect.TypeOf((*MockSubstrateExt)(nil).GetNodeTwin), id)
 }
 
+// GetPricingPolicy mocks base method.
+func (m *MockSubstrateExt) GetPricingPolicy(policyID uint32) (substrate.PricingPolicy, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPricingPolicy", policyID)
+	ret0, _ := ret[0].(substrate.PricingPolicy)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPricingPolicy indicates an expected call of GetPricingPolicy.
+func (mr *MockSubstrateExtMockRecorder) GetPricingPolicy(policyID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPricingPolicy", reflect.TypeOf((*MockSubstrateExt)(nil).GetPricingPolicy), policyID)
+}
+
 // GetTwinByPubKey mocks base method.
 func (m *MockSubstrateExt) GetTwinByPubKey(pk []byte) (uint32, error) {
 	m.ctrl.T.Helper()
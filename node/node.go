@@ -75,7 +75,6 @@ package client
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"net"
 	"time"
 
@@ -368,21 +367,9 @@ func AreNodesUp(ctx context.Context, sub subi.SubstrateExt, nodes []uint32, nc N
 	return nil
 }
 
-// GetNodeFreeWGPort returns node free wireguard port
+// GetNodeFreeWGPort returns node free wireguard port in the default ports range, the port is not reserved
 func (n *NodeClient) GetNodeFreeWGPort(ctx context.Context, nodeID uint32) (int, error) {
-	rand.Seed(time.Now().UnixNano())
-	freePorts, err := n.NetworkListWGPorts(ctx)
-	if err != nil {
-		return 0, errors.Wrap(err, "failed to list wg ports")
-	}
-	log.Debug().Msgf("reserved ports for node %d: %v", nodeID, freePorts)
-	p := uint(rand.Intn(6000) + 2000)
-
-	for contains(freePorts, uint16(p)) {
-		p = uint(rand.Intn(6000) + 2000)
-	}
-	log.Debug().Msgf("Selected port for node %d is %d", nodeID, p)
-	return int(p), nil
+	return n.ReserveWGPort(ctx, nodeID, NewWGPortAllocator(DefaultWGPortRange))
 }
 
 // GetNodeEndpoint gets node end point network ip
@@ -0,0 +1,111 @@
+// Package client for node client
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultWGPortRange is the default range of the wireguard ports of the nodes networks
+var DefaultWGPortRange = WGPortRange{Min: 2000, Max: 7999}
+
+// ErrNoFreeWGPort is returned if all the ports of the wireguard ports range are used or reserved on a node
+var ErrNoFreeWGPort = errors.New("no free wireguard port")
+
+// WGPortRange is an inclusive range of wireguard ports
+type WGPortRange struct {
+	Min uint16
+	Max uint16
+}
+
+// Validate validates the range is not empty
+func (r WGPortRange) Validate() error {
+	if r.Min == 0 || r.Min > r.Max {
+		return fmt.Errorf("invalid wireguard ports range %d-%d", r.Min, r.Max)
+	}
+	return nil
+}
+
+// WGPortAllocator picks free wireguard ports of the nodes and reserves them locally,
+// so concurrent deployments on the same node don't pick the same port before they are deployed
+type WGPortAllocator struct {
+	lock      sync.Mutex
+	portRange WGPortRange
+	rand      *rand.Rand
+	reserved  map[uint32]map[uint16]struct{}
+}
+
+// NewWGPortAllocator creates a new wireguard ports allocator of a ports range
+func NewWGPortAllocator(portRange WGPortRange) *WGPortAllocator {
+	return &WGPortAllocator{
+		portRange: portRange,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		reserved:  make(map[uint32]map[uint16]struct{}),
+	}
+}
+
+// Reserve reserves a random port of the range that is neither used on the node nor reserved for it
+func (a *WGPortAllocator) Reserve(nodeID uint32, usedPorts []uint16) (int, error) {
+	if err := a.portRange.Validate(); err != nil {
+		return 0, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	reserved := a.reserved[nodeID]
+	free := make([]uint16, 0)
+	for port := int(a.portRange.Min); port <= int(a.portRange.Max); port++ {
+		if _, ok := reserved[uint16(port)]; ok || contains(usedPorts, uint16(port)) {
+			continue
+		}
+		free = append(free, uint16(port))
+	}
+	if len(free) == 0 {
+		return 0, errors.Wrapf(ErrNoFreeWGPort, "all ports in range %d-%d are used on node %d", a.portRange.Min, a.portRange.Max, nodeID)
+	}
+
+	port := free[a.rand.Intn(len(free))]
+	if reserved == nil {
+		reserved = make(map[uint16]struct{})
+		a.reserved[nodeID] = reserved
+	}
+	reserved[port] = struct{}{}
+
+	return int(port), nil
+}
+
+// Release releases the reservations of node ports
+func (a *WGPortAllocator) Release(nodeID uint32, ports ...int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, port := range ports {
+		delete(a.reserved[nodeID], uint16(port))
+	}
+	if len(a.reserved[nodeID]) == 0 {
+		delete(a.reserved, nodeID)
+	}
+}
+
+// ReserveWGPort reserves a wireguard port that is not used on the node using the allocator
+func (n *NodeClient) ReserveWGPort(ctx context.Context, nodeID uint32, allocator *WGPortAllocator) (int, error) {
+	usedPorts, err := n.NetworkListWGPorts(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list wg ports")
+	}
+	log.Debug().Msgf("reserved ports for node %d: %v", nodeID, usedPorts)
+
+	port, err := allocator.Reserve(nodeID, usedPorts)
+	if err != nil {
+		return 0, err
+	}
+	log.Debug().Msgf("Selected port for node %d is %d", nodeID, port)
+	return port, nil
+}
@@ -0,0 +1,58 @@
+// Package client for node client
+package client
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWGPortAllocator(t *testing.T) {
+	t.Run("reserve free ports", func(t *testing.T) {
+		allocator := NewWGPortAllocator(WGPortRange{Min: 2000, Max: 2002})
+
+		ports := []int{}
+		for i := 0; i < 2; i++ {
+			port, err := allocator.Reserve(1, []uint16{2001})
+			assert.NoError(t, err)
+			ports = append(ports, port)
+		}
+		assert.ElementsMatch(t, []int{2000, 2002}, ports)
+
+		// reservations are per node
+		port, err := allocator.Reserve(2, []uint16{2000, 2002})
+		assert.NoError(t, err)
+		assert.Equal(t, 2001, port)
+	})
+
+	t.Run("exhausted range", func(t *testing.T) {
+		allocator := NewWGPortAllocator(WGPortRange{Min: 2000, Max: 2001})
+
+		_, err := allocator.Reserve(1, []uint16{2000})
+		assert.NoError(t, err)
+		_, err = allocator.Reserve(1, []uint16{2000})
+		assert.True(t, errors.Is(err, ErrNoFreeWGPort))
+	})
+
+	t.Run("release", func(t *testing.T) {
+		allocator := NewWGPortAllocator(WGPortRange{Min: 2000, Max: 2000})
+
+		port, err := allocator.Reserve(1, nil)
+		assert.NoError(t, err)
+		_, err = allocator.Reserve(1, nil)
+		assert.Error(t, err)
+
+		allocator.Release(1, port)
+		port, err = allocator.Reserve(1, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 2000, port)
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		allocator := NewWGPortAllocator(WGPortRange{Min: 3000, Max: 2000})
+
+		_, err := allocator.Reserve(1, nil)
+		assert.Error(t, err)
+	})
+}
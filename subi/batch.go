@@ -0,0 +1,160 @@
+// Package subi for substrate client
+package subi
+
+import (
+	"github.com/centrifuge/go-substrate-rpc-client/v4/types"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// BatchCreateContractInput is a node contract to create in a batch
+type BatchCreateContractInput struct {
+	Node               uint32
+	Body               string
+	Hash               string
+	PublicIPs          uint32
+	SolutionProviderID *uint64
+}
+
+// BatchUpdateContractInput is a node contract to update in a batch
+type BatchUpdateContractInput struct {
+	ContractID uint64
+	Body       string
+	Hash       string
+}
+
+// BatchContractsInput is a mixed batch of node contracts creations, updates and cancellations
+type BatchContractsInput struct {
+	Create []BatchCreateContractInput
+	Update []BatchUpdateContractInput
+	Cancel []uint64
+}
+
+// BatchCreateNodeContracts creates many node contracts in one extrinsic
+// it returns the IDs of the created contracts in the same order of the input
+func (s *SubstrateImpl) BatchCreateNodeContracts(identity substrate.Identity, contracts []BatchCreateContractInput) ([]uint64, error) {
+	return s.BatchContracts(identity, BatchContractsInput{Create: contracts})
+}
+
+// BatchCancelContracts cancels many contracts in one extrinsic, contracts that don't exist are ignored
+func (s *SubstrateImpl) BatchCancelContracts(identity substrate.Identity, contracts []uint64) error {
+	_, err := s.BatchContracts(identity, BatchContractsInput{Cancel: contracts})
+	return err
+}
+
+// DefaultMaxBatchSize is the default maximum number of calls submitted in one batch extrinsic
+const DefaultMaxBatchSize = 100
+
+// BatchContracts creates, updates and cancels node contracts in batch extrinsics of at most MaxBatchSize calls.
+// each extrinsic is atomic, either all its operations are applied or none of them, but a failed extrinsic doesn't revert
+// the ones submitted before it, so the atomicity only holds if all the operations fit in one extrinsic.
+// it returns the IDs of the created contracts in the same order of the input, if an extrinsic fails the contracts
+// created by the extrinsics before it are returned with the error
+func (s *SubstrateImpl) BatchContracts(identity substrate.Identity, input BatchContractsInput) ([]uint64, error) {
+	// the contracts are checked under the lock, so a concurrent batch can't cancel them before this batch is submitted
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// cancelling a contract that doesn't exist fails the whole batch
+	cancel := make([]uint64, 0, len(input.Cancel))
+	for _, contractID := range input.Cancel {
+		valid, err := s.IsValidContract(contractID)
+		if err != nil {
+			return nil, err
+		}
+		if valid {
+			cancel = append(cancel, contractID)
+		}
+	}
+
+	if len(input.Create)+len(input.Update)+len(cancel) == 0 {
+		return []uint64{}, nil
+	}
+
+	cl, meta, err := s.Substrate.GetClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// the creations are the first calls, so their IDs can be read after each extrinsic
+	calls := make([]types.Call, 0, len(input.Create)+len(input.Update)+len(cancel))
+	for _, contract := range input.Create {
+		var providerID types.OptionU64
+		if contract.SolutionProviderID != nil {
+			providerID = types.NewOptionU64(types.U64(*contract.SolutionProviderID))
+		}
+
+		c, err := types.NewCall(meta, "SmartContractModule.create_node_contract",
+			contract.Node, substrate.NewHexHash(contract.Hash), contract.Body, contract.PublicIPs, providerID,
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create contract call for node %d", contract.Node)
+		}
+		calls = append(calls, c)
+	}
+
+	for _, contract := range input.Update {
+		c, err := types.NewCall(meta, "SmartContractModule.update_node_contract",
+			contract.ContractID, substrate.NewHexHash(contract.Hash), contract.Body,
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create update call for contract %d", contract.ContractID)
+		}
+		calls = append(calls, c)
+	}
+
+	for _, contractID := range cancel {
+		c, err := types.NewCall(meta, "SmartContractModule.cancel_contract", contractID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create cancel call for contract %d", contractID)
+		}
+		calls = append(calls, c)
+	}
+
+	created := make([]uint64, 0, len(input.Create))
+	submitted := 0
+	for _, chunk := range chunks(calls, s.maxBatchSize()) {
+		batch, err := types.NewCall(meta, "Utility.batch_all", chunk)
+		if err != nil {
+			return created, errors.Wrap(err, "failed to create batch call")
+		}
+
+		if _, err := s.Substrate.Call(cl, meta, identity, batch); err != nil {
+			return created, errors.Wrap(normalizeNotFoundErrors(err), "failed to submit contracts batch")
+		}
+
+		submitted += len(chunk)
+
+		for len(created) < len(input.Create) && len(created) < submitted {
+			contract := input.Create[len(created)]
+			contractID, err := s.Substrate.GetContractWithHash(contract.Node, substrate.NewHexHash(contract.Hash))
+			if err != nil {
+				return created, errors.Wrapf(normalizeNotFoundErrors(err), "failed to get created contract of node %d", contract.Node)
+			}
+			created = append(created, contractID)
+		}
+	}
+
+	return created, nil
+}
+
+// maxBatchSize returns the maximum number of calls in one batch extrinsic
+func (s *SubstrateImpl) maxBatchSize() int {
+	if s.MaxBatchSize <= 0 {
+		return DefaultMaxBatchSize
+	}
+	return s.MaxBatchSize
+}
+
+// chunks splits a slice into chunks of at most size items
+func chunks[T any](items []T, size int) [][]T {
+	res := make([][]T, 0, (len(items)+size-1)/size)
+	for len(items) > size {
+		res = append(res, items[:size])
+		items = items[size:]
+	}
+	if len(items) != 0 {
+		res = append(res, items)
+	}
+	return res
+}
@@ -0,0 +1,30 @@
+// Package subi for substrate client
+package subi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunks(t *testing.T) {
+	t.Run("split", func(t *testing.T) {
+		assert.Equal(t, [][]int{{1, 2}, {3, 4}, {5}}, chunks([]int{1, 2, 3, 4, 5}, 2))
+	})
+
+	t.Run("fits in one chunk", func(t *testing.T) {
+		assert.Equal(t, [][]int{{1, 2, 3}}, chunks([]int{1, 2, 3}, 3))
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		assert.Empty(t, chunks([]int{}, 2))
+	})
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	sub := SubstrateImpl{}
+	assert.Equal(t, DefaultMaxBatchSize, sub.maxBatchSize())
+
+	sub.MaxBatchSize = 10
+	assert.Equal(t, 10, sub.maxBatchSize())
+}
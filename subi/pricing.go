@@ -0,0 +1,41 @@
+// Package subi for substrate client
+package subi
+
+import (
+	"github.com/centrifuge/go-substrate-rpc-client/v4/types"
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/substrate-client"
+)
+
+// GetPricingPolicy returns a pricing policy given its ID
+func (s *SubstrateImpl) GetPricingPolicy(policyID uint32) (substrate.PricingPolicy, error) {
+	cl, meta, err := s.Substrate.GetClient()
+	if err != nil {
+		return substrate.PricingPolicy{}, err
+	}
+
+	bytes, err := types.Encode(policyID)
+	if err != nil {
+		return substrate.PricingPolicy{}, errors.Wrap(err, "substrate: encoding error building query arguments")
+	}
+
+	key, err := types.CreateStorageKey(meta, "TfgridModule", "PricingPolicies", bytes)
+	if err != nil {
+		return substrate.PricingPolicy{}, errors.Wrap(err, "failed to create substrate query key")
+	}
+
+	raw, err := cl.RPC.State.GetStorageRawLatest(key)
+	if err != nil {
+		return substrate.PricingPolicy{}, errors.Wrap(err, "failed to lookup pricing policy")
+	}
+
+	if len(*raw) == 0 {
+		return substrate.PricingPolicy{}, substrate.ErrNotFound
+	}
+
+	var policy substrate.PricingPolicy
+	if err := types.Decode(*raw, &policy); err != nil {
+		return substrate.PricingPolicy{}, errors.Wrapf(err, "failed to decode pricing policy %d", policyID)
+	}
+	return policy, nil
+}
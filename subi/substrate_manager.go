@@ -56,12 +56,24 @@ type SubstrateExt interface {
 	GetBalance(identity substrate.Identity) (balance substrate.Balance, err error)
 	GetTwinPK(twinID uint32) ([]byte, error)
 	GetContractIDByNameRegistration(name string) (uint64, error)
+	GetContractIDByNodeHash(nodeID uint32, hash string) (uint64, error)
+
+	GetNode(nodeID uint32) (*substrate.Node, error)
+	GetFarm(farmID uint32) (*substrate.Farm, error)
+	GetNodeRentContract(nodeID uint32) (uint64, error)
+	GetPricingPolicy(policyID uint32) (substrate.PricingPolicy, error)
+
+	BatchCreateNodeContracts(identity substrate.Identity, contracts []BatchCreateContractInput) ([]uint64, error)
+	BatchCancelContracts(identity substrate.Identity, contracts []uint64) error
+	BatchContracts(identity substrate.Identity, input BatchContractsInput) ([]uint64, error)
 }
 
 // SubstrateImpl struct to use dev substrate
 type SubstrateImpl struct {
 	*substrate.Substrate
-	m sync.Mutex
+	// MaxBatchSize is the maximum number of calls in one batch extrinsic, default is DefaultMaxBatchSize
+	MaxBatchSize int
+	m            sync.Mutex
 }
 
 // GetAccount returns the user's account
@@ -90,6 +102,24 @@ func (s *SubstrateImpl) GetNodeTwin(nodeID uint32) (uint32, error) {
 	return uint32(node.TwinID), nil
 }
 
+// GetNode returns a node given its ID
+func (s *SubstrateImpl) GetNode(nodeID uint32) (*substrate.Node, error) {
+	node, err := s.Substrate.GetNode(nodeID)
+	return node, normalizeNotFoundErrors(err)
+}
+
+// GetFarm returns a farm given its ID
+func (s *SubstrateImpl) GetFarm(farmID uint32) (*substrate.Farm, error) {
+	farm, err := s.Substrate.GetFarm(farmID)
+	return farm, normalizeNotFoundErrors(err)
+}
+
+// GetNodeRentContract returns the active rent contract of a node
+func (s *SubstrateImpl) GetNodeRentContract(nodeID uint32) (uint64, error) {
+	contractID, err := s.Substrate.GetNodeRentContract(nodeID)
+	return contractID, normalizeNotFoundErrors(err)
+}
+
 // GetTwinPK returns twin's public key
 func (s *SubstrateImpl) GetTwinPK(id uint32) ([]byte, error) {
 	twin, err := s.Substrate.GetTwin(id)
@@ -113,6 +143,12 @@ func (s *SubstrateImpl) GetContractIDByNameRegistration(name string) (uint64, er
 	return res, normalizeNotFoundErrors(err)
 }
 
+// GetContractIDByNodeHash returns the node contract ID using the node ID and the deployment hash
+func (s *SubstrateImpl) GetContractIDByNodeHash(nodeID uint32, hash string) (uint64, error) {
+	res, err := s.Substrate.GetContractWithHash(nodeID, substrate.NewHexHash(hash))
+	return res, normalizeNotFoundErrors(err)
+}
+
 // CreateNodeContract creates a new node contract
 func (s *SubstrateImpl) CreateNodeContract(identity substrate.Identity, node uint32, body string, hash string, publicIPs uint32, solutionProviderID *uint64) (uint64, error) {
 	s.m.Lock()
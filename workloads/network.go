@@ -15,13 +15,74 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// UserAccess struct
+// UserAccess is a named wireguard peer giving a user access to the network through its public node
 type UserAccess struct {
+	Name string
+
+	// computed
+	Subnet             gridtypes.IPNet
 	UserAddress        string
 	UserSecretKey      string
+	UserPublicKey      string
 	PublicNodePK       string
 	AllowedIPs         []string
 	PublicNodeEndpoint string
+	WGConfig           string
+}
+
+// PublicKey returns the wireguard public key of the user access.
+// only UserPublicKey is kept in the network workloads, so it's used if UserSecretKey is not known
+func (u *UserAccess) PublicKey() (wgtypes.Key, error) {
+	if u.UserSecretKey == "" {
+		key, err := wgtypes.ParseKey(u.UserPublicKey)
+		if err != nil {
+			return wgtypes.Key{}, errors.Wrapf(err, "failed to parse user access %s public key", u.Name)
+		}
+		return key, nil
+	}
+
+	key, err := wgtypes.ParseKey(u.UserSecretKey)
+	if err != nil {
+		return wgtypes.Key{}, errors.Wrapf(err, "failed to parse user access %s private key", u.Name)
+	}
+	return key.PublicKey(), nil
+}
+
+const (
+	// DefaultSubnetPrefix is the default prefix length of the network nodes subnets
+	DefaultSubnetPrefix = 24
+	// maxSubnetPrefix is the longest subnet prefix, the wireguard ip of a subnet is generated from its second and third bytes
+	maxSubnetPrefix = 24
+	// minIPRangePrefix is the shortest ip range prefix, so the second and third bytes of the subnets are unique
+	minIPRangePrefix = 8
+	// maxIPRangePrefix is the longest ip range prefix, so the range has a subnet after its first two /24 subnets
+	maxIPRangePrefix = 22
+)
+
+// networkMetadataVersion is the version of the network workloads metadata
+const networkMetadataVersion = 1
+
+// NetworkMetaData is the metadata of the network workloads, it keeps the network data that is not part of the workload data
+type NetworkMetaData struct {
+	Version      int                  `json:"version"`
+	UserAccesses []UserAccessMetaData `json:"user_accesses"`
+	// PublicNodeID and BackupPublicNodeIDs are only set if the network has backup public nodes
+	PublicNodeID        uint32   `json:"public_node_id,omitempty"`
+	BackupPublicNodeIDs []uint32 `json:"backup_public_node_ids,omitempty"`
+	// AccessDNS and AccessMTU are the optional fields of the user accesses wireguard configs
+	AccessDNS []string `json:"access_dns,omitempty"`
+	AccessMTU int      `json:"access_mtu,omitempty"`
+}
+
+// UserAccessMetaData is a user wireguard access to the network, the access of AddWGAccess has no name.
+// the metadata is readable by anyone, so it only has the access public key
+type UserAccessMetaData struct {
+	Name      string `json:"name,omitempty"`
+	Subnet    string `json:"subnet"`
+	PublicKey string `json:"public_key,omitempty"`
+	// PrivateKey is only set in the metadata of older networks, it's still loaded so their user accesses keep working
+	PrivateKey string `json:"private_key,omitempty"`
+	NodeID     uint32 `json:"node_id"`
 }
 
 // ZNet is zos network workload
@@ -31,16 +92,31 @@ type ZNet struct {
 	Nodes       []uint32
 	IPRange     gridtypes.IPNet
 	AddWGAccess bool
+	// UserAccesses are named user accesses added to the one of AddWGAccess
+	UserAccesses []UserAccess
+	// SubnetPrefix is the prefix length of the nodes and user accesses subnets, default is 24
+	SubnetPrefix int
+	// NodesSubnetPrefix overrides SubnetPrefix for the subnets of some nodes
+	NodesSubnetPrefix map[uint32]int
+	// PublicNodesCount is the number of public nodes the hidden nodes and the user accesses peer with, it defaults to 1
+	PublicNodesCount int
+	// AccessDNS and AccessMTU are set in the wireguard configs of the user accesses if they are not empty
+	AccessDNS []string
+	AccessMTU int
 
 	// computed
 	SolutionType     string
 	AccessWGConfig   string
 	ExternalIP       *gridtypes.IPNet
 	ExternalSK       wgtypes.Key
+	ExternalPK       wgtypes.Key
 	PublicNodeID     uint32
 	NodesIPRange     map[uint32]gridtypes.IPNet
 	NodeDeploymentID map[uint32]uint64
 
+	// BackupPublicNodeIDs are the public nodes used with PublicNodeID if PublicNodesCount is more than 1
+	BackupPublicNodeIDs []uint32
+
 	WGPort map[uint32]int
 	Keys   map[uint32]wgtypes.Key
 }
@@ -57,20 +133,217 @@ func NewNetworkFromWorkload(wl gridtypes.Workload, nodeID uint32) (ZNet, error)
 		return ZNet{}, fmt.Errorf("could not create network workload from data %v", dataI)
 	}
 
-	return ZNet{
-		Name:        wl.Name.String(),
-		Description: wl.Description,
-		Nodes:       []uint32{nodeID},
-		IPRange:     data.NetworkIPRange,
-		AddWGAccess: data.WGPrivateKey != "",
-	}, nil
+	znet := ZNet{
+		Name:         wl.Name.String(),
+		Description:  wl.Description,
+		Nodes:        []uint32{nodeID},
+		IPRange:      data.NetworkIPRange,
+		NodesIPRange: map[uint32]gridtypes.IPNet{nodeID: data.Subnet},
+		WGPort:       map[uint32]int{nodeID: int(data.WGListenPort)},
+		Keys:         map[uint32]wgtypes.Key{},
+	}
+
+	if data.WGPrivateKey != "" {
+		key, err := wgtypes.ParseKey(data.WGPrivateKey)
+		if err != nil {
+			return ZNet{}, errors.Wrapf(err, "failed to parse network %s wireguard private key", wl.Name)
+		}
+		znet.Keys[nodeID] = key
+	}
+
+	// only the public node has peers without endpoints, the hidden nodes and the user accesses
+	for _, peer := range data.Peers {
+		if peer.Endpoint == "" {
+			znet.PublicNodeID = nodeID
+			break
+		}
+	}
+
+	if err := znet.loadMetadata(wl.Metadata); err != nil {
+		return ZNet{}, errors.Wrapf(err, "failed to load network %s metadata", wl.Name)
+	}
+
+	return znet, nil
+}
+
+// loadMetadata loads the user accesses of the network from its workload metadata
+func (znet *ZNet) loadMetadata(metadata string) error {
+	if metadata == "" {
+		return nil
+	}
+
+	var data NetworkMetaData
+	if err := json.Unmarshal([]byte(metadata), &data); err != nil {
+		return err
+	}
+
+	for _, access := range data.UserAccesses {
+		subnet, err := gridtypes.ParseIPNet(access.Subnet)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse user access subnet %s", access.Subnet)
+		}
+		secretKey, publicKey, err := access.keys()
+		if err != nil {
+			return err
+		}
+		znet.PublicNodeID = access.NodeID
+
+		if access.Name != "" {
+			userAccess := UserAccess{
+				Name:          access.Name,
+				Subnet:        subnet,
+				UserPublicKey: publicKey.String(),
+			}
+			if secretKey != nil {
+				userAccess.UserSecretKey = secretKey.String()
+			}
+			znet.UserAccesses = append(znet.UserAccesses, userAccess)
+			continue
+		}
+
+		znet.AddWGAccess = true
+		znet.ExternalIP = &subnet
+		znet.ExternalPK = publicKey
+		if secretKey != nil {
+			znet.ExternalSK = *secretKey
+		}
+	}
+
+	if data.PublicNodeID != 0 {
+		znet.PublicNodeID = data.PublicNodeID
+		znet.BackupPublicNodeIDs = data.BackupPublicNodeIDs
+		znet.PublicNodesCount = len(data.BackupPublicNodeIDs) + 1
+	}
+	znet.AccessDNS = data.AccessDNS
+	znet.AccessMTU = data.AccessMTU
+	return nil
+}
+
+// keys returns the public key of a user access, and its private key if the metadata is of an older network that has it
+func (access *UserAccessMetaData) keys() (*wgtypes.Key, wgtypes.Key, error) {
+	if access.PrivateKey != "" {
+		key, err := wgtypes.ParseKey(access.PrivateKey)
+		if err != nil {
+			return nil, wgtypes.Key{}, errors.Wrap(err, "failed to parse user access private key")
+		}
+		return &key, key.PublicKey(), nil
+	}
+
+	key, err := wgtypes.ParseKey(access.PublicKey)
+	if err != nil {
+		return nil, wgtypes.Key{}, errors.Wrap(err, "failed to parse user access public key")
+	}
+	return nil, key, nil
+}
+
+// ExternalPublicKey returns the public key of the user access of AddWGAccess.
+// only ExternalPK is kept in the network workloads, so it's used if ExternalSK is not known
+func (znet *ZNet) ExternalPublicKey() wgtypes.Key {
+	if znet.ExternalSK != (wgtypes.Key{}) {
+		return znet.ExternalSK.PublicKey()
+	}
+	return znet.ExternalPK
+}
+
+// PublicNodes returns the network public nodes, PublicNodeID comes first then the backup public nodes
+func (znet *ZNet) PublicNodes() []uint32 {
+	if znet.PublicNodeID == 0 {
+		return []uint32{}
+	}
+	return append([]uint32{znet.PublicNodeID}, znet.BackupPublicNodeIDs...)
+}
+
+// isPublicSubnet returns true if the subnet is the subnet of one of the public nodes, or if the public node has no subnet yet
+func (znet *ZNet) isPublicSubnet(subnet gridtypes.IPNet) bool {
+	for _, nodeID := range znet.PublicNodes() {
+		publicSubnet, ok := znet.NodesIPRange[nodeID]
+		if !ok || publicSubnet.String() == subnet.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// workloadMetadata generates the metadata of the network workload of a node subnet.
+// the user accesses are only kept in the public nodes workloads, so adding or revoking them doesn't change the other nodes workloads,
+// and only their public keys are kept since the deployments metadata can be read by anyone
+func (znet *ZNet) workloadMetadata(subnet gridtypes.IPNet) string {
+	data := NetworkMetaData{
+		Version:      networkMetadataVersion,
+		UserAccesses: []UserAccessMetaData{},
+	}
+
+	if !znet.isPublicSubnet(subnet) {
+		// marshaling the metadata can't fail, it only has strings and numbers
+		metadata, _ := json.Marshal(data)
+		return string(metadata)
+	}
+
+	if len(znet.BackupPublicNodeIDs) != 0 {
+		data.PublicNodeID = znet.PublicNodeID
+		data.BackupPublicNodeIDs = znet.BackupPublicNodeIDs
+	}
+	data.AccessDNS = znet.AccessDNS
+	data.AccessMTU = znet.AccessMTU
+
+	if znet.AddWGAccess && znet.ExternalIP != nil {
+		data.UserAccesses = append(data.UserAccesses, UserAccessMetaData{
+			Subnet:    znet.ExternalIP.String(),
+			PublicKey: znet.ExternalPublicKey().String(),
+			NodeID:    znet.PublicNodeID,
+		})
+	}
+	for _, access := range znet.UserAccesses {
+		// the public node peers can't be generated with an invalid key, so it's always valid here
+		publicKey, _ := access.PublicKey()
+		data.UserAccesses = append(data.UserAccesses, UserAccessMetaData{
+			Name:      access.Name,
+			Subnet:    access.Subnet.String(),
+			PublicKey: publicKey.String(),
+			NodeID:    znet.PublicNodeID,
+		})
+	}
+	metadata, _ := json.Marshal(data)
+	return string(metadata)
 }
 
-// Validate validates a network mask to be 16
+// Validate validates a network ip range and subnets prefixes, and its user accesses to have unique names
 func (znet *ZNet) Validate() error {
-	mask := znet.IPRange.Mask
-	if ones, _ := mask.Size(); ones != 16 {
-		return fmt.Errorf("subnet in ip range %s should be 16", znet.IPRange.String())
+	if znet.IPRange.IP.To4() == nil {
+		return fmt.Errorf("ip range %s should be an ipv4 range", znet.IPRange.String())
+	}
+	ones, bits := znet.IPRange.Mask.Size()
+	if bits != 32 || ones < minIPRangePrefix || ones > maxIPRangePrefix {
+		return fmt.Errorf("subnet in ip range %s should be between %d and %d", znet.IPRange.String(), minIPRangePrefix, maxIPRangePrefix)
+	}
+
+	prefixes := []int{znet.subnetPrefix(0)}
+	for nodeID := range znet.NodesSubnetPrefix {
+		prefixes = append(prefixes, znet.subnetPrefix(nodeID))
+	}
+	for _, prefix := range prefixes {
+		if prefix <= ones || prefix > maxSubnetPrefix {
+			return fmt.Errorf("subnets prefix %d should be longer than the ip range prefix %d and at most %d", prefix, ones, maxSubnetPrefix)
+		}
+	}
+
+	if znet.AccessMTU < 0 {
+		return fmt.Errorf("invalid user accesses mtu %d", znet.AccessMTU)
+	}
+
+	if znet.PublicNodesCount < 0 {
+		return fmt.Errorf("public nodes count %d can't be negative", znet.PublicNodesCount)
+	}
+
+	names := make(map[string]bool)
+	for _, access := range znet.UserAccesses {
+		if access.Name == "" {
+			return errors.New("user access name is required")
+		}
+		if names[access.Name] {
+			return fmt.Errorf("user access name %s is duplicated", access.Name)
+		}
+		names[access.Name] = true
 	}
 
 	return nil
@@ -83,6 +356,7 @@ func (znet *ZNet) ZosWorkload(subnet gridtypes.IPNet, wgPrivateKey string, wgLis
 		Type:        zos.NetworkType,
 		Description: znet.Description,
 		Name:        gridtypes.Name(znet.Name),
+		Metadata:    znet.workloadMetadata(subnet),
 		Data: gridtypes.MustMarshal(zos.Network{
 			NetworkIPRange: gridtypes.MustParseIPNet(znet.IPRange.String()),
 			Subnet:         subnet,
@@ -113,54 +387,100 @@ func (znet *ZNet) GenerateMetadata() (string, error) {
 	return string(deploymentDataBytes), nil
 }
 
-// AssignNodesIPs assign network nodes ips
+// AssignNodesIPs assign network nodes ips, the subnets of the nodes and the user accesses are kept if they are already assigned.
+// new subnets are allocated after the first two /24 subnets of the ip range, which were never assigned
 func (znet *ZNet) AssignNodesIPs(nodes []uint32) error {
+	allocator, err := NewSubnetAllocator(znet.IPRange)
+	if err != nil {
+		return err
+	}
 	ips := make(map[uint32]gridtypes.IPNet)
-	l := len(znet.IPRange.IP)
-	usedIPs := make([]byte, 0) // the third octet
 	for node, ip := range znet.NodesIPRange {
 		if Contains(nodes, node) {
-			usedIPs = append(usedIPs, ip.IP[l-2])
+			if err := allocator.Reserve(ip); err != nil {
+				return errors.Wrapf(err, "invalid node %d subnet", node)
+			}
 			ips[node] = ip
 		}
 	}
-	var cur byte = 2
+	for _, access := range znet.UserAccesses {
+		if access.Subnet.IP != nil && znet.IPRange.Contains(access.Subnet.IP) {
+			if err := allocator.Reserve(access.Subnet); err != nil {
+				return errors.Wrapf(err, "invalid user access %s subnet", access.Name)
+			}
+		}
+	}
+	// the first two /24 subnets of the range are kept free unless they are already used
+	for _, subnet := range firstSubnets(znet.IPRange, 2) {
+		_ = allocator.Reserve(subnet)
+	}
 	if znet.AddWGAccess {
 		if znet.ExternalIP != nil {
-			usedIPs = append(usedIPs, znet.ExternalIP.IP[l-2])
+			if err := allocator.Reserve(*znet.ExternalIP); err != nil {
+				return errors.Wrap(err, "invalid wireguard access subnet")
+			}
 		} else {
-			err := nextFreeIP(usedIPs, &cur)
+			ip, err := allocator.Allocate(znet.subnetPrefix(0))
 			if err != nil {
 				return err
 			}
-			usedIPs = append(usedIPs, cur)
-			ip := IPNet(znet.IPRange.IP[l-4], znet.IPRange.IP[l-3], cur, znet.IPRange.IP[l-1], 24)
 			znet.ExternalIP = &ip
 		}
 	}
+	for i := range znet.UserAccesses {
+		access := &znet.UserAccesses[i]
+		if access.Subnet.IP != nil && znet.IPRange.Contains(access.Subnet.IP) {
+			continue
+		}
+		subnet, err := allocator.Allocate(znet.subnetPrefix(0))
+		if err != nil {
+			return err
+		}
+		access.Subnet = subnet
+	}
 	for _, nodeID := range nodes {
 		if _, ok := ips[nodeID]; !ok {
-			err := nextFreeIP(usedIPs, &cur)
+			subnet, err := allocator.Allocate(znet.subnetPrefix(nodeID))
 			if err != nil {
 				return err
 			}
-			usedIPs = append(usedIPs, cur)
-			ips[nodeID] = IPNet(znet.IPRange.IP[l-4], znet.IPRange.IP[l-3], cur, znet.IPRange.IP[l-2], 24)
+			ips[nodeID] = subnet
 		}
 	}
 	znet.NodesIPRange = ips
 	return nil
 }
 
-// AssignNodesWGPort assign network nodes wireguard port
-func (znet *ZNet) AssignNodesWGPort(ctx context.Context, sub subi.SubstrateExt, ncPool client.NodeClientGetter, nodes []uint32) error {
+// firstSubnets returns the first /24 subnets of an ip range
+func firstSubnets(ipRange gridtypes.IPNet, count int) []gridtypes.IPNet {
+	ip := ipRange.IP.To4().Mask(ipRange.Mask)
+	subnets := make([]gridtypes.IPNet, 0, count)
+	for i := 0; i < count; i++ {
+		subnets = append(subnets, IPNet(ip[0], ip[1], ip[2]+byte(i), 0, 24))
+	}
+	return subnets
+}
+
+// subnetPrefix returns the prefix length of a node subnet, the user accesses subnets use the network SubnetPrefix
+func (znet *ZNet) subnetPrefix(nodeID uint32) int {
+	if prefix, ok := znet.NodesSubnetPrefix[nodeID]; ok && prefix != 0 {
+		return prefix
+	}
+	if znet.SubnetPrefix != 0 {
+		return znet.SubnetPrefix
+	}
+	return DefaultSubnetPrefix
+}
+
+// AssignNodesWGPort assign network nodes wireguard port, the ports are reserved using the allocator until they are released
+func (znet *ZNet) AssignNodesWGPort(ctx context.Context, sub subi.SubstrateExt, ncPool client.NodeClientGetter, allocator *client.WGPortAllocator, nodes []uint32) error {
 	for _, nodeID := range nodes {
 		if _, ok := znet.WGPort[nodeID]; !ok {
 			cl, err := ncPool.GetNodeClient(sub, nodeID)
 			if err != nil {
 				return errors.Wrap(err, "could not get node client")
 			}
-			port, err := cl.GetNodeFreeWGPort(ctx, nodeID)
+			port, err := cl.ReserveWGPort(ctx, nodeID, allocator)
 			if err != nil {
 				return errors.Wrap(err, "failed to get node free wg ports")
 			}
@@ -197,6 +517,33 @@ func (znet *ZNet) AssignNodesWGKey(nodes []uint32) error {
 	return nil
 }
 
+// AssignUserAccessesKeys assign the network user accesses wireguard keys, the accesses that only have a public key keep it
+func (znet *ZNet) AssignUserAccessesKeys() error {
+	if znet.AddWGAccess && znet.ExternalPublicKey() == (wgtypes.Key{}) {
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate wg private key")
+		}
+		znet.ExternalSK = key
+		znet.ExternalPK = key.PublicKey()
+	}
+
+	for i := range znet.UserAccesses {
+		if znet.UserAccesses[i].UserSecretKey != "" || znet.UserAccesses[i].UserPublicKey != "" {
+			continue
+		}
+
+		key, err := wgtypes.GenerateKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate wg private key")
+		}
+		znet.UserAccesses[i].UserSecretKey = key.String()
+		znet.UserAccesses[i].UserPublicKey = key.PublicKey().String()
+	}
+
+	return nil
+}
+
 // IPNet returns an IP net type
 func IPNet(a, b, c, d, msk byte) gridtypes.IPNet {
 	return gridtypes.NewIPNet(net.IPNet{
@@ -205,7 +552,8 @@ func IPNet(a, b, c, d, msk byte) gridtypes.IPNet {
 	})
 }
 
-// WgIP return wireguard IP network
+// WgIP return wireguard IP network, it's generated from the second and third bytes of the subnet like zos does,
+// so it's unique for subnets of at most 24 bits in ip ranges of at least 8 bits
 func WgIP(ip gridtypes.IPNet) gridtypes.IPNet {
 	a := ip.IP[len(ip.IP)-3]
 	b := ip.IP[len(ip.IP)-2]
@@ -217,7 +565,17 @@ func WgIP(ip gridtypes.IPNet) gridtypes.IPNet {
 
 }
 
+// WgIPRange returns the range of the wireguard IPs of the subnets of a network ip range
+func WgIPRange(ipRange gridtypes.IPNet) gridtypes.IPNet {
+	ones, _ := ipRange.Mask.Size()
+	ip := ipRange.IP.To4().Mask(ipRange.Mask)
+
+	return IPNet(100, 64, ip[1], ip[2], byte(ones+8))
+}
+
 // GenerateWGConfig generates wireguard configs
+//
+// Deprecated: use WGConfig, which supports several peers and the optional wg-quick fields
 func GenerateWGConfig(Address string, AccessPrivatekey string, NodePublicKey string, NodeEndpoint string, NetworkIPRange string) string {
 
 	return fmt.Sprintf(`
@@ -231,14 +589,3 @@ PersistentKeepalive = 25
 Endpoint = %s
 	`, Address, AccessPrivatekey, NodePublicKey, NetworkIPRange, NodeEndpoint)
 }
-
-// nextFreeIP finds a free ip for a node
-func nextFreeIP(used []byte, start *byte) error {
-	for Contains(used, *start) && *start <= 254 {
-		*start++
-	}
-	if *start == 255 {
-		return errors.New("could not find a free ip to add node")
-	}
-	return nil
-}
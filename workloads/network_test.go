@@ -9,6 +9,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/threefoldtech/zos/pkg/gridtypes"
+	"github.com/threefoldtech/zos/pkg/gridtypes/zos"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // Network
@@ -38,6 +40,12 @@ func TestNetwork(t *testing.T) {
 		assert.Equal(t, wgIP, wgIPRange)
 	})
 
+	t.Run("test_wg_ip_range", func(t *testing.T) {
+		assert.Equal(t, "100.64.20.0/24", WgIPRange(Network.IPRange).String())
+		assert.Equal(t, "100.64.16.0/20", WgIPRange(IPNet(10, 16, 0, 0, 12)).String())
+		assert.Equal(t, "100.64.0.0/16", WgIPRange(IPNet(10, 0, 0, 0, 8)).String())
+	})
+
 	t.Run("test_generate_wg_config", func(t *testing.T) {
 		config := GenerateWGConfig(
 			"", "", "", "",
@@ -56,4 +64,143 @@ func TestNetwork(t *testing.T) {
 			`, "", "", "", Network.IPRange.String(), ""), "\t", "")+"\t",
 		)
 	})
+	t.Run("test_network_from_workload", func(t *testing.T) {
+		key, err := wgtypes.GenerateKey()
+		assert.NoError(t, err)
+		externalSK, err := wgtypes.GenerateKey()
+		assert.NoError(t, err)
+		externalIP := IPNet(10, 20, 3, 0, 24)
+
+		znet := Network
+		znet.AddWGAccess = true
+		znet.ExternalIP = &externalIP
+		znet.ExternalSK = externalSK
+		znet.PublicNodeID = 1
+		znet.AccessDNS = []string{"1.1.1.1"}
+		znet.AccessMTU = 1400
+
+		subnet := IPNet(10, 20, 2, 0, 24)
+		peers := []zos.Peer{{Subnet: externalIP, WGPublicKey: externalSK.PublicKey().String()}}
+		wl := znet.ZosWorkload(subnet, key.String(), 1000, peers)
+
+		got, err := NewNetworkFromWorkload(wl, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, map[uint32]gridtypes.IPNet{1: subnet}, got.NodesIPRange)
+		assert.Equal(t, map[uint32]int{1: 1000}, got.WGPort)
+		assert.Equal(t, map[uint32]wgtypes.Key{1: key}, got.Keys)
+		assert.True(t, got.AddWGAccess)
+		assert.Equal(t, externalIP.String(), got.ExternalIP.String())
+		assert.Equal(t, externalSK.PublicKey(), got.ExternalPK)
+		assert.Equal(t, wgtypes.Key{}, got.ExternalSK)
+		assert.NotContains(t, wl.Metadata, externalSK.String())
+		assert.Equal(t, uint32(1), got.PublicNodeID)
+		assert.Equal(t, []string{"1.1.1.1"}, got.AccessDNS)
+		assert.Equal(t, 1400, got.AccessMTU)
+	})
+
+	t.Run("test_network_from_older_workload", func(t *testing.T) {
+		externalSK, err := wgtypes.GenerateKey()
+		assert.NoError(t, err)
+		userSK, err := wgtypes.GenerateKey()
+		assert.NoError(t, err)
+
+		// older networks kept the user accesses private keys in the metadata
+		wl := Network.ZosWorkload(IPNet(10, 20, 2, 0, 24), "", 1000, nil)
+		wl.Metadata = fmt.Sprintf(
+			`{"version":1,"user_accesses":[{"subnet":"10.20.3.0/24","private_key":"%s","node_id":1},{"name":"laptop","subnet":"10.20.4.0/24","private_key":"%s","node_id":1}]}`,
+			externalSK, userSK,
+		)
+
+		got, err := NewNetworkFromWorkload(wl, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, externalSK, got.ExternalSK)
+		assert.Equal(t, externalSK.PublicKey(), got.ExternalPublicKey())
+		assert.Equal(t, []UserAccess{
+			{Name: "laptop", Subnet: IPNet(10, 20, 4, 0, 24), UserSecretKey: userSK.String(), UserPublicKey: userSK.PublicKey().String()},
+		}, got.UserAccesses)
+	})
+
+	t.Run("test_user_accesses", func(t *testing.T) {
+		znet := Network
+		znet.PublicNodeID = 1
+		znet.NodesIPRange = map[uint32]gridtypes.IPNet{1: IPNet(10, 20, 2, 0, 24)}
+		znet.UserAccesses = []UserAccess{
+			{Name: "laptop"},
+			{Name: "phone", Subnet: IPNet(10, 20, 3, 0, 24)},
+		}
+
+		assert.NoError(t, znet.Validate())
+		assert.NoError(t, znet.AssignNodesIPs([]uint32{1, 2}))
+		assert.NoError(t, znet.AssignUserAccessesKeys())
+
+		assert.Equal(t, IPNet(10, 20, 4, 0, 24), znet.UserAccesses[0].Subnet)
+		assert.Equal(t, IPNet(10, 20, 3, 0, 24), znet.UserAccesses[1].Subnet)
+		assert.Equal(t, IPNet(10, 20, 5, 0, 24), znet.NodesIPRange[2])
+		assert.NotEmpty(t, znet.UserAccesses[0].UserSecretKey)
+
+		// the user accesses are only kept in the public node workload
+		wl := znet.ZosWorkload(znet.NodesIPRange[1], "", 1000, nil)
+		got, err := NewNetworkFromWorkload(wl, 1)
+		assert.NoError(t, err)
+		assert.False(t, got.AddWGAccess)
+		assert.Equal(t, []UserAccess{
+			{Name: "laptop", Subnet: znet.UserAccesses[0].Subnet, UserPublicKey: znet.UserAccesses[0].UserPublicKey},
+			{Name: "phone", Subnet: znet.UserAccesses[1].Subnet, UserPublicKey: znet.UserAccesses[1].UserPublicKey},
+		}, got.UserAccesses)
+		for _, access := range znet.UserAccesses {
+			assert.NotContains(t, wl.Metadata, access.UserSecretKey)
+		}
+
+		wl = znet.ZosWorkload(znet.NodesIPRange[2], "", 1000, nil)
+		got, err = NewNetworkFromWorkload(wl, 2)
+		assert.NoError(t, err)
+		assert.Empty(t, got.UserAccesses)
+
+		znet.UserAccesses = append(znet.UserAccesses, UserAccess{Name: "laptop"})
+		assert.Error(t, znet.Validate())
+	})
+
+	t.Run("test_ip_range_sizes", func(t *testing.T) {
+		znet := Network
+		znet.IPRange = IPNet(10, 20, 0, 0, 20)
+		znet.NodesSubnetPrefix = map[uint32]int{2: 22}
+		znet.AddWGAccess = true
+		assert.NoError(t, znet.Validate())
+
+		assert.NoError(t, znet.AssignNodesIPs([]uint32{1, 2, 3}))
+		assert.Equal(t, "10.20.2.0/24", znet.ExternalIP.String())
+		assert.Equal(t, "10.20.3.0/24", znet.NodesIPRange[1].String())
+		assert.Equal(t, "10.20.4.0/22", znet.NodesIPRange[2].String())
+		assert.Equal(t, "10.20.8.0/24", znet.NodesIPRange[3].String())
+		assert.Equal(t, "100.64.20.4/32", WgIP(znet.NodesIPRange[2]).String())
+
+		// the node subnets are kept
+		znet.NodesSubnetPrefix = nil
+		assert.NoError(t, znet.AssignNodesIPs([]uint32{2, 4}))
+		assert.Equal(t, "10.20.4.0/22", znet.NodesIPRange[2].String())
+		assert.Equal(t, "10.20.3.0/24", znet.NodesIPRange[4].String())
+
+		// used subnets at the start of the range are kept
+		znet.NodesIPRange[5] = IPNet(10, 20, 0, 0, 24)
+		assert.NoError(t, znet.AssignNodesIPs([]uint32{5, 6}))
+		assert.Equal(t, "10.20.0.0/24", znet.NodesIPRange[5].String())
+		assert.Equal(t, "10.20.3.0/24", znet.NodesIPRange[6].String())
+
+		znet.IPRange = IPNet(10, 20, 0, 0, 22)
+		znet.NodesIPRange = nil
+		znet.ExternalIP = nil
+		assert.NoError(t, znet.Validate())
+		assert.ErrorIs(t, znet.AssignNodesIPs([]uint32{1, 2}), ErrSubnetsExhausted)
+
+		znet.IPRange = IPNet(10, 0, 0, 0, 12)
+		assert.NoError(t, znet.Validate())
+		znet.SubnetPrefix = 12
+		assert.Error(t, znet.Validate())
+		znet.SubnetPrefix = 25
+		assert.Error(t, znet.Validate())
+
+		znet.SubnetPrefix = 0
+		znet.IPRange = IPNet(10, 20, 0, 0, 24)
+		assert.Error(t, znet.Validate())
+	})
 }
@@ -0,0 +1,104 @@
+// Package workloads includes workloads types (vm, zdb, QSFS, public IP, gateway name, gateway fqdn, disk)
+package workloads
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+// ErrSubnetsExhausted is returned if a network ip range has no free subnet of the requested size
+var ErrSubnetsExhausted = errors.New("no free subnet in the network ip range")
+
+// SubnetAllocator allocates non overlapping ipv4 subnets of different sizes in a network ip range
+type SubnetAllocator struct {
+	ipRange net.IPNet
+	used    []net.IPNet
+}
+
+// NewSubnetAllocator creates a subnet allocator of an ipv4 network ip range
+func NewSubnetAllocator(ipRange gridtypes.IPNet) (*SubnetAllocator, error) {
+	ip := ipRange.IP.To4()
+	if ip == nil || len(ipRange.Mask) == 0 {
+		return nil, fmt.Errorf("ip range %s is not a valid ipv4 range", ipRange.String())
+	}
+	return &SubnetAllocator{
+		ipRange: net.IPNet{IP: ip.Mask(ipRange.Mask), Mask: ipRange.Mask},
+	}, nil
+}
+
+// Reserve marks a subnet as used, it fails if the subnet is not in the ip range or overlaps a used subnet
+func (a *SubnetAllocator) Reserve(subnet gridtypes.IPNet) error {
+	ip := subnet.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("subnet %s is not a valid ipv4 subnet", subnet.String())
+	}
+	s := net.IPNet{IP: ip.Mask(subnet.Mask), Mask: subnet.Mask}
+
+	if !subnetInRange(a.ipRange, s) {
+		return fmt.Errorf("subnet %s is not in ip range %s", s.String(), a.ipRange.String())
+	}
+	for _, used := range a.used {
+		if overlaps(used, s) {
+			return fmt.Errorf("subnet %s overlaps subnet %s", s.String(), used.String())
+		}
+	}
+	a.used = append(a.used, s)
+	return nil
+}
+
+// Allocate reserves the first free subnet of the prefix length in the ip range
+func (a *SubnetAllocator) Allocate(prefix int) (gridtypes.IPNet, error) {
+	rangePrefix, bits := a.ipRange.Mask.Size()
+	if prefix < rangePrefix || prefix > bits {
+		return gridtypes.IPNet{}, fmt.Errorf("subnet prefix %d is not valid in ip range %s", prefix, a.ipRange.String())
+	}
+
+	mask := net.CIDRMask(prefix, bits)
+	start := ipToUint32(a.ipRange.IP)
+	size := uint64(1) << (bits - prefix)
+	count := uint64(1) << (prefix - rangePrefix)
+
+	for i := uint64(0); i < count; i++ {
+		subnet := net.IPNet{IP: uint32ToIP(start + uint32(i*size)), Mask: mask}
+
+		free := true
+		for _, used := range a.used {
+			if overlaps(used, subnet) {
+				free = false
+				break
+			}
+		}
+		if free {
+			a.used = append(a.used, subnet)
+			return gridtypes.NewIPNet(subnet), nil
+		}
+	}
+
+	return gridtypes.IPNet{}, errors.Wrapf(ErrSubnetsExhausted, "could not allocate a /%d subnet in ip range %s", prefix, a.ipRange.String())
+}
+
+// subnetInRange returns true if the subnet is inside the ip range
+func subnetInRange(ipRange, subnet net.IPNet) bool {
+	rangePrefix, _ := ipRange.Mask.Size()
+	prefix, _ := subnet.Mask.Size()
+	return prefix >= rangePrefix && ipRange.Contains(subnet.IP)
+}
+
+// overlaps returns true if two subnets share any ip
+func overlaps(a, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3])
+}
@@ -0,0 +1,56 @@
+// Package workloads includes workloads types (vm, zdb, QSFS, public IP, gateway name, gateway fqdn, disk)
+package workloads
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/threefoldtech/zos/pkg/gridtypes"
+)
+
+func TestSubnetAllocator(t *testing.T) {
+	t.Run("allocate subnets of different sizes", func(t *testing.T) {
+		allocator, err := NewSubnetAllocator(gridtypes.MustParseIPNet("10.20.0.0/20"))
+		assert.NoError(t, err)
+
+		assert.NoError(t, allocator.Reserve(IPNet(10, 20, 1, 0, 24)))
+
+		subnet, err := allocator.Allocate(24)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.20.0.0/24", subnet.String())
+
+		subnet, err = allocator.Allocate(22)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.20.4.0/22", subnet.String())
+
+		subnet, err = allocator.Allocate(24)
+		assert.NoError(t, err)
+		assert.Equal(t, "10.20.2.0/24", subnet.String())
+	})
+
+	t.Run("overlapping and out of range subnets", func(t *testing.T) {
+		allocator, err := NewSubnetAllocator(gridtypes.MustParseIPNet("10.20.0.0/20"))
+		assert.NoError(t, err)
+
+		assert.NoError(t, allocator.Reserve(IPNet(10, 20, 4, 0, 22)))
+		assert.Error(t, allocator.Reserve(IPNet(10, 20, 5, 0, 24)))
+		assert.Error(t, allocator.Reserve(IPNet(10, 20, 0, 0, 16)))
+		assert.Error(t, allocator.Reserve(IPNet(10, 21, 0, 0, 24)))
+	})
+
+	t.Run("exhausted range", func(t *testing.T) {
+		allocator, err := NewSubnetAllocator(gridtypes.MustParseIPNet("10.20.0.0/23"))
+		assert.NoError(t, err)
+
+		_, err = allocator.Allocate(24)
+		assert.NoError(t, err)
+		_, err = allocator.Allocate(24)
+		assert.NoError(t, err)
+		_, err = allocator.Allocate(24)
+		assert.True(t, errors.Is(err, ErrSubnetsExhausted))
+
+		_, err = allocator.Allocate(16)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,227 @@
+// Package workloads includes workloads types (vm, zdb, QSFS, public IP, gateway name, gateway fqdn, disk)
+package workloads
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultPersistentKeepalive is the persistent keepalive interval in seconds of the network access peers
+const DefaultPersistentKeepalive = 25
+
+// WGConfig is a wg-quick config of a wireguard interface and its peers
+type WGConfig struct {
+	Interface WGInterface
+	Peers     []WGPeer
+}
+
+// WGInterface is the [Interface] section of a wg-quick config
+type WGInterface struct {
+	PrivateKey string
+	Addresses  []string
+	ListenPort int
+	// DNS is the dns servers and search domains set while the interface is up
+	DNS []string
+	MTU int
+	// Table is the routing table of the peers allowed ips, wg-quick uses the main table if it's empty
+	Table string
+}
+
+// WGPeer is a [Peer] section of a wg-quick config
+type WGPeer struct {
+	PublicKey    string
+	PresharedKey string
+	// AllowedIPs is the ranges routed through the peer, a split tunnel only routes the network ranges
+	AllowedIPs []string
+	// Endpoint is the host and port of the peer, ipv6 hosts are enclosed in brackets
+	Endpoint            string
+	PersistentKeepalive int
+}
+
+// Validate validates the config addresses, allowed ips and endpoints
+func (c *WGConfig) Validate() error {
+	if c.Interface.PrivateKey == "" {
+		return errors.New("interface private key is required")
+	}
+	for _, address := range c.Interface.Addresses {
+		if net.ParseIP(address) == nil {
+			if _, _, err := net.ParseCIDR(address); err != nil {
+				return fmt.Errorf("invalid interface address %s", address)
+			}
+		}
+	}
+	if c.Interface.MTU < 0 || c.Interface.ListenPort < 0 || c.Interface.ListenPort > 65535 {
+		return errors.New("interface mtu and listen port can't be negative and the listen port should be at most 65535")
+	}
+
+	for idx, peer := range c.Peers {
+		if peer.PublicKey == "" {
+			return fmt.Errorf("peer %d public key is required", idx)
+		}
+		for _, allowedIP := range peer.AllowedIPs {
+			if _, _, err := net.ParseCIDR(allowedIP); err != nil {
+				return fmt.Errorf("invalid peer %d allowed ip %s", idx, allowedIP)
+			}
+		}
+		if peer.Endpoint != "" {
+			if _, _, err := net.SplitHostPort(peer.Endpoint); err != nil {
+				return errors.Wrapf(err, "invalid peer %d endpoint %s", idx, peer.Endpoint)
+			}
+		}
+		if peer.PersistentKeepalive < 0 {
+			return fmt.Errorf("peer %d persistent keepalive can't be negative", idx)
+		}
+	}
+	return nil
+}
+
+// Render renders the config as a wg-quick config file, the optional fields are only written if they are set
+func (c *WGConfig) Render() string {
+	var b strings.Builder
+
+	b.WriteString("[Interface]\n")
+	writeWGField(&b, "PrivateKey", c.Interface.PrivateKey)
+	writeWGField(&b, "Address", strings.Join(c.Interface.Addresses, ", "))
+	writeWGIntField(&b, "ListenPort", c.Interface.ListenPort)
+	writeWGField(&b, "DNS", strings.Join(c.Interface.DNS, ", "))
+	writeWGIntField(&b, "MTU", c.Interface.MTU)
+	writeWGField(&b, "Table", c.Interface.Table)
+
+	for _, peer := range c.Peers {
+		b.WriteString("\n[Peer]\n")
+		writeWGField(&b, "PublicKey", peer.PublicKey)
+		writeWGField(&b, "PresharedKey", peer.PresharedKey)
+		writeWGField(&b, "AllowedIPs", strings.Join(peer.AllowedIPs, ", "))
+		writeWGField(&b, "Endpoint", peer.Endpoint)
+		writeWGIntField(&b, "PersistentKeepalive", peer.PersistentKeepalive)
+	}
+	return b.String()
+}
+
+// ParseWGConfig parses a wg-quick config file, comments are ignored and list fields can be repeated.
+// it fails on the fields it doesn't support, like the wg-quick hooks
+func ParseWGConfig(config string) (WGConfig, error) {
+	var (
+		cfg     WGConfig
+		section string
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(config))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if idx := strings.Index(text, "#"); idx != -1 {
+			text = text[:idx]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section = strings.ToLower(strings.TrimSpace(text[1 : len(text)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				cfg.Peers = append(cfg.Peers, WGPeer{})
+			default:
+				return WGConfig{}, fmt.Errorf("line %d: unknown section %s", line, text)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return WGConfig{}, fmt.Errorf("line %d: invalid field %s", line, text)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section {
+		case "interface":
+			err = parseWGInterfaceField(&cfg.Interface, key, value)
+		case "peer":
+			err = parseWGPeerField(&cfg.Peers[len(cfg.Peers)-1], key, value)
+		default:
+			err = errors.New("field is not in a section")
+		}
+		if err != nil {
+			return WGConfig{}, errors.Wrapf(err, "line %d", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return WGConfig{}, errors.Wrap(err, "failed to read wireguard config")
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func parseWGInterfaceField(iface *WGInterface, key, value string) (err error) {
+	switch key {
+	case "privatekey":
+		iface.PrivateKey = value
+	case "address":
+		iface.Addresses = append(iface.Addresses, splitWGList(value)...)
+	case "listenport":
+		iface.ListenPort, err = strconv.Atoi(value)
+	case "dns":
+		iface.DNS = append(iface.DNS, splitWGList(value)...)
+	case "mtu":
+		iface.MTU, err = strconv.Atoi(value)
+	case "table":
+		iface.Table = value
+	default:
+		return fmt.Errorf("unsupported interface field %s", key)
+	}
+	return errors.Wrapf(err, "invalid interface field %s", key)
+}
+
+func parseWGPeerField(peer *WGPeer, key, value string) (err error) {
+	switch key {
+	case "publickey":
+		peer.PublicKey = value
+	case "presharedkey":
+		peer.PresharedKey = value
+	case "allowedips":
+		peer.AllowedIPs = append(peer.AllowedIPs, splitWGList(value)...)
+	case "endpoint":
+		peer.Endpoint = value
+	case "persistentkeepalive":
+		if value == "off" {
+			peer.PersistentKeepalive = 0
+			return nil
+		}
+		peer.PersistentKeepalive, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unsupported peer field %s", key)
+	}
+	return errors.Wrapf(err, "invalid peer field %s", key)
+}
+
+// splitWGList splits a comma separated list field
+func splitWGList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func writeWGField(b *strings.Builder, key, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s = %s\n", key, value)
+	}
+}
+
+func writeWGIntField(b *strings.Builder, key string, value int) {
+	if value != 0 {
+		fmt.Fprintf(b, "%s = %d\n", key, value)
+	}
+}
@@ -0,0 +1,108 @@
+// Package workloads includes workloads types (vm, zdb, QSFS, public IP, gateway name, gateway fqdn, disk)
+package workloads
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWGConfig(t *testing.T) {
+	config := WGConfig{
+		Interface: WGInterface{
+			PrivateKey: "private",
+			Addresses:  []string{"100.64.20.2"},
+			DNS:        []string{"1.1.1.1", "example.com"},
+			MTU:        1420,
+		},
+		Peers: []WGPeer{
+			{
+				PublicKey:           "public1",
+				AllowedIPs:          []string{"10.20.0.0/16", "100.64.20.0/24"},
+				Endpoint:            "1.1.1.1:3000",
+				PersistentKeepalive: DefaultPersistentKeepalive,
+			},
+			{
+				PublicKey:  "public2",
+				AllowedIPs: []string{"10.20.3.0/24"},
+				Endpoint:   "[2a02:1802:5e::1]:4000",
+			},
+		},
+	}
+	rendered := `[Interface]
+PrivateKey = private
+Address = 100.64.20.2
+DNS = 1.1.1.1, example.com
+MTU = 1420
+
+[Peer]
+PublicKey = public1
+AllowedIPs = 10.20.0.0/16, 100.64.20.0/24
+Endpoint = 1.1.1.1:3000
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = public2
+AllowedIPs = 10.20.3.0/24
+Endpoint = [2a02:1802:5e::1]:4000
+`
+
+	t.Run("render", func(t *testing.T) {
+		assert.NoError(t, config.Validate())
+		assert.Equal(t, rendered, config.Render())
+	})
+
+	t.Run("parse", func(t *testing.T) {
+		parsed, err := ParseWGConfig(rendered)
+		assert.NoError(t, err)
+		assert.Equal(t, config, parsed)
+	})
+
+	t.Run("parse repeated fields and comments", func(t *testing.T) {
+		parsed, err := ParseWGConfig(`
+# laptop access
+[interface]
+privatekey = private
+Address = 100.64.20.2/32
+Address = fd00::2/128 # ipv6 address
+Table = off
+ListenPort = 51820
+
+[Peer]
+PublicKey = public1
+AllowedIPs = 10.20.0.0/16
+AllowedIPs = 100.64.20.0/24,
+PersistentKeepalive = off
+`)
+		assert.NoError(t, err)
+		assert.Equal(t, WGConfig{
+			Interface: WGInterface{
+				PrivateKey: "private",
+				Addresses:  []string{"100.64.20.2/32", "fd00::2/128"},
+				ListenPort: 51820,
+				Table:      "off",
+			},
+			Peers: []WGPeer{{
+				PublicKey:  "public1",
+				AllowedIPs: []string{"10.20.0.0/16", "100.64.20.0/24"},
+			}},
+		}, parsed)
+	})
+
+	t.Run("invalid configs", func(t *testing.T) {
+		invalid := []string{
+			"[Interface]\nPrivateKey = private\nPostUp = iptables -A FORWARD",
+			"[Interface]\nPrivateKey = private\nMTU = big",
+			"[Interface]\nPrivateKey = private\n[Peer]\nPublicKey = public\nAllowedIPs = 10.20.0.0",
+			"[Interface]\nPrivateKey = private\n[Peer]\nPublicKey = public\nEndpoint = 2a02:1802:5e::1:4000",
+			"[Interface]\nPrivateKey = private\n[Peer]\nAllowedIPs = 10.20.0.0/16",
+			"[Interface]\nPrivateKey = private\n[Peers]",
+			"PrivateKey = private",
+			"[Interface]\nAddress = 100.64.20.2",
+		}
+		for _, config := range invalid {
+			_, err := ParseWGConfig(config)
+			assert.Error(t, err, config)
+		}
+	})
+}